@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// AckTopic is the application level topic on which the receivers report the
+// latency they observe to an adaptive publisher. Its messages are not part of
+// the test workload.
+const AckTopic = "congestion-ack"
+
+// AdaptiveParams configure a publisher that adapts its rate to congestion,
+// with additive increase and multiplicative decrease of the fraction of the
+// workload's rate it publishes at. Congestion is signaled either by the
+// receivers' latency on the ack topic, or by messages dropped from the local
+// outbound queues.
+type AdaptiveParams struct {
+	// ack or queue
+	Signal   string
+	Interval time.Duration
+	// with the ack signal, the network is congested when the mean latency
+	// reported by the receivers is above this
+	LatencyThreshold time.Duration
+	// factor the rate is multiplied by on congestion, and fraction of the
+	// workload's rate added back in every interval without congestion
+	Backoff  float64
+	Increase float64
+	// lowest fraction of the workload's rate
+	MinRate float64
+}
+
+func (a AdaptiveParams) enabled() bool {
+	return a.Signal != ""
+}
+
+func (a AdaptiveParams) validate() error {
+	switch a.Signal {
+	case "ack":
+		if a.LatencyThreshold <= 0 {
+			return fmt.Errorf("the ack congestion signal requires a latency threshold")
+		}
+	case "queue":
+	default:
+		return fmt.Errorf("unsupported congestion signal %s", a.Signal)
+	}
+	if a.Interval <= 0 {
+		return fmt.Errorf("adaptive publishing requires a positive interval")
+	}
+	if a.Backoff <= 0 || a.Backoff >= 1 {
+		return fmt.Errorf("invalid backoff %f; must be between 0 and 1", a.Backoff)
+	}
+	if a.MinRate <= 0 || a.MinRate > 1 {
+		return fmt.Errorf("invalid min rate %f; must be between 0 and 1", a.MinRate)
+	}
+	return nil
+}
+
+// AckReport is published periodically by the receivers of an adaptive publisher
+type AckReport struct {
+	Sender        string
+	Count         int64
+	MeanLatencyMs float64
+}
+
+// ackWindow accumulates the delivery latencies since the last ack report
+type ackWindow struct {
+	lk    sync.Mutex
+	count int64
+	sumMs float64
+}
+
+func (w *ackWindow) record(latency time.Duration) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	w.count++
+	w.sumMs += float64(latency) / float64(time.Millisecond)
+}
+
+func (w *ackWindow) take() (int64, float64) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	count, sum := w.count, w.sumMs
+	w.count, w.sumMs = 0, 0
+	return count, sum
+}
+
+// rateController holds the fraction of the workload's rate the publisher
+// publishes at
+type rateController struct {
+	lk     sync.Mutex
+	factor float64
+}
+
+func (r *rateController) get() float64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.factor
+}
+
+// adjust backs off on congestion, and recovers additively otherwise
+func (r *rateController) adjust(congested bool, params AdaptiveParams) float64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if congested {
+		r.factor *= params.Backoff
+	} else {
+		r.factor += params.Increase
+	}
+	if r.factor < params.MinRate {
+		r.factor = params.MinRate
+	}
+	if r.factor > 1 {
+		r.factor = 1
+	}
+	return r.factor
+}
+
+// adaptiveWorkload stretches the delays of a workload by the current rate
+type adaptiveWorkload struct {
+	inner Workload
+	rate  *rateController
+}
+
+func (w *adaptiveWorkload) Next() (uint64, time.Duration, string) {
+	size, delay, topic := w.inner.Next()
+	return size, time.Duration(float64(delay) / w.rate.get()), topic
+}
+
+// runAdaptive runs the congestion feedback loop. Receivers report their
+// latency on the ack topic, and the publisher adjusts its rate every interval.
+func (p *PubsubNode) runAdaptive() {
+	params := p.cfg.Adaptive
+	acks := &ackWindow{}
+	if params.Signal == "ack" {
+		topic, err := p.ps.Join(AckTopic)
+		if err != nil {
+			p.log("error joining ack topic: %s", err)
+			return
+		}
+		if !p.cfg.Publisher {
+			p.publishAcks(topic)
+			return
+		}
+		sub, err := topic.Subscribe()
+		if err != nil {
+			p.log("error subscribing to ack topic: %s", err)
+			return
+		}
+		go func() {
+			for {
+				msg, err := sub.Next(p.ctx)
+				if err != nil {
+					return
+				}
+				var report AckReport
+				if err := json.Unmarshal(msg.Data, &report); err != nil {
+					p.log("error decoding ack report: %s", err)
+					continue
+				}
+				acks.lk.Lock()
+				acks.count += report.Count
+				acks.sumMs += report.MeanLatencyMs * float64(report.Count)
+				acks.lk.Unlock()
+			}
+		}()
+	}
+	if !p.cfg.Publisher {
+		return
+	}
+
+	var dropped uint64
+	if tracer := p.testTracer(); tracer != nil {
+		dropped = tracer.DroppedRPCs()
+	}
+	ticker := time.NewTicker(params.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var congested bool
+		switch params.Signal {
+		case "ack":
+			count, sum := acks.take()
+			if count > 0 {
+				mean := sum / float64(count)
+				congested = mean > float64(params.LatencyThreshold)/float64(time.Millisecond)
+				p.runenv.R().RecordPoint("ack_mean_latency_ms", mean)
+			}
+		case "queue":
+			if tracer := p.testTracer(); tracer != nil {
+				now := tracer.DroppedRPCs()
+				congested = now > dropped
+				dropped = now
+			}
+		}
+		factor := p.rate.adjust(congested, params)
+		if congested {
+			p.log("congestion detected, publishing at %.2f of the workload rate", factor)
+			p.runenv.R().RecordPoint("publish_congested", 1)
+		} else {
+			p.runenv.R().RecordPoint("publish_congested", 0)
+		}
+		p.runenv.R().RecordPoint("publish_rate_factor", factor)
+	}
+}
+
+// publishAcks reports the receiver's mean delivery latency every interval
+func (p *PubsubNode) publishAcks(topic *pubsub.Topic) {
+	ticker := time.NewTicker(p.cfg.Adaptive.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		count, sum := p.acks.take()
+		if count == 0 {
+			continue
+		}
+		report := AckReport{Sender: p.h.ID().String(), Count: count, MeanLatencyMs: sum / float64(count)}
+		data, err := json.Marshal(report)
+		if err != nil {
+			p.log("error encoding ack report: %s", err)
+			continue
+		}
+		if err := topic.Publish(p.ctx, data); err != nil && p.ctx.Err() == nil {
+			p.log("error publishing ack report: %s", err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// Kinds of the anomalies logged by the watchdog
+const (
+	AnomalyMeshLow             = "mesh_low"
+	AnomalyNoDelivery          = "no_delivery"
+	AnomalyValidationSaturated = "validation_saturated"
+)
+
+// AnomalyParams configure the watchdog of each node, which logs the anomalies
+// of the run as custom events as they happen
+type AnomalyParams struct {
+	// how often the node is checked, disabled if zero
+	Interval time.Duration
+	// how long the mesh of a topic has to stay below D_lo
+	MeshLowFor time.Duration
+	// how long the node has to go without any delivery, not checked if zero
+	NoDeliveryFor time.Duration
+}
+
+func (a AnomalyParams) enabled() bool {
+	return a.Interval > 0
+}
+
+func (a AnomalyParams) validate() error {
+	if a.Interval < 0 || a.MeshLowFor < 0 || a.NoDeliveryFor < 0 {
+		return fmt.Errorf("anomaly durations must not be negative")
+	}
+	return nil
+}
+
+// anomalyState is the state of the watchdog. lastDelivery is the time of the
+// last delivery in unix nanoseconds, and is accessed atomically.
+type anomalyState struct {
+	lastDelivery int64
+
+	lk     sync.Mutex
+	counts map[string]int
+}
+
+func (a *anomalyState) delivered(now time.Time) {
+	atomic.StoreInt64(&a.lastDelivery, now.UnixNano())
+}
+
+// runAnomalyWatchdog checks the node every interval until stop is closed. An
+// anomaly is logged once when it starts, and again only after it cleared.
+func (p *PubsubNode) runAnomalyWatchdog(stop <-chan struct{}) {
+	tracer := p.testTracer()
+	params := p.cfg.Anomalies
+	dlo := gossipSubParams(p.cfg).Dlo
+	// the node isn't expected to have a mesh or deliveries before it joined
+	// the topics and the first message was published
+	watchStart := p.runStart.Add(p.cfg.JoinOffset + p.cfg.SubscribeDelay)
+	deliveriesStart := watchStart
+	if start := p.runStart.Add(p.cfg.FirstPublishOffset); start.After(deliveriesStart) {
+		deliveriesStart = start
+	}
+
+	meshLowSince := make(map[string]time.Time)
+	meshLogged := make(map[string]bool)
+	noDeliveryLogged := false
+	var throttled uint64
+	if tracer != nil {
+		throttled = tracer.ValidationThrottled()
+	}
+
+	ticker := time.NewTicker(params.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+		now := time.Now()
+		if now.Before(watchStart) {
+			continue
+		}
+
+		if tracer != nil {
+			for _, t := range p.cfg.Topics {
+				size := tracer.MeshSize(t.Id)
+				if size >= dlo {
+					delete(meshLowSince, t.Id)
+					meshLogged[t.Id] = false
+					continue
+				}
+				since, ok := meshLowSince[t.Id]
+				if !ok {
+					since = now
+					meshLowSince[t.Id] = now
+				}
+				if !meshLogged[t.Id] && now.Sub(since) >= params.MeshLowFor {
+					meshLogged[t.Id] = true
+					p.logAnomaly(outputs.Anomaly{
+						Kind:       AnomalyMeshLow,
+						Topic:      t.Id,
+						Detail:     fmt.Sprintf("mesh of %d peers, below D_lo=%d", size, dlo),
+						DurationMs: float64(now.Sub(since)) / float64(time.Millisecond),
+						Count:      int64(size),
+					})
+				}
+			}
+
+			total := tracer.ValidationThrottled()
+			if total > throttled {
+				p.logAnomaly(outputs.Anomaly{
+					Kind:       AnomalyValidationSaturated,
+					Detail:     fmt.Sprintf("%d messages dropped by a full validation queue or throttle", total-throttled),
+					DurationMs: float64(params.Interval) / float64(time.Millisecond),
+					Count:      int64(total - throttled),
+				})
+			}
+			throttled = total
+		}
+
+		if params.NoDeliveryFor > 0 && now.After(deliveriesStart) {
+			last := deliveriesStart
+			if ns := atomic.LoadInt64(&p.anomalies.lastDelivery); ns > last.UnixNano() {
+				last = time.Unix(0, ns)
+			}
+			switch {
+			case now.Sub(last) < params.NoDeliveryFor:
+				noDeliveryLogged = false
+			case !noDeliveryLogged:
+				noDeliveryLogged = true
+				p.logAnomaly(outputs.Anomaly{
+					Kind:       AnomalyNoDelivery,
+					Detail:     fmt.Sprintf("no message delivered for %s", now.Sub(last).Round(time.Millisecond)),
+					DurationMs: float64(now.Sub(last)) / float64(time.Millisecond),
+				})
+			}
+		}
+	}
+}
+
+// logAnomaly writes an anomaly to the log and the custom events, and counts it
+func (p *PubsubNode) logAnomaly(a outputs.Anomaly) {
+	if a.Topic != "" {
+		p.log("anomaly %s on topic %s: %s", a.Kind, a.Topic, a.Detail)
+	} else {
+		p.log("anomaly %s: %s", a.Kind, a.Detail)
+	}
+	p.traceEvent("anomaly", a)
+
+	p.anomalies.lk.Lock()
+	defer p.anomalies.lk.Unlock()
+	if p.anomalies.counts == nil {
+		p.anomalies.counts = make(map[string]int)
+	}
+	p.anomalies.counts[a.Kind]++
+}
+
+// anomalyCounts returns the number of anomalies logged by kind
+func (p *PubsubNode) anomalyCounts() map[string]int {
+	p.anomalies.lk.Lock()
+	defer p.anomalies.lk.Unlock()
+	if len(p.anomalies.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]int, len(p.anomalies.counts))
+	for kind, n := range p.anomalies.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// summarizeAnomalies adds up the anomalies logged by the nodes
+func summarizeAnomalies(reports []NodeReport) *outputs.Anomalies {
+	s := &outputs.Anomalies{ByKind: make(map[string]int)}
+	for _, r := range reports {
+		if len(r.Anomalies) == 0 {
+			continue
+		}
+		s.Nodes = append(s.Nodes, r.Seq)
+		for kind, n := range r.Anomalies {
+			s.Total += n
+			s.ByKind[kind] += n
+		}
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i] < s.Nodes[j] })
+	return s
+}
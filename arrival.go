@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ArrivalParams configure the arrival processes of the poisson and bursty
+// workloads. Both keep the mean rate of each topic.
+type ArrivalParams struct {
+	// messages published back to back in every burst
+	BurstSize int
+	// time between the start of two bursts. Zero spaces the bursts so that
+	// the topic's mean rate is kept.
+	BurstInterval time.Duration
+	// seed of the poisson arrivals. Zero draws different arrivals on every
+	// run.
+	Seed int64
+}
+
+func (a ArrivalParams) validate(workload string) error {
+	if workload == "bursty" && a.BurstSize <= 0 {
+		return fmt.Errorf("the bursty workload requires a positive burst_size")
+	}
+	if a.BurstInterval < 0 {
+		return fmt.Errorf("t_burst_interval can't be negative")
+	}
+	return nil
+}
+
+// arrivalProcess returns the time until the next message of a topic
+type arrivalProcess interface {
+	gap() time.Duration
+}
+
+// poissonArrivals are exponentially distributed around the mean interval
+type poissonArrivals struct {
+	mean time.Duration
+	rng  *rand.Rand
+}
+
+func (a *poissonArrivals) gap() time.Duration {
+	return time.Duration(a.rng.ExpFloat64() * float64(a.mean))
+}
+
+// burstArrivals publish size messages at once every interval
+type burstArrivals struct {
+	size     int
+	interval time.Duration
+	sent     int
+}
+
+func (a *burstArrivals) gap() time.Duration {
+	first := a.sent%a.size == 0
+	a.sent++
+	if first {
+		return a.interval
+	}
+	return 0
+}
+
+// arrivalWorkload publishes to each topic following the topic's arrival
+// process, interleaving messages for different topics by their publish time
+type arrivalWorkload struct {
+	topics    []TopicConfig
+	processes []arrivalProcess
+	// offset of the next message for each topic, relative to the start
+	next []time.Duration
+	// offset of the last message returned
+	now time.Duration
+}
+
+func newArrivalWorkload(topics []TopicConfig, process func(interval time.Duration) arrivalProcess) *arrivalWorkload {
+	w := &arrivalWorkload{}
+	for _, t := range topics {
+		if t.MessageRate.Quantity <= 0 {
+			continue
+		}
+		interval := time.Duration(float64(t.MessageRate.Interval) / t.MessageRate.Quantity)
+		p := process(interval)
+		w.topics = append(w.topics, t)
+		w.processes = append(w.processes, p)
+		w.next = append(w.next, p.gap())
+	}
+	return w
+}
+
+func newPoissonWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	seed := env.Arrival.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	// every publisher draws its own arrivals
+	rng := rand.New(rand.NewSource(seed + env.Seq))
+	w := newArrivalWorkload(topics, func(interval time.Duration) arrivalProcess {
+		return &poissonArrivals{mean: interval, rng: rng}
+	})
+	if len(w.topics) == 0 {
+		return nil, fmt.Errorf("poisson workload requires at least one topic with a positive message rate")
+	}
+	return w, nil
+}
+
+func newBurstyWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	size := env.Arrival.BurstSize
+	w := newArrivalWorkload(topics, func(interval time.Duration) arrivalProcess {
+		b := &burstArrivals{size: size, interval: env.Arrival.BurstInterval}
+		if b.interval == 0 {
+			b.interval = interval * time.Duration(size)
+		}
+		return b
+	})
+	if len(w.topics) == 0 {
+		return nil, fmt.Errorf("bursty workload requires at least one topic with a positive message rate")
+	}
+	return w, nil
+}
+
+func (w *arrivalWorkload) Next() (uint64, time.Duration, string) {
+	idx := 0
+	earliest := time.Duration(math.MaxInt64)
+	for i, next := range w.next {
+		if next < earliest {
+			idx = i
+			earliest = next
+		}
+	}
+
+	delay := earliest - w.now
+	w.now = earliest
+	w.next[idx] += w.processes[idx].gap()
+
+	t := w.topics[idx]
+	return uint64(t.MessageSize), delay, t.Id
+}
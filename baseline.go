@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"gossipsub_testplan/outputs"
+)
+
+// BaselineParams point to the summary of a previous run that this run is
+// compared against, to track regressions across gossipsub versions
+type BaselineParams struct {
+	// path or http(s) URL of a summary.json
+	Summary string
+	// maximum tolerated worsening of each ratio, eg 0.01 is one percentage point
+	Tolerance float64
+	// maximum tolerated increase of each latency, relative to the baseline, eg
+	// 0.1 is 10% slower
+	LatencyTolerance float64
+}
+
+func (b BaselineParams) enabled() bool {
+	return b.Summary != ""
+}
+
+// loadBaseline reads the baseline summary from a local file or a URL
+func loadBaseline(location string) (*outputs.Summary, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := http.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error fetching baseline %s: %s", location, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+	return outputs.DecodeSummary(r)
+}
+
+// summaryMetric is a metric compared against the baseline. higherIsBetter
+// says in which direction a change is a regression, and relative metrics are
+// compared against the latency tolerance as a fraction of the baseline.
+type summaryMetric struct {
+	name           string
+	value          float64
+	higherIsBetter bool
+	relative       bool
+}
+
+// summaryMetrics returns the compared metrics: fractions of the expected
+// deliveries, and the first delivery latencies
+func summaryMetrics(s outputs.Summary) []summaryMetric {
+	c := s.LossCauses
+	ratio := func(n int) float64 {
+		if c.Expected == 0 {
+			return 0
+		}
+		return float64(n) / float64(c.Expected)
+	}
+	return []summaryMetric{
+		{"delivery_ratio", ratio(c.Delivered), true, false},
+		{"node_down_ratio", ratio(c.NodeDown), false, false},
+		{"rejected_ratio", ratio(c.Rejected), false, false},
+		{"queue_drop_ratio", ratio(c.QueueDrop), false, false},
+		{"never_reached_neighbors_ratio", ratio(c.NeverReachedNeighbors), false, false},
+		{"unknown_loss_ratio", ratio(c.Unknown), false, false},
+		{"p50_latency_ms", s.Latency.P50Ms, false, true},
+		{"p99_latency_ms", s.Latency.P99Ms, false, true},
+	}
+}
+
+func compareWithBaseline(location string, baseline outputs.Summary, current outputs.Summary, params BaselineParams) outputs.BaselineComparison {
+	cmp := outputs.BaselineComparison{
+		Version:          outputs.SchemaVersion,
+		Baseline:         location,
+		Tolerance:        params.Tolerance,
+		LatencyTolerance: params.LatencyTolerance,
+	}
+
+	base := summaryMetrics(baseline)
+	for i, cur := range summaryMetrics(current) {
+		d := outputs.MetricDelta{
+			Name:     cur.name,
+			Baseline: base[i].value,
+			Current:  cur.value,
+			Delta:    cur.value - base[i].value,
+		}
+		worsening, tolerance := d.Delta, params.Tolerance
+		if cur.higherIsBetter {
+			worsening = -d.Delta
+		}
+		if cur.relative {
+			// a baseline without the metric can't be compared
+			if d.Baseline == 0 {
+				cmp.Metrics = append(cmp.Metrics, d)
+				continue
+			}
+			worsening, tolerance = worsening/d.Baseline, params.LatencyTolerance
+		}
+		if worsening > tolerance {
+			d.Regression = true
+			cmp.Regressions++
+		}
+		cmp.Metrics = append(cmp.Metrics, d)
+	}
+	return cmp
+}
+
+// reportBaselineComparison compares the run summary with the baseline, logs a
+// warning for every regression and writes the comparison
+func (p *PubsubNode) reportBaselineComparison(summary outputs.Summary) error {
+	params := p.cfg.Baseline
+	baseline, err := loadBaseline(params.Summary)
+	if err != nil {
+		return fmt.Errorf("error loading baseline summary %s: %w", params.Summary, err)
+	}
+
+	cmp := compareWithBaseline(params.Summary, *baseline, summary, params)
+	for _, d := range cmp.Metrics {
+		if d.Regression {
+			p.log("REGRESSION: %s is %.4f, baseline %.4f (delta %+.4f)", d.Name, d.Current, d.Baseline, d.Delta)
+		}
+	}
+	p.log("compared with baseline %s: %d regressions", params.Summary, cmp.Regressions)
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.BaselineComparisonFile)
+	jsonstr, err := json.MarshalIndent(cmp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
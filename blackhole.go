@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// BlackholeParams select the nodes that lose connectivity over one transport
+// protocol during the run
+type BlackholeParams struct {
+	// Protocol to drop, udp or tcp
+	Protocol string
+	// Percentage of nodes affected
+	Pct      int
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func (b BlackholeParams) enabled() bool {
+	return b.Protocol != "" && b.Duration > 0
+}
+
+// ProtocolBlackhole drops all connections over a transport protocol while it is
+// active, forcing libp2p to fall back to the other transport.
+// The testground sidecar can only filter traffic by subnet, so the blackhole is
+// applied by the host's connection gater instead of by the network rules.
+type ProtocolBlackhole struct {
+	code   int
+	active atomic.Bool
+}
+
+func NewProtocolBlackhole(protocol string) (*ProtocolBlackhole, error) {
+	switch protocol {
+	case "udp":
+		return &ProtocolBlackhole{code: multiaddr.P_UDP}, nil
+	case "tcp":
+		return &ProtocolBlackhole{code: multiaddr.P_TCP}, nil
+	default:
+		return nil, fmt.Errorf("unsupported blackhole protocol %s", protocol)
+	}
+}
+
+func (b *ProtocolBlackhole) SetActive(active bool) {
+	b.active.Store(active)
+}
+
+// Blocks returns true if the blackhole is active and the address uses the protocol
+func (b *ProtocolBlackhole) Blocks(addr multiaddr.Multiaddr) bool {
+	if !b.active.Load() {
+		return false
+	}
+	_, err := addr.ValueForProtocol(b.code)
+	return err == nil
+}
+
+func (b *ProtocolBlackhole) InterceptPeerDial(p peer.ID) bool {
+	return true
+}
+
+func (b *ProtocolBlackhole) InterceptAddrDial(p peer.ID, addr multiaddr.Multiaddr) bool {
+	return !b.Blocks(addr)
+}
+
+func (b *ProtocolBlackhole) InterceptAccept(addrs lnetwork.ConnMultiaddrs) bool {
+	return !b.Blocks(addrs.RemoteMultiaddr())
+}
+
+func (b *ProtocolBlackhole) InterceptSecured(dir lnetwork.Direction, p peer.ID, addrs lnetwork.ConnMultiaddrs) bool {
+	return !b.Blocks(addrs.RemoteMultiaddr())
+}
+
+func (b *ProtocolBlackhole) InterceptUpgraded(conn lnetwork.Conn) (bool, control.DisconnectReason) {
+	return !b.Blocks(conn.RemoteMultiaddr()), 0
+}
+
+// runBlackhole activates the blackhole for the configured window, closing the
+// connections that use the blackholed protocol and redialing the same peers.
+// The deliveries during the window show whether gossip kept flowing over the
+// other transport.
+func (p *PubsubNode) runBlackhole() {
+	params := p.cfg.BlackholeParams
+	select {
+	case <-time.After(time.Until(p.runStart.Add(params.Start))):
+	case <-p.ctx.Done():
+		return
+	}
+
+	p.cfg.Blackhole.SetActive(true)
+	p.markTimeline("blackhole", params.Protocol+" start", params.Start)
+	startDeliveries := p.deliveredCount()
+	var closed []peer.ID
+	for _, conn := range p.h.Network().Conns() {
+		if p.cfg.Blackhole.Blocks(conn.RemoteMultiaddr()) {
+			conn.Close()
+			closed = append(closed, conn.RemotePeer())
+		}
+	}
+	p.log("blackholing %s traffic, closed %d connections", params.Protocol, len(closed))
+
+	// redial the peers, the gater only lets the other transport through
+	var fallbacks int64
+	for _, pid := range closed {
+		go func(pid peer.ID) {
+			ctx, cancel := context.WithTimeout(p.ctx, PeerConnectTimeout)
+			defer cancel()
+			if err := p.h.Connect(ctx, p.h.Peerstore().PeerInfo(pid)); err != nil {
+				p.log("error falling back to another transport for peer %s: %s", pid.Loggable(), err)
+				return
+			}
+			atomic.AddInt64(&fallbacks, 1)
+		}(pid)
+	}
+
+	select {
+	case <-time.After(params.Duration):
+	case <-p.ctx.Done():
+		return
+	}
+
+	p.cfg.Blackhole.SetActive(false)
+	p.markTimeline("blackhole", params.Protocol+" end", params.Start+params.Duration)
+	deliveries := p.deliveredCount() - startDeliveries
+	p.log("lifting %s blackhole, %d of %d peers reached over another transport, %d messages delivered during the window",
+		params.Protocol, atomic.LoadInt64(&fallbacks), len(closed), deliveries)
+	p.runenv.R().RecordPoint("blackhole_closed_conns", float64(len(closed)))
+	p.runenv.R().RecordPoint("blackhole_fallback_conns", float64(atomic.LoadInt64(&fallbacks)))
+	p.runenv.R().RecordPoint("blackhole_deliveries", float64(deliveries))
+	p.runenv.R().RecordPoint("blackhole_deliveries_per_sec", float64(deliveries)/params.Duration.Seconds())
+}
+
+// deliveredCount returns the number of messages delivered to the node so far
+func (p *PubsubNode) deliveredCount() int64 {
+	p.handleLk.Lock()
+	defer p.handleLk.Unlock()
+	deliveries, _, _ := p.order.reordering()
+	return deliveries
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// BlacklistTopic is the application level topic on which nodes share the peers
+// they observed misbehaving. Its messages are not part of the test workload.
+const BlacklistTopic = "blacklist"
+
+// BlacklistParams configure the collaborative blacklist, which runs on top of
+// the local peer scoring
+type BlacklistParams struct {
+	Enabled bool
+	// peers scoring below this are reported on the blacklist topic
+	Threshold float64
+	// what recipients do with the reported peers: log, disconnect or gate
+	Action string
+	// number of distinct reporters required before acting on a peer
+	Quorum int
+}
+
+func (b BlacklistParams) validate() error {
+	switch b.Action {
+	case "log", "disconnect", "gate":
+	default:
+		return fmt.Errorf("unsupported blacklist action %s", b.Action)
+	}
+	if b.Quorum < 1 {
+		return fmt.Errorf("invalid blacklist quorum %d; must be >= 1", b.Quorum)
+	}
+	return nil
+}
+
+// BlacklistEntry is published by a node that observed a misbehaving peer
+type BlacklistEntry struct {
+	Reporter string
+	Peer     string
+	Score    float64
+}
+
+// blacklist tracks the reports sent and received by a node
+type blacklist struct {
+	lk        sync.Mutex
+	topic     *pubsub.Topic
+	reported  map[peer.ID]struct{}
+	reporters map[peer.ID]map[string]struct{}
+	acted     map[peer.ID]struct{}
+}
+
+// runBlacklist joins the blacklist topic, reports the local peers scoring
+// below the threshold and acts on the reports of the other nodes
+func (p *PubsubNode) runBlacklist() {
+	topic, err := p.ps.Join(BlacklistTopic)
+	if err != nil {
+		p.log("error joining blacklist topic: %s", err)
+		return
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		p.log("error subscribing to blacklist topic: %s", err)
+		return
+	}
+	bl := &blacklist{
+		topic:     topic,
+		reported:  make(map[peer.ID]struct{}),
+		reporters: make(map[peer.ID]map[string]struct{}),
+		acted:     make(map[peer.ID]struct{}),
+	}
+
+	go func() {
+		for {
+			msg, err := sub.Next(p.ctx)
+			if err != nil {
+				return
+			}
+			var entry BlacklistEntry
+			if err := json.Unmarshal(msg.Data, &entry); err != nil {
+				p.log("error decoding blacklist entry: %s", err)
+				continue
+			}
+			p.handleBlacklistEntry(bl, entry)
+		}
+	}()
+
+	// attackers listen to the blacklist but don't report honest misbehaviour
+	if p.cfg.Attacker {
+		return
+	}
+	ticker := time.NewTicker(p.cfg.Heartbeat.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.reportMisbehaving(bl)
+		}
+	}
+}
+
+// reportMisbehaving publishes every peer scoring below the threshold, once
+func (p *PubsubNode) reportMisbehaving(bl *blacklist) {
+	for pid, score := range p.peerScores() {
+		if score >= p.cfg.Blacklist.Threshold {
+			continue
+		}
+		bl.lk.Lock()
+		_, ok := bl.reported[pid]
+		bl.reported[pid] = struct{}{}
+		bl.lk.Unlock()
+		if ok {
+			continue
+		}
+
+		entry := BlacklistEntry{Reporter: p.h.ID().String(), Peer: pid.String(), Score: score}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			p.log("error encoding blacklist entry: %s", err)
+			continue
+		}
+		p.log("reporting peer %s with score %f to the blacklist", pid.Loggable(), score)
+		if err := bl.topic.Publish(p.ctx, data); err != nil {
+			p.log("error publishing blacklist entry: %s", err)
+		}
+	}
+}
+
+// handleBlacklistEntry counts the distinct reporters of a peer, and acts on
+// the peer once the quorum is reached
+func (p *PubsubNode) handleBlacklistEntry(bl *blacklist, entry BlacklistEntry) {
+	pid, err := peer.Decode(entry.Peer)
+	if err != nil || pid == p.h.ID() {
+		return
+	}
+
+	bl.lk.Lock()
+	if bl.reporters[pid] == nil {
+		bl.reporters[pid] = make(map[string]struct{})
+	}
+	bl.reporters[pid][entry.Reporter] = struct{}{}
+	_, acted := bl.acted[pid]
+	if acted || len(bl.reporters[pid]) < p.cfg.Blacklist.Quorum {
+		bl.lk.Unlock()
+		return
+	}
+	bl.acted[pid] = struct{}{}
+	blacklisted := len(bl.acted)
+	bl.lk.Unlock()
+
+	p.log("peer %s blacklisted by %d nodes, action: %s", pid.Loggable(), p.cfg.Blacklist.Quorum, p.cfg.Blacklist.Action)
+	p.runenv.R().RecordPoint("blacklisted_peers", float64(blacklisted))
+	switch p.cfg.Blacklist.Action {
+	case "disconnect":
+		p.h.Network().ClosePeer(pid)
+	case "gate":
+		// the router ignores blacklisted peers, even if they reconnect
+		p.ps.BlacklistPeer(pid)
+		p.h.Network().ClosePeer(pid)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+	"github.com/testground/sdk-go/runtime"
+)
+
+// BandwidthProfile is the bandwidth of a percentage of the nodes
+type BandwidthProfile struct {
+	Pct int
+	MB  int
+}
+
+// parseBandwidthProfiles parses a distribution of bandwidths in Mbps separated
+// by commas, eg "50%:100,30%:25,20%:5". The percentages must add up to 100.
+func parseBandwidthProfiles(s string) ([]BandwidthProfile, error) {
+	var profiles []BandwidthProfile
+	var total int
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], "%") {
+			return nil, fmt.Errorf("bandwidth profile %q must be <pct>%%:<mbps>", entry)
+		}
+		pct, err := strconv.Atoi(strings.TrimSuffix(parts[0], "%"))
+		if err != nil || pct <= 0 {
+			return nil, fmt.Errorf("invalid percentage of bandwidth profile %q", entry)
+		}
+		mb, err := strconv.Atoi(parts[1])
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("invalid bandwidth of bandwidth profile %q", entry)
+		}
+		profiles = append(profiles, BandwidthProfile{Pct: pct, MB: mb})
+		total += pct
+	}
+	if len(profiles) > 0 && total != 100 {
+		return nil, fmt.Errorf("bandwidth profiles add up to %d%%, expected 100%%", total)
+	}
+	return profiles, nil
+}
+
+// nodeBandwidthMB returns the bandwidth of the node with the given sequence
+// number. Profiles are assigned to consecutive ranges of sequence numbers in
+// the order they are listed, so the first profile includes the publisher.
+func (np NetworkParams) nodeBandwidthMB(seq int64, instances int) int {
+	var pct int
+	for _, p := range np.bandwidthProfiles {
+		pct += p.Pct
+		end := int64(math.Round(float64(instances) * float64(pct) / 100))
+		if seq <= end {
+			return p.MB
+		}
+	}
+	return np.bandwidthMB
+}
+
+// asymmetric returns true if the node has separate uplink and downlink
+// bandwidths, like a residential link
+func (np NetworkParams) asymmetric(seq int64, instances int) bool {
+	return (np.uplinkMB > 0 || np.downlinkMB > 0) && inCohort(seq, instances, np.asymmetricPct)
+}
+
+// configureDownlinks caps the bandwidth of the links towards the nodes that
+// registered a downlink bandwidth. The sidecar only shapes the egress of each
+// node, so a downlink is modeled by every sender on its own: the aggregate
+// ingress of a node can exceed its downlink.
+func configureDownlinks(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, config *network.Config, remote []PeerRegistration) error {
+	cfg := *config
+	cfg.Rules = append([]network.LinkRule(nil), config.Rules...)
+	capped := 0
+	for _, r := range remote {
+		if r.Link.DownlinkMB <= 0 {
+			continue
+		}
+		if r.Link.IP == nil {
+			return fmt.Errorf("node %d did not register its data network address", r.NodeTypeSeq)
+		}
+		bw := uint64(r.Link.DownlinkMB) * 1000 * 1000
+		found := false
+		for i := range cfg.Rules {
+			if cfg.Rules[i].Subnet.IP.Equal(r.Link.IP) {
+				found = true
+				if cfg.Rules[i].Bandwidth == 0 || bw < cfg.Rules[i].Bandwidth {
+					cfg.Rules[i].Bandwidth = bw
+				}
+			}
+		}
+		if !found {
+			shape := cfg.Default
+			if shape.Bandwidth == 0 || bw < shape.Bandwidth {
+				shape.Bandwidth = bw
+			}
+			cfg.Rules = append(cfg.Rules, network.LinkRule{
+				LinkShape: shape,
+				Subnet:    ptypes.IPNet{IPNet: net.IPNet{IP: r.Link.IP, Mask: net.CIDRMask(8*len(r.Link.IP), 8*len(r.Link.IP))}},
+			})
+		}
+		capped++
+	}
+	if capped == 0 {
+		return nil
+	}
+
+	cfg.CallbackState = "downlinks-configured"
+	runenv.RecordMessage("Capping the links towards %d nodes to their downlink bandwidth", capped)
+	if err := netclient.ConfigureNetwork(ctx, &cfg); err != nil {
+		return err
+	}
+	*config = cfg
+	return nil
+}
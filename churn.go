@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ChurnParams make a fraction of the lurkers leave the network and rejoin it
+// during the run
+type ChurnParams struct {
+	// probability that an eligible node leaves at each churn interval
+	Rate     float64
+	Interval time.Duration
+	// time a node stays up after (re)joining before it can leave again
+	MinUptime time.Duration
+	// time a node stays away before rejoining
+	Downtime time.Duration
+}
+
+func (c ChurnParams) enabled() bool {
+	return c.Rate > 0 && c.Interval > 0
+}
+
+// runChurn makes the node leave with probability Rate at every interval, once
+// it has been up for at least MinUptime. A leaving node unsubscribes from its
+// topics and disconnects from all its peers, then after Downtime it reconnects
+// through discovery and subscribes again.
+func (p *PubsubNode) runChurn() {
+	params := p.cfg.Churn
+	ticker := time.NewTicker(params.Interval)
+	defer ticker.Stop()
+
+	up := p.runStart
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+		if time.Since(up) < params.MinUptime || rand.Float64() >= params.Rate {
+			continue
+		}
+
+		p.log("churn: leaving the network for %s", params.Downtime)
+		p.runenv.R().RecordPoint("churn_leave", 1)
+		p.markTimeline("churn", "leave", unplanned)
+		down := TimeWindow{Start: time.Now().UnixNano()}
+		p.unsubscribeAll()
+		for _, pid := range p.h.Network().Peers() {
+			p.h.Network().ClosePeer(pid)
+		}
+
+		select {
+		case <-time.After(params.Downtime):
+		case <-p.ctx.Done():
+			return
+		}
+
+		down.End = time.Now().UnixNano()
+		p.downLk.Lock()
+		p.downWindows = append(p.downWindows, down)
+		p.downLk.Unlock()
+
+		if p.cfg.PX.discovery() {
+			p.connectTopology(p.ctx, 0)
+		} else if err := p.discovery.ConnectTopology(p.ctx, 0); err != nil {
+			p.log("churn: error reconnecting to the topology: %s", err)
+		}
+		p.resubscribeAll()
+		up = time.Now()
+		p.markTimeline("churn", "rejoin", unplanned)
+		p.log("churn: rejoined the network with %d peers", len(p.h.Network().Peers()))
+	}
+}
+
+// unsubscribeAll cancels the subscriptions to every joined topic
+func (p *PubsubNode) unsubscribeAll() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, ts := range p.topics {
+		if ts.sub != nil {
+			ts.sub.Cancel()
+			ts.sub = nil
+		}
+	}
+}
+
+// resubscribeAll subscribes again to the topics left by unsubscribeAll
+func (p *PubsubNode) resubscribeAll() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, ts := range p.topics {
+		if ts.sub == nil {
+			p.subscribeTopic(ts)
+		}
+	}
+}
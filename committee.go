@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// CommitteeParams configure the committee workload, where each slot a random
+// committee of nodes publish small messages nearly simultaneously, like
+// attestations in a beacon chain
+type CommitteeParams struct {
+	// number of nodes publishing each slot
+	Size int
+	Slot time.Duration
+	// maximum random delay of each member's message after the start of the slot
+	Jitter      time.Duration
+	MessageSize int
+	// node measuring the deliveries within the aggregation window
+	Collector         int64
+	AggregationWindow time.Duration
+	// seed shared by all nodes, so that they agree on the committees
+	Seed int64
+}
+
+// slotOf returns the slot in which the time falls. Slots are aligned to unix
+// time so that all nodes agree on them without coordination.
+func (c CommitteeParams) slotOf(t time.Time) int64 {
+	return t.UnixNano() / int64(c.Slot)
+}
+
+func (c CommitteeParams) slotStart(slot int64) time.Time {
+	return time.Unix(0, slot*int64(c.Slot))
+}
+
+// members returns the sequence numbers of the committee for the slot
+func (c CommitteeParams) members(slot int64, instances int) map[int64]struct{} {
+	r := rand.New(rand.NewSource(c.Seed ^ slot))
+	size := c.Size
+	if size > instances {
+		size = instances
+	}
+	members := make(map[int64]struct{}, size)
+	for _, idx := range r.Perm(instances)[:size] {
+		members[int64(idx)+1] = struct{}{}
+	}
+	return members
+}
+
+// committeeWorkload publishes one message in every slot in which the node is
+// part of the committee
+type committeeWorkload struct {
+	params CommitteeParams
+	env    WorkloadEnv
+	topic  string
+	rng    *rand.Rand
+
+	slot int64
+	// time of the last message returned
+	now time.Time
+}
+
+func newCommitteeWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	params := env.Committee
+	if params.Size <= 0 || params.Slot <= 0 {
+		return nil, fmt.Errorf("committee workload requires a positive committee_size and t_slot")
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("committee workload requires a topic")
+	}
+	now := time.Now()
+	return &committeeWorkload{
+		params: params,
+		env:    env,
+		topic:  topics[0].Id,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		slot:   params.slotOf(now),
+		now:    now,
+	}, nil
+}
+
+func (w *committeeWorkload) Next() (uint64, time.Duration, string) {
+	for {
+		w.slot++
+		if _, ok := w.params.members(w.slot, w.env.Instances)[w.env.Seq]; ok {
+			break
+		}
+	}
+
+	at := w.params.slotStart(w.slot)
+	if w.params.Jitter > 0 {
+		at = at.Add(time.Duration(w.rng.Int63n(int64(w.params.Jitter))))
+	}
+	delay := at.Sub(w.now)
+	w.now = at
+	return uint64(w.params.MessageSize), delay, w.topic
+}
+
+// CommitteeCollector counts, for every slot, the committee messages received
+// within the aggregation window
+type CommitteeCollector struct {
+	lk       sync.Mutex
+	params   CommitteeParams
+	inWindow map[int64]map[string]struct{}
+	late     map[int64]map[string]struct{}
+}
+
+func NewCommitteeCollector(params CommitteeParams) *CommitteeCollector {
+	return &CommitteeCollector{
+		params:   params,
+		inWindow: make(map[int64]map[string]struct{}),
+		late:     make(map[int64]map[string]struct{}),
+	}
+}
+
+// Record accounts for a committee message published by sender at published
+// and received at received
+func (c *CommitteeCollector) Record(sender string, published time.Time, received time.Time) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	slot := c.params.slotOf(published)
+	set := c.late
+	if received.Sub(c.params.slotStart(slot)) <= c.params.AggregationWindow {
+		set = c.inWindow
+	}
+	if set[slot] == nil {
+		set[slot] = make(map[string]struct{})
+	}
+	set[slot][sender] = struct{}{}
+}
+
+// Write outputs the delivery ratio within the aggregation window for every
+// slot between the first and last slot with a committee message
+func (c *CommitteeCollector) Write(path string, seq int64, instances int) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	var slots []int64
+	for slot := range c.inWindow {
+		slots = append(slots, slot)
+	}
+	for slot := range c.late {
+		if _, ok := c.inWindow[slot]; !ok {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+
+	out := outputs.Committee{
+		Version:             outputs.SchemaVersion,
+		Collector:           seq,
+		CommitteeSize:       c.params.Size,
+		SlotMs:              c.params.Slot.Milliseconds(),
+		AggregationWindowMs: c.params.AggregationWindow.Milliseconds(),
+	}
+	if len(slots) > 0 {
+		var total float64
+		out.MinRatio = 1
+		for slot := slots[0]; slot <= slots[len(slots)-1]; slot++ {
+			expected := len(c.params.members(slot, instances))
+			s := outputs.CommitteeSlot{
+				Slot:     slot,
+				Expected: expected,
+				InWindow: len(c.inWindow[slot]),
+				Late:     len(c.late[slot]),
+			}
+			if expected > 0 {
+				s.Ratio = float64(s.InWindow) / float64(expected)
+			}
+			if s.Ratio < out.MinRatio {
+				out.MinRatio = s.Ratio
+			}
+			if s.InWindow == expected {
+				out.CompleteSlots++
+			}
+			total += s.Ratio
+			out.Slots = append(out.Slots, s)
+		}
+		out.MeanRatio = total / float64(len(out.Slots))
+	}
+
+	jsonstr, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// recordPublishedSeq records the sequence number of a message the node
+// published on a topic
+func (p *PubsubNode) recordPublishedSeq(topic string, seq int64) {
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+	if p.publishedSeqs == nil {
+		p.publishedSeqs = make(map[string][]int64)
+	}
+	p.publishedSeqs[topic] = append(p.publishedSeqs[topic], seq)
+}
+
+// publishedSequences returns the sequence numbers of the messages the node
+// published, by topic
+func (p *PubsubNode) publishedSequences() map[string][]int64 {
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+	if len(p.publishedSeqs) == 0 {
+		return nil
+	}
+	out := make(map[string][]int64, len(p.publishedSeqs))
+	for topic, seqs := range p.publishedSeqs {
+		out[topic] = append([]int64(nil), seqs...)
+	}
+	return out
+}
+
+// receivedBitmaps returns the messages delivered to the node as a bitmap of
+// sequence numbers for each publisher, keyed by topic/sender
+func (p *PubsubNode) receivedBitmaps() map[string][]byte {
+	p.handleLk.Lock()
+	defer p.handleLk.Unlock()
+	return p.order.bitmaps()
+}
+
+// bitmaps returns the delivered sequence numbers of each publisher as a
+// bitmap, keyed by topic/sender
+func (o deliveryOrder) bitmaps() map[string][]byte {
+	out := make(map[string][]byte, len(o))
+	for key, seqs := range o {
+		var bitmap []byte
+		for _, seq := range seqs {
+			if seq < 0 {
+				continue
+			}
+			i := int(seq / 8)
+			for len(bitmap) <= i {
+				bitmap = append(bitmap, 0)
+			}
+			bitmap[i] |= 1 << uint(seq%8)
+		}
+		out[key] = bitmap
+	}
+	return out
+}
+
+func bitmapHas(bitmap []byte, seq int64) bool {
+	i := int(seq / 8)
+	return seq >= 0 && i < len(bitmap) && bitmap[i]&(1<<uint(seq%8)) != 0
+}
+
+// computeCompleteness checks that every honest node got every message
+// published by the other nodes, from the sequence numbers the publishers
+// reported and the bitmaps of the messages each node received
+func computeCompleteness(reports []NodeReport) *outputs.Completeness {
+	s := &outputs.Completeness{}
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		node := outputs.NodeCompleteness{Seq: r.Seq}
+		for _, pub := range reports {
+			if pub.PeerID == r.PeerID {
+				continue
+			}
+			for topic, seqs := range pub.PublishedSeqs {
+				bitmap := r.ReceivedBitmaps[topic+"/"+pub.PeerID]
+				for _, seq := range seqs {
+					node.Expected++
+					if bitmapHas(bitmap, seq) {
+						node.Received++
+					}
+				}
+			}
+		}
+		node.CompletenessPct = 100
+		if node.Expected > 0 {
+			node.CompletenessPct = 100 * float64(node.Received) / float64(node.Expected)
+		}
+		if node.Received == node.Expected {
+			s.CompleteNodes++
+		}
+		s.Expected += node.Expected
+		s.Received += node.Received
+		s.Nodes = append(s.Nodes, node)
+	}
+	for _, r := range reports {
+		for _, seqs := range r.PublishedSeqs {
+			s.Messages += len(seqs)
+		}
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Seq < s.Nodes[j].Seq })
+	s.Reliability = 1
+	if s.Expected > 0 {
+		s.Reliability = float64(s.Received) / float64(s.Expected)
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// ConnFloodParams configure the connection exhaustion attack, where attackers
+// open many connections and streams to their victims without speaking pubsub,
+// to check whether the resource manager limits protect the gossip traffic
+type ConnFloodParams struct {
+	// connections opened to each victim, each from a fresh identity
+	Conns int
+	// streams opened and held on each connection
+	Streams int
+	// number of victims of each attacker
+	Victims int
+	// transport of the flooding hosts, the same as the rest of the network
+	Transport string
+}
+
+func (c ConnFloodParams) enabled() bool {
+	return c.Conns > 0
+}
+
+// connFloodStats count the connections and streams accepted and refused by the victims
+type connFloodStats struct {
+	conns          int64
+	refusedConns   int64
+	streams        int64
+	refusedStreams int64
+}
+
+// runConnFlood floods the victims with connections during the attack window
+func (p *PubsubNode) runConnFlood() {
+	params := p.cfg.ConnFlood
+	w := p.cfg.AttackWindow
+	if !p.waitAttackStart() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, w.Duration)
+	defer cancel()
+
+	victims := append([]PeerRegistration(nil), p.discovery.allPeers...)
+	rand.Shuffle(len(victims), func(i, j int) { victims[i], victims[j] = victims[j], victims[i] })
+	if len(victims) > params.Victims {
+		victims = victims[:params.Victims]
+	}
+	p.log("flooding %d victims with %d connections and %d streams each", len(victims), params.Conns, params.Conns*params.Streams)
+
+	var stats connFloodStats
+	var hostsLk sync.Mutex
+	var hosts []host.Host
+	var wg sync.WaitGroup
+	for _, victim := range victims {
+		for i := 0; i < params.Conns; i++ {
+			wg.Add(1)
+			go func(victim PeerRegistration) {
+				defer wg.Done()
+				h, err := createHost(ctx, params.Transport, false, nil, nil, nil)
+				if err != nil {
+					return
+				}
+				hostsLk.Lock()
+				hosts = append(hosts, h)
+				hostsLk.Unlock()
+				p.floodVictim(ctx, h, victim, &stats)
+			}(victim)
+		}
+	}
+	wg.Wait()
+
+	p.log("connection flood: %d connections (%d refused), %d streams (%d refused)",
+		stats.conns, stats.refusedConns, stats.streams, stats.refusedStreams)
+	p.runenv.R().RecordPoint("conn_flood_connections", float64(stats.conns))
+	p.runenv.R().RecordPoint("conn_flood_refused_connections", float64(stats.refusedConns))
+	p.runenv.R().RecordPoint("conn_flood_streams", float64(stats.streams))
+	p.runenv.R().RecordPoint("conn_flood_refused_streams", float64(stats.refusedStreams))
+
+	// hold the connections and streams until the end of the attack window
+	<-ctx.Done()
+	for _, h := range hosts {
+		h.Close()
+	}
+	p.log("connection flood over")
+}
+
+// floodVictim connects to the victim from the given host and opens streams
+// that are never used, so that they count against the victim's limits
+func (p *PubsubNode) floodVictim(ctx context.Context, h host.Host, victim PeerRegistration, stats *connFloodStats) {
+	cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+	defer cancel()
+	if err := h.Connect(cctx, victim.Info); err != nil {
+		atomic.AddInt64(&stats.refusedConns, 1)
+		return
+	}
+	atomic.AddInt64(&stats.conns, 1)
+
+	for i := 0; i < p.cfg.ConnFlood.Streams; i++ {
+		// the streams are left open, and closed along with the host
+		if _, err := h.NewStream(ctx, victim.Info.ID, ping.ID); err != nil {
+			atomic.AddInt64(&stats.refusedStreams, 1)
+			continue
+		}
+		atomic.AddInt64(&stats.streams, 1)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+)
+
+// disconnections within this time of a connection manager trim are counted as
+// pruned by the connection manager
+const trimWindow = time.Second
+
+// ConnLimits configure the connection manager and the resource manager of a
+// host, and count the connections they pruned or refused. A zero HighWater
+// leaves the connections unmanaged, and zero resource limits keep the libp2p
+// defaults.
+type ConnLimits struct {
+	LowWater    int
+	HighWater   int
+	GracePeriod time.Duration
+
+	MaxConns          int
+	MaxConnsPerPeer   int
+	MaxStreamsPerPeer int
+
+	trimmed int64
+	blocked int64
+}
+
+func (c *ConnLimits) validate() error {
+	if c.HighWater > 0 && c.LowWater > c.HighWater {
+		return fmt.Errorf("connection manager low watermark %d is above the high watermark %d", c.LowWater, c.HighWater)
+	}
+	if c.MaxConns < 0 || c.MaxConnsPerPeer < 0 || c.MaxStreamsPerPeer < 0 {
+		return fmt.Errorf("resource manager limits can't be negative")
+	}
+	return nil
+}
+
+func (c *ConnLimits) limitsResources() bool {
+	return c.MaxConns > 0 || c.MaxConnsPerPeer > 0 || c.MaxStreamsPerPeer > 0
+}
+
+// options returns the host options for the limits, and a notifiee counting
+// the connections pruned by the connection manager
+func (c *ConnLimits) options() ([]libp2p.Option, network.Notifiee, error) {
+	var opts []libp2p.Option
+	var notifiee network.Notifiee
+	if c.HighWater > 0 {
+		cm, err := connmgr.NewConnManager(c.LowWater, c.HighWater, connmgr.WithGracePeriod(c.GracePeriod))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating connection manager: %w", err)
+		}
+		opts = append(opts, libp2p.ConnectionManager(cm))
+		notifiee = &network.NotifyBundle{
+			DisconnectedF: func(_ network.Network, _ network.Conn) {
+				if time.Since(cm.GetInfo().LastTrim) < trimWindow {
+					atomic.AddInt64(&c.trimmed, 1)
+				}
+			},
+		}
+	}
+
+	if c.limitsResources() {
+		partial := rcmgr.PartialLimitConfig{
+			System: rcmgr.ResourceLimits{Conns: rcmgr.LimitVal(c.MaxConns)},
+			PeerDefault: rcmgr.ResourceLimits{
+				Conns:   rcmgr.LimitVal(c.MaxConnsPerPeer),
+				Streams: rcmgr.LimitVal(c.MaxStreamsPerPeer),
+			},
+		}
+		limiter := rcmgr.NewFixedLimiter(partial.Build(rcmgr.DefaultLimits.AutoScale()))
+		rm, err := rcmgr.NewResourceManager(limiter, rcmgr.WithTraceReporter(c))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error creating resource manager: %w", err)
+		}
+		opts = append(opts, libp2p.ResourceManager(rm))
+	}
+	return opts, notifiee, nil
+}
+
+// ConsumeEvent counts the connections and streams refused by the resource manager
+func (c *ConnLimits) ConsumeEvent(evt rcmgr.TraceEvt) {
+	switch evt.Type {
+	case rcmgr.TraceBlockAddConnEvt, rcmgr.TraceBlockAddStreamEvt:
+		atomic.AddInt64(&c.blocked, 1)
+	}
+}
+
+// Pruned returns the number of connections pruned by the connection manager,
+// and of connections and streams refused by the resource manager
+func (c *ConnLimits) Pruned() (trimmed int64, blocked int64) {
+	return atomic.LoadInt64(&c.trimmed), atomic.LoadInt64(&c.blocked)
+}
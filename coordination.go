@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+// AttackerMessage is shared by the attackers on their private sync topic
+type AttackerMessage struct {
+	Seq int64
+	// victim of the sender, and number of its sybil identities in the
+	// victim's mesh
+	Victim int64
+	InMesh int64
+}
+
+var AttackerTopic = tgsync.NewTopic("attacker-coordination", &AttackerMessage{})
+
+// attackTeam coordinates the attackers of the run. The attackers must be a
+// group of their own, so that the group instance count is the team size.
+type attackTeam struct {
+	size    int
+	started chan struct{}
+
+	lk sync.Mutex
+	// identities in the victim's mesh, by attacker sequence number
+	inMesh map[int64]int64
+}
+
+// joinAttackTeam subscribes to the attackers' topic and runs the attack phases
+func (p *PubsubNode) joinAttackTeam() error {
+	t := &attackTeam{
+		size:    p.runenv.TestGroupInstanceCount,
+		started: make(chan struct{}),
+		inMesh:  make(map[int64]int64),
+	}
+	ch := make(chan *AttackerMessage, 16)
+	if _, err := p.client.Subscribe(p.ctx, AttackerTopic, ch); err != nil {
+		return fmt.Errorf("error subscribing to attacker topic: %w", err)
+	}
+	p.team = t
+
+	go func() {
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				t.lk.Lock()
+				t.inMesh[msg.Seq] = msg.InMesh
+				t.lk.Unlock()
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+	go p.runAttackPhases()
+	return nil
+}
+
+// runAttackPhases makes all the attackers start and end the attack window
+// together, whatever the skew between their clocks
+func (p *PubsubNode) runAttackPhases() {
+	w := p.cfg.AttackWindow
+	if !p.attackPhase("start", p.runStart.Add(w.Start)) {
+		return
+	}
+	close(p.team.started)
+	p.attackPhase("end", p.runStart.Add(w.Start+w.Duration))
+}
+
+// attackPhase waits until at, then for every attacker to reach the phase
+func (p *PubsubNode) attackPhase(phase string, at time.Time) bool {
+	select {
+	case <-time.After(time.Until(at)):
+	case <-p.ctx.Done():
+		return false
+	}
+	state := tgsync.State("attack-phase-" + phase)
+	if _, err := p.client.SignalAndWait(p.ctx, state, p.team.size); err != nil {
+		p.log("error waiting for the attackers to %s the attack: %s", phase, err)
+		return false
+	}
+	p.log("attackers entered the %s phase", phase)
+	p.traceEvent("attack_phase", struct{ Phase string }{phase})
+	p.markTimeline("attack", "phase "+phase, at.Sub(p.runStart))
+	return true
+}
+
+// waitAttackStart blocks until the start of the attack window, and returns
+// false if the run ended before it
+func (p *PubsubNode) waitAttackStart() bool {
+	if p.team != nil {
+		select {
+		case <-p.team.started:
+			return true
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+	select {
+	case <-time.After(time.Until(p.runStart.Add(p.cfg.AttackWindow.Start))):
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// shareVictimMesh tells the other attackers how many of this attacker's
+// identities are in the victim's mesh
+func (p *PubsubNode) shareVictimMesh(victim int64, inMesh int64) {
+	msg := &AttackerMessage{Seq: p.seq, Victim: victim, InMesh: inMesh}
+	if _, err := p.client.Publish(p.ctx, AttackerTopic, msg); err != nil && p.ctx.Err() == nil {
+		p.log("error sharing victim mesh membership: %s", err)
+	}
+}
+
+// victimMeshShare returns the number of identities of the whole team in the
+// victim's mesh
+func (t *attackTeam) victimMeshShare() int64 {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	var total int64
+	for _, n := range t.inMesh {
+		total += n
+	}
+	return total
+}
+
+// waitMeshRoom blocks while the team already holds the d slots of the
+// victim's mesh, so that coordinated attackers don't compete for the same slots
+func (t *attackTeam) waitMeshRoom(ctx context.Context, d int) bool {
+	for t.victimMeshShare() >= int64(d) {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// messageSender returns the peer ID of the sender of a message from its key
+func messageSender(key string) string {
+	end := strings.LastIndex(key, "/")
+	if end < 0 {
+		return ""
+	}
+	start := strings.LastIndex(key[:end], "/")
+	return key[start+1 : end]
+}
+
+// computeDeadlineMisses counts, for every message, the honest nodes other
+// than its sender that received it after the deadline or never. The messages
+// are the ones delivered to any node.
+func computeDeadlineMisses(reports []NodeReport, deadline time.Duration) *outputs.DeadlineMisses {
+	out := &outputs.DeadlineMisses{DeadlineMs: float64(deadline) / float64(time.Millisecond)}
+	var honest []NodeReport
+	messages := make(map[string]struct{})
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		honest = append(honest, r)
+		for key := range r.MessageLatenciesMs {
+			messages[key] = struct{}{}
+		}
+	}
+	out.Messages = len(messages)
+
+	rates := make([]float64, 0, len(messages))
+	for key := range messages {
+		sender := messageSender(key)
+		var expected, late, never int64
+		for _, r := range honest {
+			if r.PeerID == sender {
+				continue
+			}
+			expected++
+			lat, ok := r.MessageLatenciesMs[key]
+			switch {
+			case !ok:
+				never++
+			case lat > out.DeadlineMs:
+				late++
+			}
+		}
+		out.Expected += expected
+		out.Late += late
+		out.Never += never
+		if late+never > 0 {
+			out.MessagesMissed++
+		}
+		if expected > 0 {
+			rates = append(rates, float64(late+never)/float64(expected))
+		}
+	}
+	out.OnTime = out.Expected - out.Late - out.Never
+	if out.Expected > 0 {
+		out.MissRate = float64(out.Late+out.Never) / float64(out.Expected)
+		out.LateRate = float64(out.Late) / float64(out.Expected)
+		out.NeverRate = float64(out.Never) / float64(out.Expected)
+	}
+
+	if len(rates) > 0 {
+		sort.Float64s(rates)
+		at := func(pct float64) float64 { return rates[int(pct*float64(len(rates)-1))] }
+		out.MessageMissRate = outputs.MissRateDistribution{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: rates[len(rates)-1]}
+	}
+	return out
+}
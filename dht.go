@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kaddht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+)
+
+// DHTProtocolPrefix keeps the test DHT apart from the public one
+const DHTProtocolPrefix = protocol.ID("/gossipsub-testplan")
+
+// Peer discovery modes
+const (
+	DiscoverySync = "sync"
+	DiscoveryDHT  = "dht"
+)
+
+// DHTParams configure peer discovery through a Kademlia DHT. The nodes with
+// a sequence number up to Bootstrappers are the bootstrap nodes of the DHT:
+// the other nodes only dial them, and find the peers of their topics through
+// the DHT. The sync service is still used to share the bootstrap addresses
+// and the sequence numbers of the nodes for the reports.
+type DHTParams struct {
+	Bootstrappers int
+}
+
+func (d DHTParams) enabled() bool {
+	return d.Bootstrappers > 0
+}
+
+// dhtDiscovery advertises and finds the peers of the pubsub topics
+type dhtDiscovery struct {
+	dht     *kaddht.IpfsDHT
+	routing *drouting.RoutingDiscovery
+}
+
+func newDHTDiscovery(ctx context.Context, h host.Host) (*dhtDiscovery, error) {
+	dht, err := kaddht.New(ctx, h, kaddht.Mode(kaddht.ModeServer), kaddht.ProtocolPrefix(DHTProtocolPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("error creating dht: %w", err)
+	}
+	return &dhtDiscovery{dht: dht, routing: drouting.NewRoutingDiscovery(dht)}, nil
+}
+
+// bootstrap connects to the bootstrap nodes and fills the routing table.
+// Pubsub then advertises and looks up its topics through the DHT.
+func (p *PubsubNode) bootstrapDHT(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+
+	var bootstrap []PeerRegistration
+	for _, r := range p.discovery.allPeers {
+		if r.NodeTypeSeq <= int64(p.cfg.DHT.Bootstrappers) {
+			bootstrap = append(bootstrap, r)
+		}
+	}
+	p.log("bootstrapping the dht with %d nodes after %s", len(bootstrap), delay)
+	if len(bootstrap) > 0 {
+		if err := p.discovery.ConnectingToPeers(ctx, bootstrap); err != nil {
+			return err
+		}
+	}
+	if err := p.dht.dht.Bootstrap(ctx); err != nil {
+		return fmt.Errorf("error bootstrapping dht: %w", err)
+	}
+	p.runenv.R().RecordPoint("dht_routing_table_size", float64(p.dht.dht.RoutingTable().Size()))
+	return nil
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	swarm "github.com/libp2p/go-libp2p/p2p/net/swarm"
 	"golang.org/x/sync/errgroup"
@@ -21,17 +21,20 @@ import (
 
 type NodeType string
 
-/*const (
-	NodeTypeSybil  NodeType = "sybil"
-	NodeTypeGraft  NodeType = "graft"
+const (
 	NodeTypeHonest NodeType = "honest"
-)*/
+	NodeTypeSybil  NodeType = "sybil"
+	// eclipse attackers only connect to their victim and to each other
+	NodeTypeEclipse NodeType = "eclipse"
+)
 
 const (
 	PeerConnectTimeout = time.Second * 10
 	MaxConnectRetries  = 10
 )
 
+// ConnectionsDef is the legacy format of the connections of a node in the
+// topology param, see upgradeConnectionsDef
 type ConnectionsDef struct {
 	Latency     time.Duration
 	Connections []string
@@ -46,12 +49,19 @@ type SyncDiscovery struct {
 	runenv         *runtime.RunEnv
 	peerSubscriber *PeerSubscriber
 	topology       Topology
-	//nodeType       NodeType
-	nodeTypeSeq int64
-	isPublisher bool
+	nodeType       NodeType
+	nodeTypeSeq    int64
+	isPublisher    bool
+	// registered along with the peer info
+	link LinkMetadata
+	// registered instead of the host's info, for the nodes running another
+	// implementation in an external process
+	info *peer.AddrInfo
 
 	// All peers in the test
 	allPeers []PeerRegistration
+	// The sequence number of every peer in the test
+	seqs map[peer.ID]int64
 
 	// The peers that this node connects to
 	connectedLk sync.RWMutex
@@ -105,6 +115,89 @@ func (t RandomTopology) SelectNPeers(n int, local peer.ID, remote []PeerRegistra
 	return out
 }
 
+// SmallWorldTopology is a Watts-Strogatz small-world graph: a ring lattice of
+// all the nodes ordered by sequence number, where each node is connected to its
+// K nearest neighbors and every edge is rewired to a random node with
+// probability Beta. The graph is derived from Seed so that all the nodes build
+// the same graph.
+type SmallWorldTopology struct {
+	// Seq is the sequence number of the local node
+	Seq       int64
+	Instances int
+	K         int
+	Beta      float64
+	Seed      int64
+}
+
+func (t SmallWorldTopology) SelectPeers(local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	neighbors := t.graph()[t.Seq]
+	out := make([]PeerRegistration, 0, len(neighbors))
+	for _, p := range remote {
+		if _, ok := neighbors[p.NodeTypeSeq]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (t SmallWorldTopology) SelectNPeers(n int, local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	return RandomTopology{}.SelectNPeers(n, local, remote)
+}
+
+// graph returns the neighbors of every node, by sequence number
+func (t SmallWorldTopology) graph() map[int64]map[int64]struct{} {
+	n := t.Instances
+	adj := make(map[int64]map[int64]struct{}, n)
+	for i := 1; i <= n; i++ {
+		adj[int64(i)] = make(map[int64]struct{})
+	}
+	connect := func(a, b int64) {
+		adj[a][b] = struct{}{}
+		adj[b][a] = struct{}{}
+	}
+	disconnect := func(a, b int64) {
+		delete(adj[a], b)
+		delete(adj[b], a)
+	}
+	// sequence numbers start at 1
+	seq := func(i int) int64 {
+		return int64(i%n) + 1
+	}
+
+	// ring lattice
+	for i := 0; i < n; i++ {
+		for j := 1; j <= t.K/2; j++ {
+			if seq(i) != seq(i+j) {
+				connect(seq(i), seq(i+j))
+			}
+		}
+	}
+
+	// rewire each edge to the right with probability beta, avoiding self loops
+	// and duplicate edges
+	rng := rand.New(rand.NewSource(t.Seed))
+	for j := 1; j <= t.K/2; j++ {
+		for i := 0; i < n; i++ {
+			if rng.Float64() >= t.Beta {
+				continue
+			}
+			a, b := seq(i), seq(i+j)
+			if _, ok := adj[a][b]; !ok || len(adj[a]) >= n-1 {
+				continue
+			}
+			for {
+				c := int64(rng.Intn(n)) + 1
+				if _, ok := adj[a][c]; c != a && !ok {
+					disconnect(a, b)
+					connect(a, c)
+					break
+				}
+			}
+		}
+	}
+	return adj
+}
+
 // RandomHonestTopology is a Topology that returns a subset of all non-attack nodes
 type RandomHonestTopology struct {
 	// Count is the number of total peers to return
@@ -123,7 +216,7 @@ func (t RandomHonestTopology) SelectPeers(local peer.ID, remote []PeerRegistrati
 	for _, peer := range remote {
 		// Only connect to honest nodes.
 		// If PublishersOnly is true, only connect to Publishers
-		if /*peer.NType == NodeTypeHonest &&*/ !t.PublishersOnly || peer.IsPublisher {
+		if peer.NType != NodeTypeSybil && (!t.PublishersOnly || peer.IsPublisher) {
 			filtered = append(filtered, peer)
 		}
 	}
@@ -162,43 +255,15 @@ func selectSinglePublisher(peers []PeerRegistration) *PeerRegistration {
 	return &lowestp
 }
 
-// FixedTopology is defined by a topology file
-type FixedTopology struct {
-	// def contains the definition of the topology
-	def *ConnectionsDef
-}
-
-func (t FixedTopology) SelectPeers(local peer.ID, remote []PeerRegistration) []PeerRegistration {
-	if len(remote) == 0 {
-		return []PeerRegistration{}
-	}
-
-	out := make([]PeerRegistration, 0, len(t.def.Connections))
-	for _, conn := range t.def.Connections {
-		parts := strings.Split(conn, "-")
-		if len(parts) != 3 {
-			panic(fmt.Sprintf("Badly formatted topology file"))
-		}
-		//nodeType := parts[0]
-		nodeTypeSeq := parts[0]
-		//nodeIdx := parts[2]
-		for _, p := range remote {
-			//if nodeType == string(p.NType) && nodeTypeSeq == strconv.Itoa(int(p.NodeTypeSeq)) {
-			if nodeTypeSeq == strconv.Itoa(int(p.NodeTypeSeq)) {
-				out = append(out, p)
-			}
-		}
-	}
-	return out
-}
-
 // PeerRegistration contains the addresses, sequence numbers and node type (honest / sybil / etc)
 // for each peer in the test. It is shared with every other peer using the sync service.
 type PeerRegistration struct {
-	Info peer.AddrInfo
-	//NType       NodeType
+	Info        peer.AddrInfo
+	NType       NodeType
 	NodeTypeSeq int64
 	IsPublisher bool
+	// used to shape the links towards the node
+	Link LinkMetadata
 }
 
 // PeerSubscriber subscribes to peer information from all nodes in all containers.
@@ -209,6 +274,23 @@ type PeerSubscriber struct {
 	runenv         *runtime.RunEnv
 	client         tgsync.Client
 	containerCount int
+	// only log progress every 500 peers
+	quiet bool
+	// sync topic the registrations are shared on
+	topic *tgsync.Topic
+
+	// if greater than 1, the registrations of the local nodes are published
+	// in batches of up to batchSize records on batchTopic
+	batchSize  int
+	batchTopic *tgsync.Topic
+	pendingLk  sync.Mutex
+	pending    []PeerRegistration
+}
+
+// PeerRegistrationBatch carries the registrations of several nodes running in
+// the same container, to reduce the number of sync messages
+type PeerRegistrationBatch struct {
+	Peers []PeerRegistration
 }
 
 func NewPeerSubscriber(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client, containerCount int) *PeerSubscriber {
@@ -216,16 +298,40 @@ func NewPeerSubscriber(ctx context.Context, runenv *runtime.RunEnv, client tgsyn
 		runenv:         runenv,
 		client:         client,
 		containerCount: containerCount,
+		topic:          PeerRegistrationTopic,
+		batchTopic:     PeerRegistrationBatchTopic,
 	}
 }
 
+// batching returns true if the registrations are published in batches
+func (ps *PeerSubscriber) batching() bool {
+	return ps.batchSize > 1
+}
+
 var PeerRegistrationTopic = tgsync.NewTopic("pubsub-test-peers", &PeerRegistration{})
 
+var PeerRegistrationBatchTopic = tgsync.NewTopic("pubsub-test-peer-batches", &PeerRegistrationBatch{})
+
+// HeavyPeerRegistrationTopic is used by the dedicated hosts of the heavy topic,
+// which form a separate network
+var HeavyPeerRegistrationTopic = tgsync.NewTopic("pubsub-test-heavy-peers", &PeerRegistration{})
+
 // Register node information for the local node
 func (ps *PeerSubscriber) register(ctx context.Context, entry PeerRegistration) error {
 
+	if ps.batching() {
+		ps.pendingLk.Lock()
+		ps.pending = append(ps.pending, entry)
+		full := len(ps.pending) >= ps.batchSize
+		ps.pendingLk.Unlock()
+		if full {
+			return ps.flush(ctx)
+		}
+		return nil
+	}
+
 	//ps.runenv.RecordMessage("registering peers for %s %s %d %s \n", entry.Info, entry.NType, entry.NodeTypeSeq, entry.IsPublisher)
-	if _, err := ps.client.Publish(ctx, PeerRegistrationTopic, &entry); err != nil {
+	if _, err := ps.client.Publish(ctx, ps.topic, &entry); err != nil {
 		ps.runenv.RecordMessage("registering peers not publishing %w", err)
 		return fmt.Errorf("failed to write to pubsub subtree in sync service: %w", err)
 	}
@@ -233,6 +339,22 @@ func (ps *PeerSubscriber) register(ctx context.Context, entry PeerRegistration)
 	return nil
 }
 
+// flush publishes the pending registrations as a single batch
+func (ps *PeerSubscriber) flush(ctx context.Context) error {
+	ps.pendingLk.Lock()
+	batch := PeerRegistrationBatch{Peers: ps.pending}
+	ps.pending = nil
+	ps.pendingLk.Unlock()
+
+	if len(batch.Peers) == 0 {
+		return nil
+	}
+	if _, err := ps.client.Publish(ctx, ps.batchTopic, &batch); err != nil {
+		return fmt.Errorf("failed to write registration batch to sync service: %w", err)
+	}
+	return nil
+}
+
 // Wait for node information from all nodes in all containers
 func (ps *PeerSubscriber) waitForPeers(ctx context.Context) ([]PeerRegistration, error) {
 	ps.lk.Lock()
@@ -242,6 +364,15 @@ func (ps *PeerSubscriber) waitForPeers(ctx context.Context) ([]PeerRegistration,
 		return ps.peers, nil
 	}
 
+	if ps.batching() {
+		// the local nodes must register before waiting, publish a partial
+		// batch if there is one
+		if err := ps.flush(ctx); err != nil {
+			return nil, err
+		}
+		return ps.waitForBatches(ctx)
+	}
+
 	// wait for all other peers to send their peer registration
 	peerCh := make(chan *PeerRegistration, 16)
 	ps.peers = make([]PeerRegistration, 0, ps.containerCount)
@@ -254,7 +385,7 @@ func (ps *PeerSubscriber) waitForPeers(ctx context.Context) ([]PeerRegistration,
 	time.Sleep(delay)
 
 	sctx, cancelSub := context.WithCancel(ctx)
-	if _, err := ps.client.Subscribe(sctx, PeerRegistrationTopic, peerCh); err != nil {
+	if _, err := ps.client.Subscribe(sctx, ps.topic, peerCh); err != nil {
 		cancelSub()
 		return nil, err
 	}
@@ -269,7 +400,9 @@ func (ps *PeerSubscriber) waitForPeers(ctx context.Context) ([]PeerRegistration,
 				return nil, fmt.Errorf("not enough peer infos. expected %d, got %d", ps.containerCount, len(ps.peers))
 			}
 			ps.peers = append(ps.peers, *ai)
-			ps.runenv.RecordMessage("received peer information from %d of %d peers in %s %s", len(ps.peers), ps.containerCount, time.Since(start), ai.Info.ID)
+			if !ps.quiet {
+				ps.runenv.RecordMessage("received peer information from %d of %d peers in %s %s", len(ps.peers), ps.containerCount, time.Since(start), ai.Info.ID)
+			}
 
 			if len(ps.peers)%500 == 0 {
 				ps.runenv.RecordMessage("received peer information from %d of %d peers in %s", len(ps.peers), ps.containerCount, time.Since(start))
@@ -285,6 +418,39 @@ func (ps *PeerSubscriber) waitForPeers(ctx context.Context) ([]PeerRegistration,
 	return ps.peers, nil
 }
 
+// waitForBatches collects the batched registrations of all the nodes
+func (ps *PeerSubscriber) waitForBatches(ctx context.Context) ([]PeerRegistration, error) {
+	batchCh := make(chan *PeerRegistrationBatch, 16)
+	ps.peers = make([]PeerRegistration, 0, ps.containerCount)
+
+	sctx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	if _, err := ps.client.Subscribe(sctx, ps.batchTopic, batchCh); err != nil {
+		ps.peers = nil
+		return nil, err
+	}
+
+	start := time.Now()
+	batches := 0
+	for len(ps.peers) < ps.containerCount {
+		select {
+		case batch, ok := <-batchCh:
+			if !ok {
+				n := len(ps.peers)
+				ps.peers = nil
+				return nil, fmt.Errorf("not enough peer infos. expected %d, got %d", ps.containerCount, n)
+			}
+			ps.peers = append(ps.peers, batch.Peers...)
+			batches++
+		case <-ctx.Done():
+			ps.peers = nil
+			return nil, ctx.Err()
+		}
+	}
+	ps.runenv.RecordMessage("received peer information from %d peers in %d batches in %s", len(ps.peers), batches, time.Since(start))
+	return ps.peers, nil
+}
+
 /*func NewSyncDiscovery(h host.Host, runenv *runtime.RunEnv, peerSubscriber *PeerSubscriber, topology Topology, nodeType NodeType, nodeTypeSeq int64, nodeIdx int, isPublisher bool) (*SyncDiscovery, error) {
 
 	return &SyncDiscovery{
@@ -307,6 +473,7 @@ func NewSyncDiscovery(h host.Host, seq int64, runenv *runtime.RunEnv, peerSubscr
 		runenv:         runenv,
 		peerSubscriber: peerSubscriber,
 		topology:       topology,
+		nodeType:       NodeTypeHonest,
 		nodeTypeSeq:    seq,
 		//nodeIdx:        nodeIdx,
 		connected: make(map[peer.ID]PeerRegistration),
@@ -317,12 +484,16 @@ func NewSyncDiscovery(h host.Host, seq int64, runenv *runtime.RunEnv, peerSubscr
 func (s *SyncDiscovery) registerAndWait(ctx context.Context) error {
 	// Register this node's information
 	localPeer := *host.InfoFromHost(s.h)
+	if s.info != nil {
+		localPeer = *s.info
+	}
 	entry := PeerRegistration{
-		Info: localPeer,
-		//NType:       s.nodeType,
+		Info:        localPeer,
+		NType:       s.nodeType,
 		NodeTypeSeq: s.nodeTypeSeq,
 		//NodeIdx:     s.nodeIdx,
 		IsPublisher: s.isPublisher,
+		Link:        s.link,
 	}
 
 	s.peerSubscriber.runenv.RecordMessage("registering peers %s", entry)
@@ -344,7 +515,9 @@ func (s *SyncDiscovery) registerAndWait(ctx context.Context) error {
 
 	// Filter out this node's information from all peers
 	s.allPeers = make([]PeerRegistration, 0, len(peers)-1)
+	s.seqs = make(map[peer.ID]int64, len(peers))
 	for _, p := range peers {
+		s.seqs[p.Info.ID] = p.NodeTypeSeq
 		if p.Info.ID != localPeer.ID {
 			s.allPeers = append(s.allPeers, p)
 		}
@@ -367,7 +540,7 @@ func (s *SyncDiscovery) ConnectTopology(ctx context.Context, delay time.Duration
 
 	s.runenv.RecordMessage("selecting peers between %d", len(s.allPeers))
 
-	selected := s.topology.SelectPeers(s.h.ID(), s.allPeers)
+	selected := s.topology.SelectPeers(s.h.ID(), s.candidates())
 
 	s.runenv.RecordMessage("Connecting topology with %d nodes", len(selected))
 	if len(selected) == 0 {
@@ -467,6 +640,59 @@ func (s *SyncDiscovery) connectWithRetry(ctx context.Context, p peer.AddrInfo) e
 	)
 }
 
+// candidates returns the peers the topology selects from. Honest nodes never
+// dial the eclipse attackers.
+func (s *SyncDiscovery) candidates() []PeerRegistration {
+	if s.nodeType == NodeTypeEclipse {
+		return s.allPeers
+	}
+	out := make([]PeerRegistration, 0, len(s.allPeers))
+	for _, p := range s.allPeers {
+		if p.NType != NodeTypeEclipse {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// HoldConnections keeps the host connected to the peers until the context is
+// done, redialing any of them as soon as its connection is closed, eg trimmed
+// by the remote's connection manager. Every redial is added to redials.
+func (s *SyncDiscovery) HoldConnections(ctx context.Context, peers []PeerRegistration, interval time.Duration, redials *int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for _, p := range peers {
+			if s.h.Network().Connectedness(p.Info.ID) == network.Connected {
+				continue
+			}
+			atomic.AddInt64(redials, 1)
+			if sw, ok := s.h.Network().(*swarm.Swarm); ok {
+				sw.Backoff().Clear(p.Info.ID)
+			}
+			cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+			if err := s.h.Connect(cctx, p.Info); err != nil && ctx.Err() == nil {
+				s.runenv.RecordMessage("error redialing %d: %s", p.NodeTypeSeq, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// SeqOf returns the sequence number of a peer in the test, or -1 if the peer is unknown
+func (s *SyncDiscovery) SeqOf(id peer.ID) int64 {
+	seq, ok := s.seqs[id]
+	if !ok {
+		return -1
+	}
+	return seq
+}
+
 func (s *SyncDiscovery) Connected() []PeerRegistration {
 	s.connectedLk.RLock()
 	defer s.connectedLk.RUnlock()
@@ -477,3 +703,37 @@ func (s *SyncDiscovery) Connected() []PeerRegistration {
 	}
 	return d
 }
+
+// Rewire connects to a fresh selection of peers from the topology, then closes
+// the connections to every peer that was not selected again
+func (s *SyncDiscovery) Rewire(ctx context.Context) (int, error) {
+	selected := s.topology.SelectPeers(s.h.ID(), s.candidates())
+	keep := make(map[peer.ID]PeerRegistration, len(selected))
+	for _, p := range selected {
+		keep[p.Info.ID] = p
+	}
+
+	errgrp, gctx := errgroup.WithContext(ctx)
+	for _, p := range selected {
+		p := p
+		errgrp.Go(func() error {
+			cctx, cancel := context.WithTimeout(gctx, PeerConnectTimeout)
+			defer cancel()
+			return s.h.Connect(cctx, p.Info)
+		})
+	}
+	err := errgrp.Wait()
+
+	closed := 0
+	for _, pid := range s.h.Network().Peers() {
+		if _, ok := keep[pid]; !ok {
+			s.h.Network().ClosePeer(pid)
+			closed++
+		}
+	}
+
+	s.connectedLk.Lock()
+	s.connected = keep
+	s.connectedLk.Unlock()
+	return closed, err
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// EclipseParams configure the eclipse scenario. The attackers, the highest
+// sequence numbers, connect only to the victim and to each other and hold
+// those connections for the whole run. They join the victim's mesh but never
+// forward a message, and the honest nodes never dial them.
+type EclipseParams struct {
+	Attackers int
+	// sequence number of the victim, 0 for the first publisher
+	Victim int64
+	// honest peers the victim dials in the dout scenario
+	Outbound int
+}
+
+func (e EclipseParams) enabled() bool {
+	return e.Attackers > 0
+}
+
+func (e EclipseParams) validate(instances int) error {
+	if e.Attackers <= 0 || e.Attackers >= instances-1 {
+		return fmt.Errorf("eclipse_attackers must be between 1 and %d", instances-2)
+	}
+	if e.Victim < 0 || e.attacker(e.Victim, instances) {
+		return fmt.Errorf("eclipse_victim %d is not an honest node", e.Victim)
+	}
+	if e.Outbound < 0 {
+		return fmt.Errorf("dout_victim_outbound must not be negative")
+	}
+	return nil
+}
+
+// attacker returns true if the node belongs to the eclipse attackers
+func (e EclipseParams) attacker(seq int64, instances int) bool {
+	return e.enabled() && seq > int64(instances-e.Attackers)
+}
+
+// victimOf returns the sequence number of the victim, the lowest publisher
+// unless set
+func (e EclipseParams) victimOf(publishers map[int64]bool) int64 {
+	if e.Victim > 0 {
+		return e.Victim
+	}
+	var victim int64
+	for seq := range publishers {
+		if victim == 0 || seq < victim {
+			victim = seq
+		}
+	}
+	return victim
+}
+
+// EclipseTopology connects an attacker to the victim and to every other attacker
+type EclipseTopology struct {
+	Victim int64
+}
+
+func (t EclipseTopology) SelectPeers(local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	out := make([]PeerRegistration, 0, len(remote))
+	for _, p := range remote {
+		if p.NodeTypeSeq == t.Victim || p.NType == NodeTypeEclipse {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (t EclipseTopology) SelectNPeers(n int, local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	return t.SelectPeers(local, remote)
+}
+
+// DoutTopology is the connection-direction-aware topology of the dout
+// scenario: the victim dials Outbound honest peers and no honest node dials
+// the victim, so its only inbound connections are the attackers'. Whether the
+// victim keeps honest peers in its mesh then depends on the outbound quota
+// of the mesh, Dout.
+type DoutTopology struct {
+	Topology
+	Seq      int64
+	Victim   int64
+	Outbound int
+}
+
+func (t DoutTopology) SelectPeers(local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	if t.Seq == t.Victim {
+		return RandomTopology{Count: t.Outbound}.SelectPeers(local, remote)
+	}
+	return t.Topology.SelectPeers(local, t.withoutVictim(remote))
+}
+
+func (t DoutTopology) SelectNPeers(n int, local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	if t.Seq == t.Victim {
+		return nil
+	}
+	return t.Topology.SelectNPeers(n, local, t.withoutVictim(remote))
+}
+
+func (t DoutTopology) withoutVictim(remote []PeerRegistration) []PeerRegistration {
+	out := make([]PeerRegistration, 0, len(remote))
+	for _, p := range remote {
+		if p.NodeTypeSeq != t.Victim {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// eclipseState is the largest share of the victim's mesh held by attackers,
+// how many of the samples found a mesh held entirely by attackers, and the
+// fewest outbound peers seen in a mesh
+type eclipseState struct {
+	lk          sync.Mutex
+	meshShare   float64
+	samples     int
+	eclipsed    int
+	minOutbound int
+}
+
+// eclipsing returns true if this node is an eclipse attacker
+func (p *PubsubNode) eclipsing() bool {
+	return p.cfg.Attacker && p.cfg.Eclipse.enabled()
+}
+
+// runEclipse keeps an attacker connected to the victim and the other attackers
+func (p *PubsubNode) runEclipse() {
+	peers := EclipseTopology{Victim: p.cfg.Eclipse.Victim}.SelectPeers(p.h.ID(), p.discovery.allPeers)
+	p.log("eclipsing node %d along with %d attackers", p.cfg.Eclipse.Victim, len(peers)-1)
+	var redials int64
+	p.discovery.HoldConnections(p.ctx, peers, time.Second, &redials)
+	p.log("eclipse attack over, %d redials", redials)
+	p.runenv.R().RecordPoint("eclipse_redials", float64(redials))
+}
+
+// sampleEclipsedMesh records the largest share of the victim's mesh held by
+// the attackers, across its topics. Once the warmup is over, it also samples
+// whether the attackers hold the whole mesh and the outbound peers left in it.
+func (p *PubsubNode) sampleEclipsedMesh() {
+	warm := time.Now().Add(p.cfg.Warmup)
+	attackers := make(map[peer.ID]struct{})
+	for _, pr := range p.discovery.allPeers {
+		if pr.NType == NodeTypeEclipse {
+			attackers[pr.Info.ID] = struct{}{}
+		}
+	}
+	tracer := p.testTracer()
+	if tracer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			p.eclipse.lk.Lock()
+			share := p.eclipse.meshShare
+			p.eclipse.lk.Unlock()
+			p.runenv.R().RecordPoint("eclipse_mesh_share", share)
+			return
+		}
+		for _, t := range p.cfg.Topics {
+			mesh := tracer.MeshPeers(t.Id)
+			if len(mesh) == 0 {
+				continue
+			}
+			held := 0
+			for _, pid := range mesh {
+				if _, ok := attackers[pid]; ok {
+					held++
+				}
+			}
+			share := float64(held) / float64(len(mesh))
+			outbound := p.outboundPeers(mesh)
+			p.eclipse.lk.Lock()
+			if share > p.eclipse.meshShare {
+				p.eclipse.meshShare = share
+			}
+			if time.Now().After(warm) {
+				p.eclipse.samples++
+				if held == len(mesh) {
+					p.eclipse.eclipsed++
+				}
+				if p.eclipse.samples == 1 || outbound < p.eclipse.minOutbound {
+					p.eclipse.minOutbound = outbound
+				}
+			}
+			p.eclipse.lk.Unlock()
+		}
+	}
+}
+
+// outboundPeers counts the peers with a connection dialed by this node
+func (p *PubsubNode) outboundPeers(peers []peer.ID) int {
+	n := 0
+	for _, pid := range peers {
+		for _, c := range p.h.Network().ConnsToPeer(pid) {
+			if c.Stat().Direction == network.DirOutbound {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// eclipsedMeshShare returns the largest share of the mesh held by attackers
+func (p *PubsubNode) eclipsedMeshShare() float64 {
+	p.eclipse.lk.Lock()
+	defer p.eclipse.lk.Unlock()
+	return p.eclipse.meshShare
+}
+
+// eclipseResistance returns the fraction of the samples that found a mesh
+// held entirely by attackers, and the fewest outbound mesh peers
+func (p *PubsubNode) eclipseResistance() (float64, int) {
+	p.eclipse.lk.Lock()
+	defer p.eclipse.lk.Unlock()
+	if p.eclipse.samples == 0 {
+		return 0, 0
+	}
+	return float64(p.eclipse.eclipsed) / float64(p.eclipse.samples), p.eclipse.minOutbound
+}
+
+// computeEclipse checks whether the honest nodes other than the victim still
+// received the victim's messages, or every message if the victim published
+// none
+func computeEclipse(reports []NodeReport, params EclipseParams) *outputs.Eclipse {
+	s := &outputs.Eclipse{Victim: params.Victim, Attackers: params.Attackers, VictimOutbound: params.Outbound}
+	published := make(map[string]struct{})
+	for _, r := range reports {
+		if r.Seq == params.Victim {
+			s.MaxMeshShare = r.EclipsedMeshShare
+			s.EclipsedFraction = r.EclipsedFraction
+			s.MinOutboundMeshPeers = r.MinOutboundMeshPeers
+			for id := range r.Published {
+				published[id] = struct{}{}
+			}
+		}
+	}
+	if len(published) == 0 {
+		for _, r := range reports {
+			for id := range r.Published {
+				published[id] = struct{}{}
+			}
+		}
+	}
+
+	for _, r := range reports {
+		if r.Attacker || r.Seq == params.Victim {
+			continue
+		}
+		delivered := toSet(r.Delivered)
+		for id := range r.Published {
+			delivered[id] = struct{}{}
+		}
+		missing := false
+		for id := range published {
+			s.Expected++
+			if _, ok := delivered[id]; ok {
+				s.Delivered++
+			} else {
+				missing = true
+			}
+		}
+		s.Nodes++
+		if missing {
+			s.NodesMissing++
+		}
+	}
+	if s.Expected > 0 {
+		s.DeliveredFraction = float64(s.Delivered) / float64(s.Expected)
+	}
+	return s
+}
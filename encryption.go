@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// payloadKey is the AES-256 key shared by all the nodes. It only has to be the
+// same everywhere: the point is the cost of the encryption, not its secrecy.
+var payloadKey = sha256.Sum256([]byte("gossipsub_testplan payload key"))
+
+// payloadCipher encrypts the payloads of the workload messages with AES-GCM,
+// prefixing them with their random nonce. The counters are updated
+// atomically.
+type payloadCipher struct {
+	aead cipher.AEAD
+
+	sealed     int64
+	opened     int64
+	sealNs     int64
+	openNs     int64
+	plainBytes int64
+}
+
+func newPayloadCipher() (*payloadCipher, error) {
+	block, err := aes.NewCipher(payloadKey[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &payloadCipher{aead: aead}, nil
+}
+
+// overhead is the number of bytes encryption adds to a payload
+func (c *payloadCipher) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func (c *payloadCipher) seal(plain []byte) ([]byte, error) {
+	start := time.Now()
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plain)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plain, nil)
+	atomic.AddInt64(&c.sealNs, int64(time.Since(start)))
+	atomic.AddInt64(&c.sealed, 1)
+	atomic.AddInt64(&c.plainBytes, int64(len(plain)))
+	return sealed, nil
+}
+
+func (c *payloadCipher) open(data []byte) ([]byte, error) {
+	start := time.Now()
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("encrypted payload of %d bytes is shorter than its nonce", len(data))
+	}
+	plain, err := c.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.openNs, int64(time.Since(start)))
+	atomic.AddInt64(&c.opened, 1)
+	return plain, nil
+}
+
+// decodeMessage decrypts the payload of a workload message if payload
+// encryption is enabled, and decodes it
+func (p *PubsubNode) decodeMessage(data []byte, m *Msg) error {
+	if p.cipher != nil {
+		plain, err := p.cipher.open(data)
+		if err != nil {
+			return fmt.Errorf("error decrypting payload: %w", err)
+		}
+		data = plain
+	}
+	return json.Unmarshal(data, m)
+}
+
+// EncryptionReport is the time a node spent encrypting and decrypting
+// payloads
+type EncryptionReport struct {
+	Sealed     int64
+	Opened     int64
+	SealMs     float64
+	OpenMs     float64
+	PlainBytes int64
+}
+
+func (p *PubsubNode) encryptionReport() *EncryptionReport {
+	c := p.cipher
+	return &EncryptionReport{
+		Sealed:     atomic.LoadInt64(&c.sealed),
+		Opened:     atomic.LoadInt64(&c.opened),
+		SealMs:     float64(atomic.LoadInt64(&c.sealNs)) / float64(time.Millisecond),
+		OpenMs:     float64(atomic.LoadInt64(&c.openNs)) / float64(time.Millisecond),
+		PlainBytes: atomic.LoadInt64(&c.plainBytes),
+	}
+}
+
+// summarizeEncryption adds up the time the honest nodes spent on payload
+// encryption, along with their CPU time and delivery latency to compare with
+// a run without it
+func summarizeEncryption(reports []NodeReport, overhead int) *outputs.Encryption {
+	s := &outputs.Encryption{OverheadBytes: overhead, RunCost: summarizeRunCost(reports)}
+	var sealMs, openMs float64
+	var plainBytes int64
+	for _, r := range reports {
+		if r.Attacker || r.Encryption == nil {
+			continue
+		}
+		s.Sealed += r.Encryption.Sealed
+		s.Opened += r.Encryption.Opened
+		sealMs += r.Encryption.SealMs
+		openMs += r.Encryption.OpenMs
+		plainBytes += r.Encryption.PlainBytes
+	}
+	if s.Sealed > 0 {
+		s.MeanSealUs = sealMs * 1000 / float64(s.Sealed)
+		s.MeanPayloadBytes = plainBytes / s.Sealed
+	}
+	if s.Opened > 0 {
+		s.MeanOpenUs = openMs * 1000 / float64(s.Opened)
+	}
+	if plainBytes > 0 {
+		s.SealUsPerKB = sealMs * 1000 / (float64(plainBytes) / 1024)
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// customEvents writes the trace events emitted by the test plan to the node's
+// custom-events file. The file is created on the first event.
+type customEvents struct {
+	lk  sync.Mutex
+	out *os.File
+	// set once the file is closed at the end of the run
+	closed bool
+}
+
+// traceEvent writes a custom trace event. data is encoded as json.
+func (p *PubsubNode) traceEvent(typ string, data interface{}) {
+	if p.cfg.Name != "" {
+		// only the main node of an instance writes the per-node outputs
+		return
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		p.log("error encoding %s event: %s", typ, err)
+		return
+	}
+	evt := outputs.CustomEvent{
+		Version:   outputs.SchemaVersion,
+		Type:      typ,
+		Timestamp: time.Now().UnixNano(),
+		Seq:       p.seq,
+		Data:      raw,
+	}
+
+	e := &p.events
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	if e.closed {
+		return
+	}
+	if e.out == nil {
+		path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.CustomEventsPrefix, p.seq)
+		f, err := os.Create(path)
+		if err != nil {
+			p.log("error creating custom events file: %s", err)
+			e.closed = true
+			return
+		}
+		e.out = f
+	}
+	if err := json.NewEncoder(e.out).Encode(evt); err != nil {
+		p.log("error writing %s event: %s", typ, err)
+	}
+}
+
+func (p *PubsubNode) closeCustomEvents() {
+	e := &p.events
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.closed = true
+	if e.out != nil {
+		e.out.Close()
+		e.out = nil
+	}
+}
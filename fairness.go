@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// summarizeFairness computes how evenly the honest nodes share the upload
+// load. Nodes that downloaded nothing have no ratio and are left out of it.
+func summarizeFairness(reports []NodeReport) outputs.Fairness {
+	var s outputs.Fairness
+	var uploads, ratios []float64
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		s.Nodes++
+		s.BytesOut += r.BytesOut
+		s.BytesIn += r.BytesIn
+		uploads = append(uploads, float64(r.BytesOut))
+		if r.BytesIn > 0 {
+			ratios = append(ratios, float64(r.BytesOut)/float64(r.BytesIn))
+		}
+	}
+	s.UploadGini = gini(uploads)
+	s.RatioGini = gini(ratios)
+	if len(ratios) == 0 {
+		return s
+	}
+	sort.Float64s(ratios)
+	s.MinRatio = ratios[0]
+	s.MaxRatio = ratios[len(ratios)-1]
+	var sum float64
+	for _, ratio := range ratios {
+		sum += ratio
+	}
+	s.MeanRatio = sum / float64(len(ratios))
+	return s
+}
+
+// gini returns the Gini coefficient of the values, 0 if they are all zero
+func gini(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := float64(len(sorted))
+	var sum, weighted float64
+	for i, v := range sorted {
+		sum += v
+		weighted += (2*float64(i+1) - n - 1) * v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return weighted / (n * sum)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// number of heartbeats after subscribing before the mesh is sampled, so that
+// the router has had the chance to graft
+const fanoutMeshHeartbeats = 3
+
+// runFanoutTransition subscribes the publisher to the topics it has been
+// publishing to through fanout, then samples the resulting mesh
+func (p *PubsubNode) runFanoutTransition() {
+	select {
+	case <-time.After(time.Until(p.runStart.Add(p.cfg.FanoutDelay))):
+	case <-p.ctx.Done():
+		return
+	}
+
+	subscribed := time.Now()
+	p.lk.Lock()
+	for _, ts := range p.topics {
+		if ts.sub == nil {
+			p.subscribeTopic(ts)
+		}
+	}
+	p.lk.Unlock()
+	p.log("subscribed to the topics published through fanout")
+
+	select {
+	case <-time.After(fanoutMeshHeartbeats * p.cfg.Heartbeat.Interval):
+	case <-p.ctx.Done():
+		return
+	}
+
+	mesh := make(map[peer.ID]struct{})
+	if tracer := p.testTracer(); tracer != nil {
+		for _, t := range p.cfg.Topics {
+			for _, pid := range tracer.MeshPeers(t.Id) {
+				mesh[pid] = struct{}{}
+			}
+		}
+	}
+
+	p.fanoutLk.Lock()
+	defer p.fanoutLk.Unlock()
+	p.fanoutSubscribed = subscribed
+	p.fanoutMesh = mesh
+}
+
+// writeFanoutTransition compares the peers the publisher sent its messages to
+// before and after subscribing, and outputs the transition as json
+func (p *PubsubNode) writeFanoutTransition() error {
+	tracer := p.testTracer()
+	if tracer == nil {
+		return nil
+	}
+	p.fanoutLk.Lock()
+	subscribed := p.fanoutSubscribed
+	mesh := p.fanoutMesh
+	p.fanoutLk.Unlock()
+	if subscribed.IsZero() {
+		return fmt.Errorf("the publisher never subscribed")
+	}
+
+	records := tracer.Records()
+	out := outputs.FanoutTransition{
+		Version:    outputs.SchemaVersion,
+		Seq:        p.seq,
+		Subscribed: subscribed.UnixNano() / int64(time.Millisecond),
+	}
+
+	ids := make([]string, 0, len(records.Published))
+	for id := range records.Published {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return records.Published[ids[i]] < records.Published[ids[j]] })
+
+	// the fanout peers are the recipients of the last message sent before subscribing
+	var fanout map[string]struct{}
+	var recipientsBefore, recipientsAfter int
+	for _, id := range ids {
+		published := records.Published[id]
+		recipients := len(records.SentTo[id])
+		out.Messages = append(out.Messages, outputs.FanoutMessage{
+			Published:  published / int64(time.Millisecond),
+			Recipients: recipients,
+		})
+		if recipients == 0 {
+			out.Unsent++
+		}
+		if published < subscribed.UnixNano() {
+			out.PublishedBefore++
+			recipientsBefore += recipients
+			fanout = records.SentTo[id]
+		} else {
+			out.PublishedAfter++
+			recipientsAfter += recipients
+		}
+	}
+	if out.PublishedBefore > 0 {
+		out.MeanRecipientsBefore = float64(recipientsBefore) / float64(out.PublishedBefore)
+	}
+	if out.PublishedAfter > 0 {
+		out.MeanRecipientsAfter = float64(recipientsAfter) / float64(out.PublishedAfter)
+	}
+
+	for pid := range fanout {
+		out.FanoutPeers = append(out.FanoutPeers, pid)
+	}
+	for pid := range mesh {
+		out.MeshPeers = append(out.MeshPeers, pid.String())
+		if _, ok := fanout[pid.String()]; ok {
+			out.Promoted++
+		}
+	}
+	p.log("fanout transition: %d of %d fanout peers promoted to a mesh of %d", out.Promoted, len(out.FanoutPeers), len(out.MeshPeers))
+
+	path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.FanoutTransitionPrefix, p.seq)
+	jsonstr, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+)
+
+// FaultInjector is a fault applied to a node for a period of the run. Inject
+// starts the fault and Recover undoes it.
+type FaultInjector interface {
+	Name() string
+	Inject(p *PubsubNode) error
+	Recover(p *PubsubNode) error
+}
+
+// FaultParams configure one fault of the node_failing node. Start is an
+// offset from the start of the run. Latency is the latency added by the slow
+// fault and Loss the packet loss (%) of the link_drop fault.
+type FaultParams struct {
+	Type     string
+	Start    ptypes.Duration
+	Duration ptypes.Duration
+	Latency  ptypes.Duration
+	Loss     float32
+}
+
+func (f FaultParams) injector() (FaultInjector, error) {
+	switch f.Type {
+	case "pause":
+		return pauseFault{}, nil
+	case "crash_restart":
+		return crashRestartFault{}, nil
+	case "restart":
+		return restartFault{}, nil
+	case "slow":
+		if f.Latency.Duration <= 0 {
+			return nil, fmt.Errorf("slow fault requires a Latency")
+		}
+		return slowFault{latency: f.Latency.Duration}, nil
+	case "link_drop":
+		if f.Loss <= 0 || f.Loss > 100 {
+			return nil, fmt.Errorf("link_drop fault requires a Loss between 0 and 100, got %f", f.Loss)
+		}
+		return linkDropFault{loss: f.Loss}, nil
+	default:
+		return nil, fmt.Errorf("unknown fault type %s", f.Type)
+	}
+}
+
+// ScheduledFault is a fault injected Start after the start of the run, and
+// recovered from Duration later
+type ScheduledFault struct {
+	Fault    FaultInjector
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func scheduleFaults(params []FaultParams) ([]ScheduledFault, error) {
+	faults := make([]ScheduledFault, 0, len(params))
+	for _, f := range params {
+		inj, err := f.injector()
+		if err != nil {
+			return nil, err
+		}
+		faults = append(faults, ScheduledFault{Fault: inj, Start: f.Start.Duration, Duration: f.Duration.Duration})
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Start < faults[j].Start })
+	return faults, nil
+}
+
+// runFaults is the timeline of the node's faults. Every fault runs in its own
+// goroutine, so overlapping faults are allowed.
+func (p *PubsubNode) runFaults() {
+	for _, f := range p.cfg.Faults {
+		go p.runFault(f)
+	}
+}
+
+func (p *PubsubNode) runFault(f ScheduledFault) {
+	select {
+	case <-time.After(time.Until(p.runStart.Add(f.Start))):
+	case <-p.ctx.Done():
+		return
+	}
+	p.log("injecting %s fault for %s", f.Fault.Name(), f.Duration)
+	if err := f.Fault.Inject(p); err != nil {
+		p.log("error injecting %s fault: %s", f.Fault.Name(), err)
+		return
+	}
+	p.markTimeline("fault", f.Fault.Name()+" injected", f.Start)
+
+	select {
+	case <-time.After(f.Duration):
+	case <-p.ctx.Done():
+		return
+	}
+	p.log("recovering from %s fault", f.Fault.Name())
+	if err := f.Fault.Recover(p); err != nil {
+		p.log("error recovering from %s fault: %s", f.Fault.Name(), err)
+		return
+	}
+	p.markTimeline("fault", f.Fault.Name()+" recovered", f.Start+f.Duration)
+}
+
+// crashRestartFault closes all the node's connections, and reconnects to its
+// topology peers on recovery. The time in between is reported as downtime.
+type crashRestartFault struct{}
+
+func (crashRestartFault) Name() string { return "crash_restart" }
+
+func (crashRestartFault) Inject(p *PubsubNode) error {
+	p.downLk.Lock()
+	p.faultDown = TimeWindow{Start: time.Now().UnixNano()}
+	p.downLk.Unlock()
+	for _, peer := range p.h.Network().Peers() {
+		p.h.Network().ClosePeer(peer)
+	}
+	return nil
+}
+
+func (crashRestartFault) Recover(p *PubsubNode) error {
+	p.downLk.Lock()
+	down := p.faultDown
+	down.End = time.Now().UnixNano()
+	p.downWindows = append(p.downWindows, down)
+	p.downLk.Unlock()
+	return p.discovery.ConnectTopology(p.ctx, 0)
+}
+
+// pauseFault drops all the traffic of the node, as if the process was frozen.
+// Connections stay open, so they resume where they left off on recovery. The
+// sidecar doesn't implement filters yet, so the packets are also lost.
+type pauseFault struct{}
+
+func (pauseFault) Name() string { return "pause" }
+
+func (pauseFault) Inject(p *PubsubNode) error {
+	return p.reconfigureNetwork("pause-injected", false, func(s *network.LinkShape) {
+		s.Filter = network.Drop
+		s.Loss = 100
+	})
+}
+
+func (pauseFault) Recover(p *PubsubNode) error {
+	return p.reconfigureNetwork("pause-recovered", false, nil)
+}
+
+// slowFault adds latency to all the node's links
+type slowFault struct {
+	latency time.Duration
+}
+
+func (slowFault) Name() string { return "slow" }
+
+func (f slowFault) Inject(p *PubsubNode) error {
+	return p.reconfigureNetwork("slow-injected", false, func(s *network.LinkShape) { s.Latency += f.latency })
+}
+
+func (slowFault) Recover(p *PubsubNode) error {
+	return p.reconfigureNetwork("slow-recovered", false, nil)
+}
+
+// linkDropFault drops a percentage of the packets sent on all the node's links
+type linkDropFault struct {
+	loss float32
+}
+
+func (linkDropFault) Name() string { return "link_drop" }
+
+func (f linkDropFault) Inject(p *PubsubNode) error {
+	return p.reconfigureNetwork("link_drop-injected", false, func(s *network.LinkShape) { s.Loss = f.loss })
+}
+
+func (linkDropFault) Recover(p *PubsubNode) error {
+	return p.reconfigureNetwork("link_drop-recovered", false, nil)
+}
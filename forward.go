@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ExtraForwardProtocol carries the copies of the messages forwarded outside of
+// the pubsub router, to explore redundancy beyond what D and Dlazy allow
+const ExtraForwardProtocol = protocol.ID("/gossipsub-testplan/extra-forward/1.0.0")
+
+// maximum size of a forwarded message, in addition to the payload size
+const extraForwardOverhead = 64 * 1024
+
+// forwardedMsg is a message forwarded outside of the router
+type forwardedMsg struct {
+	Topic string
+	Data  []byte
+}
+
+// markSeen returns true if the message had not been seen before. The caller
+// must hold p.handleLk.
+func (p *PubsubNode) markSeen(message *Msg) bool {
+	key := fmt.Sprintf("%s-%d", message.Sender, message.Seq)
+	if _, ok := p.seen[key]; ok {
+		p.extraDuplicates++
+		return false
+	}
+	p.seen[key] = struct{}{}
+	return true
+}
+
+// forwardExtra sends a copy of the message to random connected peers other than
+// the one it was received from, regardless of whether they have seen it
+func (p *PubsubNode) forwardExtra(topic string, data []byte, from peer.ID) {
+	frame, err := json.Marshal(forwardedMsg{Topic: topic, Data: data})
+	if err != nil {
+		p.log("error encoding forwarded message: %s", err)
+		return
+	}
+
+	peers := p.h.Network().Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	sent := 0
+	for _, pid := range peers {
+		if sent == p.cfg.ExtraForward {
+			break
+		}
+		if pid == from {
+			continue
+		}
+		s, err := p.h.NewStream(p.ctx, pid, ExtraForwardProtocol)
+		if err != nil {
+			continue
+		}
+		if _, err := s.Write(frame); err != nil {
+			s.Reset()
+			continue
+		}
+		s.Close()
+		sent++
+	}
+}
+
+// handleExtraForward handles a message forwarded by a peer outside of the
+// router, as if it had been delivered by the router
+func (p *PubsubNode) handleExtraForward(s lnetwork.Stream) {
+	defer s.Close()
+
+	limit := int64(extraForwardOverhead)
+	for _, t := range p.cfg.Topics {
+		limit += 2 * int64(t.MessageSize)
+	}
+	frame, err := io.ReadAll(io.LimitReader(s, limit))
+	if err != nil {
+		s.Reset()
+		return
+	}
+	var fwd forwardedMsg
+	if err := json.Unmarshal(frame, &fwd); err != nil {
+		p.log("error decoding forwarded message: %s", err)
+		return
+	}
+	var message Msg
+	if err := p.decodeMessage(fwd.Data, &message); err != nil {
+		p.log("error decoding forwarded message: %s", err)
+		return
+	}
+
+	// only subscribed topics are delivered
+	p.lk.RLock()
+	ts, ok := p.topics[fwd.Topic]
+	subscribed := ok && ts.sub != nil
+	p.lk.RUnlock()
+	if !subscribed {
+		return
+	}
+	if p.handleMessage(ts, &message, len(fwd.Data), s.Conn().RemotePeer()) {
+		p.forwardExtra(fwd.Topic, fwd.Data, s.Conn().RemotePeer())
+	}
+}
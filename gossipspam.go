@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+
+	"gossipsub_testplan/outputs"
+)
+
+// GossipSpamParams configure the gossip spam attack. During the attack window
+// every attacker connects fresh identities to each of its victims, which
+// announce message IDs that don't exist in IHAVEs, and request the messages
+// the attacker has seen over and over in IWANTs. The identities don't
+// subscribe, so that the victims never graft them and every message they get
+// is an answer to an IWANT.
+type GossipSpamParams struct {
+	// IHAVEs and IWANTs sent per second by each identity, disabled if zero
+	Rate int
+	// message IDs in every IHAVE and IWANT
+	IDs int
+	// number of victims of each attacker, its mesh peers first
+	Victims int
+	// identities each attacker connects to each victim
+	Identities int
+	Transport  string
+}
+
+func (g GossipSpamParams) enabled() bool {
+	return g.Rate > 0
+}
+
+func (g GossipSpamParams) validate() error {
+	if g.Rate < 0 {
+		return fmt.Errorf("gossip_spam_rate must not be negative")
+	}
+	if g.IDs <= 0 {
+		return fmt.Errorf("gossip_spam_ids must be positive")
+	}
+	if g.Victims <= 0 {
+		return fmt.Errorf("gossip_spam_victims must be positive")
+	}
+	if g.Identities <= 0 {
+		return fmt.Errorf("gossip_spam_identities must be positive")
+	}
+	return nil
+}
+
+// GossipSpamReport is the part of the node report about the gossip spam. The
+// attackers report their identities, the IDs they announced and requested,
+// and what the victims sent back. The honest nodes report the scores they
+// gave to the identities.
+type GossipSpamReport struct {
+	Identities []string
+	IHaveIDs   int64
+	IWantIDs   int64
+	// messages the victims sent in answer to the IWANTs, and the most times
+	// the same message was sent to one identity
+	Served             int64
+	MaxServedPerIdent  int64
+	RequestedByVictims int64
+
+	SpammerScores map[string]float64
+}
+
+// gossipSpamStats count the control messages sent by a spamming attacker
+type gossipSpamStats struct {
+	ihaveIDs  int64
+	iwantIDs  int64
+	served    int64
+	requested int64
+
+	lk         sync.Mutex
+	identities []string
+	maxServed  int64
+}
+
+// runGossipSpam floods the victims with IHAVEs and IWANTs during the attack
+// window
+func (p *PubsubNode) runGossipSpam() {
+	params := p.cfg.GossipSpam
+	w := p.cfg.AttackWindow
+	if !p.waitAttackStart() {
+		return
+	}
+
+	victims := p.pruneFloodVictims(params.Victims)
+	ctx, cancel := context.WithTimeout(p.ctx, w.Duration)
+	defer cancel()
+	p.log("spamming %d victims from %d identities each with %d IHAVEs and IWANTs per second of %d IDs",
+		len(victims), params.Identities, params.Rate, params.IDs)
+
+	stats := &p.gossipSpam
+	var wg sync.WaitGroup
+	for _, victim := range victims {
+		for i := 0; i < params.Identities; i++ {
+			wg.Add(1)
+			go func(victim PeerRegistration) {
+				defer wg.Done()
+				h, err := createHost(ctx, params.Transport, false, nil, nil, nil)
+				if err != nil {
+					p.log("error creating gossip spam host: %s", err)
+					return
+				}
+				defer h.Close()
+				stats.lk.Lock()
+				stats.identities = append(stats.identities, h.ID().String())
+				stats.lk.Unlock()
+				if err := p.gossipSpamVictim(ctx, h, victim, stats); err != nil && ctx.Err() == nil {
+					p.log("gossip spam of %s failed: %s", victim.Info.ID.Loggable(), err)
+				}
+			}(victim)
+		}
+	}
+	wg.Wait()
+
+	report := p.gossipSpamReport()
+	p.log("gossip spam over: %d IHAVE IDs and %d IWANT IDs sent, %d messages served, at most %d times the same one, %d bogus IDs requested back",
+		report.IHaveIDs, report.IWantIDs, report.Served, report.MaxServedPerIdent, report.RequestedByVictims)
+	p.runenv.R().RecordPoint("gossip_spam_ihave_ids_sent", float64(report.IHaveIDs))
+	p.runenv.R().RecordPoint("gossip_spam_iwant_ids_sent", float64(report.IWantIDs))
+	p.runenv.R().RecordPoint("gossip_spam_served", float64(report.Served))
+}
+
+// gossipSpamVictim connects the identity to the victim and alternates IHAVEs
+// of bogus IDs with IWANTs of known messages until the context is done
+func (p *PubsubNode) gossipSpamVictim(ctx context.Context, h host.Host, victim PeerRegistration, stats *gossipSpamStats) error {
+	// the answers arrive on the stream the victim's router opens to us
+	var lk sync.Mutex
+	served := make(map[[sha256.Size]byte]int64)
+	handler := func(s lnetwork.Stream) {
+		defer s.Reset()
+		readRPCs(s, func(rpc *pb.RPC) {
+			for _, iwant := range rpc.GetControl().GetIwant() {
+				atomic.AddInt64(&stats.requested, int64(len(iwant.GetMessageIDs())))
+			}
+			for _, m := range rpc.GetPublish() {
+				atomic.AddInt64(&stats.served, 1)
+				lk.Lock()
+				key := sha256.Sum256(m.GetData())
+				served[key]++
+				n := served[key]
+				lk.Unlock()
+				stats.lk.Lock()
+				if n > stats.maxServed {
+					stats.maxServed = n
+				}
+				stats.lk.Unlock()
+			}
+		})
+	}
+	h.SetStreamHandler(pubsub.GossipSubID_v11, handler)
+	h.SetStreamHandler(pubsub.GossipSubID_v10, handler)
+
+	cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+	defer cancel()
+	if err := h.Connect(cctx, victim.Info); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, victim.Info.ID, pubsub.GossipSubID_v11)
+	if err != nil {
+		return err
+	}
+	defer s.Reset()
+
+	params := p.cfg.GossipSpam
+	tracer := p.testTracer()
+	ticker := time.NewTicker(time.Second / time.Duration(params.Rate))
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		var ids []string
+		if i%2 == 1 && tracer != nil {
+			ids = tracer.DeliveredMessageIDs(params.IDs)
+		}
+		if len(ids) > 0 {
+			ctrl := &pb.ControlMessage{Iwant: []*pb.ControlIWant{{MessageIDs: ids}}}
+			if err := writeSybilRPC(s, &pb.RPC{Control: ctrl}); err != nil {
+				return err
+			}
+			atomic.AddInt64(&stats.iwantIDs, int64(len(ids)))
+			continue
+		}
+
+		ctrl := &pb.ControlMessage{}
+		for _, t := range p.cfg.Topics {
+			bogus, err := bogusMessageIDs(params.IDs)
+			if err != nil {
+				return err
+			}
+			id := t.Id
+			ctrl.Ihave = append(ctrl.Ihave, &pb.ControlIHave{TopicID: &id, MessageIDs: bogus})
+		}
+		if err := writeSybilRPC(s, &pb.RPC{Control: ctrl}); err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.ihaveIDs, int64(len(ctrl.Ihave)*params.IDs))
+	}
+}
+
+// bogusMessageIDs returns n random message IDs of messages that don't exist
+func bogusMessageIDs(n int) ([]string, error) {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id := make([]byte, 32)
+		if _, err := crand.Read(id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, string(id))
+	}
+	return ids, nil
+}
+
+// gossipSpamReport collects the node's part of the gossip spam report. The
+// victims report the scores of every peer, as they don't know the identities.
+func (p *PubsubNode) gossipSpamReport() *GossipSpamReport {
+	stats := &p.gossipSpam
+	report := &GossipSpamReport{
+		IHaveIDs:           atomic.LoadInt64(&stats.ihaveIDs),
+		IWantIDs:           atomic.LoadInt64(&stats.iwantIDs),
+		Served:             atomic.LoadInt64(&stats.served),
+		RequestedByVictims: atomic.LoadInt64(&stats.requested),
+	}
+	stats.lk.Lock()
+	report.Identities = append(report.Identities, stats.identities...)
+	report.MaxServedPerIdent = stats.maxServed
+	stats.lk.Unlock()
+	if p.cfg.Attacker {
+		return report
+	}
+
+	scores := p.peerScores()
+	report.SpammerScores = make(map[string]float64, len(scores))
+	for pid, score := range scores {
+		report.SpammerScores[pid.String()] = score
+	}
+	return report
+}
+
+// summarizeGossipSpam adds up the spam sent by the attackers and what the
+// victims did about it: the messages they retransmitted against the
+// retransmission limit, and the scores they gave to the identities
+func summarizeGossipSpam(reports []NodeReport, params GossipSpamParams, retransmission int) *outputs.GossipSpam {
+	s := &outputs.GossipSpam{Rate: params.Rate, IDs: params.IDs, RetransmissionLimit: retransmission}
+	identities := make(map[string]struct{})
+	for _, r := range reports {
+		if !r.Attacker || r.GossipSpam == nil {
+			continue
+		}
+		s.Attackers++
+		s.IHaveIDsSent += r.GossipSpam.IHaveIDs
+		s.IWantIDsSent += r.GossipSpam.IWantIDs
+		s.MessagesServed += r.GossipSpam.Served
+		s.BogusIDsRequested += r.GossipSpam.RequestedByVictims
+		if r.GossipSpam.MaxServedPerIdent > s.MaxServedPerIdentity {
+			s.MaxServedPerIdentity = r.GossipSpam.MaxServedPerIdent
+		}
+		for _, id := range r.GossipSpam.Identities {
+			identities[id] = struct{}{}
+		}
+	}
+	s.Identities = len(identities)
+	s.RetransmissionLimitHeld = s.MaxServedPerIdentity <= int64(retransmission)
+
+	var scoreSum float64
+	for _, r := range reports {
+		if r.Attacker || r.GossipSpam == nil {
+			continue
+		}
+		for id, score := range r.GossipSpam.SpammerScores {
+			if _, ok := identities[id]; !ok {
+				continue
+			}
+			if s.ScoredIdentities == 0 || score < s.MinIdentityScore {
+				s.MinIdentityScore = score
+			}
+			if score < 0 {
+				s.NegativeScores++
+			}
+			scoreSum += score
+			s.ScoredIdentities++
+		}
+	}
+	if s.ScoredIdentities > 0 {
+		s.MeanIdentityScore = scoreSum / float64(s.ScoredIdentities)
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// maximum number of nodes the path lengths are measured from. Beyond it the
+// path metrics are estimated from evenly spread sources, which keeps the
+// observe test case tractable with thousands of nodes.
+const graphPathSources = 1000
+
+// graphMetrics characterizes the topology as an undirected graph
+func graphMetrics(topo outputs.Topology) outputs.GraphMetrics {
+	adj := make(map[int64]map[int64]struct{}, len(topo.Nodes))
+	for _, n := range topo.Nodes {
+		adj[n.Seq] = make(map[int64]struct{})
+	}
+	for _, e := range topo.Edges {
+		if e.From == e.To || adj[e.From] == nil || adj[e.To] == nil {
+			continue
+		}
+		adj[e.From][e.To] = struct{}{}
+		adj[e.To][e.From] = struct{}{}
+	}
+
+	seqs := make([]int64, 0, len(adj))
+	for seq := range adj {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	m := outputs.GraphMetrics{Nodes: len(seqs), DegreeHistogram: make(map[int]int)}
+	var degrees, clustering float64
+	for _, seq := range seqs {
+		neighbors := adj[seq]
+		degree := len(neighbors)
+		m.Edges += degree
+		degrees += float64(degree)
+		m.DegreeHistogram[degree]++
+		if degree < 2 {
+			continue
+		}
+		// links between the node's neighbors
+		links := 0
+		for a := range neighbors {
+			for b := range adj[a] {
+				if _, ok := neighbors[b]; ok {
+					links++
+				}
+			}
+		}
+		clustering += float64(links) / float64(degree*(degree-1))
+	}
+	m.Edges /= 2
+	if m.Nodes == 0 {
+		return m
+	}
+	m.MeanDegree = degrees / float64(m.Nodes)
+	m.Clustering = clustering / float64(m.Nodes)
+	m.Components = countComponents(adj, seqs)
+
+	sources := seqs
+	if len(seqs) > graphPathSources {
+		sources = make([]int64, 0, graphPathSources)
+		for i := 0; i < graphPathSources; i++ {
+			sources = append(sources, seqs[i*len(seqs)/graphPathSources])
+		}
+	}
+	m.PathSources = len(sources)
+	var total, paths int64
+	for _, src := range sources {
+		for _, dist := range bfsDistances(adj, src) {
+			if dist == 0 {
+				continue
+			}
+			total += int64(dist)
+			paths++
+			if dist > m.Diameter {
+				m.Diameter = dist
+			}
+		}
+	}
+	if paths > 0 {
+		m.AvgPathLength = float64(total) / float64(paths)
+	}
+	return m
+}
+
+// bfsDistances returns the hop count from src to every node it reaches
+func bfsDistances(adj map[int64]map[int64]struct{}, src int64) map[int64]int {
+	dist := map[int64]int{src: 0}
+	queue := []int64{src}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for next := range adj[cur] {
+			if _, ok := dist[next]; !ok {
+				dist[next] = dist[cur] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	return dist
+}
+
+func countComponents(adj map[int64]map[int64]struct{}, seqs []int64) int {
+	seen := make(map[int64]struct{}, len(seqs))
+	components := 0
+	for _, seq := range seqs {
+		if _, ok := seen[seq]; ok {
+			continue
+		}
+		components++
+		for reached := range bfsDistances(adj, seq) {
+			seen[reached] = struct{}{}
+		}
+	}
+	return components
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// errHealthGate aborts the run when too few nodes formed healthy meshes
+// before the publishing phase
+var errHealthGate = errors.New("health gate failed")
+
+// HealthGateParams gate the publishing phase on the health of the meshes.
+// Once every node joined the topics, each node waits for the mesh of every
+// topic to reach Dlo peers, and reports whether it did on the sync service.
+// Publishing only starts if enough honest nodes did, and the run is aborted
+// otherwise, instead of running its full length on broken meshes.
+type HealthGateParams struct {
+	// percentage of the honest nodes that must be healthy, disabled if zero
+	Pct int
+	// how long the nodes wait for their meshes
+	Timeout time.Duration
+}
+
+func (h HealthGateParams) enabled() bool {
+	return h.Pct > 0
+}
+
+// budget is the longest the gate can delay the publishing phase: the wait for
+// the meshes, then the collection of the reports of the other nodes
+func (h HealthGateParams) budget() time.Duration {
+	if !h.enabled() {
+		return 0
+	}
+	return h.Timeout + h.collectTimeout()
+}
+
+// collectTimeout is how long the nodes wait for the reports of the others.
+// Every node waits at most the timeout before reporting.
+func (h HealthGateParams) collectTimeout() time.Duration {
+	return 2 * h.Timeout
+}
+
+func (h HealthGateParams) validate() error {
+	if h.Pct > 100 {
+		return fmt.Errorf("health_gate_pct must be between 0 and 100")
+	}
+	if h.Timeout <= 0 {
+		return fmt.Errorf("t_health_gate_timeout must be positive")
+	}
+	return nil
+}
+
+// HealthReport is the mesh health of a node at the gate. Nodes that subscribe
+// late have no mesh yet and are left out.
+type HealthReport struct {
+	Seq       int64
+	Attacker  bool
+	Late      bool
+	Healthy   bool
+	Dlo       int
+	Peers     int
+	MeshSizes map[string]int
+	WaitMs    float64
+}
+
+var HealthReportTopic = tgsync.NewTopic("health-reports", &HealthReport{})
+
+// passHealthGate reports the health of the node's meshes, and collects the
+// reports of every node. It returns false, after cancelling the run, if too
+// few honest nodes were healthy. The leader writes the verdict to
+// health-gate.json.
+func (p *PubsubNode) passHealthGate(late bool) bool {
+	params := p.cfg.HealthGate
+	report := HealthReport{Seq: p.seq, Attacker: p.cfg.Attacker, Late: late, Dlo: gossipSubParams(p.cfg).Dlo}
+	if !late {
+		start := time.Now()
+		report.Healthy, report.MeshSizes = p.waitHealthyMeshes(report.Dlo, params.Timeout)
+		report.WaitMs = float64(time.Since(start)) / float64(time.Millisecond)
+	}
+	report.Peers = len(p.h.Network().Peers())
+	p.log("health gate: healthy %t with %d peers and mesh sizes %v after %.0fms", report.Healthy, report.Peers, report.MeshSizes, report.WaitMs)
+	if _, err := p.client.Publish(p.ctx, HealthReportTopic, &report); err != nil {
+		p.log("error publishing the health report: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, params.collectTimeout())
+	defer cancel()
+	reports, err := collectHealthReports(ctx, p.client, p.runenv.TestInstanceCount)
+	if err != nil {
+		p.log("error collecting the health reports: %s", err)
+	}
+	gate := evaluateHealthGate(reports, p.runenv.TestInstanceCount, params)
+	p.markTimeline("health gate", fmt.Sprintf("%.1f%% healthy", gate.HealthyPct), unplanned)
+	if p.seq == 1 {
+		if err := p.writeHealthGate(gate); err != nil {
+			p.log("error writing the health gate: %s", err)
+		}
+	}
+	p.healthGate = gate
+	if gate.Passed {
+		p.log("health gate passed: %d of %d honest nodes healthy (%.1f%%, %d%% required)",
+			gate.HealthyNodes, gate.Nodes, gate.HealthyPct, gate.RequiredPct)
+		return true
+	}
+	p.log("HEALTH GATE FAILED: %d of %d honest nodes healthy (%.1f%%, %d%% required), %d without Dlo connected peers, %d connected but not grafted, %d reports missing. Aborting the run",
+		gate.HealthyNodes, gate.Nodes, gate.HealthyPct, gate.RequiredPct, gate.Underconnected, gate.Ungrafted, gate.Missing)
+	p.healthGateFailed.Store(true)
+	p.shutdown()
+	return false
+}
+
+// waitHealthyMeshes waits for the mesh of every topic to reach dlo peers, and
+// returns whether it did before the timeout and the mesh sizes
+func (p *PubsubNode) waitHealthyMeshes(dlo int, timeout time.Duration) (bool, map[string]int) {
+	tracer := p.testTracer()
+	sizes := make(map[string]int, len(p.cfg.Topics))
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		healthy := tracer != nil
+		for _, t := range p.cfg.Topics {
+			if tracer != nil {
+				sizes[t.Id] = tracer.MeshSize(t.Id)
+			}
+			if sizes[t.Id] < dlo {
+				healthy = false
+			}
+		}
+		if healthy {
+			return true, sizes
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return false, sizes
+		case <-p.ctx.Done():
+			return false, sizes
+		}
+	}
+}
+
+// collectHealthReports collects the health reports of all the instances, or
+// the ones published before the context is done
+func collectHealthReports(ctx context.Context, client tgsync.Client, instances int) ([]HealthReport, error) {
+	reportCh := make(chan *HealthReport)
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err := client.Subscribe(sctx, HealthReportTopic, reportCh); err != nil {
+		return nil, err
+	}
+	reports := make([]HealthReport, 0, instances)
+	for len(reports) < instances {
+		select {
+		case r := <-reportCh:
+			reports = append(reports, *r)
+		case <-ctx.Done():
+			return reports, ctx.Err()
+		}
+	}
+	return reports, nil
+}
+
+// evaluateHealthGate counts the healthy honest nodes, and tells the unhealthy
+// ones that lacked connections from the ones that had enough but weren't
+// grafted. Missing reports count as unhealthy nodes.
+func evaluateHealthGate(reports []HealthReport, instances int, params HealthGateParams) *outputs.HealthGate {
+	gate := &outputs.HealthGate{
+		Version:     outputs.SchemaVersion,
+		RequiredPct: params.Pct,
+		TimeoutSecs: params.Timeout.Seconds(),
+	}
+	var waits []float64
+	for _, r := range reports {
+		switch {
+		case r.Attacker:
+			gate.Attackers++
+			continue
+		case r.Late:
+			gate.LateNodes++
+			continue
+		}
+		gate.Nodes++
+		waits = append(waits, r.WaitMs)
+		if r.Healthy {
+			gate.HealthyNodes++
+			continue
+		}
+		if r.Peers < r.Dlo {
+			gate.Underconnected++
+		} else {
+			gate.Ungrafted++
+		}
+		gate.Unhealthy = append(gate.Unhealthy, outputs.UnhealthyNode{Seq: r.Seq, Peers: r.Peers, Dlo: r.Dlo, MeshSizes: r.MeshSizes})
+	}
+	sort.Slice(gate.Unhealthy, func(i, j int) bool { return gate.Unhealthy[i].Seq < gate.Unhealthy[j].Seq })
+	gate.Missing = instances - len(reports)
+	gate.Nodes += gate.Missing
+	if gate.Nodes > 0 {
+		gate.HealthyPct = float64(gate.HealthyNodes) / float64(gate.Nodes) * 100
+	}
+	gate.Passed = gate.HealthyPct >= float64(params.Pct)
+	gate.WaitMs = latencyStats(waits)
+	return gate
+}
+
+func (p *PubsubNode) writeHealthGate(gate *outputs.HealthGate) error {
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.HealthGateFile)
+	jsonstr, err := json.MarshalIndent(gate, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Reasons of the heartbeat's mesh changes, refined from MeshCauseHeartbeat
+const (
+	meshReasonUndersubscribed = "undersubscribed"
+	meshReasonOversubscribed  = "oversubscribed"
+	meshReasonNegativeScore   = "negative_score"
+)
+
+// HeartbeatTick is the data of the heartbeat events. The router doesn't
+// expose its heartbeat, so the ticks follow the configured heartbeat schedule
+// and cover the changes from half an interval before to half an interval
+// after each heartbeat.
+type HeartbeatTick struct {
+	Tick int
+	// mesh delta of each joined topic
+	Topics map[string]*MeshDelta
+}
+
+// MeshDelta is the change of the mesh of a topic during a tick, and its size
+// at the end of the tick
+type MeshDelta struct {
+	Size    int
+	Added   []MeshPeerDelta `json:",omitempty"`
+	Removed []MeshPeerDelta `json:",omitempty"`
+}
+
+// MeshPeerDelta is a peer added to or removed from a mesh, and the reason of
+// the change: the cause the tracer inferred, refined for the heartbeat's own
+// changes with the mesh size at the start of the tick and the peer's score
+type MeshPeerDelta struct {
+	Peer   string
+	Reason string
+}
+
+type heartbeatLog struct {
+	lk      sync.Mutex
+	changes []MeshChange
+	// mesh size of each topic at the start of the tick
+	sizes map[string]int
+}
+
+// startHeartbeatEvents emits a heartbeat event for every tick of the router's
+// heartbeat until the end of the run
+func (p *PubsubNode) startHeartbeatEvents(tracer *TestTracer) {
+	l := &heartbeatLog{sizes: make(map[string]int)}
+	tracer.OnMeshChange(func(c MeshChange) {
+		if c.Cause == MeshCauseHeartbeat && !c.Graft {
+			if score, ok := p.peerScores()[c.Peer]; ok && score < 0 {
+				c.Cause = meshReasonNegativeScore
+			}
+		}
+		l.lk.Lock()
+		l.changes = append(l.changes, c)
+		l.lk.Unlock()
+	})
+
+	params := gossipSubParams(p.cfg)
+	go func() {
+		interval := params.HeartbeatInterval
+		select {
+		case <-time.After(params.HeartbeatInitialDelay + interval/2):
+		case <-p.ctx.Done():
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for tick := 1; ; tick++ {
+			p.traceEvent("heartbeat", l.tick(tick, tracer, params.Dlo, params.Dhi))
+			select {
+			case <-ticker.C:
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (l *heartbeatLog) tick(tick int, tracer *TestTracer, dlo int, dhi int) HeartbeatTick {
+	l.lk.Lock()
+	changes := l.changes
+	l.changes = nil
+	l.lk.Unlock()
+
+	t := HeartbeatTick{Tick: tick, Topics: make(map[string]*MeshDelta)}
+	delta := func(topic string) *MeshDelta {
+		d, ok := t.Topics[topic]
+		if !ok {
+			d = &MeshDelta{}
+			t.Topics[topic] = d
+		}
+		return d
+	}
+	for _, c := range changes {
+		reason := c.Cause
+		size := l.sizes[c.Topic]
+		if reason == MeshCauseHeartbeat {
+			if c.Graft && size < dlo {
+				reason = meshReasonUndersubscribed
+			} else if !c.Graft && size > dhi {
+				reason = meshReasonOversubscribed
+			}
+		}
+		d := delta(c.Topic)
+		pd := MeshPeerDelta{Peer: c.Peer.String(), Reason: reason}
+		if c.Graft {
+			d.Added = append(d.Added, pd)
+		} else {
+			d.Removed = append(d.Removed, pd)
+		}
+	}
+	for topic := range l.sizes {
+		delta(topic)
+	}
+	for topic, d := range t.Topics {
+		d.Size = tracer.MeshSize(topic)
+		l.sizes[topic] = d.Size
+	}
+	return t
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+const (
+	HeavyTopicID = "heavy_channel"
+
+	// the dedicated hosts listen for UDP transports on their own port
+	heavyQUICPort = 9001
+)
+
+// HeavyTopicParams add a high volume topic to the run. The topic either shares
+// the connections of the other topics, or is carried by a dedicated host on
+// every node, to compare latency isolation with and without multiplexing.
+type HeavyTopicParams struct {
+	// messages per second, disabled if zero
+	Rate         int
+	Size         int
+	SeparateHost bool
+}
+
+func (h HeavyTopicParams) enabled() bool {
+	return h.Rate > 0
+}
+
+func (h HeavyTopicParams) topic() TopicConfig {
+	return TopicConfig{
+		Id:          HeavyTopicID,
+		MessageRate: ptypes.Rate{Quantity: float64(h.Rate), Interval: time.Second},
+		MessageSize: ptypes.Size(h.Size),
+	}
+}
+
+// heavyNodeConfig derives the config of the dedicated heavy topic node from
+// the main node's config. It only takes the router and publishing settings of
+// the main node: the experiments coordinated by the leader and the per-node
+// outputs are left to the main node.
+func heavyNodeConfig(cfg NodeConfig, tracer *TestTracer, topic TopicConfig) NodeConfig {
+	return NodeConfig{
+		Name:                    "heavy",
+		Implementation:          cfg.Implementation,
+		GossipsubProtocol:       cfg.GossipsubProtocol,
+		Topics:                  []TopicConfig{topic},
+		Publisher:               cfg.Publisher,
+		FloodPublishing:         cfg.FloodPublishing,
+		Tracer:                  tracer,
+		Seq:                     cfg.Seq,
+		Warmup:                  cfg.Warmup,
+		Cooldown:                cfg.Cooldown,
+		Heartbeat:               cfg.Heartbeat,
+		FirstPublishOffset:      cfg.FirstPublishOffset,
+		PeerScoreParams:         cfg.PeerScoreParams,
+		OverlayParams:           cfg.OverlayParams,
+		Repetitions:             1,
+		Quiet:                   cfg.Quiet,
+		ValidateQueueSize:       cfg.ValidateQueueSize,
+		OutboundQueueSize:       cfg.OutboundQueueSize,
+		SignaturePolicy:         cfg.SignaturePolicy,
+		OpportunisticGraftTicks: cfg.OpportunisticGraftTicks,
+		Workload:                "constant",
+		TopicLatency:            cfg.TopicLatency,
+	}
+}
+
+// createHeavyNode creates the dedicated host for the heavy topic, and connects
+// it to the dedicated hosts of the other nodes with the topology of the run
+func createHeavyNode(ctx context.Context, runenv *runtime.RunEnv, params testParams, seq int64, client tgsync.Client, netclient *network.Client, netconfig *network.Config, mainCfg NodeConfig) (*PubsubNode, *TestTracer, error) {
+	bwc := metrics.NewBandwidthCounter()
+	h, err := createHost(ctx, params.netParams.transport, false, bwc, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating heavy topic host: %w", err)
+	}
+
+	laddr := listenAddrs(netclient, params.netParams.transport, false, heavyQUICPort, params.netParams.ipFamily(seq, runenv.TestInstanceCount))
+	if err := h.Network().Listen(laddr...); err != nil {
+		return nil, nil, fmt.Errorf("error listening on heavy topic host: %w", err)
+	}
+
+	subscriber := NewPeerSubscriber(ctx, runenv, client, runenv.TestInstanceCount)
+	subscriber.quiet = true
+	subscriber.topic = HeavyPeerRegistrationTopic
+	topology, err := newTopology(params, seq, runenv.TestInstanceCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	discovery, err := NewSyncDiscovery(h, seq, runenv, subscriber, topology)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := discovery.registerAndWait(ctx); err != nil {
+		return nil, nil, fmt.Errorf("error waiting for heavy topic discovery: %w", err)
+	}
+
+	tracerOut := fmt.Sprintf("%s%ctracer-output-heavy-%d", runenv.TestOutputsPath, os.PathSeparator, seq)
+	tracer, err := NewTestTracer(tracerOut, h.ID(), false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating heavy topic tracer: %w", err)
+	}
+
+	cfg := heavyNodeConfig(mainCfg, tracer, params.heavyTopic.topic())
+	cfg.Bandwidth = bwc
+	p, err := createPubSubNode(ctx, runenv, seq, h, discovery, client, netclient, netconfig, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, tracer, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// IdleParams configure the nodes that close their connections without pubsub
+// traffic, modeling aggressive resource constrained peers. The other nodes
+// redial the peers they dialed as soon as their connection is closed.
+type IdleParams struct {
+	Timeout time.Duration
+	// percentage of the nodes closing idle connections, taken from the
+	// highest sequence numbers
+	Pct int
+}
+
+func (i IdleParams) enabled() bool {
+	return i.Timeout > 0
+}
+
+func (i IdleParams) validate() error {
+	if i.Pct <= 0 || i.Pct > 100 {
+		return fmt.Errorf("idle_disconnect_pct must be between 1 and 100")
+	}
+	return nil
+}
+
+// closes returns true if the node closes its idle connections
+func (i IdleParams) closes(seq int64, instances int) bool {
+	return i.enabled() && inCohort(seq, instances, i.Pct)
+}
+
+// idleStats count the connections closed for idleness and the redials
+type idleStats struct {
+	disconnects     int64
+	meshDisconnects int64
+	redials         int64
+}
+
+// runIdleDisconnect closes the connections to the peers that exchanged no
+// pubsub RPC for the idle timeout, counting from the last RPC or from the
+// opening of the connection
+func (p *PubsubNode) runIdleDisconnect() {
+	tracer := p.testTracer()
+	if tracer == nil {
+		p.log("idle disconnection requires the test tracer")
+		return
+	}
+	timeout := p.cfg.Idle.Timeout
+	p.log("closing connections idle for %s", timeout)
+
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			p.runenv.R().RecordPoint("idle_disconnects", float64(atomic.LoadInt64(&p.idle.disconnects)))
+			p.runenv.R().RecordPoint("idle_mesh_disconnects", float64(atomic.LoadInt64(&p.idle.meshDisconnects)))
+			return
+		}
+
+		mesh := make(map[peer.ID]struct{})
+		for _, t := range p.cfg.Topics {
+			for _, pid := range tracer.MeshPeers(t.Id) {
+				mesh[pid] = struct{}{}
+			}
+		}
+		now := time.Now()
+		for _, pid := range p.h.Network().Peers() {
+			last, _ := tracer.LastActivity(pid)
+			for _, c := range p.h.Network().ConnsToPeer(pid) {
+				if opened := c.Stat().Opened; opened.After(last) {
+					last = opened
+				}
+			}
+			if now.Sub(last) < timeout {
+				continue
+			}
+			p.h.Network().ClosePeer(pid)
+			atomic.AddInt64(&p.idle.disconnects, 1)
+			if _, ok := mesh[pid]; ok {
+				atomic.AddInt64(&p.idle.meshDisconnects, 1)
+			}
+		}
+	}
+}
+
+// holdDialedPeers redials the peers this node dialed whenever their
+// connection is closed
+func (p *PubsubNode) holdDialedPeers() {
+	p.discovery.HoldConnections(p.ctx, p.discovery.Connected(), time.Second, &p.idle.redials)
+	p.runenv.R().RecordPoint("idle_redials", float64(atomic.LoadInt64(&p.idle.redials)))
+}
+
+// summarizeIdle adds up the disconnections and the redials of all the nodes
+func summarizeIdle(reports []NodeReport, params IdleParams) *outputs.IdleDisconnect {
+	s := &outputs.IdleDisconnect{TimeoutSecs: params.Timeout.Seconds(), Pct: params.Pct}
+	for _, r := range reports {
+		if r.IdleCloser {
+			s.Closers++
+		}
+		s.Disconnects += r.IdleDisconnects
+		s.MeshDisconnects += r.IdleMeshDisconnects
+		s.Redials += r.Redials
+	}
+	return s
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// Commands sent to an interop process, and events it sends back. See the
+// interop section of README.md for the control protocol.
+const (
+	InteropCmdListen    = "listen"
+	InteropCmdConnect   = "connect"
+	InteropCmdSubscribe = "subscribe"
+	InteropCmdStats     = "stats"
+	InteropCmdStop      = "stop"
+
+	InteropEventReady     = "ready"
+	InteropEventConnected = "connected"
+	InteropEventDelivered = "delivered"
+	InteropEventStats     = "stats"
+	InteropEventLog       = "log"
+)
+
+const (
+	// time for an interop process to answer a command
+	interopReplyTimeout = 30 * time.Second
+	// largest line of the control protocol, enough for a base64 payload
+	interopMaxLine = 64 << 20
+)
+
+// InteropParams run a cohort of nodes on another pubsub implementation, eg
+// rust-libp2p or nim-libp2p gossipsub. Each node of the cohort runs the
+// implementation's binary as a child process and drives it over its stdin and
+// stdout, so that the node goes through the same discovery, topology and
+// reporting as the others.
+type InteropParams struct {
+	// percentage of the nodes, with the highest sequence numbers
+	Pct int
+	// name of the implementation, the nodes are in class interop:<name>
+	Name string
+	// binary and its arguments, separated by spaces
+	Command string
+}
+
+func (i InteropParams) enabled() bool {
+	return i.Pct > 0
+}
+
+func (i InteropParams) validate() error {
+	if i.Pct < 0 || i.Pct > 100 {
+		return fmt.Errorf("interop_pct must be between 0 and 100")
+	}
+	if !i.enabled() {
+		return nil
+	}
+	if i.Name == "" {
+		return fmt.Errorf("interop nodes require an interop_name")
+	}
+	if len(strings.Fields(i.Command)) == 0 {
+		return fmt.Errorf("interop nodes require an interop_command")
+	}
+	return nil
+}
+
+func (i InteropParams) applies(seq int64, instances int) bool {
+	return i.enabled() && inCohort(seq, instances, i.Pct)
+}
+
+func (i InteropParams) class() string {
+	return "interop:" + i.Name
+}
+
+// InteropCommand is a line of the control protocol sent to the process
+type InteropCommand struct {
+	Cmd string
+	// listen
+	Transport       string                `json:",omitempty"`
+	ListenAddrs     []string              `json:",omitempty"`
+	Router          *outputs.RouterParams `json:",omitempty"`
+	SignaturePolicy string                `json:",omitempty"`
+	// connect
+	Peer *peer.AddrInfo `json:",omitempty"`
+	// subscribe
+	Topic string `json:",omitempty"`
+}
+
+// InteropEvent is a line of the control protocol sent by the process. The
+// message ID and payload of a delivery are base64 encoded.
+type InteropEvent struct {
+	Event string
+	// ready
+	PeerID string
+	Addrs  []string
+	// connected, set on failure
+	Error string
+	// delivered
+	Topic string
+	MsgID []byte
+	From  string
+	Data  []byte
+	// stats
+	Peers     int
+	MeshPeers map[string]int
+	// log
+	Message string
+}
+
+// interopProcess is the running binary of an interop node
+type interopProcess struct {
+	runenv *runtime.RunEnv
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	info   peer.AddrInfo
+
+	encLk  sync.Mutex
+	enc    *json.Encoder
+	events chan InteropEvent
+	stderr *os.File
+}
+
+// startInterop starts the binary and has it listen on the node's addresses.
+// The binary's stderr is written to interop-<seq>.log in the outputs.
+func startInterop(ctx context.Context, runenv *runtime.RunEnv, params InteropParams, seq int64, laddrs []multiaddr.Multiaddr, transport string, router outputs.RouterParams, signaturePolicy string) (*interopProcess, error) {
+	args := strings.Fields(params.Command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("%s%cinterop-%d.log", runenv.TestOutputsPath, os.PathSeparator, seq)
+	stderr, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		stderr.Close()
+		return nil, fmt.Errorf("error starting %s: %w", params.Command, err)
+	}
+
+	ip := &interopProcess{
+		runenv: runenv,
+		cmd:    cmd,
+		stdin:  stdin,
+		enc:    json.NewEncoder(stdin),
+		events: make(chan InteropEvent, 1024),
+		stderr: stderr,
+	}
+	go ip.readEvents(stdout)
+
+	cmdListen := InteropCommand{
+		Cmd:             InteropCmdListen,
+		Transport:       transport,
+		Router:          &router,
+		SignaturePolicy: signaturePolicy,
+	}
+	for _, a := range laddrs {
+		cmdListen.ListenAddrs = append(cmdListen.ListenAddrs, a.String())
+	}
+	if err := ip.send(cmdListen); err != nil {
+		ip.stop()
+		return nil, err
+	}
+	ready, err := ip.waitEvent(ctx, InteropEventReady)
+	if err != nil {
+		ip.stop()
+		return nil, err
+	}
+	if ip.info.ID, err = peer.Decode(ready.PeerID); err != nil {
+		ip.stop()
+		return nil, fmt.Errorf("interop process reported an invalid peer ID %q: %w", ready.PeerID, err)
+	}
+	for _, s := range ready.Addrs {
+		a, err := multiaddr.NewMultiaddr(s)
+		if err != nil {
+			ip.stop()
+			return nil, fmt.Errorf("interop process reported an invalid address %q: %w", s, err)
+		}
+		ip.info.Addrs = append(ip.info.Addrs, a)
+	}
+	return ip, nil
+}
+
+// readEvents decodes the events of the process until its stdout is closed
+func (ip *interopProcess) readEvents(r io.Reader) {
+	defer close(ip.events)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), interopMaxLine)
+	for scanner.Scan() {
+		var evt InteropEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			ip.runenv.RecordMessage("invalid interop event %q: %s", scanner.Text(), err)
+			continue
+		}
+		if evt.Event == InteropEventLog {
+			ip.runenv.RecordMessage("interop: %s", evt.Message)
+			continue
+		}
+		ip.events <- evt
+	}
+	if err := scanner.Err(); err != nil {
+		ip.runenv.RecordMessage("error reading interop events: %s", err)
+	}
+}
+
+func (ip *interopProcess) send(c InteropCommand) error {
+	ip.encLk.Lock()
+	defer ip.encLk.Unlock()
+	if err := ip.enc.Encode(c); err != nil {
+		return fmt.Errorf("error sending %s to the interop process: %w", c.Cmd, err)
+	}
+	return nil
+}
+
+// waitEvent waits for an event of a kind, dropping the others. Only used
+// before the events are consumed by the node.
+func (ip *interopProcess) waitEvent(ctx context.Context, kind string) (InteropEvent, error) {
+	timeout := time.After(interopReplyTimeout)
+	for {
+		select {
+		case evt, ok := <-ip.events:
+			if !ok {
+				return InteropEvent{}, fmt.Errorf("interop process exited before %s", kind)
+			}
+			if evt.Event == kind {
+				return evt, nil
+			}
+		case <-timeout:
+			return InteropEvent{}, fmt.Errorf("interop process didn't send %s within %s", kind, interopReplyTimeout)
+		case <-ctx.Done():
+			return InteropEvent{}, ctx.Err()
+		}
+	}
+}
+
+// stop asks the process to exit, and kills it if it doesn't in time
+func (ip *interopProcess) stop() {
+	if err := ip.send(InteropCommand{Cmd: InteropCmdStop}); err != nil {
+		ip.runenv.RecordMessage("%s", err)
+	}
+	ip.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- ip.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			ip.runenv.RecordMessage("interop process exited: %s", err)
+		}
+	case <-time.After(interopReplyTimeout):
+		ip.runenv.RecordMessage("killing the interop process")
+		ip.cmd.Process.Kill()
+		<-done
+	}
+	ip.stderr.Close()
+}
+
+// InteropNode stands in for the PubsubNode of an interop node. It connects
+// the process to the topology, subscribes it to the topics and records its
+// deliveries the same way.
+type InteropNode struct {
+	runenv    *runtime.RunEnv
+	discovery *SyncDiscovery
+	proc      *interopProcess
+	cfg       NodeConfig
+	seq       int64
+	cipher    *payloadCipher
+
+	stats  chan InteropEvent
+	dialed []int64
+
+	lk           sync.Mutex
+	order        deliveryOrder
+	delivered    map[string]struct{}
+	latenciesMs  []float64
+	latencySumMs float64
+}
+
+// runInteropNode runs an interop node through the phases of a PubsubNode:
+// connect, warm up, join the topics, run and cool down, then report
+func runInteropNode(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client, discovery *SyncDiscovery, proc *interopProcess, cfg NodeConfig, runTime time.Duration) error {
+	defer proc.stop()
+	n := &InteropNode{
+		runenv:    runenv,
+		discovery: discovery,
+		proc:      proc,
+		cfg:       cfg,
+		seq:       cfg.Seq,
+		stats:     make(chan InteropEvent, 1),
+		delivered: make(map[string]struct{}),
+	}
+	if cfg.PayloadEncryption {
+		var err error
+		if n.cipher, err = newPayloadCipher(); err != nil {
+			return fmt.Errorf("error creating the payload cipher: %w", err)
+		}
+	}
+	go n.consumeEvents()
+
+	if err := n.connectTopology(ctx); err != nil {
+		return err
+	}
+	if err := waitForReadyState(ctx, runenv, client); err != nil {
+		return err
+	}
+
+	runenv.RecordMessage("Wait for %s warmup time", cfg.Warmup)
+	select {
+	case <-time.After(cfg.Warmup):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	runStart := time.Now()
+	for _, t := range cfg.Topics {
+		if err := proc.send(InteropCommand{Cmd: InteropCmdSubscribe, Topic: t.Id}); err != nil {
+			return err
+		}
+	}
+	if err := waitTillAllJoined(ctx, runenv, client, tgsync.State("joined")); err != nil {
+		return fmt.Errorf("error waiting for all nodes to join: %w", err)
+	}
+
+	runenv.RecordMessage("Wait for %s run time", runTime)
+	select {
+	case <-time.After(time.Until(runStart.Add(runTime))):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	runenv.RecordMessage("Run time complete, cooling down for %s", cfg.Cooldown)
+	select {
+	case <-time.After(cfg.Cooldown):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	report := n.buildNodeReport(ctx)
+	runenv.R().RecordPoint("interop_deliveries", float64(report.Deliveries))
+	runenv.R().RecordPoint("interop_mean_latency_ms", report.MeanLatencyMs)
+	if !cfg.Summary {
+		return nil
+	}
+	if _, err := client.Publish(ctx, NodeReportTopic, &report); err != nil {
+		return fmt.Errorf("failed to publish node report: %w", err)
+	}
+	return nil
+}
+
+// connectTopology has the process dial the peers the topology selects for it,
+// after a random delay within the warmup like the other nodes
+func (n *InteropNode) connectTopology(ctx context.Context) error {
+	var delay time.Duration
+	if n.cfg.Warmup >= time.Second {
+		delay = time.Duration(rand.Intn(int(n.cfg.Warmup.Seconds()))) * time.Second
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	selected := n.discovery.topology.SelectPeers(n.proc.info.ID, n.discovery.candidates())
+	n.runenv.RecordMessage("Connecting interop node to %d peers", len(selected))
+	for _, p := range selected {
+		info := p.Info
+		if err := n.proc.send(InteropCommand{Cmd: InteropCmdConnect, Peer: &info}); err != nil {
+			return err
+		}
+		n.dialed = append(n.dialed, p.NodeTypeSeq)
+	}
+	return nil
+}
+
+// consumeEvents records the deliveries of the process until it exits
+func (n *InteropNode) consumeEvents() {
+	for evt := range n.proc.events {
+		switch evt.Event {
+		case InteropEventDelivered:
+			n.handleDelivery(evt)
+		case InteropEventConnected:
+			if evt.Error != "" {
+				n.runenv.RecordMessage("interop node failed to connect to %s: %s", evt.PeerID, evt.Error)
+			}
+		case InteropEventStats:
+			select {
+			case n.stats <- evt:
+			default:
+			}
+		}
+	}
+}
+
+func (n *InteropNode) handleDelivery(evt InteropEvent) {
+	data := evt.Data
+	if n.cipher != nil {
+		plain, err := n.cipher.open(data)
+		if err != nil {
+			n.runenv.RecordMessage("error decrypting payload: %s", err)
+			return
+		}
+		data = plain
+	}
+	var m Msg
+	if err := json.Unmarshal(data, &m); err != nil {
+		n.runenv.RecordMessage("error decoding message delivered on %s: %s", evt.Topic, err)
+		return
+	}
+	latency := float64(time.Since(time.Unix(0, m.Published))) / float64(time.Millisecond)
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	id := encodeMsgID(evt.MsgID)
+	if _, ok := n.delivered[id]; ok {
+		return
+	}
+	n.delivered[id] = struct{}{}
+	n.order.record(evt.Topic, &m)
+	n.latenciesMs = append(n.latenciesMs, latency)
+	n.latencySumMs += latency
+}
+
+// buildNodeReport collects the interop node's records for the run summary.
+// The process is asked for its connections and meshes, which are left out if
+// it doesn't answer.
+func (n *InteropNode) buildNodeReport(ctx context.Context) NodeReport {
+	report := NodeReport{
+		Seq:         n.seq,
+		PeerID:      n.proc.info.ID.String(),
+		Class:       n.cfg.Class,
+		Dialed:      n.dialed,
+		Location:    n.discovery.link.Location,
+		BandwidthMB: n.discovery.link.BandwidthMB,
+	}
+	if err := n.proc.send(InteropCommand{Cmd: InteropCmdStats}); err == nil {
+		select {
+		case stats := <-n.stats:
+			report.Degree = stats.Peers
+			n.runenv.RecordMessage("interop node has %d peers, meshes %v", stats.Peers, stats.MeshPeers)
+		case <-time.After(interopReplyTimeout):
+			n.runenv.RecordMessage("interop process didn't send its stats")
+		case <-ctx.Done():
+		}
+	}
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	report.Deliveries, report.OutOfOrder, report.MaxDisplacement = n.order.reordering()
+	report.ReceivedBitmaps = n.order.bitmaps()
+	for id := range n.delivered {
+		report.Delivered = append(report.Delivered, id)
+	}
+	report.LatenciesMs = append(report.LatenciesMs, n.latenciesMs...)
+	if len(n.latenciesMs) > 0 {
+		report.MeanLatencyMs = n.latencySumMs / float64(len(n.latenciesMs))
+	}
+	return report
+}
+
+// summarizeInterop compares the deliveries to the interop nodes with those to
+// the other honest nodes
+func summarizeInterop(reports []NodeReport, completeness *outputs.Completeness, params InteropParams) *outputs.Interop {
+	s := &outputs.Interop{Implementation: params.Name}
+	pct := make(map[int64]float64)
+	if completeness != nil {
+		for _, c := range completeness.Nodes {
+			pct[c.Seq] = c.CompletenessPct
+		}
+	}
+	var interopLatency, nativeLatency []float64
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		cohort, latencies := &s.Native, &nativeLatency
+		if r.Class == params.class() {
+			cohort, latencies = &s.Interop, &interopLatency
+		}
+		cohort.Nodes++
+		cohort.Deliveries += r.Deliveries
+		cohort.CompletenessPct += pct[r.Seq]
+		if pct[r.Seq] == 100 {
+			cohort.CompleteNodes++
+		}
+		*latencies = append(*latencies, r.MeanLatencyMs)
+	}
+	for _, c := range []struct {
+		cohort    *outputs.InteropCohort
+		latencies []float64
+	}{{&s.Interop, interopLatency}, {&s.Native, nativeLatency}} {
+		if c.cohort.Nodes == 0 {
+			continue
+		}
+		c.cohort.CompletenessPct /= float64(c.cohort.Nodes)
+		c.cohort.MeanLatencyMs = estimate(c.latencies)
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Address families a node can listen on in the data network
+const (
+	IPFamilyV4   = "ipv4"
+	IPFamilyV6   = "ipv6"
+	IPFamilyDual = "dual"
+)
+
+func validIPFamily(family string) bool {
+	switch family {
+	case IPFamilyV4, IPFamilyV6, IPFamilyDual:
+		return true
+	}
+	return false
+}
+
+// ipFamily returns the address family of a node. The last ipFamilyPct percent
+// of the nodes by sequence number use ipFamily, the rest IPv4 only.
+func (np NetworkParams) ipFamily(seq int64, instances int) string {
+	n := int64(math.Round(float64(instances) * float64(np.ipFamilyPct) / 100))
+	if seq > int64(instances)-n {
+		return np.family
+	}
+	return IPFamilyV4
+}
+
+// dataNetworkIPs returns the addresses of the node in the data network for an
+// address family. The testground SDK only detects the IPv4 address, the IPv6
+// one is looked up on the same interface.
+func dataNetworkIPs(ip4 net.IP, family string) ([]net.IP, error) {
+	if family == IPFamilyV4 {
+		return []net.IP{ip4}, nil
+	}
+	ip6, err := interfaceIPv6(ip4)
+	if err != nil {
+		return nil, err
+	}
+	if family == IPFamilyV6 {
+		return []net.IP{ip6}, nil
+	}
+	return []net.IP{ip4, ip6}, nil
+}
+
+func interfaceIPv6(ip4 net.IP) (net.IP, error) {
+	if ip4.IsLoopback() {
+		return net.IPv6loopback, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get local network interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		var found bool
+		var ip6 net.IP
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.Equal(ip4) {
+				found = true
+			} else if ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+				ip6 = ipnet.IP
+			}
+		}
+		if found {
+			if ip6 == nil {
+				return nil, fmt.Errorf("data network interface %s has no IPv6 address", iface.Name)
+			}
+			return ip6, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface with the data network address %s", ip4)
+}
+
+// connsByFamily counts the open connections over IPv4 and IPv6
+func connsByFamily(conns []lnetwork.Conn) (v4 int, v6 int) {
+	for _, c := range conns {
+		ip, err := manet.ToIP(c.RemoteMultiaddr())
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	return v4, v6
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JoinSchedule staggers the time at which the lurkers join the network,
+// instead of connecting during the warmup. A joining node doesn't dial its
+// topology peers nor subscribe until its offset from the start of the run.
+// Its host is up from the start, so the other nodes may still dial it.
+type JoinSchedule struct {
+	// uniform, exponential or offsets, disabled if empty
+	Mode string
+	// nodes join uniformly within this window, or after an exponential delay
+	// of this mean
+	Window time.Duration
+	// join offset by sequence number in the offsets mode, the nodes that
+	// aren't listed join at the start of the run
+	Offsets map[int64]time.Duration
+}
+
+// parseJoinSchedule parses a join schedule, eg "uniform:60s" for a slow
+// rollout, "exponential:5s" for a flash crowd, or "offsets:2=10s,3=20s"
+func parseJoinSchedule(schedule string) (JoinSchedule, error) {
+	var s JoinSchedule
+	schedule = strings.TrimSpace(schedule)
+	if schedule == "" {
+		return s, nil
+	}
+	parts := strings.SplitN(schedule, ":", 2)
+	if len(parts) != 2 {
+		return s, fmt.Errorf("join schedule %q must be <mode>:<spec>", schedule)
+	}
+	s.Mode = parts[0]
+	switch s.Mode {
+	case "uniform", "exponential":
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return s, fmt.Errorf("invalid window of join schedule %q: %w", schedule, err)
+		}
+		if d <= 0 {
+			return s, fmt.Errorf("window of join schedule %q must be positive", schedule)
+		}
+		s.Window = d
+	case "offsets":
+		s.Offsets = make(map[int64]time.Duration)
+		for _, kv := range strings.Split(parts[1], ",") {
+			pair := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(pair) != 2 {
+				return s, fmt.Errorf("join offset %q must be <seq>=<offset>", kv)
+			}
+			seq, err := strconv.ParseInt(pair[0], 10, 64)
+			if err != nil || seq <= 0 {
+				return s, fmt.Errorf("invalid sequence number of join offset %q", kv)
+			}
+			d, err := time.ParseDuration(pair[1])
+			if err != nil || d < 0 {
+				return s, fmt.Errorf("invalid join offset %q", kv)
+			}
+			s.Offsets[seq] = d
+		}
+	default:
+		return s, fmt.Errorf("unknown join schedule mode %s", s.Mode)
+	}
+	return s, nil
+}
+
+func (s JoinSchedule) enabled() bool {
+	return s.Mode != ""
+}
+
+// offset returns when the node joins, from the start of the run. The offsets
+// are seeded with the node's sequence number, so that runs are reproducible.
+func (s JoinSchedule) offset(seq int64) time.Duration {
+	rng := rand.New(rand.NewSource(seq))
+	switch s.Mode {
+	case "uniform":
+		return time.Duration(rng.Int63n(int64(s.Window)))
+	case "exponential":
+		return time.Duration(rng.ExpFloat64() * float64(s.Window))
+	case "offsets":
+		return s.Offsets[seq]
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// TopicLatencyRecorder keeps the delivery latencies of every topic, so that
+// the latency of topics sharing (or not) the same connections can be compared
+type TopicLatencyRecorder struct {
+	lk        sync.Mutex
+	latencies map[string][]float64
+}
+
+func NewTopicLatencyRecorder() *TopicLatencyRecorder {
+	return &TopicLatencyRecorder{latencies: make(map[string][]float64)}
+}
+
+// Record accounts for a message delivered on the topic with the given latency
+func (r *TopicLatencyRecorder) Record(topic string, latency time.Duration) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.latencies[topic] = append(r.latencies[topic], float64(latency)/float64(time.Millisecond))
+}
+
+// Latencies returns the delivery latencies recorded for a topic, in milliseconds
+func (r *TopicLatencyRecorder) Latencies(topic string) []float64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return append([]float64(nil), r.latencies[topic]...)
+}
+
+// Stats returns the latency distribution of each topic
+func (r *TopicLatencyRecorder) Stats() map[string]outputs.LatencyStats {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	stats := make(map[string]outputs.LatencyStats, len(r.latencies))
+	for topic, lats := range r.latencies {
+		stats[topic] = latencyStats(lats)
+	}
+	return stats
+}
+
+// Write outputs the latency distribution of each topic as json
+func (r *TopicLatencyRecorder) Write(path string, seq int64) error {
+	out := outputs.TopicLatencies{
+		Version: outputs.SchemaVersion,
+		Seq:     seq,
+		Topics:  r.Stats(),
+	}
+
+	jsonstr, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
+
+func latencyStats(lats []float64) outputs.LatencyStats {
+	s := outputs.LatencyStats{Count: len(lats)}
+	if len(lats) == 0 {
+		return s
+	}
+	sorted := append([]float64(nil), lats...)
+	sort.Float64s(sorted)
+
+	var total float64
+	for _, l := range sorted {
+		total += l
+	}
+	percentile := func(pct float64) float64 {
+		return sorted[int(pct*float64(len(sorted)-1))]
+	}
+	s.MeanMs = total / float64(len(sorted))
+	s.P50Ms = percentile(0.5)
+	s.P90Ms = percentile(0.9)
+	s.P99Ms = percentile(0.99)
+	s.MaxMs = sorted[len(sorted)-1]
+	return s
+}
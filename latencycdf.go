@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// number of points of the CDF written to latency-cdf.json. The csv file has
+// every sample.
+const latencyCDFPoints = 1000
+
+// buildLatencyCDF aggregates the first delivery latency of every message at
+// every honest node
+func buildLatencyCDF(reports []NodeReport) (outputs.LatencyCDF, []float64) {
+	cdf := outputs.LatencyCDF{Version: outputs.SchemaVersion}
+	var lats []float64
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		cdf.Nodes++
+		for _, lat := range r.MessageLatenciesMs {
+			lats = append(lats, lat)
+		}
+	}
+	sort.Float64s(lats)
+	cdf.Stats = latencyStats(lats)
+	if len(lats) == 0 {
+		return cdf, lats
+	}
+	cdf.P999Ms = lats[int(0.999*float64(len(lats)-1))]
+
+	step := 1
+	if len(lats) > latencyCDFPoints {
+		step = len(lats) / latencyCDFPoints
+	}
+	for i := step - 1; i < len(lats); i += step {
+		cdf.CDF = append(cdf.CDF, outputs.CDFPoint{LatencyMs: lats[i], Fraction: float64(i+1) / float64(len(lats))})
+	}
+	if last := cdf.CDF[len(cdf.CDF)-1]; last.Fraction < 1 {
+		cdf.CDF = append(cdf.CDF, outputs.CDFPoint{LatencyMs: lats[len(lats)-1], Fraction: 1})
+	}
+	return cdf, lats
+}
+
+// writeLatencyCDF writes the latency distribution of all the nodes to
+// latency-cdf.json, and every sample with its cumulative fraction to
+// latency-cdf.csv
+func (p *PubsubNode) writeLatencyCDF(reports []NodeReport) error {
+	cdf, lats := buildLatencyCDF(reports)
+	jsonstr, err := json.MarshalIndent(cdf, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.LatencyCDFFile)
+	if err := ioutil.WriteFile(path, jsonstr, os.ModePerm); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("latency_ms,fraction\n")
+	for i, lat := range lats {
+		fmt.Fprintf(&b, "%.3f,%.6f\n", lat, float64(i+1)/float64(len(lats)))
+	}
+	path = fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.LatencyCDFCSVFile)
+	if err := ioutil.WriteFile(path, b.Bytes(), os.ModePerm); err != nil {
+		return err
+	}
+	p.log("latency of %d deliveries across %d nodes: p50 %.1fms, p90 %.1fms, p99 %.1fms, p99.9 %.1fms",
+		cdf.Stats.Count, cdf.Nodes, cdf.Stats.P50Ms, cdf.Stats.P90Ms, cdf.Stats.P99Ms, cdf.P999Ms)
+	return nil
+}
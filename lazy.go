@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// Lazy nodes subscribe and get grafted into the meshes like any other node,
+// but their validator ignores every message they didn't publish. Ignored
+// messages are neither forwarded nor added to the message cache, so lazy
+// nodes never forward or gossip anything, and only the mesh message delivery
+// penalties of the peer score can tell them apart.
+
+// LazyReport is what a node saw of its peers at the end of a run with lazy
+// nodes: its mesh peers over all topics, and the score of every peer
+type LazyReport struct {
+	MeshPeers []string
+	Scores    map[string]float64
+}
+
+// lazyReport collects the node's mesh peers and peer scores
+func (p *PubsubNode) lazyReport() *LazyReport {
+	report := &LazyReport{}
+	if tracer := p.testTracer(); tracer != nil {
+		seen := make(map[string]struct{})
+		for _, t := range p.cfg.Topics {
+			for _, pid := range tracer.MeshPeers(t.Id) {
+				seen[pid.String()] = struct{}{}
+			}
+		}
+		for pid := range seen {
+			report.MeshPeers = append(report.MeshPeers, pid)
+		}
+		sort.Strings(report.MeshPeers)
+	}
+	scores := p.peerScores()
+	report.Scores = make(map[string]float64, len(scores))
+	for pid, score := range scores {
+		report.Scores[pid.String()] = score
+	}
+	return report
+}
+
+// summarizeLazy compares the place the lazy nodes kept in the meshes of the
+// honest nodes with their share of the nodes, and the scores the honest
+// nodes gave them with the ones they gave to each other
+func summarizeLazy(reports []NodeReport, completeness *outputs.Completeness, pct int) *outputs.Lazy {
+	s := &outputs.Lazy{Pct: pct}
+	lazy := make(map[string]struct{})
+	honest := make(map[string]struct{})
+	honestSeqs := make(map[int64]struct{})
+	for _, r := range reports {
+		switch {
+		case r.Lazy:
+			lazy[r.PeerID] = struct{}{}
+		case !r.Attacker:
+			honest[r.PeerID] = struct{}{}
+			honestSeqs[r.Seq] = struct{}{}
+		}
+	}
+	s.LazyNodes, s.HonestNodes = len(lazy), len(honest)
+	if n := s.LazyNodes + s.HonestNodes; n > 0 {
+		s.NodeShare = float64(s.LazyNodes) / float64(n)
+	}
+
+	var lazyScores, honestScores []float64
+	var meshSlots, lazySlots int
+	for _, r := range reports {
+		if r.Attacker || r.LazyPeers == nil {
+			continue
+		}
+		for _, pid := range r.LazyPeers.MeshPeers {
+			meshSlots++
+			if _, ok := lazy[pid]; ok {
+				lazySlots++
+			}
+		}
+		for pid, score := range r.LazyPeers.Scores {
+			if _, ok := lazy[pid]; ok {
+				lazyScores = append(lazyScores, score)
+				if score < 0 {
+					s.NegativeLazyScores++
+				}
+			} else if _, ok := honest[pid]; ok {
+				honestScores = append(honestScores, score)
+			}
+		}
+	}
+	if meshSlots > 0 {
+		s.LazyMeshShare = float64(lazySlots) / float64(meshSlots)
+	}
+	s.LazyScore = estimate(lazyScores)
+	s.HonestScore = estimate(honestScores)
+
+	if completeness != nil {
+		var sum float64
+		var nodes int
+		for _, c := range completeness.Nodes {
+			if _, ok := honestSeqs[c.Seq]; ok {
+				sum += c.CompletenessPct
+				nodes++
+			}
+		}
+		if nodes > 0 {
+			s.HonestCompletenessPct = sum / float64(nodes)
+		}
+	}
+	var latencies []float64
+	for _, r := range reports {
+		if _, ok := honest[r.PeerID]; ok && r.Deliveries > 0 {
+			latencies = append(latencies, r.MeanLatencyMs)
+		}
+	}
+	s.HonestMeanLatencyMs = estimate(latencies)
+	return s
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+	"github.com/testground/sdk-go/runtime"
+)
+
+// propagation speed of light in fiber, in km per millisecond
+const fiberKmPerMs = 200
+
+// LinkLatencyParams select how the latency of each link is derived
+type LinkLatencyParams struct {
+	// Model is uniform (a single random latency for all the links of a node),
+	// matrix or geo
+	Model string
+	// MatrixFile is a json NxN array of one way latencies in milliseconds,
+	// indexed by sequence number - 1. Used by the matrix model.
+	MatrixFile string
+}
+
+// perLink returns true if every link gets its own latency
+func (l LinkLatencyParams) perLink() bool {
+	return l.Model == "matrix" || l.Model == "geo"
+}
+
+func (l LinkLatencyParams) validate() error {
+	switch l.Model {
+	case "uniform", "geo":
+	case "matrix":
+		if l.MatrixFile == "" {
+			return fmt.Errorf("latency model matrix requires latency_matrix_file")
+		}
+	default:
+		return fmt.Errorf("unknown latency model %s", l.Model)
+	}
+	return nil
+}
+
+// GeoLocation is a point on the earth, in degrees
+type GeoLocation struct {
+	Lat float64
+	Lon float64
+}
+
+// randomGeoLocation returns a point uniformly distributed over the earth's surface
+func randomGeoLocation() *GeoLocation {
+	return &GeoLocation{
+		Lat: math.Asin(2*rand.Float64()-1) * 180 / math.Pi,
+		Lon: rand.Float64()*360 - 180,
+	}
+}
+
+// distanceKm returns the great circle distance between two locations
+func (g GeoLocation) distanceKm(o GeoLocation) float64 {
+	const earthRadiusKm = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(o.Lat - g.Lat)
+	dLon := rad(o.Lon - g.Lon)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(g.Lat))*math.Cos(rad(o.Lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// LinkMetadata is shared in each node's registration, so that the other nodes
+// can shape their links towards it
+type LinkMetadata struct {
+	// address in the data network
+	IP net.IP
+	// address families the node listens on: ipv4, ipv6 or dual
+	Family string
+	// bandwidth the node's links were shaped with, in Mbps
+	BandwidthMB int
+	// downlink bandwidth of an asymmetric node in Mbps, the other nodes cap
+	// their links towards it. Zero if the node is symmetric.
+	DownlinkMB int
+	// set by the geo latency model
+	Location *GeoLocation
+	// IPv6 address of the second interface of a multi-homed node
+	SecondaryIP net.IP
+	// sequence number of the relay of a NAT'd node, zero if it is public
+	RelaySeq int64
+}
+
+func loadLatencyMatrix(path string, instances int) ([][]float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading latency matrix: %w", err)
+	}
+	var matrix [][]float64
+	if err := json.Unmarshal(data, &matrix); err != nil {
+		return nil, fmt.Errorf("error decoding latency matrix: %w", err)
+	}
+	if len(matrix) < instances {
+		return nil, fmt.Errorf("latency matrix has %d rows, expected %d", len(matrix), instances)
+	}
+	for i, row := range matrix[:instances] {
+		if len(row) < instances {
+			return nil, fmt.Errorf("row %d of the latency matrix has %d columns, expected %d", i, len(row), instances)
+		}
+	}
+	return matrix, nil
+}
+
+// linkLatencies returns the one way latency of the link from the local node to
+// each remote node. The geo model adds the propagation delay over the distance
+// between both nodes to the base latency.
+func linkLatencies(runenv *runtime.RunEnv, params LinkLatencyParams, seq int64, local LinkMetadata, base int, remote []PeerRegistration) (map[int64]time.Duration, error) {
+	lats := make(map[int64]time.Duration, len(remote))
+	switch params.Model {
+	case "matrix":
+		matrix, err := loadLatencyMatrix(params.MatrixFile, runenv.TestInstanceCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range remote {
+			lats[r.NodeTypeSeq] = time.Duration(matrix[seq-1][r.NodeTypeSeq-1] * float64(time.Millisecond))
+		}
+	case "geo":
+		for _, r := range remote {
+			if local.Location == nil || r.Link.Location == nil {
+				return nil, fmt.Errorf("node %d did not register its location", r.NodeTypeSeq)
+			}
+			km := local.Location.distanceKm(*r.Link.Location)
+			lats[r.NodeTypeSeq] = time.Duration(base)*time.Millisecond + time.Duration(km/fiberKmPerMs*float64(time.Millisecond))
+		}
+	}
+	return lats, nil
+}
+
+// configureLinkLatencies installs a rule in the sidecar for every remote node,
+// so that each link gets its own latency. The rest of the shape of the link is
+// copied from the default rule.
+func configureLinkLatencies(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, config *network.Config, lats map[int64]time.Duration, remote []PeerRegistration) error {
+	rules := make([]network.LinkRule, 0, len(remote))
+	var min, max time.Duration
+	for _, r := range remote {
+		if r.Link.IP == nil {
+			return fmt.Errorf("node %d did not register its data network address", r.NodeTypeSeq)
+		}
+		shape := config.Default
+		shape.Latency = lats[r.NodeTypeSeq]
+		rules = append(rules, network.LinkRule{
+			LinkShape: shape,
+			Subnet:    ptypes.IPNet{IPNet: net.IPNet{IP: r.Link.IP, Mask: net.CIDRMask(8*len(r.Link.IP), 8*len(r.Link.IP))}},
+		})
+		if min == 0 || shape.Latency < min {
+			min = shape.Latency
+		}
+		if shape.Latency > max {
+			max = shape.Latency
+		}
+	}
+
+	cfg := *config
+	cfg.Rules = rules
+	cfg.CallbackState = "link-latencies-configured"
+	runenv.RecordMessage("Configuring %d link latencies between %s and %s", len(rules), min, max)
+	if err := netclient.ConfigureNetwork(ctx, &cfg); err != nil {
+		return err
+	}
+	*config = cfg
+	return nil
+}
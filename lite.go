@@ -0,0 +1,54 @@
+package main
+
+import (
+	"runtime/debug"
+)
+
+// LiteParams configure the minimal-resource lurker mode, which strips most of
+// the per-node overhead so that very large runs fit on fewer machines
+type LiteParams struct {
+	Enabled bool
+	// Percentage of lite lurkers that still record live metrics
+	MetricsSamplePct int
+	// GOGC value for lite lurkers, unchanged if zero. The setting applies to
+	// the whole process, ie to every node of the container, and is ignored in
+	// local runs where all the instances share the process.
+	GCPercent int
+}
+
+// applies returns true if the node runs as a lite lurker. Publishers always run
+// with the full configuration.
+func (l LiteParams) applies(publisher bool) bool {
+	return l.Enabled && !publisher
+}
+
+// sampled returns true if the lite lurker should still record metrics
+func (l LiteParams) sampled(seq int64) bool {
+	if l.MetricsSamplePct <= 0 {
+		return false
+	}
+	if l.MetricsSamplePct >= 100 {
+		return true
+	}
+	return seq%int64(100/l.MetricsSamplePct) == 0
+}
+
+// summary returns true if the run summary is still collected. Lite runs don't
+// collect it, as the leader would wait for the records of every lurker.
+func (l LiteParams) summary(requested bool) bool {
+	return requested && !l.Enabled
+}
+
+// apply strips the node config down to the minimum
+func (l LiteParams) apply(seq int64, cfg *NodeConfig) {
+	cfg.Quiet = true
+	if !l.sampled(seq) {
+		cfg.MetricsPeriod = 0
+		cfg.ThroughputWindow = 0
+		cfg.PingInterval = 0
+		cfg.TopicLatency = nil
+	}
+	if l.GCPercent > 0 && localSync == nil {
+		debug.SetGCPercent(l.GCPercent)
+	}
+}
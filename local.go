@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/run"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+	"golang.org/x/sync/errgroup"
+)
+
+// localSync is the sync service shared by the instances of a local run, nil
+// when running under testground
+var localSync tgsync.Client
+
+// boundSyncClient returns the sync client of the instance and a function
+// closing it
+func boundSyncClient(ctx context.Context, runenv *runtime.RunEnv) (tgsync.Client, func()) {
+	if localSync != nil {
+		return localSync, func() {}
+	}
+	client := tgsync.MustBoundClient(ctx, runenv)
+	return client, func() { client.Close() }
+}
+
+// runLocal runs the instances of a test case in this process, without
+// testground: the sync service is in memory and the hosts listen on the
+// loopback address. The SDK doesn't shape traffic without a sidecar, so the
+// per-hop latency is emulated by delaying the validation of every message by
+// t_latency, unless validate_delay_ms is set. Control messages are not delayed.
+//
+//	go run . local -n 20 -p t_run=30s -p block_size=1024
+func runLocal(args []string) error {
+	fs := flag.NewFlagSet("local", flag.ExitOnError)
+	instances := fs.Int("n", 10, "number of instances")
+	testcase := fs.String("case", "test", "test case to run")
+	manifest := fs.String("manifest", "manifest.toml", "manifest declaring the params and their defaults")
+	out := fs.String("out", "local-outputs", "directory the outputs of each instance are written to")
+	latency := fs.Bool("latency", true, "emulate t_latency by delaying the validation of every message")
+	var overrides localParams
+	fs.Var(&overrides, "p", "param override as name=value, can be repeated")
+	fs.Parse(args)
+
+	fn, ok := testcases[*testcase].(run.InitializedTestCaseFn)
+	if !ok {
+		return fmt.Errorf("unknown test case %s", *testcase)
+	}
+	params, err := manifestDefaults(*manifest, *testcase)
+	if err != nil {
+		return err
+	}
+	for k, v := range overrides {
+		if _, ok := params[k]; !ok {
+			return fmt.Errorf("param %s is not declared by test case %s", k, *testcase)
+		}
+		params[k] = v
+	}
+	if *latency && params["validate_delay_ms"] == "0" {
+		params["validate_delay_ms"] = params["t_latency"]
+	}
+
+	runID := fmt.Sprintf("local-%d", time.Now().Unix())
+	localSync = newLocalSyncClient()
+	var g errgroup.Group
+	for i := 1; i <= *instances; i++ {
+		outputs := filepath.Join(*out, runID, "single", strconv.Itoa(i-1))
+		if err := os.MkdirAll(outputs, 0755); err != nil {
+			return err
+		}
+		instanceParams := make(map[string]string, len(params))
+		for k, v := range params {
+			instanceParams[k] = v
+		}
+		runenv := runtime.NewRunEnv(runtime.RunParams{
+			TestPlan:               "gossipsub",
+			TestCase:               *testcase,
+			TestRun:                runID,
+			TestOutputsPath:        outputs,
+			TestTempPath:           os.TempDir(),
+			TestInstanceCount:      *instances,
+			TestInstanceParams:     instanceParams,
+			TestGroupID:            "single",
+			TestGroupInstanceCount: *instances,
+			TestStartTime:          time.Now(),
+		})
+		initCtx := &run.InitContext{
+			SyncClient: localSync,
+			NetClient:  network.NewClient(localSync, runenv),
+			GlobalSeq:  int64(i),
+			GroupSeq:   int64(i),
+		}
+		g.Go(func() error {
+			defer runenv.Close()
+			return fn(runenv, initCtx)
+		})
+	}
+	err = g.Wait()
+	fmt.Printf("outputs written to %s\n", filepath.Join(*out, runID))
+	return err
+}
+
+// localParams collects the -p flags
+type localParams map[string]string
+
+func (p *localParams) String() string {
+	return fmt.Sprint(map[string]string(*p))
+}
+
+func (p *localParams) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("param %q must be name=value", s)
+	}
+	if *p == nil {
+		*p = make(localParams)
+	}
+	(*p)[parts[0]] = parts[1]
+	return nil
+}
+
+var manifestParamRe = regexp.MustCompile(`^\s*(\w+)\s*=\s*\{.*\bdefault\s*=\s*("(?:[^"\\]|\\.)*"|[^\s,}]+)`)
+var manifestNameRe = regexp.MustCompile(`^name\s*=\s*"([^"]*)"`)
+
+// manifestDefaults returns the default values of the params of a test case.
+// Params without a default are left unset.
+func manifestDefaults(path string, testcase string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest: %w", err)
+	}
+	defer f.Close()
+
+	params := make(map[string]string)
+	var inCase, inParams, found bool
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "[[testcases]]":
+			inCase, inParams = false, false
+			continue
+		case trimmed == "[testcases.params]":
+			inParams = inCase
+			continue
+		}
+		if m := manifestNameRe.FindStringSubmatch(line); m != nil {
+			inCase = m[1] == testcase
+			found = found || inCase
+			continue
+		}
+		if !inParams {
+			continue
+		}
+		m := manifestParamRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		val := m[2]
+		if strings.HasPrefix(val, "\"") {
+			if val, err = strconv.Unquote(val); err != nil {
+				return nil, fmt.Errorf("invalid default of param %s: %w", m[1], err)
+			}
+		}
+		params[m[1]] = val
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("test case %s is not in the manifest", testcase)
+	}
+	return params, nil
+}
+
+// localSyncClient is an in-memory sync service. Like the testground sync
+// service, payloads are encoded as json, so that every subscriber gets its own
+// copy, and subscribers are fed asynchronously.
+type localSyncClient struct {
+	lk       sync.Mutex
+	states   map[tgsync.State]int64
+	barriers map[tgsync.State][]localBarrier
+	topics   map[string]*localTopic
+}
+
+type localBarrier struct {
+	target int64
+	ch     chan error
+}
+
+type localTopic struct {
+	published [][]byte
+	// closed and replaced on every publish
+	changed chan struct{}
+}
+
+func newLocalSyncClient() *localSyncClient {
+	return &localSyncClient{
+		states:   make(map[tgsync.State]int64),
+		barriers: make(map[tgsync.State][]localBarrier),
+		topics:   make(map[string]*localTopic),
+	}
+}
+
+// topic returns the topic with the given key. The caller must hold lk.
+func (c *localSyncClient) topic(t *tgsync.Topic) *localTopic {
+	key := t.Key(&runtime.RunParams{})
+	lt, ok := c.topics[key]
+	if !ok {
+		lt = &localTopic{changed: make(chan struct{})}
+		c.topics[key] = lt
+	}
+	return lt
+}
+
+func (c *localSyncClient) Publish(_ context.Context, topic *tgsync.Topic, payload interface{}) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return -1, fmt.Errorf("error encoding payload: %w", err)
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	lt := c.topic(topic)
+	lt.published = append(lt.published, data)
+	close(lt.changed)
+	lt.changed = make(chan struct{})
+	return int64(len(lt.published)), nil
+}
+
+func (c *localSyncClient) Subscribe(ctx context.Context, topic *tgsync.Topic, ch interface{}) (*tgsync.Subscription, error) {
+	chv := reflect.ValueOf(ch)
+	if chv.Kind() != reflect.Chan || chv.Type().Elem().Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("subscription channel must be a channel of pointers")
+	}
+	typ := chv.Type().Elem().Elem()
+
+	go func() {
+		for next := 0; ; next++ {
+			c.lk.Lock()
+			lt := c.topic(topic)
+			for next >= len(lt.published) {
+				changed := lt.changed
+				c.lk.Unlock()
+				select {
+				case <-changed:
+				case <-ctx.Done():
+					return
+				}
+				c.lk.Lock()
+			}
+			data := lt.published[next]
+			c.lk.Unlock()
+
+			payload := reflect.New(typ)
+			if err := json.Unmarshal(data, payload.Interface()); err != nil {
+				continue
+			}
+			cases := []reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: chv, Send: payload},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			}
+			if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+				return
+			}
+		}
+	}()
+	return &tgsync.Subscription{}, nil
+}
+
+func (c *localSyncClient) PublishAndWait(ctx context.Context, topic *tgsync.Topic, payload interface{}, state tgsync.State, target int) (int64, error) {
+	seq, err := c.Publish(ctx, topic, payload)
+	if err != nil {
+		return -1, err
+	}
+	b, err := c.Barrier(ctx, state, target)
+	if err != nil {
+		return -1, err
+	}
+	return seq, <-b.C
+}
+
+func (c *localSyncClient) PublishSubscribe(ctx context.Context, topic *tgsync.Topic, payload interface{}, ch interface{}) (int64, *tgsync.Subscription, error) {
+	seq, err := c.Publish(ctx, topic, payload)
+	if err != nil {
+		return -1, nil, err
+	}
+	sub, err := c.Subscribe(ctx, topic, ch)
+	return seq, sub, err
+}
+
+func (c *localSyncClient) Barrier(ctx context.Context, state tgsync.State, target int) (*tgsync.Barrier, error) {
+	ch := make(chan error, 1)
+	c.lk.Lock()
+	if c.states[state] >= int64(target) {
+		ch <- nil
+	} else {
+		c.barriers[state] = append(c.barriers[state], localBarrier{target: int64(target), ch: ch})
+	}
+	c.lk.Unlock()
+
+	// the barrier fails when the context expires, like the testground one
+	out := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-ch:
+			out <- err
+		case <-ctx.Done():
+			out <- ctx.Err()
+		}
+	}()
+	return &tgsync.Barrier{C: out}, nil
+}
+
+func (c *localSyncClient) SignalEntry(_ context.Context, state tgsync.State) (int64, error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.states[state]++
+	count := c.states[state]
+	waiting := c.barriers[state][:0]
+	for _, b := range c.barriers[state] {
+		if count >= b.target {
+			b.ch <- nil
+			continue
+		}
+		waiting = append(waiting, b)
+	}
+	c.barriers[state] = waiting
+	return count, nil
+}
+
+func (c *localSyncClient) SignalAndWait(ctx context.Context, state tgsync.State, target int) (int64, error) {
+	seq, err := c.SignalEntry(ctx, state)
+	if err != nil {
+		return -1, err
+	}
+	b, err := c.Barrier(ctx, state, target)
+	if err != nil {
+		return -1, err
+	}
+	return seq, <-b.C
+}
+
+func (c *localSyncClient) MustBarrier(ctx context.Context, state tgsync.State, target int) *tgsync.Barrier {
+	b, err := c.Barrier(ctx, state, target)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (c *localSyncClient) MustSignalEntry(ctx context.Context, state tgsync.State) int64 {
+	seq, err := c.SignalEntry(ctx, state)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+func (c *localSyncClient) MustSubscribe(ctx context.Context, topic *tgsync.Topic, ch interface{}) *tgsync.Subscription {
+	sub, err := c.Subscribe(ctx, topic, ch)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+func (c *localSyncClient) MustPublish(ctx context.Context, topic *tgsync.Topic, payload interface{}) int64 {
+	seq, err := c.Publish(ctx, topic, payload)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+func (c *localSyncClient) MustPublishAndWait(ctx context.Context, topic *tgsync.Topic, payload interface{}, state tgsync.State, target int) int64 {
+	seq, err := c.PublishAndWait(ctx, topic, payload, state, target)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+func (c *localSyncClient) MustPublishSubscribe(ctx context.Context, topic *tgsync.Topic, payload interface{}, ch interface{}) (int64, *tgsync.Subscription) {
+	seq, sub, err := c.PublishSubscribe(ctx, topic, payload, ch)
+	if err != nil {
+		panic(err)
+	}
+	return seq, sub
+}
+
+func (c *localSyncClient) MustSignalAndWait(ctx context.Context, state tgsync.State, target int) int64 {
+	seq, err := c.SignalAndWait(ctx, state, target)
+	if err != nil {
+		panic(err)
+	}
+	return seq
+}
+
+func (c *localSyncClient) SignalEvent(context.Context, *runtime.Event) error {
+	return nil
+}
+
+func (c *localSyncClient) Close() error {
+	return nil
+}
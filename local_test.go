@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+const testManifest = `name = "gossip"
+
+[defaults]
+builder = "exec:go"
+
+[[testcases]]
+name = "test"
+instances = { min = 2, max = 500, default = 100 }
+  [testcases.params]
+  # a comment = { default = "ignored" }
+  t_run = { type = "duration", desc = "how long to publish", default="2m" }
+  n_topics = { type = "int", desc = "number of topics", default=1 }
+  gossip_factor = { type = "float", desc = "gossip factor", default = 0.25 }
+  transport = { type = "string", desc = "tcp, quic, ws or webtransport", default="" }
+  topics = { type = "json", desc = "topics, eg [{\"id\":\"a\"}]", default="[{\"id\":\"blocks\", \"message_rate\":\"1/s\"}]" }
+  summary = { type = "bool", desc = "write the summary", default=false }
+  score_params = { type = "json", desc = "no default" }
+
+[[testcases]]
+name = "observe"
+instances = { min = 2, max = 10000, default = 100 }
+  [testcases.params]
+  t_run = { type = "duration", desc = "how long to observe", default="10m" }
+`
+
+func TestManifestDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.toml")
+	if err := os.WriteFile(path, []byte(testManifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		testcase string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "first testcase",
+			testcase: "test",
+			want: map[string]string{
+				"t_run":         "2m",
+				"n_topics":      "1",
+				"gossip_factor": "0.25",
+				"transport":     "",
+				"topics":        `[{"id":"blocks", "message_rate":"1/s"}]`,
+				"summary":       "false",
+			},
+		},
+		{
+			name:     "other testcase",
+			testcase: "observe",
+			want:     map[string]string{"t_run": "10m"},
+		},
+		{
+			name:     "unknown testcase",
+			testcase: "missing",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := manifestDefaults(path, tt.testcase)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestDefaultsOfPlan(t *testing.T) {
+	params, err := manifestDefaults("manifest.toml", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"t_run", "t_latency", "validate_delay_ms", "transport", "summary"} {
+		if _, ok := params[name]; !ok {
+			t.Errorf("param %s has no default", name)
+		}
+	}
+}
+
+func TestLocalParams(t *testing.T) {
+	tests := []struct {
+		flags   []string
+		want    localParams
+		wantErr bool
+	}{
+		{flags: []string{"t_run=30s"}, want: localParams{"t_run": "30s"}},
+		{flags: []string{"topics=[{\"id\":\"a=b\"}]"}, want: localParams{"topics": `[{"id":"a=b"}]`}},
+		{flags: []string{"transport="}, want: localParams{"transport": ""}},
+		{flags: []string{"t_run=30s", "t_run=1m"}, want: localParams{"t_run": "1m"}},
+		{flags: []string{"t_run"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		var p localParams
+		var err error
+		for _, f := range tt.flags {
+			if err = p.Set(f); err != nil {
+				break
+			}
+		}
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.flags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", tt.flags, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.flags, p, tt.want)
+		}
+	}
+}
+
+// barrierDone returns the result of the barrier, or false if it is still
+// waiting after a short while
+func barrierDone(b *tgsync.Barrier) (bool, error) {
+	select {
+	case err := <-b.C:
+		return true, err
+	case <-time.After(50 * time.Millisecond):
+		return false, nil
+	}
+}
+
+func TestLocalSyncBarrier(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   int
+		target   int
+		after    int
+		wantDone bool
+	}{
+		{name: "reached before", before: 3, target: 3, wantDone: true},
+		{name: "exceeded before", before: 4, target: 3, wantDone: true},
+		{name: "reached after", before: 1, target: 3, after: 2, wantDone: true},
+		{name: "not reached", before: 1, target: 3, after: 1, wantDone: false},
+		{name: "zero target", target: 0, wantDone: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := newLocalSyncClient()
+			state := tgsync.State("ready")
+			for i := 0; i < tt.before; i++ {
+				c.MustSignalEntry(ctx, state)
+			}
+			b := c.MustBarrier(ctx, state, tt.target)
+			for i := 0; i < tt.after; i++ {
+				c.MustSignalEntry(ctx, state)
+			}
+			done, err := barrierDone(b)
+			if done != tt.wantDone {
+				t.Fatalf("barrier done %t, want %t", done, tt.wantDone)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLocalSyncBarrierContext(t *testing.T) {
+	c := newLocalSyncClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := c.MustBarrier(ctx, "ready", 2)
+	cancel()
+	done, err := barrierDone(b)
+	if !done || err != context.Canceled {
+		t.Fatalf("barrier returned %v (done %t), want %v", err, done, context.Canceled)
+	}
+}
+
+func TestLocalSyncSignalAndWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := newLocalSyncClient()
+
+	const instances = 5
+	seqs := make(chan int64, instances)
+	for i := 0; i < instances; i++ {
+		go func() {
+			seqs <- c.MustSignalAndWait(ctx, "ready", instances)
+		}()
+	}
+	seen := make(map[int64]bool, instances)
+	for i := 0; i < instances; i++ {
+		select {
+		case seq := <-seqs:
+			seen[seq] = true
+		case <-ctx.Done():
+			t.Fatalf("only %d instances passed the barrier", i)
+		}
+	}
+	for seq := int64(1); seq <= instances; seq++ {
+		if !seen[seq] {
+			t.Errorf("no instance signalled with seq %d", seq)
+		}
+	}
+}
+
+type testPayload struct {
+	Seq   int
+	Peers []string
+}
+
+func TestLocalSyncTopic(t *testing.T) {
+	tests := []struct {
+		name string
+		// payloads published before and after subscribing
+		before []testPayload
+		after  []testPayload
+	}{
+		{name: "published before", before: []testPayload{{Seq: 1}, {Seq: 2, Peers: []string{"a"}}}},
+		{name: "published after", after: []testPayload{{Seq: 1}, {Seq: 2}}},
+		{name: "both", before: []testPayload{{Seq: 1}}, after: []testPayload{{Seq: 2}, {Seq: 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c := newLocalSyncClient()
+			topic := tgsync.NewTopic("payloads", &testPayload{})
+			other := tgsync.NewTopic("other", &testPayload{})
+
+			var seq int64
+			for _, p := range tt.before {
+				seq = c.MustPublish(ctx, topic, p)
+			}
+			c.MustPublish(ctx, other, testPayload{Seq: 100})
+			ch := make(chan *testPayload)
+			c.MustSubscribe(ctx, topic, ch)
+			for _, p := range tt.after {
+				seq = c.MustPublish(ctx, topic, p)
+			}
+
+			want := append(append([]testPayload(nil), tt.before...), tt.after...)
+			if seq != int64(len(want)) {
+				t.Fatalf("last publish returned seq %d, want %d", seq, len(want))
+			}
+			for _, w := range want {
+				select {
+				case got := <-ch:
+					if !reflect.DeepEqual(*got, w) {
+						t.Fatalf("got %v, want %v", *got, w)
+					}
+				case <-ctx.Done():
+					t.Fatalf("payload %v not received", w)
+				}
+			}
+			select {
+			case got := <-ch:
+				t.Fatalf("unexpected payload %v", *got)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestLocalSyncTopicCopies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := newLocalSyncClient()
+	topic := tgsync.NewTopic("payloads", &testPayload{})
+	c.MustPublish(ctx, topic, testPayload{Seq: 1, Peers: []string{"a"}})
+
+	ch1, ch2 := make(chan *testPayload, 1), make(chan *testPayload, 1)
+	c.MustSubscribe(ctx, topic, ch1)
+	c.MustSubscribe(ctx, topic, ch2)
+	p1, p2 := <-ch1, <-ch2
+	p1.Peers[0] = "changed"
+	if p2.Peers[0] != "a" {
+		t.Fatalf("subscribers share their payloads")
+	}
+}
+
+func TestLocalSyncSubscribeInvalidChannel(t *testing.T) {
+	c := newLocalSyncClient()
+	topic := tgsync.NewTopic("payloads", &testPayload{})
+	if _, err := c.Subscribe(context.Background(), topic, make(chan testPayload)); err == nil {
+		t.Fatal("expected an error subscribing with a channel of values")
+	}
+}
@@ -1,13 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/testground/sdk-go/run"
 )
 
 var testcases = map[string]interface{}{
-	"test": run.InitializedTestCaseFn(test),
+	"test":    run.InitializedTestCaseFn(test),
+	"observe": run.InitializedTestCaseFn(observe),
 }
 
 func main() {
+	// go run . local [flags] runs the plan without testground
+	if len(os.Args) > 1 && os.Args[1] == "local" {
+		if err := runLocal(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	run.InvokeMap(testcases)
 }
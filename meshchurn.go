@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// meshChurnCounter counts the local GRAFT and PRUNE events from the start of
+// the run, leaving out the mesh formation during the warmup
+type meshChurnCounter struct {
+	start  time.Time
+	grafts int64
+	prunes int64
+}
+
+// startMeshChurn marks the start of the mesh churn measurement
+func (p *PubsubNode) startMeshChurn() {
+	tracer := p.testTracer()
+	if tracer == nil {
+		return
+	}
+	p.meshChurn.start = time.Now()
+	p.meshChurn.grafts, p.meshChurn.prunes = tracer.MeshChanges()
+}
+
+// meshChurnPerMin returns the number of GRAFT and PRUNE events per minute
+// since the start of the run
+func (p *PubsubNode) meshChurnPerMin() float64 {
+	tracer := p.testTracer()
+	if tracer == nil || p.meshChurn.start.IsZero() {
+		return 0
+	}
+	mins := time.Since(p.meshChurn.start).Minutes()
+	if mins <= 0 {
+		return 0
+	}
+	grafts, prunes := tracer.MeshChanges()
+	return float64(grafts-p.meshChurn.grafts+prunes-p.meshChurn.prunes) / mins
+}
+
+// summarizeMeshChurn computes the distribution of the mesh churn of the honest
+// nodes
+func summarizeMeshChurn(reports []NodeReport) outputs.MeshChurn {
+	var churn []float64
+	for _, r := range reports {
+		if !r.Attacker {
+			churn = append(churn, r.MeshChurnPerMin)
+		}
+	}
+	s := outputs.MeshChurn{Nodes: len(churn)}
+	if len(churn) == 0 {
+		return s
+	}
+	sort.Float64s(churn)
+
+	var total float64
+	for _, c := range churn {
+		total += c
+	}
+	percentile := func(pct float64) float64 {
+		return churn[int(pct*float64(len(churn)-1))]
+	}
+	s.MeanPerMin = total / float64(len(churn))
+	s.P50PerMin = percentile(0.5)
+	s.P90PerMin = percentile(0.9)
+	s.P99PerMin = percentile(0.99)
+	s.MaxPerMin = churn[len(churn)-1]
+	return s
+}
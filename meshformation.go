@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// MeshFormationReport is shared by every node with the leader at the end of a
+// run without summary, for the network wide mesh formation times
+type MeshFormationReport struct {
+	Seq             int64
+	Attacker        bool
+	MeshFormationMs map[string]float64
+}
+
+var MeshFormationTopic = tgsync.NewTopic("mesh-formation", &MeshFormationReport{})
+
+// connTimer records when the host established its first connection
+type connTimer struct {
+	lk    sync.Mutex
+	first time.Time
+}
+
+func (c *connTimer) notifiee() lnetwork.Notifiee {
+	return &lnetwork.NotifyBundle{
+		ConnectedF: func(lnetwork.Network, lnetwork.Conn) {
+			c.lk.Lock()
+			defer c.lk.Unlock()
+			if c.first.IsZero() {
+				c.first = time.Now()
+			}
+		},
+	}
+}
+
+func (c *connTimer) First() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.first
+}
+
+// startMeshFormationTimer starts tracking the time it takes for the meshes to
+// reach D peers. Must be called before connecting to any peer.
+func (p *PubsubNode) startMeshFormationTimer() {
+	p.h.Network().Notify(p.firstConn.notifiee())
+	if tracer := p.testTracer(); tracer != nil {
+		tracer.SetMeshTarget(gossipSubParams(p.cfg).D)
+	}
+}
+
+// meshFormationTimes returns the time from the first connection until the mesh
+// of each topic reached D peers, in milliseconds. Topics whose mesh never
+// reached D are left out.
+func (p *PubsubNode) meshFormationTimes() map[string]float64 {
+	times := make(map[string]float64)
+	tracer := p.testTracer()
+	first := p.firstConn.First()
+	if tracer == nil || first.IsZero() {
+		return times
+	}
+	for topic, ts := range tracer.MeshFormed() {
+		times[topic] = float64(time.Unix(0, ts).Sub(first)) / float64(time.Millisecond)
+	}
+	return times
+}
+
+// recordMeshFormation records the node's mesh formation times as metrics
+func (p *PubsubNode) recordMeshFormation() {
+	times := p.meshFormationTimes()
+	d := gossipSubParams(p.cfg).D
+	for _, t := range p.cfg.Topics {
+		ms, ok := times[t.Id]
+		if !ok {
+			p.log("mesh for topic %s never reached D=%d peers", t.Id, d)
+			continue
+		}
+		p.runenv.R().RecordPoint("time_to_mesh_ms_"+t.Id, ms)
+	}
+}
+
+// reportMeshFormation shares the node's mesh formation times with the leader,
+// which writes their network wide distribution. The run summary carries them
+// in the node reports instead.
+func (p *PubsubNode) reportMeshFormation() error {
+	report := MeshFormationReport{
+		Seq:             p.seq,
+		Attacker:        p.cfg.Attacker || p.cfg.Lazy,
+		MeshFormationMs: p.meshFormationTimes(),
+	}
+	if _, err := p.client.Publish(p.ctx, MeshFormationTopic, &report); err != nil {
+		return fmt.Errorf("failed to publish mesh formation report: %w", err)
+	}
+
+	if p.seq != 1 {
+		return nil
+	}
+
+	reports, err := collectMeshFormationReports(p.ctx, p.runenv, p.client)
+	if err != nil {
+		return err
+	}
+	return p.writeMeshFormation(summarizeMeshFormation(reports))
+}
+
+func collectMeshFormationReports(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client) ([]MeshFormationReport, error) {
+	reportCh := make(chan *MeshFormationReport, 16)
+	sctx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	if _, err := client.Subscribe(sctx, MeshFormationTopic, reportCh); err != nil {
+		return nil, err
+	}
+
+	reports := make([]MeshFormationReport, 0, runenv.TestInstanceCount)
+	for len(reports) < runenv.TestInstanceCount {
+		select {
+		case r, ok := <-reportCh:
+			if !ok {
+				return nil, fmt.Errorf("not enough mesh formation reports. expected %d, got %d", runenv.TestInstanceCount, len(reports))
+			}
+			reports = append(reports, *r)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return reports, nil
+}
+
+// writeMeshFormation writes the network wide mesh formation times, and records
+// their percentiles for each topic
+func (p *PubsubNode) writeMeshFormation(formation map[string]outputs.MeshFormation) error {
+	for topic, f := range formation {
+		p.runenv.R().RecordPoint("mesh_formation_p50_ms_"+topic, f.TimeMs.P50Ms)
+		p.runenv.R().RecordPoint("mesh_formation_p90_ms_"+topic, f.TimeMs.P90Ms)
+		p.runenv.R().RecordPoint("mesh_formation_p99_ms_"+topic, f.TimeMs.P99Ms)
+		p.runenv.R().RecordPoint("mesh_formation_formed_"+topic, float64(f.Formed))
+	}
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.MeshFormationFile)
+	jsonstr, err := json.MarshalIndent(formation, "", "  ")
+	if err != nil {
+		return err
+	}
+	p.log("writing mesh formation times to %s", path)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
+
+// meshFormationReports extracts the mesh formation times of the node reports
+func meshFormationReports(reports []NodeReport) []MeshFormationReport {
+	out := make([]MeshFormationReport, 0, len(reports))
+	for _, r := range reports {
+		out = append(out, MeshFormationReport{Seq: r.Seq, Attacker: r.Attacker, MeshFormationMs: r.MeshFormationMs})
+	}
+	return out
+}
+
+// summarizeMeshFormation computes the network wide distribution of the mesh
+// formation times of the honest nodes, for each topic
+func summarizeMeshFormation(reports []MeshFormationReport) map[string]outputs.MeshFormation {
+	times := make(map[string][]float64)
+	honest := 0
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		honest++
+		for topic, ms := range r.MeshFormationMs {
+			times[topic] = append(times[topic], ms)
+		}
+	}
+
+	topics := make([]string, 0, len(times))
+	for topic := range times {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	formation := make(map[string]outputs.MeshFormation, len(topics))
+	for _, topic := range topics {
+		formation[topic] = outputs.MeshFormation{
+			Nodes:  honest,
+			Formed: len(times[topic]),
+			TimeMs: latencyStats(times[topic]),
+		}
+	}
+	return formation
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// runMeshSnapshots writes the mesh of every joined topic to
+// mesh-snapshots-<seq>.json every interval until the end of the run. The
+// snapshots are aligned on the wall clock, so that the leader can join the
+// snapshots taken by all the nodes at the same time.
+func (p *PubsubNode) runMeshSnapshots(interval time.Duration) {
+	tracer := p.testTracer()
+	if tracer == nil {
+		p.log("mesh snapshots require the test tracer")
+		return
+	}
+	path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.MeshSnapshotsPrefix, p.seq)
+	f, err := os.Create(path)
+	if err != nil {
+		p.log("error creating mesh snapshots file: %s", err)
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+
+	next := time.Now().Truncate(interval).Add(interval)
+	for {
+		select {
+		case <-time.After(time.Until(next)):
+		case <-p.ctx.Done():
+			return
+		}
+		snapshot := outputs.MeshSnapshot{
+			Version:   outputs.SchemaVersion,
+			Timestamp: next,
+			Seq:       p.seq,
+			Mesh:      make(map[string][]int64),
+		}
+		for _, t := range p.cfg.Topics {
+			var seqs []int64
+			for _, pid := range tracer.MeshPeers(t.Id) {
+				if seq := p.discovery.SeqOf(pid); seq >= 0 {
+					seqs = append(seqs, seq)
+				}
+			}
+			sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+			snapshot.Mesh[t.Id] = seqs
+		}
+		if err := enc.Encode(snapshot); err != nil {
+			p.log("error writing mesh snapshot: %s", err)
+		}
+		p.snapshotsLk.Lock()
+		p.meshSnapshots = append(p.meshSnapshots, snapshot)
+		p.snapshotsLk.Unlock()
+		next = next.Add(interval)
+	}
+}
+
+// takenMeshSnapshots returns the mesh snapshots taken so far
+func (p *PubsubNode) takenMeshSnapshots() []outputs.MeshSnapshot {
+	p.snapshotsLk.Lock()
+	defer p.snapshotsLk.Unlock()
+	return append([]outputs.MeshSnapshot(nil), p.meshSnapshots...)
+}
+
+// buildMeshGraph joins the mesh snapshots of all the nodes into the global
+// mesh of each topic at every snapshot time
+func buildMeshGraph(reports []NodeReport, interval time.Duration) outputs.MeshGraph {
+	graph := outputs.MeshGraph{
+		Version:    outputs.SchemaVersion,
+		IntervalMs: float64(interval) / float64(time.Millisecond),
+	}
+
+	byTime := make(map[int64][]outputs.MeshSnapshot)
+	for _, r := range reports {
+		for _, s := range r.MeshSnapshots {
+			ts := s.Timestamp.UnixNano()
+			byTime[ts] = append(byTime[ts], s)
+		}
+	}
+	times := make([]int64, 0, len(byTime))
+	for ts := range byTime {
+		times = append(times, ts)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	for _, ts := range times {
+		snapshots := byTime[ts]
+		gs := outputs.MeshGraphSnapshot{
+			Timestamp: time.Unix(0, ts),
+			Nodes:     len(snapshots),
+			Topics:    make(map[string]*outputs.MeshGraphTopic),
+		}
+		// mesh membership, by topic then by pair of nodes
+		members := make(map[string]map[[2]int64]bool)
+		for _, s := range snapshots {
+			for topic, seqs := range s.Mesh {
+				if members[topic] == nil {
+					members[topic] = make(map[[2]int64]bool)
+				}
+				for _, seq := range seqs {
+					members[topic][[2]int64{s.Seq, seq}] = true
+				}
+			}
+		}
+		for topic, pairs := range members {
+			gt := &outputs.MeshGraphTopic{}
+			for pair := range pairs {
+				gt.Edges = append(gt.Edges, outputs.TopologyEdge{From: pair[0], To: pair[1]})
+				if !pairs[[2]int64{pair[1], pair[0]}] {
+					gt.Asymmetric++
+				}
+			}
+			sort.Slice(gt.Edges, func(i, j int) bool {
+				if gt.Edges[i].From != gt.Edges[j].From {
+					return gt.Edges[i].From < gt.Edges[j].From
+				}
+				return gt.Edges[i].To < gt.Edges[j].To
+			})
+			gs.Topics[topic] = gt
+		}
+		graph.Snapshots = append(graph.Snapshots, gs)
+	}
+	return graph
+}
+
+// writeMeshGraph writes the global mesh over time to mesh-graph.json
+func (p *PubsubNode) writeMeshGraph(reports []NodeReport) error {
+	graph := buildMeshGraph(reports, p.cfg.MeshSnapshotInterval)
+	jsonstr, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.MeshGraphFile)
+	p.log("writing %d mesh snapshots to %s", len(graph.Snapshots), path)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
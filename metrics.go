@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// metricsLoop periodically records network health metrics through the runenv,
+// so that the Testground dashboard shows them while the test is running
+func (p *PubsubNode) metricsLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	var last LiveCounts
+	if tracer := p.testTracer(); tracer != nil {
+		last = tracer.LiveCounts()
+	}
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.recordHealthMetrics()
+			last = p.recordLiveRates(last)
+		}
+	}
+}
+
+// LiveCounts are the message counters sampled by the metrics loop
+type LiveCounts struct {
+	At         time.Time
+	Delivered  uint64
+	Duplicates uint64
+	// messages in the validation pipeline. The router doesn't expose its
+	// validation queue, which its workers drain into the asynchronous
+	// validators, so these are the messages that entered a validator and
+	// weren't delivered or rejected yet.
+	Validating uint64
+}
+
+// recordLiveRates records the messages delivered and the duplicates received
+// per second since the previous sample, and the pending validations. It
+// returns the new sample.
+func (p *PubsubNode) recordLiveRates(last LiveCounts) LiveCounts {
+	tracer := p.testTracer()
+	if tracer == nil {
+		return last
+	}
+	now := tracer.LiveCounts()
+	p.runenv.R().RecordPoint("validation_pending", float64(now.Validating))
+	if secs := now.At.Sub(last.At).Seconds(); secs > 0 {
+		p.runenv.R().RecordPoint("messages_delivered_per_sec", float64(now.Delivered-last.Delivered)/secs)
+		p.runenv.R().RecordPoint("duplicates_per_sec", float64(now.Duplicates-last.Duplicates)/secs)
+	}
+	return now
+}
+
+func (p *PubsubNode) recordHealthMetrics() {
+	p.runenv.R().RecordPoint("peers_connected", float64(len(p.h.Network().Peers())))
+
+	if p.cfg.Bandwidth != nil {
+		bw := p.cfg.Bandwidth.GetBandwidthTotals()
+		p.runenv.R().RecordPoint("bandwidth_out_bytes_per_sec", bw.RateOut)
+		p.runenv.R().RecordPoint("bandwidth_in_bytes_per_sec", bw.RateIn)
+	}
+
+	if tracer := p.testTracer(); tracer != nil {
+		for _, topic := range p.ps.GetTopics() {
+			p.runenv.R().RecordPoint("mesh_size_"+topic, float64(tracer.MeshSize(topic)))
+		}
+	}
+
+	scores := p.peerScores()
+	if len(scores) == 0 {
+		return
+	}
+	summary := summarizeScores(scores)
+	p.runenv.R().RecordPoint("score_min", summary.Min)
+	p.runenv.R().RecordPoint("score_median", summary.Median)
+	p.runenv.R().RecordPoint("score_mean", summary.Mean)
+	p.runenv.R().RecordPoint("score_max", summary.Max)
+	p.runenv.R().RecordPoint("score_negative", float64(summary.Negative))
+
+	th := p.cfg.PeerScoreParams.Thresholds
+	crossed := countBelowThresholds(scores, th)
+	p.runenv.R().RecordPoint("peers_below_gossip_threshold", float64(crossed.Gossip))
+	p.runenv.R().RecordPoint("peers_below_publish_threshold", float64(crossed.Publish))
+	p.runenv.R().RecordPoint("peers_below_graylist_threshold", float64(crossed.Graylist))
+}
+
+// ThresholdCounts is the number of peers whose score is below each threshold
+type ThresholdCounts struct {
+	Gossip   int
+	Publish  int
+	Graylist int
+}
+
+func countBelowThresholds(scores map[peer.ID]float64, th PeerScoreThresholds) ThresholdCounts {
+	var c ThresholdCounts
+	for _, score := range scores {
+		if score < th.GossipThreshold {
+			c.Gossip++
+		}
+		if score < th.PublishThreshold {
+			c.Publish++
+		}
+		if score < th.GraylistThreshold {
+			c.Graylist++
+		}
+	}
+	return c
+}
+
+// inspectScores is called periodically by the pubsub router with the scores
+// of all connected peers
+func (p *PubsubNode) inspectScores(scores map[peer.ID]float64) {
+	p.scoresLk.Lock()
+	defer p.scoresLk.Unlock()
+	p.scores = scores
+
+	if p.scoresOut == nil {
+		return
+	}
+	sample := outputs.ScoreSample{
+		Version:   outputs.SchemaVersion,
+		Timestamp: time.Now(),
+		PeerID:    p.h.ID().String(),
+		Scores:    make(map[string]float64, len(scores)),
+	}
+	for pid, score := range scores {
+		sample.Scores[pid.String()] = score
+	}
+	if err := json.NewEncoder(p.scoresOut).Encode(sample); err != nil {
+		p.log("error writing peer scores: %s", err)
+	}
+}
+
+// openScoreSamples creates the file the peer score samples are written to
+func (p *PubsubNode) openScoreSamples() error {
+	path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.PeerScoresPrefix, p.seq)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating peer scores file: %w", err)
+	}
+	p.scoresOut = f
+	return nil
+}
+
+func (p *PubsubNode) closeScoreSamples() {
+	p.scoresLk.Lock()
+	defer p.scoresLk.Unlock()
+	if p.scoresOut != nil {
+		p.scoresOut.Close()
+		p.scoresOut = nil
+	}
+}
+
+// peerScores returns the most recent score for each connected peer
+func (p *PubsubNode) peerScores() map[peer.ID]float64 {
+	p.scoresLk.RLock()
+	defer p.scoresLk.RUnlock()
+	return p.scores
+}
+
+type ScoreSummary struct {
+	Min      float64
+	Median   float64
+	Mean     float64
+	Max      float64
+	Negative int
+}
+
+func summarizeScores(scores map[peer.ID]float64) ScoreSummary {
+	var s ScoreSummary
+	if len(scores) == 0 {
+		return s
+	}
+
+	vals := make([]float64, 0, len(scores))
+	var total float64
+	for _, score := range scores {
+		vals = append(vals, score)
+		total += score
+		if score < 0 {
+			s.Negative++
+		}
+	}
+	sort.Float64s(vals)
+
+	s.Min = vals[0]
+	s.Max = vals[len(vals)-1]
+	s.Median = vals[len(vals)/2]
+	s.Mean = total / float64(len(vals))
+	return s
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// MisconfigParams describe a cohort of honest nodes running with operator
+// misconfiguration. Zero values leave the corresponding setting untouched. A
+// misconfigured D also moves the other degrees of the cohort, so that an
+// absurdly small or large D still makes a router gossipsub accepts.
+type MisconfigParams struct {
+	// Percentage of nodes that are misconfigured
+	Pct int
+
+	D                 int
+	Heartbeat         time.Duration
+	ValidateQueueSize int
+	OutboundQueueSize int
+}
+
+// applies returns true if the node with the given sequence number belongs to
+// the misconfigured cohort
+func (m MisconfigParams) applies(seq int64, instances int) bool {
+	return inCohort(seq, instances, m.Pct)
+}
+
+// inCohort returns true if the node with the given sequence number belongs to a
+// cohort made of pct percent of the nodes. Cohorts are made of the highest
+// sequence numbers, so that they never include the publisher (seq 1).
+func inCohort(seq int64, instances int, pct int) bool {
+	if pct <= 0 {
+		return false
+	}
+	n := int64(math.Round(float64(instances) * float64(pct) / 100))
+	return seq > 1 && seq > int64(instances)-n
+}
+
+// apply overrides the node config with the misconfigured values
+func (m MisconfigParams) apply(cfg *NodeConfig) {
+	if m.D > 0 {
+		cfg.OverlayParams = m.overlay(cfg.OverlayParams)
+	}
+	if m.Heartbeat > 0 {
+		cfg.Heartbeat.Interval = m.Heartbeat
+	}
+	if m.ValidateQueueSize > 0 {
+		cfg.ValidateQueueSize = m.ValidateQueueSize
+	}
+	if m.OutboundQueueSize > 0 {
+		cfg.OutboundQueueSize = m.OutboundQueueSize
+	}
+}
+
+// overlay returns the overlay params of the cohort: the misconfigured D, with
+// the watermarks around it, and Dscore and Dout within the bounds gossipsub
+// expects of it
+func (m MisconfigParams) overlay(o OverlayParams) OverlayParams {
+	params := o.gossipSubParams()
+	o.d = m.D
+	o.dlo = params.Dlo
+	if o.dlo > m.D {
+		o.dlo = m.D
+	}
+	o.dhi = params.Dhi
+	if o.dhi < m.D {
+		o.dhi = m.D
+	}
+	o.dscore = params.Dscore
+	if o.dscore > m.D {
+		o.dscore = m.D
+	}
+	o.dout = params.Dout
+	if o.dout >= o.dlo {
+		o.dout = o.dlo - 1
+	}
+	if o.dout > m.D/2 {
+		o.dout = m.D / 2
+	}
+	if o.dout < 0 {
+		o.dout = 0
+	}
+	return o
+}
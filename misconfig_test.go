@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestInCohort(t *testing.T) {
+	tests := []struct {
+		instances int
+		pct       int
+		want      []int64
+	}{
+		{instances: 10, pct: 0},
+		{instances: 10, pct: 20, want: []int64{9, 10}},
+		{instances: 10, pct: 25, want: []int64{8, 9, 10}},
+		{instances: 4, pct: 10},
+		// the publisher is never part of a cohort
+		{instances: 4, pct: 100, want: []int64{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		var got []int64
+		for seq := int64(1); seq <= int64(tt.instances); seq++ {
+			if inCohort(seq, tt.instances, tt.pct) {
+				got = append(got, seq)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%d%% of %d instances: got %v, want %v", tt.pct, tt.instances, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%d%% of %d instances: got %v, want %v", tt.pct, tt.instances, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMisconfigOverlay(t *testing.T) {
+	tests := []struct {
+		name string
+		d    int
+		set  func(o *OverlayParams)
+	}{
+		{name: "absurdly small", d: 1},
+		{name: "small", d: 3},
+		{name: "absurdly large", d: 50},
+		{name: "below the run's dlo", d: 2, set: func(o *OverlayParams) { o.d, o.dlo, o.dhi, o.dscore, o.dout = 8, 6, 12, 5, 3 }},
+		{name: "above the run's dhi", d: 16, set: func(o *OverlayParams) { o.d, o.dlo, o.dhi, o.dscore, o.dout = 8, 6, 12, 5, 3 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := unsetOverlay()
+			if tt.set != nil {
+				tt.set(&o)
+			}
+			cfg := NodeConfig{OverlayParams: o}
+			MisconfigParams{Pct: 10, D: tt.d}.apply(&cfg)
+			if err := cfg.OverlayParams.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.OverlayParams.gossipSubParams().D; got != tt.d {
+				t.Fatalf("got D %d, want %d", got, tt.d)
+			}
+		})
+	}
+}
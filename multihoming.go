@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+	"github.com/testground/sdk-go/runtime"
+
+	"gossipsub_testplan/outputs"
+)
+
+// MultihomingParams give a cohort of nodes a second data network interface.
+// The testground data network has a single interface, so the multi-homed
+// nodes listen and advertise on both its IPv4 and IPv6 addresses, and the
+// IPv6 one is shaped with the profile of the second interface by every node.
+type MultihomingParams struct {
+	// percentage of the nodes, with the highest sequence numbers
+	Pct int
+	// shape of the second interface on top of the default link shape
+	Profile NetChange
+}
+
+func (m MultihomingParams) enabled() bool {
+	return m.Pct > 0
+}
+
+// parseLinkProfile parses the settings of a link shape, eg
+// "latency=150ms,bandwidth=10"
+func parseLinkProfile(profile string) (NetChange, error) {
+	var c NetChange
+	for _, kv := range strings.Split(profile, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return c, fmt.Errorf("invalid setting %q of link profile %q", kv, profile)
+		}
+		if err := c.set(strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])); err != nil {
+			return c, fmt.Errorf("invalid setting %q of link profile %q: %w", kv, profile, err)
+		}
+	}
+	return c, nil
+}
+
+// configureMultihoming adds the rules shaping the second interfaces: the
+// IPv6 traffic of a multi-homed node, and the traffic of every node to the
+// IPv6 addresses of the multi-homed ones
+func configureMultihoming(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, config *network.Config, params MultihomingParams, local LinkMetadata, remote []PeerRegistration) error {
+	shape := config.Default
+	params.Profile.apply(&shape)
+
+	var rules []network.LinkRule
+	if local.SecondaryIP != nil {
+		rules = append(rules, network.LinkRule{
+			LinkShape: shape,
+			Subnet:    ptypes.IPNet{IPNet: net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}},
+		})
+	}
+	for _, r := range remote {
+		ip := r.Link.SecondaryIP
+		if ip == nil || ip.Equal(local.SecondaryIP) {
+			continue
+		}
+		rules = append(rules, network.LinkRule{
+			LinkShape: shape,
+			Subnet:    ptypes.IPNet{IPNet: net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}},
+		})
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	cfg := *config
+	cfg.Rules = append(append([]network.LinkRule(nil), config.Rules...), rules...)
+	cfg.CallbackState = "multihoming-configured"
+	runenv.RecordMessage("Shaping %d second interface links with %+v", len(rules), shape)
+	if err := netclient.ConfigureNetwork(ctx, &cfg); err != nil {
+		return err
+	}
+	*config = cfg
+	return nil
+}
+
+// MultihomingReport is the part of the node report of a multi-homed node:
+// its connections and mesh peers over each of its interfaces
+type MultihomingReport struct {
+	PrimaryConns       int
+	SecondaryConns     int
+	PrimaryMeshPeers   int
+	SecondaryMeshPeers int
+}
+
+// multihomingReport counts the connections and mesh peers of the node over
+// its primary (IPv4) and second (IPv6) interface
+func (p *PubsubNode) multihomingReport() *MultihomingReport {
+	report := &MultihomingReport{}
+	report.PrimaryConns, report.SecondaryConns = connsByFamily(p.h.Network().Conns())
+
+	tracer := p.testTracer()
+	if tracer == nil {
+		return report
+	}
+	for _, t := range p.cfg.Topics {
+		for _, pid := range tracer.MeshPeers(t.Id) {
+			v4, v6 := connsByFamily(p.h.Network().ConnsToPeer(pid))
+			if v6 > 0 {
+				report.SecondaryMeshPeers++
+			} else if v4 > 0 {
+				report.PrimaryMeshPeers++
+			}
+		}
+	}
+	return report
+}
+
+// summarizeMultihoming adds up the interfaces used by the multi-homed nodes
+func summarizeMultihoming(reports []NodeReport) *outputs.Multihoming {
+	s := &outputs.Multihoming{}
+	for _, r := range reports {
+		if r.Multihoming == nil {
+			continue
+		}
+		s.Nodes++
+		s.PrimaryConns += r.Multihoming.PrimaryConns
+		s.SecondaryConns += r.Multihoming.SecondaryConns
+		s.PrimaryMeshPeers += r.Multihoming.PrimaryMeshPeers
+		s.SecondaryMeshPeers += r.Multihoming.SecondaryMeshPeers
+	}
+	if conns := s.PrimaryConns + s.SecondaryConns; conns > 0 {
+		s.SecondaryConnShare = float64(s.SecondaryConns) / float64(conns)
+	}
+	if peers := s.PrimaryMeshPeers + s.SecondaryMeshPeers; peers > 0 {
+		s.SecondaryMeshShare = float64(s.SecondaryMeshPeers) / float64(peers)
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/testground/sdk-go/network"
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+// NetChange changes the shape of all the links of every node At an offset
+// from the start of the run. Unset fields are left as they are.
+type NetChange struct {
+	At          time.Duration
+	Latency     *time.Duration
+	Jitter      *time.Duration
+	BandwidthMB *int
+	LossPct     *float64
+	CorruptPct  *float64
+}
+
+// parseNetChanges parses a schedule of network changes separated by
+// semicolons, eg "60s:latency=300ms,bandwidth=10;120s:latency=5ms,bandwidth=100"
+func parseNetChanges(schedule string) ([]NetChange, error) {
+	var changes []NetChange
+	for _, entry := range strings.Split(schedule, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("network change %q must be <offset>:<key>=<value>,...", entry)
+		}
+		at, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset of network change %q: %w", entry, err)
+		}
+		c := NetChange{At: at}
+		for _, kv := range strings.Split(parts[1], ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 {
+				return nil, fmt.Errorf("invalid setting %q of network change %q", kv, entry)
+			}
+			if err := c.set(strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])); err != nil {
+				return nil, fmt.Errorf("invalid setting %q of network change %q: %w", kv, entry, err)
+			}
+		}
+		changes = append(changes, c)
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].At < changes[j].At })
+	return changes, nil
+}
+
+func (c *NetChange) set(key string, value string) error {
+	switch key {
+	case "latency", "jitter":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if key == "latency" {
+			c.Latency = &d
+		} else {
+			c.Jitter = &d
+		}
+	case "bandwidth":
+		mb, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		c.BandwidthMB = &mb
+	case "loss", "corrupt":
+		pct, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("%s must be between 0 and 100", key)
+		}
+		if key == "loss" {
+			c.LossPct = &pct
+		} else {
+			c.CorruptPct = &pct
+		}
+	default:
+		return fmt.Errorf("unknown key %s, expected latency, jitter, bandwidth, loss or corrupt", key)
+	}
+	return nil
+}
+
+func (c NetChange) apply(s *network.LinkShape) {
+	if c.Latency != nil {
+		s.Latency = *c.Latency
+	}
+	if c.Jitter != nil {
+		s.Jitter = *c.Jitter
+	}
+	if c.BandwidthMB != nil {
+		s.Bandwidth = uint64(*c.BandwidthMB) * 1000 * 1000
+	}
+	if c.LossPct != nil {
+		s.Loss = float32(*c.LossPct)
+	}
+	if c.CorruptPct != nil {
+		s.Corrupt = float32(*c.CorruptPct)
+	}
+}
+
+// runNetChanges applies the network changes of the schedule in turn. Each
+// change replaces the network config faults recover to.
+func (p *PubsubNode) runNetChanges() {
+	for i, c := range p.cfg.NetChanges {
+		select {
+		case <-time.After(time.Until(p.runStart.Add(c.At))):
+		case <-p.ctx.Done():
+			return
+		}
+		p.log("applying network change %d at %s", i, c.At)
+		if err := p.reconfigureNetwork("netchange", true, c.apply); err != nil {
+			p.log("error applying network change %d: %s", i, err)
+			continue
+		}
+		p.markTimeline("net_change", fmt.Sprintf("change %d", i), c.At)
+	}
+}
+
+// reconfigureNetwork reconfigures the node's sidecar with every link shape of
+// the network config modified by fn, or with the config itself if fn is nil.
+// If persist is set the modified config replaces the network config. Only
+// this node waits for the reconfiguration.
+func (p *PubsubNode) reconfigureNetwork(state string, persist bool, fn func(s *network.LinkShape)) error {
+	return p.reconfigureNetworkWith(state, persist, func(cfg *network.Config) {
+		if fn == nil {
+			return
+		}
+		fn(&cfg.Default)
+		for i := range cfg.Rules {
+			fn(&cfg.Rules[i].LinkShape)
+		}
+	})
+}
+
+// reconfigureNetworkWith reconfigures the node's sidecar with a copy of the
+// network config modified by fn
+func (p *PubsubNode) reconfigureNetworkWith(state string, persist bool, fn func(cfg *network.Config)) error {
+	if p.netconfig == nil {
+		return fmt.Errorf("traffic shaping is not available")
+	}
+	p.netconfigLk.Lock()
+	defer p.netconfigLk.Unlock()
+
+	cfg := *p.netconfig
+	cfg.Rules = make([]network.LinkRule, len(p.netconfig.Rules))
+	copy(cfg.Rules, p.netconfig.Rules)
+	fn(&cfg)
+
+	p.netconfigs++
+	cfg.CallbackState = tgsync.State(fmt.Sprintf("netconfig-%s-%d-%s", p.h.ID(), p.netconfigs, state))
+	cfg.CallbackTarget = 1
+	if err := p.netclient.ConfigureNetwork(p.ctx, &cfg); err != nil {
+		return err
+	}
+	if persist {
+		*p.netconfig = cfg
+	}
+	return nil
+}
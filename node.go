@@ -3,26 +3,78 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/testground/sdk-go/network"
 	"github.com/testground/sdk-go/ptypes"
 	"github.com/testground/sdk-go/runtime"
 	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
 )
 
 type Msg struct {
 	Sender string
 	Seq    int64
-	Data   []byte
+	// Publish time in unix nanoseconds
+	Published int64
+	Data      []byte
 }
 
 type NodeConfig struct {
+	// Name of an additional pubsub node running in the same test instance, on
+	// its own host. Empty for the main node.
+	Name string
+
+	// Class of the node in a preset scenario
+	Class string
+
+	// pubsub router: gossipsub or floodsub
+	Implementation string
+
+	// gossipsub protocol version the router speaks: v1.0 or v1.1
+	GossipsubProtocol string
+
+	// cohort running another implementation in an external process
+	Interop InteropParams
+
+	// lurkers leaving and rejoining the network during the run
+	Churn ChurnParams
+
+	// sybil attack run by attackers during the attack window
+	Sybil SybilParams
+
+	// eclipse scenario, with the victim resolved
+	Eclipse EclipseParams
+
+	// closing of the connections without pubsub traffic
+	Idle IdleParams
+
+	// detection of the nodes consistently in the latency tail
+	Stragglers StragglerParams
+
+	// phases of the phased workload
+	Phases PhasesParams
+
+	// trace replayed by the replay workload
+	ReplayFile string
+
+	// size distributions defined by the size_histograms param, by name
+	SizeHistograms map[string]SizeHistogram
+	// arrival processes of the poisson and bursty workloads
+	Arrival ArrivalParams
+
 	// topics to join when node starts
 	Topics []TopicConfig
 
@@ -46,9 +98,55 @@ type NodeConfig struct {
 	// Gossipsub heartbeat params
 	Heartbeat HeartbeatParams
 
-	Failure bool
+	// Faults injected in this node during the run
+	Faults []ScheduledFault
+
+	// changes of the shape of the node's links during the run
+	NetChanges []NetChange
+
+	// network partition into groups of nodes during the run
+	Partition PartitionParams
+
+	// publishing rate adapting to congestion
+	Adaptive AdaptiveParams
+
+	// topic peers found through a DHT instead of the topology
+	DHT DHTParams
+	// peer exchange on PRUNE, and the bootstrap nodes if it's the only
+	// discovery mechanism
+	PX PXParams
+
+	// limits of the host's connection and resource managers
+	ConnLimits *ConnLimits
+
+	// offset from the start of the run of the first publish, leaving the
+	// overlay time to stabilize
+	FirstPublishOffset time.Duration
+
+	// whether the attackers coordinate over a private sync topic
+	AttackerCoordination bool
+
+	// whether to emit a custom event with the mesh changes of every heartbeat
+	HeartbeatEvents bool
+
+	// Interval between mesh snapshots, disabled if zero
+	MeshSnapshotInterval time.Duration
+
+	// whether the leader writes the latency distribution of all the nodes
+	LatencyCDF bool
+
+	// deliveries later than this miss their deadline, disabled if zero
+	DeliveryDeadline time.Duration
+
+	// watchdog logging the anomalies of the node
+	Anomalies AnomalyParams
+
+	// targets the leader checks for each cohort of nodes at the end of the run
+	SLOs []SLO
+
+	// simulated validation of the workload topics
+	Validation ValidationParams
 
-	FailureDuration time.Duration
 	// whether to flood the network when publishing our own messages.
 	// Ignored unless hardening_api build tag is present.
 	//FloodPublishing bool
@@ -61,29 +159,149 @@ type NodeConfig struct {
 	// Params for inspecting the scoring values.
 	//PeerScoreInspect InspectParams
 
+	// Interval between inspecting peer scores
+	PeerScoreInspectPeriod time.Duration
+
+	// log the peers grafted in place of the peers pruned for their score
+	ScoreReplacementLog bool
+
+	// Interval between recording live health metrics, disabled if zero
+	MetricsPeriod time.Duration
+
+	// whether this node belongs to the attacker cohort
+	Attacker bool
+
+	// Period of the run during which attacks take place
+	AttackWindow AttackWindow
+
+	// Counts the bytes sent and received by the libp2p host
+	Bandwidth *metrics.BandwidthCounter
+
+	// Size of the windows for reporting delivery throughput, disabled if zero
+	ThroughputWindow time.Duration
+
+	// Gater dropping one transport protocol during the blackhole window, nil
+	// if this node is not blackholed
+	Blackhole       *ProtocolBlackhole
+	BlackholeParams BlackholeParams
+
+	// Interval between pinging connected peers to sample RTTs, disabled if zero
+	PingInterval time.Duration
+
+	// If non-zero, only subscribe to the topics this long after the start of the run
+	SubscribeDelay time.Duration
+
+	// If non-zero, only connect to the topology peers and subscribe this long
+	// after the start of the run
+	JoinOffset time.Duration
+
+	// whether the node listens on a second interface
+	Multihomed bool
+
+	// number of times the measured window runs over the same overlay
+	Repetitions int
+
+	// NAT'd nodes of the run, and whether this one is only reachable through
+	// a relay
+	NAT   NATParams
+	NATed bool
+
+	// whether to share the node's records with the leader for the run summary
+	Summary bool
+	// whether to share the node's mesh formation times with the leader
+	// without the run summary
+	MeshFormationReport bool
+
+	// don't log every message sent and received
+	Quiet bool
+
 	// Size of the pubsub validation queue.
 	ValidateQueueSize int
 
 	// Size of the pubsub outbound queue.
 	OutboundQueueSize int
 
+	// whether messages are signed and verified, strict_sign or
+	// strict_no_sign
+	SignaturePolicy string
+
+	// encrypt the payloads of the workload messages with a shared key
+	PayloadEncryption bool
+
 	// Heartbeat tics for opportunistic grafting
 	OpportunisticGraftTicks int
+
+	// Name of the workload generating the published messages
+	Workload string
+
+	// Number of extra peers every message is forwarded to outside of the
+	// router, even if they have seen it already
+	ExtraForward int
+
+	// Connection exhaustion attack, run by attackers during the attack window
+	ConnFlood ConnFloodParams
+
+	// mesh churning attack, run by attackers during the attack window
+	PruneFlood PruneFloodParams
+
+	// IHAVE/IWANT spam attack, run by attackers during the attack window
+	GossipSpam GossipSpamParams
+
+	// Share of healthy meshes required before publishing
+	HealthGate HealthGateParams
+
+	// grafting of a share of the new connections as soon as they're made
+	PreGraft PreGraftParams
+
+	// Percentage of lazy nodes in the run, and whether this node is one of
+	// them: it stays in the meshes but never forwards or gossips a message
+	LazyPct int
+	Lazy    bool
+
+	// Params of the committee workload, and the collector measuring its
+	// deliveries if this node is the collector
+	Committee          CommitteeParams
+	CommitteeCollector *CommitteeCollector
+
+	// Synchronized rewiring causing a GRAFT/PRUNE storm
+	Storm StormParams
+
+	// Previous run the summary is compared against
+	Baseline BaselineParams
+
+	// If non-zero, the publisher publishes through fanout and only subscribes
+	// this long after the start of the run
+	FanoutDelay time.Duration
+
+	// Skew of the node's clock, applied to the timestamps in the payloads
+	ClockOffset time.Duration
+
+	// Collaborative blacklist shared over a dedicated topic
+	Blacklist BlacklistParams
+
+	// Per-topic delivery latencies, shared by all the pubsub nodes of the
+	// instance. nil if disabled
+	TopicLatency *TopicLatencyRecorder
 }
 
 type TopicConfig struct {
 	Id          string
 	MessageRate ptypes.Rate
 	MessageSize ptypes.Size
+	// name of a size distribution the message sizes are drawn from instead
+	// of MessageSize, see sizeHistograms
+	SizeDistribution string `json:",omitempty"`
 }
 
 type topicState struct {
-	cfg       TopicConfig
-	nMessages int64
-	topic     *pubsub.Topic
-	sub       *pubsub.Subscription
-	pubTicker *time.Ticker
-	done      chan struct{}
+	cfg   TopicConfig
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+	done  chan struct{}
+
+	// when we subscribed, and whether a message has been delivered since
+	subscribed time.Time
+	delivered  bool
 }
 
 type PubsubNode struct {
@@ -100,27 +318,137 @@ type PubsubNode struct {
 	pubwg     sync.WaitGroup
 	netclient *network.Client
 	netconfig *network.Config
+	client    tgsync.Client
+
+	// time at which the warmup completed and the run started
+	runStart time.Time
+	// verdict of the health gate, and whether it aborted the run
+	healthGate       *outputs.HealthGate
+	healthGateFailed atomic.Bool
+	// time at which the node started publishing
+	publishStart time.Time
+	// starts the publishing of every repetition after the first one
+	nextRepetition chan int
+
+	// delivery stats for the attack scoreboard
+	deliveriesLk   sync.Mutex
+	buckets        map[int64]DeliveryBucket
+	publishedSeqs  map[string][]int64
+	repetitions    []TimeWindow
+	attackBytesOut int64
+	attackScores   map[string]float64
+	// time for the meshes to recover after the partition healed
+	meshRecoveryMs float64
+	stormGrafts    int64
+	stormPrunes    int64
+
+	// when the publisher subscribed after publishing through fanout, and its
+	// mesh shortly afterwards
+	fanoutLk         sync.Mutex
+	fanoutSubscribed time.Time
+	fanoutMesh       map[peer.ID]struct{}
+
+	// when the first connection was established
+	firstConn connTimer
+	// mesh changes at the start of the run
+	meshChurn meshChurnCounter
+
+	// latencies reported to an adaptive publisher, and the publisher's rate
+	acks ackWindow
+	rate rateController
+
+	// serializes the handling of the messages received through pubsub and
+	// through the extra forwarding
+	handleLk sync.Mutex
+	// messages received, only tracked with extra forwarding
+	seen            map[string]struct{}
+	extraDuplicates int64
+	// delivery latency in milliseconds by message key, only tracked with
+	// straggler detection or the latency CDF
+	msgLatencies map[string]float64
+	// order of the first deliveries of each publisher's messages
+	order deliveryOrder
+	// messages rejected by the simulated validation
+	invalidRejected int64
+	// validation decisions by propagation source and outcome
+	validations validationStats
+	// share of the mesh held by eclipse attackers, only sampled by the victim
+	eclipse eclipseState
+
+	snapshotsLk   sync.Mutex
+	meshSnapshots []outputs.MeshSnapshot
+
+	// connections closed for idleness and redials
+	idle idleStats
+
+	// events of the run observed by this node
+	timelineLk sync.Mutex
+	timeline   []TimelineMark
+
+	// control messages sent by a PRUNE flooding attacker
+	pruneFlood pruneFloodStats
+
+	// control messages sent by a gossip spamming attacker
+	gossipSpam gossipSpamStats
+
+	// windowed delivery throughput, nil if disabled
+	throughput *ThroughputRecorder
+
+	// measured round trip times for each link
+	rttLk sync.Mutex
+	rtts  map[peer.ID]*outputs.LinkRTT
+
+	// periods during which the node was down
+	downLk      sync.Mutex
+	downWindows []TimeWindow
+	faultDown   TimeWindow
+	// peers connected before the restart fault, and the restarts
+	knownPeers []peer.ID
+	restarts   []RestartReport
+
+	// guards the network config, and counts the sidecar reconfigurations
+	// made during the run to name their callback states
+	netconfigLk sync.Mutex
+	netconfigs  int
+
+	// latest peer scores reported by the pubsub router, and where they are
+	// written to if score samples are enabled
+	scoresLk  sync.RWMutex
+	scores    map[peer.ID]float64
+	scoresOut *os.File
+
+	// set if the topic peers are found through the DHT
+	dht *dhtDiscovery
+
+	// adds GRAFTs to the hellos of the pre-grafted peers, nil if disabled
+	pregraft *preGrafter
+
+	// trace events emitted by the test plan
+	events customEvents
+
+	// last delivery and anomalies logged by the watchdog
+	anomalies anomalyState
+
+	// CPU time used by the process during the measured window, zero if it
+	// wasn't measured
+	cpuRun time.Duration
+
+	// encrypts the payloads, nil if disabled
+	cipher *payloadCipher
+
+	// set if the attackers coordinate over the sync service
+	team *attackTeam
+
+	// score-driven mesh replacements, if logged
+	replacements *replacementLog
 }
 
-func createPubSubNode(ctx context.Context, runenv *runtime.RunEnv, seq int64, h host.Host, discovery *SyncDiscovery, netclient *network.Client, netconfig *network.Config, cfg NodeConfig) (*PubsubNode, error) {
+func createPubSubNode(ctx context.Context, runenv *runtime.RunEnv, seq int64, h host.Host, discovery *SyncDiscovery, client tgsync.Client, netclient *network.Client, netconfig *network.Config, cfg NodeConfig) (*PubsubNode, error) {
 	opts, err := pubsubOptions(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set the heartbeat initial delay and interval
-	pubsub.GossipSubHeartbeatInitialDelay = cfg.Heartbeat.InitialDelay
-	pubsub.GossipSubHeartbeatInterval = cfg.Heartbeat.Interval
-	pubsub.GossipSubHistoryLength = 100
-	pubsub.GossipSubHistoryGossip = 50
-
-	ps, err := pubsub.NewGossipSub(ctx, h, opts...)
-
-	if err != nil {
-		fmt.Errorf("error making new gossipsub: %s", err)
-		return nil, err
-	}
-
 	ctx, cancel := context.WithCancel(ctx)
 	p := &PubsubNode{
 		cfg:       cfg,
@@ -129,14 +457,113 @@ func createPubSubNode(ctx context.Context, runenv *runtime.RunEnv, seq int64, h
 		seq:       seq,
 		runenv:    runenv,
 		h:         h,
-		ps:        ps,
 		discovery: discovery,
 		topics:    make(map[string]*topicState),
 		netclient: netclient,
 		netconfig: netconfig,
+		client:    client,
+		buckets:   make(map[int64]DeliveryBucket),
+		rtts:      make(map[peer.ID]*outputs.LinkRTT),
+		rate:      rateController{factor: 1},
+
+		nextRepetition: make(chan int, cfg.Repetitions),
+	}
+	if cfg.ThroughputWindow > 0 {
+		p.throughput = NewThroughputRecorder(cfg.ThroughputWindow)
+	}
+	if cfg.PayloadEncryption {
+		if p.cipher, err = newPayloadCipher(); err != nil {
+			cancel()
+			return nil, fmt.Errorf("error creating the payload cipher: %w", err)
+		}
+	}
+
+	if cfg.PeerScoreParams.enabled() {
+		inspectPeriod := cfg.PeerScoreInspectPeriod
+		if inspectPeriod <= 0 {
+			inspectPeriod = cfg.MetricsPeriod
+		}
+		if cfg.ScoreReplacementLog {
+			// the scores of the pruned peers are sampled every heartbeat
+			if inspectPeriod <= 0 || inspectPeriod > cfg.Heartbeat.Interval {
+				inspectPeriod = cfg.Heartbeat.Interval
+			}
+			tracer, ok := cfg.Tracer.(*TestTracer)
+			if !ok {
+				cancel()
+				return nil, fmt.Errorf("score replacement log requires the test tracer")
+			}
+			if err := p.openReplacementLog(); err != nil {
+				cancel()
+				p.closeScoreSamples()
+				return nil, err
+			}
+			tracer.OnMeshChange(p.auditMeshChange)
+		}
+		if inspectPeriod > 0 {
+			opts = append(opts, pubsub.WithPeerScoreInspect(pubsub.PeerScoreInspectFn(p.inspectScores), inspectPeriod))
+		}
+		if cfg.PeerScoreInspectPeriod > 0 {
+			if err := p.openScoreSamples(); err != nil {
+				cancel()
+				return nil, err
+			}
+		}
+	}
+
+	if cfg.DHT.enabled() {
+		d, err := newDHTDiscovery(ctx, h)
+		if err != nil {
+			cancel()
+			p.closeScoreSamples()
+			return nil, err
+		}
+		p.dht = d
+		opts = append(opts, pubsub.WithDiscovery(d.routing))
 	}
 
-	p.connectTopology(ctx, cfg.Warmup)
+	if cfg.PreGraft.enabled() {
+		tracer, ok := cfg.Tracer.(*TestTracer)
+		if !ok {
+			cancel()
+			p.closeScoreSamples()
+			return nil, fmt.Errorf("pre-grafting requires the test tracer")
+		}
+		opts = append(opts, p.startPreGrafting(tracer))
+	}
+
+	var ps *pubsub.PubSub
+	if cfg.Implementation == "floodsub" {
+		ps, err = pubsub.NewFloodSub(ctx, h, opts...)
+	} else {
+		ps, err = pubsub.NewGossipSub(ctx, h, opts...)
+	}
+
+	if err != nil {
+		cancel()
+		p.closeScoreSamples()
+		return nil, fmt.Errorf("error making new %s: %w", cfg.Implementation, err)
+	}
+	p.ps = ps
+
+	if cfg.HeartbeatEvents && cfg.Implementation != "floodsub" {
+		if tracer, ok := cfg.Tracer.(*TestTracer); ok {
+			p.startHeartbeatEvents(tracer)
+		}
+	}
+
+	if cfg.ExtraForward > 0 {
+		p.seen = make(map[string]struct{})
+		h.SetStreamHandler(ExtraForwardProtocol, p.handleExtraForward)
+	}
+
+	p.startMeshFormationTimer()
+	if cfg.PreGraft.enabled() && cfg.JoinOffset == 0 && cfg.SubscribeDelay == 0 {
+		p.joinTopicsEarly()
+	}
+	if cfg.JoinOffset == 0 {
+		p.connectTopology(ctx, cfg.Warmup)
+	}
 
 	return p, nil
 }
@@ -145,6 +572,11 @@ func pubsubOptions(cfg NodeConfig) ([]pubsub.Option, error) {
 	opts := []pubsub.Option{
 		pubsub.WithEventTracer(cfg.Tracer),
 	}
+	opts = append(opts, signatureOptions(cfg.SignaturePolicy)...)
+
+	if tracer, ok := cfg.Tracer.(*TestTracer); ok {
+		opts = append(opts, pubsub.WithRawTracer(tracer.RPCSizes()))
+	}
 
 	if cfg.ValidateQueueSize > 0 {
 		opts = append(opts, pubsub.WithValidateQueueSize(cfg.ValidateQueueSize))
@@ -154,23 +586,92 @@ func pubsubOptions(cfg NodeConfig) ([]pubsub.Option, error) {
 		opts = append(opts, pubsub.WithPeerOutboundQueueSize(cfg.OutboundQueueSize))
 	}
 
-	// Set the overlay parameters
-	if cfg.OverlayParams.d >= 0 {
-		pubsub.GossipSubD = cfg.OverlayParams.d
+	if cfg.PeerScoreParams.enabled() {
+		if cfg.Implementation == "floodsub" {
+			return nil, fmt.Errorf("peer scoring requires gossipsub")
+		}
+		params, thresholds := cfg.PeerScoreParams.toPubsub()
+		opts = append(opts, pubsub.WithPeerScore(params, thresholds))
+	}
+
+	if cfg.PX.Enabled {
+		opts = append(opts, pubsub.WithPeerExchange(true))
 	}
-	if cfg.OverlayParams.dlo >= 0 {
-		pubsub.GossipSubDlo = cfg.OverlayParams.dlo
+
+	if cfg.Implementation != "floodsub" && cfg.GossipsubProtocol == "v1.0" {
+		opts = append(opts, pubsub.WithGossipSubProtocols(
+			[]protocol.ID{pubsub.GossipSubID_v10, pubsub.FloodSubID}, pubsub.GossipSubDefaultFeatures))
 	}
-	if cfg.OverlayParams.dhi >= 0 {
-		pubsub.GossipSubDhi = cfg.OverlayParams.dhi
+
+	// the router gets its own copy of the parameters, rather than the
+	// process-wide gossipsub defaults, so that nodes of different classes can
+	// share a container or a local run
+	if cfg.Implementation != "floodsub" {
+		opts = append(opts, pubsub.WithGossipSubParams(gossipSubParams(cfg)))
 	}
 
 	return opts, nil
 }
 
+// gossipSubParams returns the router parameters of the node
+func gossipSubParams(cfg NodeConfig) pubsub.GossipSubParams {
+	params := cfg.OverlayParams.gossipSubParams()
+	params.HeartbeatInitialDelay = cfg.Heartbeat.InitialDelay
+	params.HeartbeatInterval = cfg.Heartbeat.Interval
+	if cfg.PX.Peers > 0 {
+		params.PrunePeers = cfg.PX.Peers
+	}
+	return params
+}
+
+// routerParams returns the router parameters recorded in the outputs
+func routerParams(cfg NodeConfig) outputs.RouterParams {
+	params := gossipSubParams(cfg)
+	rp := outputs.RouterParams{
+		D:                   params.D,
+		Dlo:                 params.Dlo,
+		Dhi:                 params.Dhi,
+		Dscore:              params.Dscore,
+		Dlazy:               params.Dlazy,
+		Dout:                params.Dout,
+		HeartbeatIntervalMs: float64(params.HeartbeatInterval) / float64(time.Millisecond),
+		GossipFactor:        params.GossipFactor,
+		HistoryLength:       params.HistoryLength,
+		HistoryGossip:       params.HistoryGossip,
+
+		GossipRetransmission: params.GossipRetransmission,
+	}
+	if cfg.PeerScoreParams.enabled() {
+		th := cfg.PeerScoreParams.Thresholds
+		rp.ScoreThresholds = &outputs.ScoreThresholds{
+			Gossip:             th.GossipThreshold,
+			Publish:            th.PublishThreshold,
+			Graylist:           th.GraylistThreshold,
+			AcceptPX:           th.AcceptPXThreshold,
+			OpportunisticGraft: th.OpportunisticGraftThreshold,
+		}
+	}
+	return rp
+}
+
 func (p *PubsubNode) connectTopology(ctx context.Context, warmup time.Duration) error {
 	// Default to a connect delay in the range of 0s - 1s
-	delay := time.Duration(rand.Intn(int(warmup.Seconds()))) * time.Second
+	var delay time.Duration
+	if warmup >= time.Second {
+		delay = time.Duration(rand.Intn(int(warmup.Seconds()))) * time.Second
+	}
+	if p.dht != nil {
+		if err := p.bootstrapDHT(ctx, delay); err != nil {
+			p.runenv.RecordMessage("Error bootstrapping the dht: %s", err)
+		}
+		return nil
+	}
+	if p.cfg.PX.discovery() {
+		if err := p.connectBootstrappers(ctx, delay); err != nil {
+			p.runenv.RecordMessage("Error connecting to the px bootstrap nodes: %s", err)
+		}
+		return nil
+	}
 	// Connect to other peers in the topology
 	err := p.discovery.ConnectTopology(ctx, delay)
 	if err != nil {
@@ -188,20 +689,52 @@ func (p *PubsubNode) Run(runtime time.Duration) error {
 		}
 		p.runenv.RecordMessage("Shutting down")
 		p.shutdown()
+		p.closeScoreSamples()
+		p.closeReplacementLog()
+		p.closeCustomEvents()
+		if p.dht != nil {
+			p.dht.dht.Close()
+		}
 	}()
 
+	if p.cfg.MetricsPeriod > 0 {
+		go p.metricsLoop(p.cfg.MetricsPeriod)
+	}
+
+	if p.cfg.PingInterval > 0 {
+		go p.pingLoop(p.cfg.PingInterval)
+	}
+
+	if p.cfg.MeshSnapshotInterval > 0 {
+		go p.runMeshSnapshots(p.cfg.MeshSnapshotInterval)
+	}
+
+	if p.cfg.Idle.closes(p.seq, p.runenv.TestInstanceCount) {
+		go p.runIdleDisconnect()
+	} else if p.cfg.Idle.enabled() {
+		go p.holdDialedPeers()
+	}
+
+	if p.eclipsing() {
+		go p.runEclipse()
+	} else if p.cfg.Eclipse.enabled() && p.seq == p.cfg.Eclipse.Victim {
+		go p.sampleEclipsedMesh()
+	}
+
 	// Wait for all nodes to be in the ready state (including attack nodes)
 	// then start connecting (asynchronously)
 	/*if err := waitForReadyStateThenConnectAsync(p.ctx); err != nil {
 		return err
 	}*/
 
-	// ensure we have at least enough peers to fill a mesh after warmup period
+	// ensure we have at least enough peers to fill a mesh after warmup period,
+	// unless only PX may find them
 	npeers := len(p.h.Network().Peers())
-	if npeers < pubsub.GossipSubDlo {
-		//panic(fmt.Errorf("not enough peers after warmup period. Need at least D=%d, have %d", pubsub.GossipSubDlo, npeers))
-		p.runenv.RecordMessage("not enough peers after warmup period. Need at least D=%d, have %d", pubsub.GossipSubD, npeers)
-		selected := p.discovery.topology.SelectNPeers(pubsub.GossipSubD-npeers, p.h.ID(), p.discovery.allPeers)
+	params := gossipSubParams(p.cfg)
+	if npeers < params.Dlo && p.cfg.JoinOffset == 0 && !p.cfg.PX.discovery() {
+		//panic(fmt.Errorf("not enough peers after warmup period. Need at least D=%d, have %d", params.Dlo, npeers))
+		p.runenv.RecordMessage("not enough peers after warmup period. Need at least D=%d, have %d", params.D, npeers)
+		selected := p.discovery.topology.SelectNPeers(params.D-npeers, p.h.ID(), p.discovery.candidates())
 		p.discovery.ConnectingToPeers(p.ctx, selected)
 	}
 
@@ -212,45 +745,155 @@ func (p *PubsubNode) Run(runtime time.Duration) error {
 	case <-p.ctx.Done():
 		return p.ctx.Err()
 	}
-	if p.cfg.Failure {
-		go func() {
-			select {
-			case <-time.After(p.cfg.Warmup * 2):
-			case <-p.ctx.Done():
-				return
-			}
-			p.runenv.RecordMessage("Node stopped !!!!!!!!!!!!!!!")
-			for _, peer := range p.h.Network().Peers() {
-				p.h.Network().ClosePeer(peer)
-			}
+	p.runStart = time.Now()
+	p.markTimeline("run", "start", 0)
+	p.startMeshChurn()
+	if p.cfg.FirstPublishOffset > 0 {
+		// mark the stabilization period before the first publish
+		p.traceEvent("stabilization", TimeWindow{
+			Start: p.runStart.UnixNano(),
+			End:   p.runStart.Add(p.cfg.FirstPublishOffset).UnixNano(),
+		})
+	}
+	if p.throughput != nil {
+		p.throughput.Start(p.runStart)
+	}
 
-			select {
-			case <-time.After(p.cfg.FailureDuration):
-			case <-p.ctx.Done():
-				return
-			}
-			p.runenv.RecordMessage("Node up again !!!!!!!!!!!!!!!")
+	if p.cfg.AttackWindow.enabled() {
+		go p.sampleAttackBandwidth()
+	}
+
+	if p.cfg.Attacker && p.cfg.AttackWindow.enabled() && p.cfg.AttackerCoordination {
+		if err := p.joinAttackTeam(); err != nil {
+			p.log("error joining the attack team: %s", err)
+		}
+	}
+
+	if p.cfg.Attacker && p.cfg.AttackWindow.enabled() && p.cfg.ConnFlood.enabled() {
+		go p.runConnFlood()
+	}
+
+	if p.cfg.Attacker && p.cfg.AttackWindow.enabled() && p.cfg.PruneFlood.enabled() {
+		go p.runPruneFlood()
+	}
+
+	if p.cfg.Attacker && p.cfg.AttackWindow.enabled() && p.cfg.GossipSpam.enabled() {
+		go p.runGossipSpam()
+	}
+
+	if p.cfg.Attacker && p.cfg.AttackWindow.enabled() && p.cfg.Sybil.enabled() {
+		go p.runSybil()
+	}
+
+	if p.cfg.Blackhole != nil {
+		go p.runBlackhole()
+	}
+
+	if p.cfg.Storm.enabled() {
+		go p.runStorm()
+	}
+
+	if p.cfg.Publisher && p.cfg.FanoutDelay > 0 {
+		go p.runFanoutTransition()
+	}
+
+	if p.cfg.Blacklist.Enabled {
+		go p.runBlacklist()
+	}
+
+	if p.cfg.Churn.enabled() && !p.cfg.Publisher && !p.cfg.Attacker {
+		go p.runChurn()
+	}
+
+	if len(p.cfg.Faults) > 0 {
+		p.runFaults()
+	}
+
+	if len(p.cfg.NetChanges) > 0 {
+		go p.runNetChanges()
+	}
+
+	if p.cfg.Partition.enabled() {
+		go p.runPartition()
+	}
 
-			err2 := p.discovery.ConnectTopology(p.ctx, 0)
-			if err2 != nil {
-				p.runenv.RecordMessage("Error connecting to topology peer: %s", err2)
+	if p.cfg.Adaptive.enabled() {
+		go p.runAdaptive()
+	}
+
+	// join initial topics, then start publishing once every node has joined
+	if p.cfg.Publisher {
+		p.pubwg.Add(1)
+	}
+	go func() {
+		if p.cfg.SubscribeDelay > 0 || p.cfg.JoinOffset > 0 {
+			p.joinTopicsLate(runtime)
+			return
+		}
+
+		p.runenv.RecordMessage("Joining initial topics %d.", len(p.cfg.Topics))
+		for _, t := range p.cfg.Topics {
+			p.runenv.RecordMessage("Joining topic %s %d.", t.Id, t.MessageSize)
+			p.joinTopic(t, runtime)
+		}
+
+		if err := waitTillAllJoined(p.ctx, p.runenv, p.client, p.joinedState()); err != nil {
+			p.log("error waiting for all nodes to join: %s", err)
+			if p.cfg.Publisher {
+				p.pubwg.Done()
 			}
-		}()
+			return
+		}
+		if p.cfg.HealthGate.enabled() && !p.passHealthGate(false) {
+			if p.cfg.Publisher {
+				p.pubwg.Done()
+			}
+			return
+		}
+		if p.cfg.Publisher {
+			p.startPublishing(runtime)
+		}
+	}()
+
+	// the instances of a local run share the process, so their CPU time
+	// isn't their own
+	var cpuStart time.Duration
+	measureCPU := p.cfg.Name == "" && localSync == nil
+	if measureCPU {
+		cpu, err := processCPU()
+		if err != nil {
+			p.log("error reading the CPU time: %s", err)
+		}
+		cpuStart, measureCPU = cpu, err == nil
 	}
-	// join initial topics
-	p.runenv.RecordMessage("Joining initial topics %d.", len(p.cfg.Topics))
-	for _, t := range p.cfg.Topics {
-		p.runenv.RecordMessage("Joining topic %s %d.", t.Id, t.MessageSize)
-		go p.joinTopic(t, runtime)
+
+	watchdogDone := make(chan struct{})
+	if p.cfg.Anomalies.enabled() {
+		go p.runAnomalyWatchdog(watchdogDone)
 	}
 
 	p.runenv.RecordMessage("Starting gossipsub. Connected to %d peers.", len(p.h.Network().Peers()))
 	// block until complete
 	p.runenv.RecordMessage("Wait for %s run time", runtime)
-	select {
-	case <-time.After(runtime):
-	case <-p.ctx.Done():
-		return p.ctx.Err()
+	err := p.runRepetitions(runtime)
+	// nothing is published while the messages drain
+	close(watchdogDone)
+	if p.healthGateFailed.Load() {
+		return errHealthGate
+	}
+	if err != nil {
+		return err
+	}
+	if measureCPU {
+		if cpu, err := processCPU(); err == nil {
+			p.cpuRun = cpu - cpuStart
+			p.runenv.R().RecordPoint("cpu_secs", p.cpuRun.Seconds())
+		}
+	}
+	if p.cfg.Repetitions > 1 {
+		p.markTimeline("run", "end", unplanned)
+	} else {
+		p.markTimeline("run", "end", runtime)
 	}
 
 	// if we're publishing, wait until we've sent all our messages or the context expires
@@ -277,68 +920,221 @@ func (p *PubsubNode) Run(runtime time.Duration) error {
 
 	p.runenv.RecordMessage("Cool down complete")
 
-	return nil
+	p.recordMeshFormation()
+	p.runenv.R().RecordPoint("mesh_churn_per_min", p.meshChurnPerMin())
+	v4, v6 := connsByFamily(p.h.Network().Conns())
+	p.runenv.R().RecordPoint("conns_ipv4", float64(v4))
+	p.runenv.R().RecordPoint("conns_ipv6", float64(v6))
+	if p.cfg.NAT.enabled() {
+		p.runenv.R().RecordPoint("relayed_conns", float64(p.relayedConns()))
+	}
+
+	if tracer := p.testTracer(); tracer != nil {
+		count, bytes := tracer.Duplicates()
+		p.runenv.R().RecordPoint("duplicate_messages", float64(count))
+		p.runenv.R().RecordPoint("duplicate_bytes", float64(bytes))
+		// replayed by the tracer, see IWantStats
+		iwants := tracer.IWants()
+		p.runenv.R().RecordPoint("iwant_ids_served_estimate", float64(iwants.Served))
+		p.runenv.R().RecordPoint("iwant_ids_refused_estimate", float64(iwants.Refused))
+		p.runenv.R().RecordPoint("iwant_ids_expired_estimate", float64(iwants.Expired))
+	}
+
+	if p.pregraft != nil {
+		p.recordPreGrafts()
+	}
+
+	if p.cfg.ConnLimits != nil {
+		trimmed, blocked := p.cfg.ConnLimits.Pruned()
+		p.runenv.R().RecordPoint("connmgr_trimmed", float64(trimmed))
+		p.runenv.R().RecordPoint("rcmgr_blocked", float64(blocked))
+	}
+
+	if p.cfg.ExtraForward > 0 {
+		p.handleLk.Lock()
+		p.runenv.R().RecordPoint("extra_forward_duplicates", float64(p.extraDuplicates))
+		p.handleLk.Unlock()
+	}
+
+	if p.cfg.Validation.enabled() {
+		p.runenv.R().RecordPoint("validation_rejected", float64(p.rejectedInvalid()))
+	}
+
+	p.handleLk.Lock()
+	deliveries, outOfOrder, maxDisplacement := p.order.reordering()
+	p.handleLk.Unlock()
+	if deliveries > 0 {
+		p.runenv.R().RecordPoint("out_of_order_pct", 100*float64(outOfOrder)/float64(deliveries))
+		p.runenv.R().RecordPoint("max_displacement", float64(maxDisplacement))
+	}
+
+	if p.cfg.CommitteeCollector != nil {
+		path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.CommitteeFile)
+		if err := p.cfg.CommitteeCollector.Write(path, p.seq, p.runenv.TestInstanceCount); err != nil {
+			p.log("error writing committee report: %s", err)
+		}
+	}
+
+	if p.throughput != nil {
+		path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.ThroughputPrefix, p.seq)
+		if err := p.throughput.Write(path, p.seq, time.Now()); err != nil {
+			p.log("error writing throughput: %s", err)
+		}
+	}
+
+	if p.cfg.Publisher && p.cfg.FanoutDelay > 0 {
+		if err := p.writeFanoutTransition(); err != nil {
+			p.log("error writing fanout transition: %s", err)
+		}
+	}
+
+	if p.cfg.PingInterval > 0 {
+		if err := p.writeRTTs(); err != nil {
+			p.log("error writing ping RTTs: %s", err)
+		}
+	}
+
+	if p.cfg.MeshFormationReport {
+		if err := p.reportMeshFormation(); err != nil {
+			p.log("error reporting mesh formation: %s", err)
+		}
+	}
+
+	var sloErr error
+	if p.cfg.Summary {
+		if err := p.reportSummary(); errors.Is(err, errSLOViolated) {
+			sloErr = err
+		} else if err != nil {
+			p.log("error reporting run summary: %s", err)
+		}
+	}
+
+	if p.cfg.Storm.enabled() {
+		if err := p.reportStorm(); err != nil {
+			p.log("error reporting storm: %s", err)
+		}
+	}
+
+	return sloErr
 }
 
 func (p *PubsubNode) joinTopic(t TopicConfig, runtime time.Duration) {
 	p.lk.Lock()
 	defer p.lk.Unlock()
 
-	publishInterval := time.Duration(float64(t.MessageRate.Interval) / t.MessageRate.Quantity)
-	totalMessages := int64(runtime / publishInterval)
-
-	if p.cfg.Publisher {
+	if p.cfg.Publisher && t.MessageRate.Quantity > 0 {
+		publishInterval := time.Duration(float64(t.MessageRate.Interval) / t.MessageRate.Quantity)
+		totalMessages := int64(runtime / publishInterval)
 		p.log("publishing to topic %s. message_rate: %.2f/%ds, publishInterval %dms, msg size %d bytes. total expected messages: %d",
 			t.Id, t.MessageRate.Quantity, t.MessageRate.Interval/time.Second, publishInterval/time.Millisecond, t.MessageSize, totalMessages)
 	} else {
 		p.log("joining topic %s as a lurker", t.Id)
 	}
+	p.addTopic(t)
+}
+
+// joinTopicsEarly joins the topics before the node connects to the topology,
+// for the new connections to be pre-grafted
+func (p *PubsubNode) joinTopicsEarly() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, t := range p.cfg.Topics {
+		p.addTopic(t)
+	}
+}
 
+// addTopic joins a topic and subscribes to it. The caller must hold p.lk.
+func (p *PubsubNode) addTopic(t TopicConfig) {
 	if _, ok := p.topics[t.Id]; ok {
 		// already joined, ignore
 		return
 	}
+	if p.cfg.Validation.enabled() || p.eclipsing() || p.cfg.Lazy {
+		if err := p.registerValidator(t.Id); err != nil {
+			p.log("%s", err)
+			return
+		}
+	}
 	topic, err := p.ps.Join(t.Id)
 	if err != nil {
 		p.log("error joining topic %s: %s", t.Id, err)
 		return
 	}
-	sub, err := topic.Subscribe()
-	if err != nil {
-		p.log("error subscribing to topic %s: %s", t.Id, err)
-		return
-	}
-	p.runenv.RecordMessage("Subscribed to topic %s.", t.Id)
 	ts := topicState{
-		cfg:       t,
-		topic:     topic,
-		sub:       sub,
-		nMessages: totalMessages,
-		done:      make(chan struct{}, 1),
+		cfg:   t,
+		topic: topic,
+		done:  make(chan struct{}, 1),
 	}
 	p.topics[t.Id] = &ts
-	go p.consumeTopic(&ts)
 
-	if err := waitTillAllJoined(p.ctx, p.runenv, tgsync.MustBoundClient(p.ctx, p.runenv)); err != nil {
+	if p.cfg.Publisher && p.cfg.FanoutDelay > 0 {
+		p.log("publishing to topic %s through fanout, without subscribing", t.Id)
 		return
 	}
+	p.subscribeTopic(&ts)
+}
 
-	if !p.cfg.Publisher {
+// subscribeTopic subscribes to a joined topic and starts consuming its
+// messages. The caller must hold p.lk.
+func (p *PubsubNode) subscribeTopic(ts *topicState) {
+	sub, err := ts.topic.Subscribe()
+	if err != nil {
+		p.log("error subscribing to topic %s: %s", ts.cfg.Id, err)
 		return
 	}
+	p.runenv.RecordMessage("Subscribed to topic %s.", ts.cfg.Id)
+	ts.sub = sub
+	ts.subscribed = time.Now()
+	go p.consumeTopic(ts, sub)
+}
 
-	go func() {
-		p.runenv.RecordMessage("Starting publisher with %s publish interval", publishInterval)
-		ts.pubTicker = time.NewTicker(publishInterval)
-		p.publishLoop(&ts)
-	}()
+// joinTopicsLate lets the other nodes start publishing, and only connects to
+// the topology once the join offset has elapsed, and subscribes to the topics
+// once the subscribe delay has elapsed too
+func (p *PubsubNode) joinTopicsLate(runtime time.Duration) {
+	if err := waitTillAllJoined(p.ctx, p.runenv, p.client, p.joinedState()); err != nil {
+		p.log("error waiting for all nodes to join: %s", err)
+		return
+	}
+	if p.cfg.HealthGate.enabled() && !p.passHealthGate(true) {
+		return
+	}
+
+	if p.cfg.JoinOffset > 0 {
+		p.log("joining the network %s into the run", p.cfg.JoinOffset)
+		select {
+		case <-time.After(time.Until(p.runStart.Add(p.cfg.JoinOffset))):
+		case <-p.ctx.Done():
+			return
+		}
+		p.markTimeline("join", "joined", p.cfg.JoinOffset)
+		p.connectTopology(p.ctx, 0)
+	}
+
+	p.log("delaying subscription by %s", p.cfg.SubscribeDelay)
+	select {
+	case <-time.After(time.Until(p.runStart.Add(p.cfg.SubscribeDelay))):
+	case <-p.ctx.Done():
+		return
+	}
+
+	for _, t := range p.cfg.Topics {
+		p.joinTopic(t, runtime)
+	}
+}
+
+// joinedState is the barrier state for the pubsub nodes with the same name
+func (p *PubsubNode) joinedState() tgsync.State {
+	if p.cfg.Name == "" {
+		return tgsync.State("joined")
+	}
+	return tgsync.State("joined-" + p.cfg.Name)
 }
 
 // Called when nodes are ready to start the run, and are waiting for all other nodes to be ready
-func waitTillAllJoined(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client) error {
+func waitTillAllJoined(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client, state tgsync.State) error {
 	// Set a state barrier.
 
-	state := tgsync.State("joined")
 	doneCh := client.MustBarrier(ctx, state, runenv.TestInstanceCount).C
 
 	// Signal we've entered the state.
@@ -360,22 +1156,23 @@ func waitTillAllJoined(ctx context.Context, runenv *runtime.RunEnv, client tgsyn
 	return nil
 }
 
-func (p *PubsubNode) consumeTopic(ts *topicState) {
+func (p *PubsubNode) consumeTopic(ts *topicState, sub *pubsub.Subscription) {
 	for {
-		msg, err := ts.sub.Next(p.ctx)
+		msg, err := sub.Next(p.ctx)
 		if err != nil /*&& err != context.Canceled*/ {
 			p.log("error reading from %s: %s", ts.cfg.Id, err)
 			return
 		}
 		//p.log("got message")
 		var message Msg
-		err = json.Unmarshal(msg.Data, &message)
+		err = p.decodeMessage(msg.Data, &message)
 		if err != nil /*&& err != context.Canceled*/ {
-			p.log("error reading data")
+			p.log("error reading data: %s", err)
 			return
 		}
-		//p.log("Data received %s", msg.Data)
-		p.log("got message %d  hops for topic %s, sent by %s\n", message.Seq, ts.cfg.Id, msg.ReceivedFrom)
+		if p.handleMessage(ts, &message, len(msg.Data), msg.ReceivedFrom) && p.cfg.ExtraForward > 0 {
+			go p.forwardExtra(ts.cfg.Id, msg.Data, msg.ReceivedFrom)
+		}
 		select {
 		case <-ts.done:
 			return
@@ -387,20 +1184,73 @@ func (p *PubsubNode) consumeTopic(ts *topicState) {
 	}
 }
 
-func (p *PubsubNode) makeMessage(seq int64, size uint64) ([]byte, error) {
+// handleMessage records the delivery of a message. It returns false if the
+// message had already been received through the extra forwarding.
+func (p *PubsubNode) handleMessage(ts *topicState, message *Msg, size int, from peer.ID) bool {
+	p.handleLk.Lock()
+	defer p.handleLk.Unlock()
+
+	if p.cfg.ExtraForward > 0 && !p.markSeen(message) {
+		return false
+	}
+
+	now := time.Now()
+	if !ts.delivered {
+		ts.delivered = true
+		ttfd := now.Sub(ts.subscribed)
+		p.log("first delivery on topic %s %s after subscribing", ts.cfg.Id, ttfd)
+		p.runenv.R().RecordPoint("time_to_first_delivery_ms_"+ts.cfg.Id, float64(ttfd)/float64(time.Millisecond))
+	}
+	p.recordDelivery(time.Unix(0, message.Published), p.now())
+	p.order.record(ts.cfg.Id, message)
+	if p.cfg.Anomalies.enabled() {
+		p.anomalies.delivered(now)
+	}
+	// the committee workload publishes to the first topic
+	if p.cfg.CommitteeCollector != nil && ts.cfg.Id == p.cfg.Topics[0].Id {
+		p.cfg.CommitteeCollector.Record(message.Sender, time.Unix(0, message.Published), p.now())
+	}
+	if p.cfg.TopicLatency != nil {
+		p.cfg.TopicLatency.Record(ts.cfg.Id, p.now().Sub(time.Unix(0, message.Published)))
+	}
+	if p.cfg.Adaptive.Signal == "ack" {
+		p.acks.record(p.now().Sub(time.Unix(0, message.Published)))
+	}
+	if p.tracksMessageLatencies() {
+		latency := p.now().Sub(time.Unix(0, message.Published))
+		p.recordMessageLatency(messageKey(ts.cfg.Id, message), float64(latency)/float64(time.Millisecond))
+	}
+	if p.throughput != nil {
+		p.throughput.Record(now, size)
+	}
+	//p.log("Data received %s", msg.Data)
+	if !p.cfg.Quiet {
+		p.log("got message %d  hops for topic %s, sent by %s\n", message.Seq, ts.cfg.Id, from)
+	}
+	return true
+}
+
+func (p *PubsubNode) makeMessage(seq int64, size uint64, published time.Time) ([]byte, error) {
 
 	data := make([]byte, size)
 	rand.Read(data)
 
-	m := &Msg{Sender: p.h.ID().String(), Seq: seq, Data: data}
+	m := &Msg{Sender: p.h.ID().String(), Seq: seq, Published: published.UnixNano(), Data: data}
 
-	return json.Marshal(m)
+	encoded, err := json.Marshal(m)
+	if err != nil || p.cipher == nil {
+		return encoded, err
+	}
+	return p.cipher.seal(encoded)
 }
 
-func (p *PubsubNode) sendMsg(seq int64, ts *topicState) {
-	p.runenv.RecordMessage("Publishing message %d %d %s bytes", seq, uint64(ts.cfg.MessageSize), p.h.ID().Loggable())
+func (p *PubsubNode) sendMsg(seq int64, size uint64, ts *topicState) {
+	if !p.cfg.Quiet {
+		p.runenv.RecordMessage("Publishing message %d %d %s bytes", seq, size, p.h.ID().Loggable())
+	}
 
-	msg, err := p.makeMessage(seq, uint64(ts.cfg.MessageSize))
+	now := p.now()
+	msg, err := p.makeMessage(seq, size, now)
 
 	//p.log("makeMessage %d", len(msg))
 
@@ -414,36 +1264,115 @@ func (p *PubsubNode) sendMsg(seq int64, ts *topicState) {
 		p.log("error publishing to %s: %s", ts.cfg.Id, err)
 		return
 	}
+	p.recordPublished(now)
+	p.recordPublishedSeq(ts.cfg.Id, seq)
 }
 
-func (p *PubsubNode) publishLoop(ts *topicState) {
-	var counter int64
-	p.pubwg.Add(1)
+// startPublishing creates the configured workload and publishes its messages
+// until the run time has elapsed
+func (p *PubsubNode) startPublishing(runtime time.Duration) {
 	defer p.pubwg.Done()
-	for {
+
+	env := WorkloadEnv{Seq: p.seq, Instances: p.runenv.TestInstanceCount, Committee: p.cfg.Committee, ReplayFile: p.cfg.ReplayFile, Arrival: p.cfg.Arrival}
+	env.Phases, _ = p.cfg.Phases.ordered(p.runenv.TestRun)
+	w, err := NewWorkload(p.cfg.Workload, p.cfg.Topics, env)
+	if err != nil {
+		p.log("error creating workload: %s", err)
+		return
+	}
+	w, err = newSizedWorkload(w, p.cfg.Topics, p.cfg.SizeHistograms, p.seq)
+	if err != nil {
+		p.log("error creating workload: %s", err)
+		return
+	}
+	if p.cfg.Adaptive.enabled() {
+		w = &adaptiveWorkload{inner: w, rate: &p.rate}
+	}
+	if p.cfg.FirstPublishOffset > 0 {
+		p.log("waiting until %s into the run to publish", p.cfg.FirstPublishOffset)
 		select {
-		case <-ts.done:
+		case <-time.After(time.Until(p.runStart.Add(p.cfg.FirstPublishOffset))):
+		case <-p.ctx.Done():
 			return
+		}
+		runtime -= p.cfg.FirstPublishOffset
+	}
+	p.runenv.RecordMessage("Starting publisher with %s workload", p.cfg.Workload)
+	p.deliveriesLk.Lock()
+	p.publishStart = time.Now()
+	p.deliveriesLk.Unlock()
+	p.markTimeline("run", "publish_start", p.cfg.FirstPublishOffset)
+	counter := p.publishLoop(w, runtime, 0)
+
+	// the next repetitions keep the sequence numbers going, and wait for
+	// the same offset from their start
+	for i := 1; i < p.cfg.Repetitions; i++ {
+		var start time.Time
+		select {
+		case <-p.nextRepetition:
+			start = time.Now()
 		case <-p.ctx.Done():
-			p.runenv.RecordMessage("Publish loop done")
 			return
-		case <-ts.pubTicker.C:
-			for id := range p.ps.ListPeers(ts.sub.Topic()) {
-				p.runenv.RecordMessage("Connected to %d", id)
-			}
-			go p.sendMsg(counter, ts)
-			counter++
-			if counter > ts.nMessages {
-				ts.pubTicker.Stop()
-				return
-			}
 		}
+		select {
+		case <-time.After(time.Until(start.Add(p.cfg.FirstPublishOffset))):
+		case <-p.ctx.Done():
+			return
+		}
+		p.log("publishing repetition %d", i+1)
+		counter = p.publishLoop(w, runtime, counter)
+	}
+}
+
+// publishLoop publishes the messages of the workload for the given time,
+// numbering them from counter. It returns the next sequence number.
+func (p *PubsubNode) publishLoop(w Workload, runtime time.Duration, counter int64) int64 {
+	end := time.After(runtime)
+	next := time.Now()
+	for {
+		size, delay, topic := w.Next()
+		next = next.Add(delay)
+
+		select {
+		case <-end:
+			p.runenv.RecordMessage("Publish loop done")
+			return counter
+		case <-p.ctx.Done():
+			p.runenv.RecordMessage("Publish loop done")
+			return counter
+		case <-time.After(time.Until(next)):
+		}
+
+		p.lk.RLock()
+		ts, ok := p.topics[topic]
+		p.lk.RUnlock()
+		if !ok {
+			p.log("workload selected topic %s which was not joined", topic)
+			continue
+		}
+		go p.sendMsg(counter, size, ts)
+		counter++
 	}
 }
 
+// now returns the time according to the node's skewed clock. It is only used
+// for the timestamps carried in the payloads
+func (p *PubsubNode) now() time.Time {
+	return time.Now().Add(p.cfg.ClockOffset)
+}
+
+// testTracer returns the node's tracer if it is a TestTracer, or nil otherwise
+func (p *PubsubNode) testTracer() *TestTracer {
+	tracer, _ := p.cfg.Tracer.(*TestTracer)
+	return tracer
+}
+
 func (p *PubsubNode) log(msg string, args ...interface{}) {
 	id := p.h.ID().String()
 	idSuffix := id[len(id)-8:]
 	prefix := fmt.Sprintf("[node %d %s] ", p.seq, idSuffix)
+	if p.cfg.Name != "" {
+		prefix = fmt.Sprintf("[node %d %s %s] ", p.seq, p.cfg.Name, idSuffix)
+	}
 	p.runenv.RecordMessage(prefix+msg, args...)
 }
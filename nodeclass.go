@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/testground/sdk-go/ptypes"
+)
+
+// NodeClassParams describe a cohort of honest nodes running with their own
+// gossipsub parameters, eg the nodes already upgraded during a network-wide
+// parameter migration. Zero values keep the parameters of the other nodes.
+type NodeClassParams struct {
+	Name string
+	// Percentage of nodes in the class
+	Pct int
+
+	D            int
+	Dlo          int
+	Dhi          int
+	Dscore       int
+	Dlazy        int
+	Dout         int
+	GossipFactor float64
+	Heartbeat    ptypes.Duration
+}
+
+// validateNodeClasses checks the classes, and the overlay params they give over
+// the ones of the other nodes
+func validateNodeClasses(classes []NodeClassParams, overlay OverlayParams) error {
+	names := make(map[string]struct{}, len(classes))
+	var total int
+	for _, c := range classes {
+		if c.Name == "" {
+			return fmt.Errorf("node classes require a name")
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate node class %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+		if c.Pct <= 0 {
+			return fmt.Errorf("node class %s requires a positive Pct", c.Name)
+		}
+		if c.D < 0 || c.Dlo < 0 || c.Dhi < 0 || c.Dscore < 0 || c.Dlazy < 0 || c.Dout < 0 || c.GossipFactor < 0 || c.GossipFactor > 1 {
+			return fmt.Errorf("node class %s has invalid gossipsub parameters", c.Name)
+		}
+		cfg := NodeConfig{OverlayParams: overlay}
+		c.apply(&cfg)
+		if err := cfg.OverlayParams.validate(); err != nil {
+			return fmt.Errorf("node class %s: %w", c.Name, err)
+		}
+		total += c.Pct
+	}
+	if total > 100 {
+		return fmt.Errorf("node classes add up to %d%% of the nodes", total)
+	}
+	return nil
+}
+
+// nodeClassOf returns the class of the node with the given sequence number, or
+// nil if it keeps the default parameters. Like other cohorts, the classes are
+// made of the highest sequence numbers, the first class taking the highest
+// ones, so that they never include the publisher (seq 1).
+func nodeClassOf(classes []NodeClassParams, seq int64, instances int) *NodeClassParams {
+	if seq == 1 {
+		return nil
+	}
+	end := int64(instances)
+	for i, c := range classes {
+		n := int64(math.Round(float64(instances) * float64(c.Pct) / 100))
+		if seq > end-n && seq <= end {
+			return &classes[i]
+		}
+		end -= n
+	}
+	return nil
+}
+
+// apply overrides the node config with the parameters of the class
+func (c NodeClassParams) apply(cfg *NodeConfig) {
+	if c.D > 0 {
+		cfg.OverlayParams.d = c.D
+	}
+	if c.Dlo > 0 {
+		cfg.OverlayParams.dlo = c.Dlo
+	}
+	if c.Dhi > 0 {
+		cfg.OverlayParams.dhi = c.Dhi
+	}
+	if c.Dscore > 0 {
+		cfg.OverlayParams.dscore = c.Dscore
+	}
+	if c.Dlazy > 0 {
+		cfg.OverlayParams.dlazy = c.Dlazy
+	}
+	if c.Dout > 0 {
+		cfg.OverlayParams.dout = c.Dout
+	}
+	if c.GossipFactor > 0 {
+		cfg.OverlayParams.gossipFactor = c.GossipFactor
+	}
+	if c.Heartbeat.Duration > 0 {
+		cfg.Heartbeat.Interval = c.Heartbeat.Duration
+	}
+}
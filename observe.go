@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/run"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// ObserverReport is the connection health of a node in the observe test case
+type ObserverReport struct {
+	Seq    int64
+	PeerID string
+	// sequence numbers of the peers this node dialed successfully, and of
+	// those it failed to connect to
+	Dialed []int64
+	Failed []int64
+	// sequence numbers of all the connected peers, dialed or not
+	Peers     []int64
+	ConnectMs float64
+}
+
+var ObserverReportTopic = tgsync.NewTopic("observer-reports", &ObserverReport{})
+
+// parseObserveParams reads the subset of the test params the observe test
+// case uses
+func parseObserveParams(runenv *runtime.RunEnv) testParams {
+	p := testParams{
+		setup:  durationParam(runenv, "t_setup"),
+		warmup: durationParam(runenv, "t_warm"),
+		netParams: NetworkParams{
+			latency:     runenv.IntParam("t_latency"),
+			latencyMax:  runenv.IntParam("t_latency_max"),
+			bandwidthMB: runenv.IntParam("bandwidth_mb"),
+			transport:   stringParam(runenv, "transport"),
+			family:      stringParam(runenv, "ip_family"),
+			ipFamilyPct: runenv.IntParam("ip_family_pct"),
+			jitterMs:    runenv.IntParam("jitter_ms"),
+			lossPct:     runenv.FloatParam("packet_loss_pct"),
+			corruptPct:  runenv.FloatParam("corrupt_pct"),
+		},
+		topologyType: stringParam(runenv, "topology_type"),
+		smallWorld: SmallWorldParams{
+			K:    runenv.IntParam("small_world_k"),
+			Beta: runenv.FloatParam("small_world_beta"),
+			Seed: int64(runenv.IntParam("topology_seed")),
+		},
+		topologyFile:      stringParam(runenv, "topology_file"),
+		nodesPerContainer: runenv.IntParam("n_nodes_per_container"),
+	}
+	if runenv.IsParamSet("topology") {
+		p.topologyDef = runenv.StringParam("topology")
+	}
+	if p.netParams.transport == "" {
+		p.netParams.transport = TransportTCP
+		if runenv.BooleanParam("quic") {
+			p.netParams.transport = TransportQUIC
+		}
+	}
+	if !validTransport(p.netParams.transport) {
+		panic(fmt.Errorf("unknown transport %s", p.netParams.transport))
+	}
+	if p.netParams.family == "" {
+		p.netParams.family = IPFamilyV4
+	}
+	if !validIPFamily(p.netParams.family) {
+		panic(fmt.Errorf("unknown ip family %s", p.netParams.family))
+	}
+	if p.topologyType == "" {
+		p.topologyType = "random"
+	}
+	profiles, err := parseBandwidthProfiles(stringParam(runenv, "bandwidth_profiles"))
+	if err != nil {
+		panic(err)
+	}
+	p.netParams.bandwidthProfiles = profiles
+	return p
+}
+
+// observe is a dry run of the test case: it performs discovery and connects
+// the topology the same way, writes the realized topology and the health of
+// the connections, and exits without running pubsub
+func observe(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
+	params := parseObserveParams(runenv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), params.setup+2*params.warmup)
+	defer cancel()
+
+	client, closeClient := boundSyncClient(ctx, runenv)
+	defer closeClient()
+	netclient := network.NewClient(client, runenv)
+
+	h, err := createHost(ctx, params.netParams.transport, false, metrics.NewBandwidthCounter(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	seq, err := client.Publish(ctx, tgsync.NewTopic("nodes", &peer.AddrInfo{}), host.InfoFromHost(h))
+	if err != nil {
+		return fmt.Errorf("failed to write peer subtree in sync service: %w", err)
+	}
+
+	np := params.netParams
+	if _, err := setupNetwork(ctx, runenv, netclient, np.latency, np.latencyMax, np.nodeBandwidthMB(seq, runenv.TestInstanceCount), np); err != nil {
+		return fmt.Errorf("Failed to set up network: %w", err)
+	}
+	netclient.MustWaitNetworkInitialized(ctx)
+
+	peerSubscriber := NewPeerSubscriber(ctx, runenv, client, runenv.TestInstanceCount)
+	peerSubscriber.quiet = seq != 1
+	peerSubscriber.batchSize = params.nodesPerContainer
+
+	topology, err := newTopology(params, seq, runenv.TestInstanceCount)
+	if err != nil {
+		return err
+	}
+	discovery, err := NewSyncDiscovery(h, seq, runenv, peerSubscriber, topology)
+	if err != nil {
+		return fmt.Errorf("error creating discovery service: %w", err)
+	}
+
+	laddr := listenAddrs(netclient, params.netParams.transport, false, 9000, np.ipFamily(seq, runenv.TestInstanceCount))
+	if err := h.Network().Listen(laddr...); err != nil {
+		return fmt.Errorf("error listening on %s: %w", laddr, err)
+	}
+	if err := discovery.registerAndWait(ctx); err != nil {
+		return fmt.Errorf("error waiting for discovery service: %s", err)
+	}
+
+	start := time.Now()
+	if err := discovery.ConnectTopology(ctx, 0); err != nil {
+		runenv.RecordMessage("Error connecting to topology peers: %s", err)
+	}
+	report := ObserverReport{
+		Seq:       seq,
+		PeerID:    h.ID().String(),
+		ConnectMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	for _, p := range discovery.Connected() {
+		if len(h.Network().ConnsToPeer(p.Info.ID)) > 0 {
+			report.Dialed = append(report.Dialed, p.NodeTypeSeq)
+		} else {
+			report.Failed = append(report.Failed, p.NodeTypeSeq)
+		}
+	}
+
+	// give the inbound connections of the other nodes time to settle
+	select {
+	case <-time.After(params.warmup):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, pid := range h.Network().Peers() {
+		if s := discovery.SeqOf(pid); s > 0 {
+			report.Peers = append(report.Peers, s)
+		}
+	}
+	runenv.R().RecordPoint("peers_connected", float64(len(report.Peers)))
+	runenv.R().RecordPoint("failed_dials", float64(len(report.Failed)))
+
+	if _, err := client.Publish(ctx, ObserverReportTopic, &report); err != nil {
+		return fmt.Errorf("failed to publish observer report: %w", err)
+	}
+	if seq != 1 {
+		return nil
+	}
+
+	reports, err := collectObserverReports(ctx, runenv, client)
+	if err != nil {
+		return err
+	}
+	nodes := make([]NodeReport, 0, len(reports))
+	for _, r := range reports {
+		nodes = append(nodes, NodeReport{Seq: r.Seq, PeerID: r.PeerID, Dialed: r.Dialed})
+	}
+	if err := writeTopologyFiles(runenv.TestOutputsPath, buildTopology(nodes)); err != nil {
+		return err
+	}
+
+	health := computeConnectionHealth(reports)
+	runenv.RecordMessage("topology has %d components, %d isolated nodes and %d failed dials",
+		health.Components, len(health.Isolated), health.FailedDials)
+	jsonstr, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s%c%s", runenv.TestOutputsPath, os.PathSeparator, outputs.ConnectionHealthFile)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
+
+func collectObserverReports(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client) ([]ObserverReport, error) {
+	reportCh := make(chan *ObserverReport, 16)
+	sctx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	if _, err := client.Subscribe(sctx, ObserverReportTopic, reportCh); err != nil {
+		return nil, err
+	}
+
+	reports := make([]ObserverReport, 0, runenv.TestInstanceCount)
+	for len(reports) < runenv.TestInstanceCount {
+		select {
+		case r, ok := <-reportCh:
+			if !ok {
+				return nil, fmt.Errorf("not enough observer reports. expected %d, got %d", runenv.TestInstanceCount, len(reports))
+			}
+			reports = append(reports, *r)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Seq < reports[j].Seq })
+	return reports, nil
+}
+
+// computeConnectionHealth summarizes the degree of the nodes, and counts the
+// connected components of the graph of their connections
+func computeConnectionHealth(reports []ObserverReport) outputs.ConnectionHealth {
+	health := outputs.ConnectionHealth{Version: outputs.SchemaVersion}
+
+	parent := make(map[int64]int64, len(reports))
+	var find func(s int64) int64
+	find = func(s int64) int64 {
+		if parent[s] != s {
+			parent[s] = find(parent[s])
+		}
+		return parent[s]
+	}
+	for _, r := range reports {
+		parent[r.Seq] = r.Seq
+	}
+
+	var total int
+	for i, r := range reports {
+		degree := len(r.Peers)
+		health.Nodes = append(health.Nodes, outputs.NodeConnections{
+			Seq:       r.Seq,
+			Dialed:    len(r.Dialed),
+			Failed:    r.Failed,
+			Degree:    degree,
+			ConnectMs: r.ConnectMs,
+		})
+		health.FailedDials += len(r.Failed)
+		if degree == 0 {
+			health.Isolated = append(health.Isolated, r.Seq)
+		}
+		if i == 0 || degree < health.MinDegree {
+			health.MinDegree = degree
+		}
+		if degree > health.MaxDegree {
+			health.MaxDegree = degree
+		}
+		total += degree
+
+		for _, s := range r.Peers {
+			if _, ok := parent[s]; ok {
+				parent[find(r.Seq)] = find(s)
+			}
+		}
+	}
+	if len(reports) > 0 {
+		health.MeanDegree = float64(total) / float64(len(reports))
+	}
+	for s := range parent {
+		if find(s) == s {
+			health.Components++
+		}
+	}
+	return health
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// deliveryOrder records the sequence numbers of the messages delivered from
+// each publisher on each topic, in the order they were first delivered. It is
+// guarded by the node's handleLk.
+type deliveryOrder map[string][]int64
+
+func (o *deliveryOrder) record(topic string, m *Msg) {
+	if *o == nil {
+		*o = make(deliveryOrder)
+	}
+	key := topic + "/" + m.Sender
+	(*o)[key] = append((*o)[key], m.Seq)
+}
+
+// reordering returns the number of deliveries of messages published before an
+// already delivered message of the same publisher, and the largest distance
+// between the position of a message in the delivery order and in the publish
+// order
+func (o deliveryOrder) reordering() (deliveries int64, outOfOrder int64, maxDisplacement int) {
+	for _, seqs := range o {
+		deliveries += int64(len(seqs))
+
+		ranks := make([]int64, len(seqs))
+		copy(ranks, seqs)
+		sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+		rank := make(map[int64]int, len(ranks))
+		for i, seq := range ranks {
+			rank[seq] = i
+		}
+
+		highest := int64(-1)
+		for i, seq := range seqs {
+			if seq < highest {
+				outOfOrder++
+			} else {
+				highest = seq
+			}
+			d := i - rank[seq]
+			if d < 0 {
+				d = -d
+			}
+			if d > maxDisplacement {
+				maxDisplacement = d
+			}
+		}
+	}
+	return deliveries, outOfOrder, maxDisplacement
+}
+
+// summarizeOrdering aggregates the reordering of the deliveries to the honest
+// nodes
+func summarizeOrdering(reports []NodeReport) outputs.Ordering {
+	var s outputs.Ordering
+	var displacements int
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		s.Nodes++
+		s.Deliveries += r.Deliveries
+		s.OutOfOrder += r.OutOfOrder
+		displacements += r.MaxDisplacement
+		if r.MaxDisplacement > s.MaxDisplacement {
+			s.MaxDisplacement = r.MaxDisplacement
+		}
+		if r.OutOfOrder > 0 {
+			s.NodesOutOfOrder++
+		}
+	}
+	if s.Deliveries > 0 {
+		s.OutOfOrderFraction = float64(s.OutOfOrder) / float64(s.Deliveries)
+	}
+	if s.Nodes > 0 {
+		s.MeanMaxDisplacement = float64(displacements) / float64(s.Nodes)
+	}
+	return s
+}
@@ -0,0 +1,282 @@
+// Package outputs defines the format of the files written by the gossipsub test
+// plan, and helpers to decode them. Downstream tooling should depend on these
+// types rather than on the layout of the files.
+//
+// Every top level type carries a Version field. SchemaVersion is bumped whenever
+// a field is removed or changes meaning; adding fields does not change it.
+package outputs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SchemaVersion is the version of the output formats written by this plan
+const SchemaVersion = 1
+
+// Names of the files written to the test outputs path. Per-node files are
+// suffixed with the node's sequence number, eg throughput-3.json.
+const (
+	SummaryFile            = "summary.json"
+	ScoreboardFile         = "attack-scoreboard.json"
+	TopologyFile           = "topology.json"
+	TopologyGraphMLFile    = "topology.graphml"
+	TopologyDOTFile        = "topology.dot"
+	StormFile              = "storm.json"
+	BaselineComparisonFile = "baseline-comparison.json"
+	CommitteeFile          = "committee.json"
+	ConnectionHealthFile   = "connection-health.json"
+	MeshGraphFile          = "mesh-graph.json"
+	LatencyCDFFile         = "latency-cdf.json"
+	LatencyCDFCSVFile      = "latency-cdf.csv"
+	OverheadFile           = "overhead.json"
+	SLOFile                = "slo.json"
+	TimelineFile           = "timeline.json"
+	HealthGateFile         = "health-gate.json"
+	MeshFormationFile      = "mesh-formation.json"
+
+	ThroughputPrefix       = "throughput-"
+	FanoutTransitionPrefix = "fanout-transition-"
+	PingRTTPrefix          = "ping-rtt-"
+	TopicLatencyPrefix     = "topic-latency-"
+	PeerScoresPrefix       = "peer-scores-"
+	ScoreReplacementPrefix = "score-replacements-"
+	CustomEventsPrefix     = "custom-events-"
+	TracerOutputsPrefix    = "tracer-output-"
+	MeshSnapshotsPrefix    = "mesh-snapshots-"
+)
+
+func checkVersion(version int) error {
+	if version > SchemaVersion {
+		return fmt.Errorf("unsupported output version %d, this package supports up to %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// DecodeSummary decodes the run summary written by the leader
+func DecodeSummary(r io.Reader) (*Summary, error) {
+	var s Summary
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, checkVersion(s.Version)
+}
+
+// DecodeScoreboard decodes the attack scoreboard written by the leader
+func DecodeScoreboard(r io.Reader) (*AttackScoreboard, error) {
+	var s AttackScoreboard
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, checkVersion(s.Version)
+}
+
+// DecodeBaselineComparison decodes the comparison with a baseline run
+func DecodeBaselineComparison(r io.Reader) (*BaselineComparison, error) {
+	var c BaselineComparison
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, checkVersion(c.Version)
+}
+
+// DecodeCommittee decodes the committee collector's report
+func DecodeCommittee(r io.Reader) (*Committee, error) {
+	var c Committee
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, checkVersion(c.Version)
+}
+
+// DecodeStorm decodes the storm report written by the leader
+func DecodeStorm(r io.Reader) (*Storm, error) {
+	var s Storm
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, checkVersion(s.Version)
+}
+
+// DecodeTopology decodes the realized topology
+func DecodeTopology(r io.Reader) (*Topology, error) {
+	var t Topology
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, checkVersion(t.Version)
+}
+
+// DecodeOverhead decodes the traffic breakdown of every node written by the
+// leader
+func DecodeOverhead(r io.Reader) (*Overhead, error) {
+	var o Overhead
+	if err := json.NewDecoder(r).Decode(&o); err != nil {
+		return nil, err
+	}
+	return &o, checkVersion(o.Version)
+}
+
+// DecodeTimeline decodes the timeline of the run written by the leader
+func DecodeTimeline(r io.Reader) (*Timeline, error) {
+	var t Timeline
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, checkVersion(t.Version)
+}
+
+// DecodeSLOReport decodes the evaluation of the service level objectives
+func DecodeSLOReport(r io.Reader) (*SLOReport, error) {
+	var s SLOReport
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, checkVersion(s.Version)
+}
+
+// DecodeHealthGate decodes the mesh health the publishing phase was gated on
+func DecodeHealthGate(r io.Reader) (*HealthGate, error) {
+	var g HealthGate
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, err
+	}
+	return &g, checkVersion(g.Version)
+}
+
+// DecodeLatencyCDF decodes the latency distribution of all the nodes
+func DecodeLatencyCDF(r io.Reader) (*LatencyCDF, error) {
+	var c LatencyCDF
+	if err := json.NewDecoder(r).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, checkVersion(c.Version)
+}
+
+// DecodeMeshGraph decodes the global mesh over time written by the leader
+func DecodeMeshGraph(r io.Reader) (*MeshGraph, error) {
+	var g MeshGraph
+	if err := json.NewDecoder(r).Decode(&g); err != nil {
+		return nil, err
+	}
+	return &g, checkVersion(g.Version)
+}
+
+// DecodeConnectionHealth decodes the connection health written by the observe
+// test case
+func DecodeConnectionHealth(r io.Reader) (*ConnectionHealth, error) {
+	var h ConnectionHealth
+	if err := json.NewDecoder(r).Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, checkVersion(h.Version)
+}
+
+// DecodeThroughput decodes a node's windowed throughput
+func DecodeThroughput(r io.Reader) (*Throughput, error) {
+	var t Throughput
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, checkVersion(t.Version)
+}
+
+// DecodeFanoutTransition decodes the publisher's fanout to mesh transition
+func DecodeFanoutTransition(r io.Reader) (*FanoutTransition, error) {
+	var f FanoutTransition
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, checkVersion(f.Version)
+}
+
+// DecodeTopicLatencies decodes a node's per-topic delivery latencies
+func DecodeTopicLatencies(r io.Reader) (*TopicLatencies, error) {
+	var t TopicLatencies
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, err
+	}
+	return &t, checkVersion(t.Version)
+}
+
+// DecodePingRTTs decodes a node's measured link RTTs
+func DecodePingRTTs(r io.Reader) (*PingRTTs, error) {
+	var p PingRTTs
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, checkVersion(p.Version)
+}
+
+// DecodeScoreSamples decodes a node's peer score samples, one json object per line
+func DecodeScoreSamples(r io.Reader) ([]ScoreSample, error) {
+	var samples []ScoreSample
+	err := decodeLines(r, func(line []byte) error {
+		var s ScoreSample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		samples = append(samples, s)
+		return checkVersion(s.Version)
+	})
+	return samples, err
+}
+
+// DecodeScoreReplacements decodes a node's score-driven mesh replacements, one
+// json object per line
+func DecodeScoreReplacements(r io.Reader) ([]ScoreReplacement, error) {
+	var replacements []ScoreReplacement
+	err := decodeLines(r, func(line []byte) error {
+		var s ScoreReplacement
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		replacements = append(replacements, s)
+		return checkVersion(s.Version)
+	})
+	return replacements, err
+}
+
+// DecodeCustomEvents decodes a node's custom trace events, one json object per line
+func DecodeCustomEvents(r io.Reader) ([]CustomEvent, error) {
+	var events []CustomEvent
+	err := decodeLines(r, func(line []byte) error {
+		var e CustomEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		events = append(events, e)
+		return checkVersion(e.Version)
+	})
+	return events, err
+}
+
+// DecodeMeshSnapshots decodes a node's mesh snapshots, one json object per line
+func DecodeMeshSnapshots(r io.Reader) ([]MeshSnapshot, error) {
+	var snapshots []MeshSnapshot
+	err := decodeLines(r, func(line []byte) error {
+		var s MeshSnapshot
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		snapshots = append(snapshots, s)
+		return checkVersion(s.Version)
+	})
+	return snapshots, err
+}
+
+func decodeLines(r io.Reader, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
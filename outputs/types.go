@@ -0,0 +1,1137 @@
+package outputs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Summary is the run summary written by the leader (seq 1) at the end of the run
+type Summary struct {
+	Version    int
+	Nodes      int
+	Messages   int
+	LossCauses LossCauses
+	// first delivery latency of the honest nodes
+	Latency LatencyStats
+	// whether every honest node got every message
+	Completeness *Completeness `json:",omitempty"`
+	// gossipsub parameters of the leader, which runs with the parameters of
+	// the run. Nil for floodsub
+	Router *RouterParams `json:",omitempty"`
+	// time for the honest nodes' meshes to reach D peers, by topic
+	MeshFormation map[string]MeshFormation
+	// GRAFT and PRUNE events of the honest nodes during the run
+	MeshChurn MeshChurn
+	// order of the deliveries to the honest nodes against the publish order
+	Ordering Ordering
+	// how evenly the honest nodes share the upload load
+	Fairness Fairness
+	// characteristics of the realized topology
+	Graph GraphMetrics
+	// duplicates and control traffic of the honest nodes, by topic. The
+	// breakdown of every node is in overhead.json
+	Overhead Overhead
+	// estimated IWANT requests served and refused by the honest nodes against
+	// the retransmission limit
+	IWants IWantServing
+	// simulated clock skew of each node in milliseconds, by sequence number.
+	// Only set when clock drift is enabled
+	ClockOffsetsMs map[int64]int64 `json:",omitempty"`
+	// consumers of each class of a preset scenario, by class name
+	Classes map[string]ClassSummary `json:",omitempty"`
+	// nodes consistently in the tail of the delivery latency. Only set when
+	// straggler detection is enabled
+	Stragglers *Stragglers `json:",omitempty"`
+	// deliveries later than the deadline or missing. Only set when a
+	// delivery deadline is set
+	DeadlineMisses *DeadlineMisses `json:",omitempty"`
+	// deliveries of each phase. Only set by the phased workload
+	Phases *Phases `json:",omitempty"`
+	// deliveries around a network partition. Only set when partitioning
+	Partition *Partition `json:",omitempty"`
+	// deliveries of each repetition of the measured window. Only set when
+	// repeating it
+	Repetitions *Repetitions `json:",omitempty"`
+	// deliveries of the victim's messages. Only set by the eclipse scenario
+	Eclipse *Eclipse `json:",omitempty"`
+	// connections closed for idleness. Only set when idle disconnection is
+	// enabled
+	Idle *IdleDisconnect `json:",omitempty"`
+	// PRUNEs flooded by the attackers and the penalties they got. Only set
+	// when the PRUNE flood is enabled
+	PruneFlood *PruneFlood `json:",omitempty"`
+	// IHAVEs and IWANTs spammed by the attackers, the messages the victims
+	// retransmitted and the penalties they gave. Only set when the gossip spam
+	// is enabled
+	GossipSpam *GossipSpam `json:",omitempty"`
+	// place of the lazy nodes in the honest meshes, their scores and the
+	// deliveries to the honest nodes. Only set when there are lazy nodes
+	Lazy *Lazy `json:",omitempty"`
+	// mesh health the publishing phase was gated on, also written to
+	// health-gate.json. Only set when the health gate is enabled
+	HealthGate *HealthGate `json:",omitempty"`
+	// peers exchanged on PRUNE and the meshes they sustained. Only set when
+	// peer exchange is enabled
+	PeerExchange *PeerExchange `json:",omitempty"`
+	// validation decisions of all the nodes. Only set when the nodes run a
+	// validator
+	Validation *Validation `json:",omitempty"`
+	// how the nodes hit by the restart fault rejoined. Only set when a node
+	// restarted
+	Restarts *Restarts `json:",omitempty"`
+	// interfaces used by the multi-homed nodes. Only set when multi-homing
+	// is enabled
+	Multihoming *Multihoming `json:",omitempty"`
+	// deliveries to the NAT'd nodes against the public ones. Only set when
+	// nodes are NAT'd
+	NAT *NAT `json:",omitempty"`
+	// deliveries to the nodes running another implementation against the
+	// others. Only set when there is an interop cohort
+	Interop *Interop `json:",omitempty"`
+	// CPU time and delivery latency under the signature policy of the run
+	Signing *Signing `json:",omitempty"`
+	// cost of the payload encryption. Only set when payloads are encrypted
+	Encryption *Encryption `json:",omitempty"`
+	// anomalies logged by the watchdog of the nodes. Only set when the
+	// watchdog is enabled
+	Anomalies *Anomalies `json:",omitempty"`
+}
+
+// RunCost is the CPU time and the delivery latency of the honest nodes, to
+// compare runs with different settings. CPUSecs is the CPU time of the
+// nodes' processes during the measured window, which includes everything
+// else they did, and is left out of local runs where the nodes share a
+// process.
+type RunCost struct {
+	Nodes            int
+	Deliveries       int64
+	CPUSecs          Estimate
+	CPUPerDeliveryMs float64
+	MeanLatencyMs    float64
+}
+
+// Signing is the cost of the signature policy of the run, to compare runs
+// with and without signatures
+type Signing struct {
+	Policy string
+	RunCost
+}
+
+// Encryption is the cost of the payload encryption: the time spent sealing
+// and opening the payloads, the bytes it adds to each of them, and the cost
+// of the run to compare with a run without encryption at the same message
+// size
+type Encryption struct {
+	Sealed           int64
+	Opened           int64
+	MeanSealUs       float64
+	MeanOpenUs       float64
+	SealUsPerKB      float64
+	MeanPayloadBytes int64
+	OverheadBytes    int
+	RunCost
+}
+
+// Anomalies counts the anomalies logged by the nodes during the run, and the
+// sequence numbers of the nodes that logged any. Each anomaly is also a custom
+// event of the node that logged it.
+type Anomalies struct {
+	Total  int
+	ByKind map[string]int
+	Nodes  []int64
+}
+
+// NAT compares the delivery latency and ratio of the honest nodes reachable
+// only through a relay with the public ones. The penalties are the NAT'd
+// percentiles minus the public ones.
+type NAT struct {
+	Relays       int
+	NATNodes     int
+	PublicNodes  int
+	RelayedConns int
+
+	NATLatencyMs        LatencyStats
+	PublicLatencyMs     LatencyStats
+	P50PenaltyMs        float64
+	P99PenaltyMs        float64
+	NATDeliveryRatio    float64
+	PublicDeliveryRatio float64
+}
+
+// Interop compares the deliveries to the nodes running another pubsub
+// implementation in an external process with those to the other honest nodes
+type Interop struct {
+	Implementation string
+	Interop        InteropCohort
+	Native         InteropCohort
+}
+
+// InteropCohort is the deliveries to the nodes of one implementation. The
+// latency is over the mean latencies of the nodes.
+type InteropCohort struct {
+	Nodes           int
+	CompleteNodes   int
+	Deliveries      int64
+	CompletenessPct float64
+	MeanLatencyMs   Estimate
+}
+
+// Multihoming counts the connections and mesh peers of the multi-homed nodes
+// over their primary (IPv4) and second (IPv6) interface, to show which of
+// their addresses the dialers picked and which links the meshes kept
+type Multihoming struct {
+	Nodes              int
+	PrimaryConns       int
+	SecondaryConns     int
+	PrimaryMeshPeers   int
+	SecondaryMeshPeers int
+	SecondaryConnShare float64
+	SecondaryMeshShare float64
+}
+
+// Restarts summarizes the restarts of the nodes with the same identity: the
+// previously known peers they redialed, the time until their first mesh peer
+// and until their meshes were back to D_lo peers, and how many of the
+// messages published while they were down they eventually received
+type Restarts struct {
+	Restarts   int
+	KnownPeers int
+	Redialed   int
+
+	FirstGraftMs   LatencyStats
+	MeshRecoveryMs LatencyStats
+
+	Missed         int64
+	Recovered      int64
+	RecoveredRatio float64
+}
+
+// Validation adds up the validation decisions of all the nodes, by verdict,
+// and by the cohort of the validating node and of the propagation source
+type Validation struct {
+	Accepted int64
+	Rejected int64
+	Ignored  int64
+	Outcomes []ValidationOutcome
+}
+
+// ValidationOutcome is the number of decisions with the same verdict and
+// reason. Validator and Source are honest or attacker, and Source is unknown
+// for peers that are not test instances, like sybil identities.
+type ValidationOutcome struct {
+	Validator     string
+	Source        string
+	Verdict       string
+	Reason        string
+	Count         int64
+	MeanLatencyMs float64
+}
+
+// ValidationEvent is the data of the validation custom event: the verdict of
+// the validator on a message received from a peer, its reason and how long
+// the validation took
+type ValidationEvent struct {
+	Topic     string
+	MessageID string
+	From      string
+	Verdict   string
+	Reason    string
+	LatencyMs float64
+}
+
+// PruneFlood summarizes the mesh churning attack: the GRAFTs and PRUNEs with
+// bogus PX sent by the attackers' identities, the PRUNEs the victims sent
+// back, the scores the victims gave to the identities, and the mesh churn of
+// the victims against the other honest nodes
+type PruneFlood struct {
+	IntervalSecs float64
+	PX           int
+	Attackers    int
+	Identities   int
+	Victims      int
+
+	GraftsSent int64
+	PrunesSent int64
+	PXSent     int64
+	PrunedBack int64
+	// PRUNEs from the identities traced by the victims
+	PrunesReceived int64
+
+	// scores of the identities at the end of the run, over every victim
+	// that scored them
+	ScoredIdentities  int
+	MeanIdentityScore float64
+	MinIdentityScore  float64
+	NegativeScores    int
+
+	VictimMeshChurnPerMin float64
+	OtherMeshChurnPerMin  float64
+}
+
+// GossipSpam summarizes the IHAVE/IWANT spam attack: the bogus IDs announced
+// and the IWANTs sent by the attackers' identities, the messages the victims
+// served to them against the gossip retransmission limit, and the scores the
+// victims gave to the identities
+type GossipSpam struct {
+	Rate       int
+	IDs        int
+	Attackers  int
+	Identities int
+
+	IHaveIDsSent int64
+	IWantIDsSent int64
+	// IWANTs the victims sent back for the bogus IDs
+	BogusIDsRequested int64
+	MessagesServed    int64
+	// most times a victim served the same message to one identity, held
+	// if it never went over the retransmission limit
+	MaxServedPerIdentity    int64
+	RetransmissionLimit     int
+	RetransmissionLimitHeld bool
+
+	ScoredIdentities  int
+	MeanIdentityScore float64
+	MinIdentityScore  float64
+	NegativeScores    int
+}
+
+// Lazy summarizes the lazy nodes, which stay in the meshes but never forward
+// or gossip a message: their share of the mesh slots of the honest nodes
+// against their share of the nodes, the scores the honest nodes gave them and
+// to each other, and the deliveries to the honest nodes
+type Lazy struct {
+	Pct         int
+	LazyNodes   int
+	HonestNodes int
+
+	NodeShare     float64
+	LazyMeshShare float64
+
+	LazyScore          Estimate
+	HonestScore        Estimate
+	NegativeLazyScores int
+
+	HonestCompletenessPct float64
+	HonestMeanLatencyMs   Estimate
+}
+
+// PeerExchange adds up the peers the honest nodes received in PX, with or
+// without a signed peer record, and the connections they opened to peers
+// they didn't dial themselves. The meshes at the end of the run show whether
+// PX sustained them, leaving out the bootstrap nodes of the px discovery mode.
+type PeerExchange struct {
+	Bootstrappers int
+
+	PeersReceived uint64
+	SignedRecords uint64
+	SignedShare   float64
+	PXConnections int
+
+	Nodes         int
+	NodesBelowDlo int
+	MeanMeshSize  float64
+}
+
+// RouterParams are the gossipsub parameters a node ran with, after the
+// overrides of its class or misconfiguration
+type RouterParams struct {
+	D      int
+	Dlo    int
+	Dhi    int
+	Dscore int
+	Dlazy  int
+	Dout   int
+
+	HeartbeatIntervalMs float64
+	GossipFactor        float64
+	HistoryLength       int
+	HistoryGossip       int
+
+	GossipRetransmission int
+
+	// peer score thresholds. Only set when peer scoring is enabled
+	ScoreThresholds *ScoreThresholds `json:",omitempty"`
+}
+
+// ScoreThresholds are the peer score thresholds of the router
+type ScoreThresholds struct {
+	Gossip             float64
+	Publish            float64
+	Graylist           float64
+	AcceptPX           float64
+	OpportunisticGraft float64
+}
+
+// IdleDisconnect adds up the connections closed by the nodes that close their
+// idle connections, and the redials of the other nodes. The impact on the
+// meshes shows in MeshChurn.
+type IdleDisconnect struct {
+	TimeoutSecs float64
+	Pct         int
+	Closers     int
+
+	Disconnects int64
+	// disconnected peers that were in a mesh of the closing node
+	MeshDisconnects int64
+	Redials         int64
+}
+
+// Eclipse summarizes the eclipse scenario: the largest share of the victim's
+// mesh held by the attackers, and whether the honest nodes other than the
+// victim still received its messages
+type Eclipse struct {
+	Victim       int64
+	Attackers    int
+	MaxMeshShare float64
+	// outbound quota of the meshes, the honest peers the victim dialed in
+	// the dout scenario, the fraction of the victim's mesh samples held
+	// entirely by attackers after the warmup, and the fewest outbound peers
+	// left in its mesh
+	Dout                 int
+	VictimOutbound       int `json:",omitempty"`
+	EclipsedFraction     float64
+	MinOutboundMeshPeers int
+
+	Nodes int
+	// nodes that missed at least one of the messages
+	NodesMissing      int
+	Expected          int
+	Delivered         int
+	DeliveredFraction float64
+}
+
+// Partition summarizes the deliveries of the messages published before, during
+// and after a network partition, and the time for the meshes of the honest
+// nodes to get back to D_lo peers once it healed
+type Partition struct {
+	Groups         int
+	StartSecs      float64
+	DurationSecs   float64
+	Before         PhaseSummary
+	During         PhaseSummary
+	After          PhaseSummary
+	MeshRecoveryMs LatencyStats
+}
+
+// Ordering measures how far the honest nodes received the messages of each
+// publisher out of their publish order. A delivery is out of order when a
+// later message of the same publisher was delivered before it, and its
+// displacement is the distance between its position in the delivery order and
+// in the publish order.
+type Ordering struct {
+	Nodes           int
+	NodesOutOfOrder int
+	Deliveries      int64
+	OutOfOrder      int64
+
+	OutOfOrderFraction float64
+	// largest displacement, and mean across the nodes of their largest one
+	MaxDisplacement     int
+	MeanMaxDisplacement float64
+}
+
+// Fairness measures how evenly the honest nodes share the load of the run.
+// The ratio of a node is the bytes it uploaded over the bytes it downloaded,
+// and the Gini coefficients are 0 when every node contributes the same and
+// approach 1 when a single node carries all the load.
+type Fairness struct {
+	Nodes    int
+	BytesOut int64
+	BytesIn  int64
+
+	UploadGini float64
+	RatioGini  float64
+	MinRatio   float64
+	MeanRatio  float64
+	MaxRatio   float64
+}
+
+// MeshChurn is the distribution across the honest nodes of the number of local
+// GRAFT and PRUNE events per minute, from the end of the warmup
+type MeshChurn struct {
+	Nodes      int
+	MeanPerMin float64
+	P50PerMin  float64
+	P90PerMin  float64
+	P99PerMin  float64
+	MaxPerMin  float64
+}
+
+// Phases summarizes the deliveries of each phase of the phased workload, in
+// the order the phases ran
+type Phases struct {
+	// whether the order was randomized, and the seed used to shuffle it
+	Randomized bool
+	Seed       int64
+	Order      []string
+	Phases     []PhaseResult
+}
+
+// Repetitions summarizes the deliveries of each repetition of the measured
+// window over the same overlay, and the spread of the metrics across them
+type Repetitions struct {
+	Count         int
+	Runs          []RepetitionResult
+	DeliveryRatio Estimate
+	MeanLatencyMs Estimate
+}
+
+type RepetitionResult struct {
+	Index int
+	// unix time at which the repetition started, and how long it ran
+	StartSecs    float64
+	DurationSecs float64
+	PhaseSummary
+}
+
+// Estimate is the mean of a metric over several samples, with its 95%
+// confidence interval from the t distribution
+type Estimate struct {
+	Samples  int
+	Mean     float64
+	StdDev   float64
+	CI95Low  float64
+	CI95High float64
+}
+
+type PhaseResult struct {
+	Name string
+	// unix time at which the phase started publishing
+	StartSecs float64
+	PhaseSummary
+}
+
+// DeadlineMisses counts the honest nodes, other than the sender, that received
+// each message after the deadline or never, like slot based chains judge the
+// gossip of their blocks and attestations
+type DeadlineMisses struct {
+	DeadlineMs float64
+	Messages   int
+	// deliveries expected, on time, late and missing
+	Expected int64
+	OnTime   int64
+	Late     int64
+	Never    int64
+	// fractions of the expected deliveries that were late or missing
+	MissRate  float64
+	LateRate  float64
+	NeverRate float64
+	// messages missed by at least one node, and the distribution of the
+	// fraction of nodes missing each message
+	MessagesMissed  int
+	MessageMissRate MissRateDistribution
+}
+
+type MissRateDistribution struct {
+	P50 float64
+	P90 float64
+	P99 float64
+	Max float64
+}
+
+// Stragglers lists the nodes whose delivery latency was above the Percentile
+// of the latencies of the same message for at least MinFraction of the
+// messages they received
+type Stragglers struct {
+	Percentile  float64
+	MinFraction float64
+	// nodes that received messages
+	Nodes      int
+	Stragglers []Straggler
+	// number of stragglers in each class
+	Classes map[string]int
+	// mean number of connected peers of all the nodes and of the stragglers
+	MeanDegree          float64
+	StragglerMeanDegree float64
+}
+
+type Straggler struct {
+	Seq    int64
+	PeerID string
+	Class  string `json:",omitempty"`
+	Degree int
+	// only set by the geo latency model
+	Location      *GeoLocation `json:",omitempty"`
+	Messages      int
+	SlowFraction  float64
+	MeanLatencyMs float64
+}
+
+// GeoLocation is a point on the earth, in degrees
+type GeoLocation struct {
+	Lat float64
+	Lon float64
+}
+
+// ClassSummary is the delivery latency of a class of consumers. The fairness
+// fields are Jain's index over the nodes of the class, from 1/n to 1 (fair).
+type ClassSummary struct {
+	Nodes   int
+	Latency LatencyStats
+	// fairness of the nodes' mean latencies
+	LatencyFairness float64
+	// fairness of the number of messages delivered to each node
+	DeliveryFairness float64
+}
+
+// Completeness is the share of the messages published by the other nodes
+// that each honest node received, checked against the sequence numbers the
+// publishers reported. Reliability is the share over all the nodes.
+type Completeness struct {
+	Messages      int
+	Expected      int
+	Received      int
+	Reliability   float64
+	CompleteNodes int
+	Nodes         []NodeCompleteness
+}
+
+// NodeCompleteness is the share of the expected messages a node received
+type NodeCompleteness struct {
+	Seq             int64
+	Expected        int
+	Received        int
+	CompletenessPct float64
+}
+
+// LossCauses attributes every expected but missing delivery to a likely cause
+type LossCauses struct {
+	Expected  int
+	Delivered int
+	Lost      int
+
+	// the node was down when the message was published
+	NodeDown int
+	// the node received the message but rejected it
+	Rejected int
+	// a neighbor dropped the message from its outbound queue to the node
+	QueueDrop int
+	// none of the node's neighbors received the message either
+	NeverReachedNeighbors int
+	Unknown               int
+}
+
+// MeshFormation is the distribution of the time it took for the nodes' meshes
+// to reach D peers, measured from each node's first connection
+type MeshFormation struct {
+	Nodes int
+	// nodes whose mesh reached D peers
+	Formed int
+	TimeMs LatencyStats
+}
+
+// PhaseSummary aggregates the deliveries of the messages published in one phase of the run
+type PhaseSummary struct {
+	Published     int64
+	Delivered     int64
+	DeliveryRatio float64
+	MeanLatencyMs float64
+}
+
+// AttackScoreboard is the standard report for mitigation experiments
+type AttackScoreboard struct {
+	Version            int
+	AttackStartSecs    float64
+	AttackDurationSecs float64
+	HonestNodes        int
+	AttackerNodes      int
+
+	Baseline PhaseSummary
+	Attack   PhaseSummary
+	Recovery PhaseSummary
+
+	DeliveryRatioDelta float64
+	AddedLatencyMs     float64
+	AttackerBytesOut   int64
+	// whether delivery fell out of the baseline levels after the start of the
+	// attack
+	Degraded bool
+	// Seconds from the start of the attack until delivery is back to baseline
+	// levels after degrading, or -1 if it never degraded or never recovered
+	TimeToMitigationSecs float64
+
+	// scores given by the honest nodes to honest and attacker peers. Only set
+	// with peer scoring
+	Scores *ScoreComparison `json:",omitempty"`
+}
+
+// ScoreComparison compares the scores of honest and attacker peers at the end
+// of the attack window and at the end of the run
+type ScoreComparison struct {
+	Attack ScoreWindow
+	After  ScoreWindow
+}
+
+type ScoreWindow struct {
+	Honest   ScoreDistribution
+	Attacker ScoreDistribution
+	// how far below the honest peers the attackers are scored
+	MedianGap float64
+}
+
+type ScoreDistribution struct {
+	Count    int
+	Min      float64
+	Median   float64
+	Mean     float64
+	Max      float64
+	Negative int
+}
+
+// BaselineComparison compares the run summary with the summary of a previous run
+type BaselineComparison struct {
+	Version  int
+	Baseline string
+	// maximum tolerated worsening of each ratio
+	Tolerance float64
+	// maximum tolerated increase of each latency, as a fraction of the
+	// baseline
+	LatencyTolerance float64
+	Metrics          []MetricDelta
+	Regressions      int
+}
+
+// MetricDelta is the change of one metric relative to the baseline
+type MetricDelta struct {
+	Name       string
+	Baseline   float64
+	Current    float64
+	Delta      float64
+	Regression bool
+}
+
+// Timeline lists the scheduled and the observed events of the run, in unix
+// nanoseconds. It is the common time reference of the other outputs.
+type Timeline struct {
+	Version  int
+	RunStart int64
+	Events   []TimelineEvent
+}
+
+// TimelineEvent is an event of the run, like a fault, a network change, a
+// partition, the attack window or a phase boundary. Planned is zero for the
+// events that are not scheduled, like churn. Phase boundaries are derived
+// from the leader's publish start rather than observed.
+type TimelineEvent struct {
+	Kind    string
+	Name    string
+	Planned int64 `json:",omitempty"`
+	// first and last time the nodes in Seqs observed the event
+	FirstActual int64
+	LastActual  int64
+	Seqs        []int64
+}
+
+// HealthGate is the health of the honest nodes' meshes once they joined the
+// topics, against the share of healthy nodes the publishing phase requires.
+// A node is healthy when the mesh of every topic reached Dlo peers before the
+// timeout. Unhealthy nodes without Dlo connected peers are underconnected,
+// the others weren't grafted.
+type HealthGate struct {
+	Version     int
+	RequiredPct int
+	TimeoutSecs float64
+
+	Nodes        int
+	HealthyNodes int
+	HealthyPct   float64
+	Passed       bool
+
+	Underconnected int
+	Ungrafted      int
+	// honest nodes that never reported, counted as unhealthy
+	Missing int
+	// attackers and nodes that subscribe late, left out
+	Attackers int
+	LateNodes int
+
+	// time the honest nodes waited for their meshes
+	WaitMs    LatencyStats
+	Unhealthy []UnhealthyNode `json:",omitempty"`
+}
+
+// UnhealthyNode is a node whose meshes didn't reach Dlo peers, with its
+// connected peers and mesh size by topic
+type UnhealthyNode struct {
+	Seq       int64
+	Peers     int
+	Dlo       int
+	MeshSizes map[string]int
+}
+
+// SLOReport is the evaluation of the service level objectives of the run, one
+// check per objective and cohort
+type SLOReport struct {
+	Version    int
+	Checks     []SLOCheck
+	Violations int
+}
+
+// SLOCheck is the value of a metric over the honest nodes of a cohort, and
+// whether it is out of its bounds. Cohorts without nodes are never violated.
+type SLOCheck struct {
+	Cohort   string
+	Metric   string
+	Nodes    int
+	Value    float64
+	Min      *float64 `json:",omitempty"`
+	Max      *float64 `json:",omitempty"`
+	Violated bool
+}
+
+// Storm is the report for the GRAFT/PRUNE storm scenario, comparing the data
+// plane before, during and after the synchronized rewiring
+type Storm struct {
+	Version     int
+	StartSecs   float64
+	WindowSecs  float64
+	HonestNodes int
+
+	Before PhaseSummary
+	During PhaseSummary
+	After  PhaseSummary
+
+	DeliveryRatioDelta float64
+	AddedLatencyMs     float64
+	// local mesh changes of all honest nodes during the storm window
+	Grafts int64
+	Prunes int64
+}
+
+// FanoutTransition follows a publisher that subscribes to a topic it was
+// already publishing to, and whose fanout peers are promoted to its mesh
+type FanoutTransition struct {
+	Version int
+	Seq     int64
+	// Unix milliseconds
+	Subscribed int64
+	// recipients of the last message published before subscribing
+	FanoutPeers []string
+	// mesh a few heartbeats after subscribing
+	MeshPeers []string
+	// fanout peers that ended up in the mesh
+	Promoted int
+
+	PublishedBefore      int
+	PublishedAfter       int
+	MeanRecipientsBefore float64
+	MeanRecipientsAfter  float64
+	// messages that were not sent to any peer, ie gaps in the stream
+	Unsent   int
+	Messages []FanoutMessage
+}
+
+// FanoutMessage is a message published by the node, and how many peers it was sent to
+type FanoutMessage struct {
+	// Unix milliseconds
+	Published  int64
+	Recipients int
+}
+
+// Committee is the report of the collector node in the committee workload
+type Committee struct {
+	Version             int
+	Collector           int64
+	CommitteeSize       int
+	SlotMs              int64
+	AggregationWindowMs int64
+
+	// delivery ratio within the aggregation window, across slots
+	MeanRatio float64
+	MinRatio  float64
+	// slots in which every committee message arrived within the window
+	CompleteSlots int
+	Slots         []CommitteeSlot
+}
+
+// CommitteeSlot counts the committee messages received by the collector for one slot
+type CommitteeSlot struct {
+	Slot     int64
+	Expected int
+	InWindow int
+	Late     int
+	Ratio    float64
+}
+
+// Throughput is a node's delivery throughput in fixed windows
+type Throughput struct {
+	Version int
+	Seq     int64
+	Windows []ThroughputWindow
+}
+
+// ThroughputWindow holds the deliveries received during one fixed window
+type ThroughputWindow struct {
+	// Start of the window in unix milliseconds
+	Start          int64
+	Messages       int64
+	Bytes          int64
+	MessagesPerSec float64
+	BytesPerSec    float64
+}
+
+// TopicLatencies are the delivery latencies measured by a node on each topic
+type TopicLatencies struct {
+	Version int
+	Seq     int64
+	Topics  map[string]LatencyStats
+}
+
+// LatencyStats summarize a latency distribution
+type LatencyStats struct {
+	Count  int
+	MeanMs float64
+	P50Ms  float64
+	P90Ms  float64
+	P99Ms  float64
+	MaxMs  float64
+}
+
+// IWantServing adds up the message IDs the honest nodes were asked for in
+// IWANTs. Requests beyond the retransmission limit of the same peer for the
+// same message are refused, requests for messages out of the message cache
+// are expired, and requests for messages the nodes never had are unknown. The
+// router doesn't trace what it refuses, so these are estimates replayed from
+// the received IWANTs and a message cache window of HistoryLength heartbeats.
+type IWantServing struct {
+	Limit     int
+	Requested int64
+	Served    int64
+	Refused   int64
+	Expired   int64
+	Unknown   int64
+	// nodes that refused requests, and the most refusals of one node
+	RefusingNodes    int
+	MaxRefusedByNode int64
+}
+
+// TopicOverhead is the traffic of a topic at a node: the duplicate receptions
+// of its messages, the payload bytes of its messages, and the bytes of its
+// IHAVE, GRAFT and PRUNE control messages
+type TopicOverhead struct {
+	Duplicates     uint64
+	DuplicateBytes uint64
+
+	PayloadBytesSent     uint64
+	PayloadBytesReceived uint64
+	ControlBytesSent     uint64
+	ControlBytesReceived uint64
+}
+
+// NodeOverhead is the traffic of each topic at a node. IWANTs name no topic,
+// so their bytes are only counted for the whole node.
+type NodeOverhead struct {
+	Seq    int64
+	Topics map[string]TopicOverhead
+
+	IWantBytesSent     uint64
+	IWantBytesReceived uint64
+}
+
+// Overhead sums the traffic of the honest nodes by topic. DuplicatesPerDelivery
+// is the number of duplicate receptions per first delivery, and
+// ControlPerPayloadByte the control bytes received, IWANTs included, per
+// payload byte received.
+type Overhead struct {
+	Version int
+	Nodes   []NodeOverhead `json:",omitempty"`
+	Topics  map[string]TopicOverhead
+
+	IWantBytesSent     uint64
+	IWantBytesReceived uint64
+
+	DuplicatesPerDelivery float64
+	ControlPerPayloadByte float64
+}
+
+// LatencyCDF is the distribution of the first delivery latency of every
+// message at every honest node. The CDF is sampled at up to 1000 points,
+// latency-cdf.csv has every sample.
+type LatencyCDF struct {
+	Version int
+	Nodes   int
+	Stats   LatencyStats
+	P999Ms  float64
+	CDF     []CDFPoint
+}
+
+// CDFPoint is the fraction of the deliveries at or below a latency
+type CDFPoint struct {
+	LatencyMs float64
+	Fraction  float64
+}
+
+// PingRTTs are the round trip times measured by a node to its peers
+type PingRTTs struct {
+	Version int
+	Seq     int64
+	Links   []*LinkRTT
+}
+
+// LinkRTT is the time series of measured round trip times over one link
+type LinkRTT struct {
+	Peer    string
+	PeerSeq int64
+	Samples []RTTSample
+}
+
+// RTTSample is a single measured round trip time to a connected peer
+type RTTSample struct {
+	// Unix milliseconds
+	Timestamp int64
+	RTTMs     float64
+}
+
+// ScoreSample holds the scores a node assigned to each of its peers at one
+// point in time
+type ScoreSample struct {
+	Version   int
+	Timestamp time.Time
+	PeerID    string
+	// scores by peer ID
+	Scores map[string]float64
+}
+
+// ScoreReplacement is a mesh peer pruned for its negative score, and the peer
+// grafted in its place. Scores are the latest sampled by the pruning node.
+type ScoreReplacement struct {
+	Version     int
+	Topic       string
+	Pruned      string
+	PrunedScore float64
+	PrunedAt    time.Time
+	// empty if no peer was grafted to the topic before the end of the run
+	Grafted      string
+	GraftedScore float64
+	GraftedAt    time.Time
+	// why the grafted peer was eligible
+	Reason string
+}
+
+// Topology is the connection graph realized during the run
+type Topology struct {
+	Version int
+	Nodes   []TopologyNode
+	Edges   []TopologyEdge
+	Metrics GraphMetrics
+}
+
+// GraphMetrics characterize the topology as an undirected graph. Path lengths
+// are only measured between nodes of the same component, from PathSources
+// nodes spread evenly across the sequence numbers. When that is fewer than
+// Nodes, the diameter is a lower bound.
+type GraphMetrics struct {
+	Nodes      int
+	Edges      int
+	Components int
+
+	Diameter      int
+	AvgPathLength float64
+	PathSources   int
+	// mean of the local clustering coefficients
+	Clustering float64
+
+	MeanDegree float64
+	// number of nodes by degree
+	DegreeHistogram map[int]int
+}
+
+type TopologyNode struct {
+	Seq      int64
+	PeerID   string
+	Attacker bool
+	// bandwidth of the node's links in Mbps, if shaped
+	BandwidthMB int `json:",omitempty"`
+}
+
+// TopologyEdge is a connection between two nodes, identified by their
+// sequence numbers. From is the node that dialed the connection.
+type TopologyEdge struct {
+	From int64
+	To   int64
+}
+
+// MeshSnapshot is the mesh of every topic joined by a node at one point in time
+type MeshSnapshot struct {
+	Version   int
+	Timestamp time.Time
+	Seq       int64
+	// sequence numbers of the mesh peers, by topic
+	Mesh map[string][]int64
+}
+
+// MeshGraph is the global mesh of each topic over time, joined by the leader
+// from the snapshots of all the nodes
+type MeshGraph struct {
+	Version    int
+	IntervalMs float64
+	Snapshots  []MeshGraphSnapshot
+}
+
+type MeshGraphSnapshot struct {
+	Timestamp time.Time
+	// nodes that took a snapshot at this time
+	Nodes  int
+	Topics map[string]*MeshGraphTopic
+}
+
+// MeshGraphTopic is the mesh of a topic. An edge goes from a node to a peer in
+// its mesh, and is asymmetric when the peer doesn't have the node in its own
+// mesh, eg while a GRAFT or a PRUNE is in flight.
+type MeshGraphTopic struct {
+	Edges      []TopologyEdge
+	Asymmetric int
+}
+
+// ConnectionHealth is the state of the connections of the topology, written by
+// the observe test case
+type ConnectionHealth struct {
+	Version int
+	Nodes   []NodeConnections
+	// nodes without any connected peer
+	Isolated    []int64
+	FailedDials int
+	MinDegree   int
+	MaxDegree   int
+	MeanDegree  float64
+	// number of connected components of the graph, 1 if every node can
+	// reach every other node
+	Components int
+}
+
+type NodeConnections struct {
+	Seq int64
+	// number of peers the node dialed successfully, and the sequence numbers
+	// of those it failed to connect to
+	Dialed int
+	Failed []int64
+	// number of connected peers, dialed or not
+	Degree int
+	// time taken to connect to the topology
+	ConnectMs float64
+}
+
+// Anomaly is the data of the anomaly custom event, logged by the watchdog of a
+// node when its mesh stayed below D_lo, it went without deliveries, or its
+// validation queue dropped messages
+type Anomaly struct {
+	Kind  string
+	Topic string `json:",omitempty"`
+	// human readable description
+	Detail string
+	// how long the condition had lasted when logged
+	DurationMs float64
+	// mesh size, or number of dropped messages
+	Count int64 `json:",omitempty"`
+}
+
+// CustomEvent is a trace event emitted by the test plan rather than by the
+// pubsub router
+type CustomEvent struct {
+	Version int
+	Type    string
+	// Unix nanoseconds
+	Timestamp int64
+	Seq       int64
+	Data      json.RawMessage
+}
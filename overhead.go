@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gossipsub_testplan/outputs"
+)
+
+// summarizeOverhead sums the traffic of the honest nodes by topic, and keeps
+// the breakdown of every node
+func summarizeOverhead(reports []NodeReport) outputs.Overhead {
+	o := outputs.Overhead{Version: outputs.SchemaVersion, Topics: make(map[string]outputs.TopicOverhead)}
+	var deliveries, duplicates, payload, control uint64
+	for _, r := range reports {
+		if r.Overhead == nil {
+			continue
+		}
+		o.Nodes = append(o.Nodes, *r.Overhead)
+		if r.Attacker {
+			continue
+		}
+		deliveries += uint64(r.Deliveries)
+		o.IWantBytesSent += r.Overhead.IWantBytesSent
+		o.IWantBytesReceived += r.Overhead.IWantBytesReceived
+		control += r.Overhead.IWantBytesReceived
+		for id, t := range r.Overhead.Topics {
+			sum := o.Topics[id]
+			sum.Duplicates += t.Duplicates
+			sum.DuplicateBytes += t.DuplicateBytes
+			sum.PayloadBytesSent += t.PayloadBytesSent
+			sum.PayloadBytesReceived += t.PayloadBytesReceived
+			sum.ControlBytesSent += t.ControlBytesSent
+			sum.ControlBytesReceived += t.ControlBytesReceived
+			o.Topics[id] = sum
+
+			duplicates += t.Duplicates
+			payload += t.PayloadBytesReceived
+			control += t.ControlBytesReceived
+		}
+	}
+	if deliveries > 0 {
+		o.DuplicatesPerDelivery = float64(duplicates) / float64(deliveries)
+	}
+	if payload > 0 {
+		o.ControlPerPayloadByte = float64(control) / float64(payload)
+	}
+	return o
+}
+
+// writeOverhead writes the traffic breakdown of every node to overhead.json
+func (p *PubsubNode) writeOverhead(reports []NodeReport) error {
+	o := summarizeOverhead(reports)
+	jsonstr, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.OverheadFile)
+	p.log("%.2f duplicates per delivery, %.3f control bytes per payload byte", o.DuplicatesPerDelivery, o.ControlPerPayloadByte)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
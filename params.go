@@ -3,10 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/testground/sdk-go/ptypes"
 	"github.com/testground/sdk-go/runtime"
 )
@@ -17,11 +19,30 @@ type HeartbeatParams struct {
 }
 
 type NetworkParams struct {
-	latency     int
-	latencyMax  int
-	jitterPct   int
+	latency    int
+	latencyMax int
+	jitterPct  int
+	// link impairments applied on top of the latency
+	jitterMs    int
+	lossPct     float64
+	corruptPct  float64
 	bandwidthMB int
-	quic        bool
+	transport   string
+	// address family of the last ipFamilyPct percent of the nodes, the
+	// others use IPv4
+	family      string
+	ipFamilyPct int
+
+	publisherBandwidthMB int
+	// bandwidth of each percentage of the nodes, overriding bandwidthMB
+	bandwidthProfiles []BandwidthProfile
+	// uplink and downlink bandwidths of the last asymmetricPct percent of
+	// the nodes, zero to keep the symmetric bandwidth
+	uplinkMB      int
+	downlinkMB    int
+	asymmetricPct int
+
+	linkLatency LinkLatencyParams
 }
 
 // ScoreParams is mapped to pubsub.PeerScoreParams when targeting the hardened_api pubsub branch
@@ -34,11 +55,17 @@ type ScoreParams struct {
 	IPColocationFactorWeight    float64
 	IPColocationFactorThreshold int
 
+	BehaviourPenaltyWeight    float64
+	BehaviourPenaltyThreshold float64
+	BehaviourPenaltyDecay     float64
+
 	DecayInterval ptypes.Duration
 	DecayToZero   float64
 	RetainScore   ptypes.Duration
 }
 
+// OverlayParams are the mesh degree parameters of gossipsub. Negative values
+// keep the gossipsub defaults.
 type OverlayParams struct {
 	d            int
 	dlo          int
@@ -47,6 +74,84 @@ type OverlayParams struct {
 	dlazy        int
 	dout         int
 	gossipFactor float64
+
+	// heartbeats of message history kept, and gossiped about
+	historyLength int
+	historyGossip int
+
+	// times a message is served to the same peer in answer to IWANTs
+	gossipRetransmission int
+}
+
+// gossipSubParams returns the gossipsub parameters set by the overlay params,
+// the unset ones keeping the defaults
+func (o OverlayParams) gossipSubParams() pubsub.GossipSubParams {
+	params := pubsub.DefaultGossipSubParams()
+	params.HistoryLength = 100
+	params.HistoryGossip = 50
+	if o.historyLength > 0 {
+		params.HistoryLength = o.historyLength
+	}
+	if o.historyGossip > 0 {
+		params.HistoryGossip = o.historyGossip
+	}
+	if o.d >= 0 {
+		params.D = o.d
+	}
+	if o.dlo >= 0 {
+		params.Dlo = o.dlo
+	}
+	if o.dhi >= 0 {
+		params.Dhi = o.dhi
+	}
+	if o.dscore >= 0 {
+		params.Dscore = o.dscore
+	}
+	if o.dlazy >= 0 {
+		params.Dlazy = o.dlazy
+	}
+	if o.dout >= 0 {
+		params.Dout = o.dout
+	}
+	if o.gossipFactor > 0 {
+		params.GossipFactor = o.gossipFactor
+	}
+	if o.gossipRetransmission >= 0 {
+		params.GossipRetransmission = o.gossipRetransmission
+	}
+	return params
+}
+
+// validate checks the relations gossipsub expects between the parameters,
+// including the defaults kept by the unset ones
+func (o OverlayParams) validate() error {
+	if o.gossipFactor < 0 || o.gossipFactor > 1 {
+		return fmt.Errorf("gossip_factor must be between 0 and 1")
+	}
+	if o.historyGossip <= 0 || o.historyLength < o.historyGossip {
+		return fmt.Errorf("history_gossip must be positive and at most history_length")
+	}
+	params := o.gossipSubParams()
+	if params.Dlo > params.D || params.Dhi < params.D {
+		return fmt.Errorf("overlay_d %d must be between overlay_dlo %d and overlay_dhi %d", params.D, params.Dlo, params.Dhi)
+	}
+	if params.Dscore > params.D {
+		return fmt.Errorf("overlay_dscore %d is above overlay_d %d", params.Dscore, params.D)
+	}
+	if params.Dout >= params.Dlo {
+		return fmt.Errorf("overlay_dout %d must be below overlay_dlo %d", params.Dout, params.Dlo)
+	}
+	if params.Dout > params.D/2 {
+		return fmt.Errorf("overlay_dout %d must be at most half of overlay_d %d", params.Dout, params.D)
+	}
+	return nil
+}
+
+// SmallWorldParams configure the Watts-Strogatz small-world topology
+type SmallWorldParams struct {
+	K    int
+	Beta float64
+	Seed int64
 }
 
 type PeerScoreThresholds struct {
@@ -78,14 +183,6 @@ type TopicScoreParams struct {
 	InvalidMessageDeliveriesWeight, InvalidMessageDeliveriesDecay float64
 }
 
-type SybilParams struct {
-	degrade           float64
-	attackDelay       time.Duration
-	regraftDelay      time.Duration
-	regraftBackoff    time.Duration
-	seenCacheDuration time.Duration
-}
-
 type testParams struct {
 	heartbeat HeartbeatParams
 	setup     time.Duration
@@ -95,20 +192,28 @@ type testParams struct {
 
 	nodeType          NodeType
 	publisher         bool
+	attacker          bool
 	floodPublishing   bool
 	fullTraces        bool
+	summary           bool
 	topics            []TopicConfig
 	degree            int
 	node_failing      int
 	node_failure_time time.Duration
+	faults            []FaultParams
+	netChanges        []NetChange
+	partition         PartitionParams
+	adaptive          AdaptiveParams
+	dht               DHTParams
+	px                PXParams
 
 	containerNodesTotal int
 	nodesPerContainer   int
 
-	sybilParams             SybilParams
+	sybil                   SybilParams
+	attackWindow            AttackWindow
 	connectDelays           []time.Duration
 	connectDelayJitterPct   int
-	connsDef                map[string]*ConnectionsDef
 	attackSingleNode        bool
 	censorSingleNode        bool
 	connectToPublishersOnly bool
@@ -117,13 +222,153 @@ type testParams struct {
 	overlayParams      OverlayParams
 	scoreParams        ScoreParams
 	scoreInspectPeriod time.Duration
+	metricsPeriod      time.Duration
+	throughputWindow   time.Duration
+	pingInterval       time.Duration
 	validateQueueSize  int
 	outboundQueueSize  int
+	signaturePolicy    string
+	payloadEncryption  bool
+
+	// log the peers grafted in place of the peers pruned for their score
+	scoreReplacementLog bool
+
+	connLimits ConnLimits
+
+	// attackers coordinate over a private sync topic
+	attackerCoordination bool
+
+	// emit the mesh changes of every heartbeat as custom events
+	heartbeatEvents bool
+
+	// interval between mesh snapshots, disabled if zero
+	meshSnapshotInterval time.Duration
+
+	latencyCDF bool
+
+	// latency after which a delivery misses its deadline, disabled if zero
+	deliveryDeadline time.Duration
+
+	anomalies AnomalyParams
+
+	// targets checked by the leader for each cohort of nodes
+	slos []SLO
+
+	validation ValidationParams
+
+	// whether the routers score their peers with scoreParams or scoreProfiles
+	peerScoring bool
+	// scoring configurations of groups of nodes, overriding scoreParams
+	scoreProfiles []ScoreProfile
+
+	// offset from the start of the run of the first publish
+	firstPublishOffset time.Duration
+
+	publishers PublisherParams
 
 	opportunisticGraftTicks int
 
+	workload string
+
+	// pubsub router, gossipsub or floodsub
+	implementation string
+	// gossipsub protocol version, v1.0 or v1.1
+	gossipsubProtocol string
+	// cohort running another implementation in an external process
+	interop InteropParams
+
+	extraForward int
+
+	connFlood ConnFloodParams
+
+	pruneFlood PruneFloodParams
+
+	gossipSpam GossipSpamParams
+
+	topologyType string
+	smallWorld   SmallWorldParams
+	// topology file of the file topology, or the legacy topology param
+	topologyFile string
+	topologyDef  string
+	committee    CommitteeParams
+
+	misconfig MisconfigParams
+	blackhole BlackholeParams
+
+	// cohorts running with their own gossipsub parameters
+	nodeClasses []NodeClassParams
+
+	lite  LiteParams
+	storm StormParams
+
+	baseline BaselineParams
+
+	// upload of the outputs to an object store at the end of the run
+	upload UploadParams
+
+	fanoutDelay time.Duration
+
+	// maximum absolute skew of each node's clock
+	clockDriftMax time.Duration
+
+	blacklist BlacklistParams
+
+	heavyTopic HeavyTopicParams
+
+	lateSubscribePct int
+	lateSubscribe    time.Duration
+	lazyPct          int
+	healthGate       HealthGateParams
+	preGraft         PreGraftParams
+
+	joinSchedule JoinSchedule
+
+	// times the measured window runs over the same overlay
+	repetitions int
+
+	multihoming MultihomingParams
+
+	nat NATParams
+
+	churn ChurnParams
+
+	stragglers StragglerParams
+
+	phases PhasesParams
+
+	replayFile string
+
+	// size distribution of the generated topics, and the custom distributions
+	sizeDistribution string
+	sizeHistograms   map[string]SizeHistogram
+
+	arrival ArrivalParams
+
+	// preset scenario overriding some of the params
+	scenario  string
+	satellite SatelliteParams
+	eclipse   EclipseParams
+
+	idle IdleParams
+
 	block_size    int
 	blocks_second int
+	nTopics       int
+}
+
+// workloadTopics returns the topics every node joins and the publishers publish
+// to. The topics param takes precedence, otherwise n_topics topics are created
+// with the block rate and size. The first one is always block_channel.
+func (p testParams) workloadTopics() []TopicConfig {
+	if len(p.topics) > 0 {
+		return append([]TopicConfig(nil), p.topics...)
+	}
+	rate := ptypes.Rate{Quantity: float64(p.blocks_second), Interval: time.Second}
+	topics := []TopicConfig{{Id: "block_channel", MessageRate: rate, MessageSize: ptypes.Size(p.block_size), SizeDistribution: p.sizeDistribution}}
+	for i := 1; i < p.nTopics; i++ {
+		topics = append(topics, TopicConfig{Id: fmt.Sprintf("block_channel_%d", i), MessageRate: rate, MessageSize: ptypes.Size(p.block_size), SizeDistribution: p.sizeDistribution})
+	}
+	return topics
 }
 
 func durationParam(runenv *runtime.RunEnv, name string) time.Duration {
@@ -134,6 +379,15 @@ func durationParam(runenv *runtime.RunEnv, name string) time.Duration {
 	return parseDuration(runenv.StringParam(name))
 }
 
+// stringParam returns the value of a string param, stripping the quotes that
+// testground adds to default values (see parseDuration)
+func stringParam(runenv *runtime.RunEnv, name string) string {
+	if !runenv.IsParamSet(name) {
+		return ""
+	}
+	return strings.ReplaceAll(runenv.StringParam(name), "\"", "")
+}
+
 func parseDuration(val string) time.Duration {
 	// FIXME: this seems like a testground bug... when default string params are not
 	// overridden by the command line, the value is wrapped in double quote chars,
@@ -152,18 +406,73 @@ func parseParams(runenv *runtime.RunEnv) testParams {
 		latency:     runenv.IntParam("t_latency"),
 		latencyMax:  runenv.IntParam("t_latency_max"),
 		jitterPct:   runenv.IntParam("jitter_pct"),
+		jitterMs:    runenv.IntParam("jitter_ms"),
+		lossPct:     runenv.FloatParam("packet_loss_pct"),
+		corruptPct:  runenv.FloatParam("corrupt_pct"),
 		bandwidthMB: runenv.IntParam("bandwidth_mb"),
-		quic:        runenv.BooleanParam("quic"),
+		transport:   stringParam(runenv, "transport"),
+		family:      stringParam(runenv, "ip_family"),
+		ipFamilyPct: runenv.IntParam("ip_family_pct"),
+
+		publisherBandwidthMB: runenv.IntParam("publisher_bandwidth_mb"),
+		uplinkMB:             runenv.IntParam("bandwidth_up_mb"),
+		downlinkMB:           runenv.IntParam("bandwidth_down_mb"),
+		asymmetricPct:        runenv.IntParam("asymmetric_bw_pct"),
+
+		linkLatency: LinkLatencyParams{
+			Model:      stringParam(runenv, "latency_model"),
+			MatrixFile: stringParam(runenv, "latency_matrix_file"),
+		},
+	}
+	if np.transport == "" {
+		np.transport = TransportTCP
+		if runenv.BooleanParam("quic") {
+			np.transport = TransportQUIC
+		}
+	}
+	if !validTransport(np.transport) {
+		panic(fmt.Errorf("unknown transport %s", np.transport))
+	}
+	if np.family == "" {
+		np.family = IPFamilyV4
+	}
+	if !validIPFamily(np.family) {
+		panic(fmt.Errorf("unknown ip family %s", np.family))
+	}
+	if np.lossPct < 0 || np.lossPct > 100 || np.corruptPct < 0 || np.corruptPct > 100 {
+		panic(fmt.Errorf("packet_loss_pct and corrupt_pct must be between 0 and 100"))
+	}
+	profiles, err := parseBandwidthProfiles(stringParam(runenv, "bandwidth_profiles"))
+	if err != nil {
+		panic(err)
+	}
+	np.bandwidthProfiles = profiles
+	if np.uplinkMB < 0 || np.downlinkMB < 0 {
+		panic(fmt.Errorf("bandwidth_up_mb and bandwidth_down_mb must not be negative"))
+	}
+	if np.linkLatency.Model == "" {
+		np.linkLatency.Model = "uniform"
+	}
+	if err := np.linkLatency.validate(); err != nil {
+		panic(err)
 	}
 
 	op := OverlayParams{
-		d:            runenv.IntParam("overlay_d"),
-		dlo:          runenv.IntParam("overlay_dlo"),
-		dhi:          runenv.IntParam("overlay_dhi"),
-		dscore:       runenv.IntParam("overlay_dscore"),
-		dlazy:        runenv.IntParam("overlay_dlazy"),
-		dout:         runenv.IntParam("overlay_dout"),
+		d:            countParam(runenv, "overlay_d"),
+		dlo:          countParam(runenv, "overlay_dlo"),
+		dhi:          countParam(runenv, "overlay_dhi"),
+		dscore:       countParam(runenv, "overlay_dscore"),
+		dlazy:        countParam(runenv, "overlay_dlazy"),
+		dout:         countParam(runenv, "overlay_dout"),
 		gossipFactor: runenv.FloatParam("gossip_factor"),
+
+		historyLength: runenv.IntParam("history_length"),
+		historyGossip: runenv.IntParam("history_gossip"),
+
+		gossipRetransmission: countParam(runenv, "gossip_retransmission"),
+	}
+	if err := op.validate(); err != nil {
+		panic(err)
 	}
 
 	p := testParams{
@@ -171,30 +480,233 @@ func parseParams(runenv *runtime.RunEnv) testParams {
 			InitialDelay: durationParam(runenv, "t_heartbeat_initial_delay"),
 			Interval:     durationParam(runenv, "t_heartbeat"),
 		},
-		setup:           durationParam(runenv, "t_setup"),
-		warmup:          durationParam(runenv, "t_warm"),
-		runtime:         durationParam(runenv, "t_run"),
-		cooldown:        durationParam(runenv, "t_cool"),
-		publisher:       runenv.BooleanParam("publisher"),
-		floodPublishing: runenv.BooleanParam("flood_publishing"),
-		fullTraces:      runenv.BooleanParam("full_traces"),
-		//nodeType:                parseNodeType(runenv.StringParam("attack_node_type")),
+		setup:                   durationParam(runenv, "t_setup"),
+		warmup:                  durationParam(runenv, "t_warm"),
+		runtime:                 durationParam(runenv, "t_run"),
+		cooldown:                durationParam(runenv, "t_cool"),
+		publisher:               runenv.BooleanParam("publisher"),
+		attacker:                runenv.BooleanParam("attacker"),
+		floodPublishing:         runenv.BooleanParam("flood_publishing"),
+		fullTraces:              runenv.BooleanParam("full_traces"),
+		summary:                 runenv.BooleanParam("summary"),
 		attackSingleNode:        runenv.BooleanParam("attack_single_node"),
 		censorSingleNode:        runenv.BooleanParam("censor_single_node"),
 		connectToPublishersOnly: runenv.BooleanParam("connect_to_publishers_only"),
-		degree:                  runenv.IntParam("degree"),
+		attackWindow: AttackWindow{
+			Start:    durationParam(runenv, "t_attack_start"),
+			Duration: durationParam(runenv, "t_attack_duration"),
+		},
+		degree:                  countParam(runenv, "degree"),
 		node_failing:            runenv.IntParam("node_failing"),
 		node_failure_time:       durationParam(runenv, "t_node_failure"),
 		containerNodesTotal:     runenv.IntParam("n_container_nodes_total"),
 		nodesPerContainer:       runenv.IntParam("n_nodes_per_container"),
 		scoreInspectPeriod:      durationParam(runenv, "t_score_inspect_period"),
+		metricsPeriod:           durationParam(runenv, "t_metrics_period"),
+		throughputWindow:        durationParam(runenv, "t_throughput_window"),
+		pingInterval:            durationParam(runenv, "t_ping_interval"),
 		netParams:               np,
 		overlayParams:           op,
 		validateQueueSize:       runenv.IntParam("validate_queue_size"),
 		outboundQueueSize:       runenv.IntParam("outbound_queue_size"),
+		signaturePolicy:         stringParam(runenv, "signature_policy"),
+		payloadEncryption:       runenv.BooleanParam("payload_encryption"),
 		opportunisticGraftTicks: runenv.IntParam("opportunistic_graft_ticks"),
 		block_size:              runenv.IntParam("block_size"),
 		blocks_second:           runenv.IntParam("blocks_second"),
+		nTopics:                 runenv.IntParam("n_topics"),
+		workload:                stringParam(runenv, "workload"),
+		implementation:          stringParam(runenv, "pubsub_implementation"),
+		gossipsubProtocol:       stringParam(runenv, "gossipsub_protocol"),
+		misconfig: MisconfigParams{
+			Pct:               runenv.IntParam("misconfig_pct"),
+			D:                 runenv.IntParam("misconfig_d"),
+			Heartbeat:         durationParam(runenv, "t_misconfig_heartbeat"),
+			ValidateQueueSize: runenv.IntParam("misconfig_validate_queue_size"),
+			OutboundQueueSize: runenv.IntParam("misconfig_outbound_queue_size"),
+		},
+		lite: LiteParams{
+			Enabled:          runenv.BooleanParam("lite_lurkers"),
+			MetricsSamplePct: runenv.IntParam("lite_metrics_sample_pct"),
+			GCPercent:        runenv.IntParam("lite_gc_percent"),
+		},
+		lateSubscribePct: runenv.IntParam("late_subscribe_pct"),
+		lateSubscribe:    durationParam(runenv, "t_late_subscribe"),
+		lazyPct:          runenv.IntParam("lazy_pct"),
+		fanoutDelay:      durationParam(runenv, "t_publisher_subscribe"),
+		clockDriftMax:    durationParam(runenv, "t_clock_drift_max"),
+		healthGate: HealthGateParams{
+			Pct:     runenv.IntParam("health_gate_pct"),
+			Timeout: durationParam(runenv, "t_health_gate_timeout"),
+		},
+		baseline: BaselineParams{
+			Summary:          stringParam(runenv, "baseline_summary"),
+			Tolerance:        runenv.FloatParam("baseline_tolerance"),
+			LatencyTolerance: runenv.FloatParam("baseline_latency_tolerance"),
+		},
+		extraForward: runenv.IntParam("extra_forward"),
+		topologyType: stringParam(runenv, "topology_type"),
+		smallWorld: SmallWorldParams{
+			K:    countParam(runenv, "small_world_k"),
+			Beta: runenv.FloatParam("small_world_beta"),
+			Seed: int64(runenv.IntParam("topology_seed")),
+		},
+		topologyFile: stringParam(runenv, "topology_file"),
+		sybil: SybilParams{
+			Strategy:      stringParam(runenv, "sybil_strategy"),
+			Victim:        int64(runenv.IntParam("sybil_victim")),
+			Identities:    countParam(runenv, "sybil_identities"),
+			GraftInterval: durationParam(runenv, "t_sybil_graft_interval"),
+			Transport:     np.transport,
+		},
+		connFlood: ConnFloodParams{
+			Conns:     runenv.IntParam("conn_flood_conns"),
+			Streams:   runenv.IntParam("conn_flood_streams"),
+			Victims:   countParam(runenv, "conn_flood_victims"),
+			Transport: np.transport,
+		},
+		pruneFlood: PruneFloodParams{
+			Interval:  durationParam(runenv, "t_prune_flood_interval"),
+			Victims:   countParam(runenv, "prune_flood_victims"),
+			PX:        runenv.IntParam("prune_flood_px"),
+			Transport: np.transport,
+		},
+		gossipSpam: GossipSpamParams{
+			Rate:       runenv.IntParam("gossip_spam_rate"),
+			IDs:        runenv.IntParam("gossip_spam_ids"),
+			Victims:    countParam(runenv, "gossip_spam_victims"),
+			Identities: runenv.IntParam("gossip_spam_identities"),
+			Transport:  np.transport,
+		},
+		committee: CommitteeParams{
+			Size:              countParam(runenv, "committee_size"),
+			Slot:              durationParam(runenv, "t_slot"),
+			Jitter:            durationParam(runenv, "t_committee_jitter"),
+			MessageSize:       runenv.IntParam("committee_msg_size"),
+			Collector:         int64(runenv.IntParam("committee_collector")),
+			AggregationWindow: durationParam(runenv, "t_aggregation_window"),
+			Seed:              int64(runenv.IntParam("committee_seed")),
+		},
+		heavyTopic: HeavyTopicParams{
+			Rate:         runenv.IntParam("heavy_topic_rate"),
+			Size:         runenv.IntParam("heavy_topic_size"),
+			SeparateHost: runenv.BooleanParam("heavy_topic_separate_host"),
+		},
+		blacklist: BlacklistParams{
+			Enabled:   runenv.BooleanParam("blacklist"),
+			Threshold: runenv.FloatParam("blacklist_threshold"),
+			Action:    stringParam(runenv, "blacklist_action"),
+			Quorum:    countParam(runenv, "blacklist_quorum"),
+		},
+		churn: ChurnParams{
+			Rate:      runenv.FloatParam("churn_rate"),
+			Interval:  durationParam(runenv, "t_churn_interval"),
+			MinUptime: durationParam(runenv, "t_churn_min_uptime"),
+			Downtime:  durationParam(runenv, "t_churn_downtime"),
+		},
+		replayFile: stringParam(runenv, "replay_file"),
+
+		sizeDistribution: stringParam(runenv, "size_distribution"),
+		arrival: ArrivalParams{
+			BurstSize:     runenv.IntParam("burst_size"),
+			BurstInterval: durationParam(runenv, "t_burst_interval"),
+			Seed:          int64(runenv.IntParam("arrival_seed")),
+		},
+		connLimits: ConnLimits{
+			LowWater:          countParam(runenv, "connmgr_low"),
+			HighWater:         countParam(runenv, "connmgr_high"),
+			GracePeriod:       durationParam(runenv, "t_connmgr_grace"),
+			MaxConns:          runenv.IntParam("rcmgr_max_conns"),
+			MaxConnsPerPeer:   runenv.IntParam("rcmgr_max_conns_per_peer"),
+			MaxStreamsPerPeer: runenv.IntParam("rcmgr_max_streams_per_peer"),
+		},
+		adaptive: AdaptiveParams{
+			Signal:           stringParam(runenv, "adaptive_signal"),
+			Interval:         durationParam(runenv, "t_adaptive_interval"),
+			LatencyThreshold: durationParam(runenv, "t_adaptive_latency_threshold"),
+			Backoff:          runenv.FloatParam("adaptive_backoff"),
+			Increase:         runenv.FloatParam("adaptive_increase"),
+			MinRate:          runenv.FloatParam("adaptive_min_rate"),
+		},
+		partition: PartitionParams{
+			Groups:   runenv.IntParam("partition_groups"),
+			Start:    durationParam(runenv, "t_partition_start"),
+			Duration: durationParam(runenv, "t_partition_duration"),
+		},
+		phases: PhasesParams{
+			Randomize: runenv.BooleanParam("phase_randomize"),
+			Seed:      int64(runenv.IntParam("phase_seed")),
+		},
+		stragglers: StragglerParams{
+			Percentile:  runenv.FloatParam("straggler_percentile"),
+			MinFraction: runenv.FloatParam("straggler_min_fraction"),
+		},
+		scenario: stringParam(runenv, "scenario"),
+		satellite: SatelliteParams{
+			Pct:     runenv.IntParam("satellite_pct"),
+			Latency: durationParam(runenv, "t_satellite_latency"),
+		},
+		eclipse: EclipseParams{
+			Attackers: countParam(runenv, "eclipse_attackers"),
+			Victim:    int64(runenv.IntParam("eclipse_victim")),
+			Outbound:  countParam(runenv, "dout_victim_outbound"),
+		},
+		storm: StormParams{
+			Start:  durationParam(runenv, "t_storm_start"),
+			Window: durationParam(runenv, "t_storm_window"),
+		},
+		blackhole: BlackholeParams{
+			Protocol: stringParam(runenv, "blackhole_protocol"),
+			Pct:      runenv.IntParam("blackhole_pct"),
+			Start:    durationParam(runenv, "t_blackhole_start"),
+			Duration: durationParam(runenv, "t_blackhole_duration"),
+		},
+	}
+	if p.blackhole.enabled() {
+		switch p.netParams.transport {
+		case TransportWS, TransportWebTransport:
+			panic(fmt.Errorf("blackhole_protocol requires the tcp and quic transports to fall back between, not %s", p.netParams.transport))
+		}
+	}
+
+	if p.workload == "" {
+		p.workload = "constant"
+	}
+	if p.topologyType == "" {
+		p.topologyType = "random"
+	}
+	switch p.implementation {
+	case "":
+		p.implementation = "gossipsub"
+	case "gossipsub", "floodsub":
+	default:
+		panic(fmt.Errorf("unknown pubsub implementation %s", p.implementation))
+	}
+	switch p.gossipsubProtocol {
+	case "":
+		p.gossipsubProtocol = "v1.1"
+	case "v1.0", "v1.1":
+	case "v1.2":
+		// IDONTWANT needs router support, see README.md
+		panic(fmt.Errorf("gossipsub v1.2 (IDONTWANT) is not implemented by the pubsub fork this plan is built against"))
+	default:
+		panic(fmt.Errorf("unknown gossipsub protocol %s", p.gossipsubProtocol))
+	}
+	switch p.signaturePolicy {
+	case "":
+		p.signaturePolicy = SignStrict
+	case SignStrict, SignStrictNo:
+	default:
+		panic(fmt.Errorf("unknown signature policy %s", p.signaturePolicy))
+	}
+	applyScenario(&p, p.scenario)
+	if p.eclipse.enabled() {
+		if err := p.eclipse.validate(runenv.TestInstanceCount); err != nil {
+			panic(err)
+		}
+	}
+	if p.scenario == "dout" && p.eclipse.Outbound == 0 {
+		panic(fmt.Errorf("the dout scenario needs the victim to dial at least one peer"))
 	}
 
 	if runenv.IsParamSet("topics") {
@@ -206,6 +718,124 @@ func parseParams(runenv *runtime.RunEnv) testParams {
 		runenv.RecordMessage("topics: %v", p.topics)
 	}
 
+	if runenv.IsParamSet("faults") {
+		jsonstr := runenv.StringParam("faults")
+		if err := json.Unmarshal([]byte(jsonstr), &p.faults); err != nil {
+			panic(err)
+		}
+	} else {
+		// a single crash of t_node_failure after twice the warmup
+		p.faults = []FaultParams{{
+			Type:     "crash_restart",
+			Start:    ptypes.Duration{Duration: p.warmup * 2},
+			Duration: ptypes.Duration{Duration: p.node_failure_time},
+		}}
+	}
+	for _, f := range p.faults {
+		if _, err := f.injector(); err != nil {
+			panic(err)
+		}
+	}
+
+	if schedule := stringParam(runenv, "netchanges"); schedule != "" {
+		changes, err := parseNetChanges(schedule)
+		if err != nil {
+			panic(err)
+		}
+		p.netChanges = changes
+	}
+
+	p.summary = p.lite.summary(p.summary)
+
+	p.repetitions = runenv.IntParam("repetitions")
+	if p.repetitions < 1 {
+		panic(fmt.Errorf("repetitions must be at least 1"))
+	}
+
+	p.nat = NATParams{
+		Pct:    runenv.IntParam("nat_pct"),
+		Relays: runenv.IntParam("nat_relays"),
+	}
+	if err := p.nat.validate(runenv.TestInstanceCount); err != nil {
+		panic(err)
+	}
+
+	p.multihoming.Pct = runenv.IntParam("multihomed_pct")
+	if p.multihoming.Pct < 0 || p.multihoming.Pct > 100 {
+		panic(fmt.Errorf("multihomed_pct must be between 0 and 100"))
+	}
+	profile, err := parseLinkProfile(stringParam(runenv, "multihome_profile"))
+	if err != nil {
+		panic(err)
+	}
+	p.multihoming.Profile = profile
+
+	schedule, err := parseJoinSchedule(stringParam(runenv, "join_schedule"))
+	if err != nil {
+		panic(err)
+	}
+	p.joinSchedule = schedule
+
+	if runenv.IsParamSet("phases") {
+		jsonstr := runenv.StringParam("phases")
+		if err := json.Unmarshal([]byte(jsonstr), &p.phases.Phases); err != nil {
+			panic(err)
+		}
+	}
+	if p.workload == "phased" && !p.phases.enabled() {
+		panic(fmt.Errorf("the phased workload requires the phases param"))
+	}
+	p.px.Enabled = runenv.BooleanParam("peer_exchange")
+	p.px.Peers = runenv.IntParam("px_peers")
+	switch discovery := stringParam(runenv, "discovery"); discovery {
+	case "", DiscoverySync:
+	case DiscoveryDHT:
+		p.dht.Bootstrappers = countParam(runenv, "dht_bootstrappers")
+		if p.dht.Bootstrappers < 1 {
+			panic(fmt.Errorf("dht discovery requires at least one bootstrapper"))
+		}
+	case DiscoveryPX:
+		p.px.Bootstrappers = countParam(runenv, "px_bootstrappers")
+		if p.px.Bootstrappers < 1 {
+			panic(fmt.Errorf("px discovery requires at least one bootstrapper"))
+		}
+		p.px.Enabled = true
+	default:
+		panic(fmt.Errorf("unknown discovery mode %s", discovery))
+	}
+	if p.px.Enabled && p.implementation == "floodsub" {
+		panic(fmt.Errorf("peer exchange requires gossipsub"))
+	}
+	if p.adaptive.enabled() {
+		if err := p.adaptive.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if runenv.IsParamSet("size_histograms") {
+		if err := json.Unmarshal([]byte(runenv.StringParam("size_histograms")), &p.sizeHistograms); err != nil {
+			panic(fmt.Errorf("invalid size_histograms: %w", err))
+		}
+		for name, h := range p.sizeHistograms {
+			if err := h.validate(); err != nil {
+				panic(fmt.Errorf("size histogram %s: %w", name, err))
+			}
+		}
+	}
+	for _, t := range p.workloadTopics() {
+		if t.SizeDistribution == "" {
+			continue
+		}
+		if _, err := lookupSizeHistogram(t.SizeDistribution, p.sizeHistograms); err != nil {
+			panic(err)
+		}
+	}
+	if p.workload == "replay" && p.replayFile == "" {
+		panic(fmt.Errorf("the replay workload requires the replay_file param"))
+	}
+	if err := p.arrival.validate(p.workload); err != nil {
+		panic(err)
+	}
+
 	if runenv.IsParamSet("score_params") {
 		jsonstr := runenv.StringParam("score_params")
 		err := json.Unmarshal([]byte(jsonstr), &p.scoreParams)
@@ -214,17 +844,256 @@ func parseParams(runenv *runtime.RunEnv) testParams {
 		}
 
 		// add warmup time to the mesh delivery activation window for each topic
-		for _, topic := range p.scoreParams.Topics {
-			topic.MeshMessageDeliveriesActivation.Duration += p.warmup
+		p.scoreParams.addWarmup(p.warmup)
+	}
+
+	// the behavioural penalty can be set individually, overriding score_params
+	if runenv.IsParamSet("behaviour_penalty_weight") {
+		p.scoreParams.BehaviourPenaltyWeight = runenv.FloatParam("behaviour_penalty_weight")
+	}
+	if runenv.IsParamSet("behaviour_penalty_threshold") {
+		p.scoreParams.BehaviourPenaltyThreshold = runenv.FloatParam("behaviour_penalty_threshold")
+	}
+	if runenv.IsParamSet("behaviour_penalty_decay") {
+		p.scoreParams.BehaviourPenaltyDecay = runenv.FloatParam("behaviour_penalty_decay")
+	}
+	if err := p.scoreParams.validateBehaviourPenalty(); err != nil {
+		panic(err)
+	}
+	// and so can the score thresholds
+	for name, th := range map[string]*float64{
+		"gossip_threshold":              &p.scoreParams.Thresholds.GossipThreshold,
+		"publish_threshold":             &p.scoreParams.Thresholds.PublishThreshold,
+		"graylist_threshold":            &p.scoreParams.Thresholds.GraylistThreshold,
+		"accept_px_threshold":           &p.scoreParams.Thresholds.AcceptPXThreshold,
+		"opportunistic_graft_threshold": &p.scoreParams.Thresholds.OpportunisticGraftThreshold,
+	} {
+		if runenv.IsParamSet(name) {
+			*th = runenv.FloatParam(name)
 		}
 	}
+	if err := p.scoreParams.Thresholds.validate(); err != nil {
+		panic(err)
+	}
+	if runenv.IsParamSet("score_profiles") {
+		jsonstr := runenv.StringParam("score_profiles")
+		if err := json.Unmarshal([]byte(jsonstr), &p.scoreProfiles); err != nil {
+			panic(err)
+		}
+		if err := validateScoreProfiles(p.scoreProfiles); err != nil {
+			panic(err)
+		}
+		for _, sp := range p.scoreProfiles {
+			sp.Params.addWarmup(p.warmup)
+		}
+	}
+	p.peerScoring = runenv.BooleanParam("peer_scoring")
+	if p.peerScoring && !p.scoreParams.enabled() && len(p.scoreProfiles) == 0 {
+		panic(fmt.Errorf("peer_scoring requires score_params or score_profiles"))
+	}
+	if !p.peerScoring {
+		p.scoreParams = ScoreParams{}
+		p.scoreProfiles = nil
+	}
+	if runenv.IsParamSet("node_classes") {
+		jsonstr := runenv.StringParam("node_classes")
+		if err := json.Unmarshal([]byte(jsonstr), &p.nodeClasses); err != nil {
+			panic(err)
+		}
+		if err := validateNodeClasses(p.nodeClasses, p.overlayParams); err != nil {
+			panic(err)
+		}
+	}
+	if p.misconfig.D > 0 {
+		cfg := NodeConfig{OverlayParams: p.overlayParams}
+		p.misconfig.apply(&cfg)
+		if err := cfg.OverlayParams.validate(); err != nil {
+			panic(fmt.Errorf("misconfig_d: %w", err))
+		}
+	}
+	p.firstPublishOffset = durationParam(runenv, "first_publish_offset")
+	if p.firstPublishOffset < 0 || p.firstPublishOffset >= p.runtime {
+		panic(fmt.Errorf("first_publish_offset %s must be between 0 and t_run", p.firstPublishOffset))
+	}
+	if err := p.connLimits.validate(); err != nil {
+		panic(err)
+	}
+	p.scoreReplacementLog = runenv.BooleanParam("score_replacement_log")
+	if p.scoreReplacementLog && !p.scoreParams.enabled() && len(p.scoreProfiles) == 0 {
+		panic(fmt.Errorf("score_replacement_log requires peer_scoring"))
+	}
 
-	if runenv.IsParamSet("topology") {
-		jsonstr := runenv.StringParam("topology")
-		err := json.Unmarshal([]byte(jsonstr), &p.connsDef)
+	p.attackerCoordination = runenv.BooleanParam("attacker_coordination")
+	p.heartbeatEvents = runenv.BooleanParam("heartbeat_events")
+	p.latencyCDF = runenv.BooleanParam("latency_cdf")
+	p.deliveryDeadline = time.Duration(runenv.IntParam("delivery_deadline_ms")) * time.Millisecond
+	if p.deliveryDeadline < 0 {
+		panic(fmt.Errorf("delivery_deadline_ms must not be negative"))
+	}
+	p.anomalies = AnomalyParams{
+		Interval:      durationParam(runenv, "t_anomaly_interval"),
+		MeshLowFor:    durationParam(runenv, "t_anomaly_mesh_low"),
+		NoDeliveryFor: durationParam(runenv, "t_anomaly_no_delivery"),
+	}
+	if err := p.anomalies.validate(); err != nil {
+		panic(err)
+	}
+	if runenv.IsParamSet("slos") {
+		if err := json.Unmarshal([]byte(runenv.StringParam("slos")), &p.slos); err != nil {
+			panic(fmt.Errorf("invalid slos: %w", err))
+		}
+		for _, slo := range p.slos {
+			if err := slo.validate(); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	p.idle = IdleParams{
+		Timeout: durationParam(runenv, "t_idle_disconnect"),
+		Pct:     runenv.IntParam("idle_disconnect_pct"),
+	}
+	if p.idle.enabled() {
+		if err := p.idle.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if runenv.BooleanParam("mesh_snapshots") {
+		// snapshot every heartbeat unless an interval is set
+		p.meshSnapshotInterval = durationParam(runenv, "t_mesh_snapshot_interval")
+		if p.meshSnapshotInterval <= 0 {
+			p.meshSnapshotInterval = p.heartbeat.Interval
+		}
+	}
+
+	p.validation = ValidationParams{
+		Delay:      time.Duration(runenv.IntParam("validate_delay_ms")) * time.Millisecond,
+		InvalidPct: runenv.FloatParam("invalid_message_pct"),
+		Events:     runenv.BooleanParam("validation_events"),
+	}
+	if err := p.validation.validate(); err != nil {
+		panic(err)
+	}
+
+	p.publishers = PublisherParams{
+		Count:    countParam(runenv, "publisher_count"),
+		Strategy: stringParam(runenv, "publisher_strategy"),
+		K:        runenv.IntParam("publisher_k"),
+		Seed:     int64(runenv.IntParam("publisher_seed")),
+	}
+	if list := stringParam(runenv, "publisher_list"); list != "" {
+		seqs, err := parsePublisherList(list)
 		if err != nil {
 			panic(err)
 		}
+		p.publishers.List = seqs
+	}
+	if err := p.publishers.validate(); err != nil {
+		panic(err)
+	}
+
+	p.nodeType = NodeTypeHonest
+	if p.sybil.enabled() {
+		if err := p.sybil.validate(); err != nil {
+			panic(err)
+		}
+		if p.attacker {
+			p.nodeType = NodeTypeSybil
+		}
+	}
+
+	p.upload = UploadParams{
+		Endpoint:  stringParam(runenv, "upload_endpoint"),
+		Bucket:    stringParam(runenv, "upload_bucket"),
+		Region:    stringParam(runenv, "upload_region"),
+		Prefix:    stringParam(runenv, "upload_prefix"),
+		AccessKey: stringParam(runenv, "upload_access_key"),
+		SecretKey: stringParam(runenv, "upload_secret_key"),
+		Traces:    runenv.BooleanParam("upload_traces"),
+		Compress:  runenv.BooleanParam("upload_compress"),
+		Timeout:   durationParam(runenv, "t_upload_timeout"),
+	}
+	// keep the credentials out of the composition if possible
+	if p.upload.AccessKey == "" {
+		p.upload.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if p.upload.SecretKey == "" {
+		p.upload.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if err := p.upload.validate(); err != nil {
+		panic(err)
+	}
+
+	p.interop = InteropParams{
+		Pct:     runenv.IntParam("interop_pct"),
+		Name:    stringParam(runenv, "interop_name"),
+		Command: stringParam(runenv, "interop_command"),
+	}
+	if err := p.interop.validate(); err != nil {
+		panic(err)
+	}
+	if p.interop.enabled() {
+		// the interop nodes only take part in the sync discovery, the run
+		// and the summary
+		switch {
+		case p.nat.enabled(), p.dht.enabled(), p.px.discovery():
+			panic(fmt.Errorf("interop nodes require sync discovery and no NAT"))
+		case p.repetitions > 1, p.attackWindow.enabled(), p.storm.enabled(), p.heavyTopic.enabled():
+			panic(fmt.Errorf("interop nodes don't support repetitions, attacks, storms or the heavy topic"))
+		}
+	}
+
+	if p.pruneFlood.enabled() {
+		if err := p.pruneFlood.validate(); err != nil {
+			panic(err)
+		}
+	}
+
+	if p.gossipSpam.enabled() {
+		if err := p.gossipSpam.validate(); err != nil {
+			panic(err)
+		}
+	}
+
+	if p.lazyPct < 0 || p.lazyPct > 100 {
+		panic(fmt.Errorf("lazy_pct must be between 0 and 100"))
+	}
+
+	if p.healthGate.enabled() {
+		if err := p.healthGate.validate(); err != nil {
+			panic(err)
+		}
+		// floodsub has no mesh, and the interop nodes don't report their health
+		if p.implementation == "floodsub" {
+			panic(fmt.Errorf("the health gate requires gossipsub"))
+		}
+		if p.interop.enabled() {
+			panic(fmt.Errorf("the health gate can't be used with an interop cohort"))
+		}
+	}
+
+	p.preGraft.Pct = runenv.IntParam("pregraft_pct")
+	if err := p.preGraft.validate(); err != nil {
+		panic(err)
+	}
+	if p.preGraft.enabled() {
+		// both ends of a pre-grafted connection must add the GRAFTs
+		if p.implementation == "floodsub" {
+			panic(fmt.Errorf("pre-grafting requires gossipsub"))
+		}
+		if p.interop.enabled() {
+			panic(fmt.Errorf("pre-grafting can't be used with an interop cohort"))
+		}
+	}
+
+	if p.blacklist.Enabled {
+		if err := p.blacklist.validate(); err != nil {
+			panic(err)
+		}
+	}
+
+	if runenv.IsParamSet("topology") {
+		p.topologyDef = runenv.StringParam("topology")
 	}
 
 	if runenv.IsParamSet("connect_delays") {
@@ -255,16 +1124,44 @@ func parseParams(runenv *runtime.RunEnv) testParams {
 		}
 	}
 
+	if names := p.summaryParams(); len(names) > 0 && !p.summary {
+		verb := "requires"
+		if len(names) > 1 {
+			verb = "require"
+		}
+		if p.lite.Enabled {
+			panic(fmt.Errorf("%s %s summary, which lite_lurkers turns off", strings.Join(names, ", "), verb))
+		}
+		panic(fmt.Errorf("%s %s summary, the results are only reported in the run summary", strings.Join(names, ", "), verb))
+	}
+
 	return p
 }
 
-/*func parseNodeType(nt string) NodeType {
-	switch nt {
-	case string(NodeTypeSybil):
-		return NodeTypeSybil
-	case string(NodeTypeGraft):
-		return NodeTypeGraft
-	default:
-		return NodeTypeHonest
+// summaryParams returns the params set whose results are computed by the
+// leader from the node reports of the run summary
+func (p testParams) summaryParams() []string {
+	var names []string
+	add := func(set bool, name string) {
+		if set {
+			names = append(names, name)
+		}
 	}
-}*/
+	add(p.baseline.enabled(), "baseline_summary")
+	add(p.latencyCDF, "latency_cdf")
+	add(p.deliveryDeadline > 0, "delivery_deadline_ms")
+	add(p.stragglers.enabled(), "straggler_percentile")
+	add(len(p.slos) > 0, "slos")
+	add(p.attackWindow.enabled(), "t_attack_duration")
+	add(p.workload == "phased", "phases")
+	add(p.partition.enabled(), "partition_groups")
+	add(p.repetitions > 1, "repetitions")
+	add(p.eclipse.enabled(), "eclipse_attackers")
+	add(p.pruneFlood.enabled(), "t_prune_flood_interval")
+	add(p.gossipSpam.enabled(), "gossip_spam_rate")
+	add(p.lazyPct > 0, "lazy_pct")
+	add(p.px.Enabled, "peer_exchange")
+	add(p.nat.enabled(), "nat_pct")
+	add(p.interop.enabled(), "interop_pct")
+	return names
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+// unsetOverlay returns overlay params keeping every gossipsub default, like a
+// run that sets none of them
+func unsetOverlay() OverlayParams {
+	return OverlayParams{
+		d:                    -1,
+		dlo:                  -1,
+		dhi:                  -1,
+		dscore:               -1,
+		dlazy:                -1,
+		dout:                 -1,
+		historyLength:        100,
+		historyGossip:        50,
+		gossipRetransmission: -1,
+	}
+}
+
+func TestOverlayParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(o *OverlayParams)
+		wantErr bool
+	}{
+		{name: "defaults", set: func(o *OverlayParams) {}},
+		{name: "consistent degrees", set: func(o *OverlayParams) { o.d, o.dlo, o.dhi, o.dscore, o.dout = 8, 6, 12, 4, 2 }},
+		{name: "d equal to the watermarks", set: func(o *OverlayParams) { o.d, o.dlo, o.dhi, o.dscore, o.dout = 4, 4, 4, 4, 2 }},
+		{name: "d below dlo", set: func(o *OverlayParams) { o.d, o.dlo = 2, 4 }, wantErr: true},
+		{name: "d above dhi", set: func(o *OverlayParams) { o.d, o.dhi = 20, 12 }, wantErr: true},
+		{name: "dscore above d", set: func(o *OverlayParams) { o.d, o.dlo, o.dscore = 4, 4, 5 }, wantErr: true},
+		{name: "dout at dlo", set: func(o *OverlayParams) { o.d, o.dlo, o.dscore, o.dout = 8, 3, 4, 3 }, wantErr: true},
+		{name: "dout above half of d", set: func(o *OverlayParams) { o.d, o.dlo, o.dscore, o.dout = 5, 5, 4, 3 }, wantErr: true},
+		{name: "gossip factor above 1", set: func(o *OverlayParams) { o.gossipFactor = 1.5 }, wantErr: true},
+		{name: "history gossip above history length", set: func(o *OverlayParams) { o.historyGossip = 200 }, wantErr: true},
+		{name: "no history gossip", set: func(o *OverlayParams) { o.historyGossip = 0 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := unsetOverlay()
+			tt.set(&o)
+			err := o.validate()
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+
+	"gossipsub_testplan/outputs"
+)
+
+// PartitionParams split the nodes into Groups of consecutive sequence numbers
+// Start after the start of the run, and heal the partition Duration later
+type PartitionParams struct {
+	Groups   int
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func (pp PartitionParams) enabled() bool {
+	return pp.Groups > 1 && pp.Duration > 0
+}
+
+func (pp PartitionParams) group(seq int64, instances int) int {
+	return int((seq - 1) * int64(pp.Groups) / int64(instances))
+}
+
+// runPartition blocks the traffic to the nodes of the other groups for the
+// duration of the partition, by dropping every packet sent to them. Both ends
+// of a link do the same, so the link is blocked in both directions.
+func (p *PubsubNode) runPartition() {
+	pp := p.cfg.Partition
+	select {
+	case <-time.After(time.Until(p.runStart.Add(pp.Start))):
+	case <-p.ctx.Done():
+		return
+	}
+
+	instances := p.runenv.TestInstanceCount
+	local := pp.group(p.seq, instances)
+	var blocked []net.IP
+	for _, r := range p.discovery.allPeers {
+		if r.Link.IP != nil && pp.group(r.NodeTypeSeq, instances) != local {
+			blocked = append(blocked, r.Link.IP)
+		}
+	}
+	p.log("partitioned in group %d of %d, blocking %d nodes", local, pp.Groups, len(blocked))
+	err := p.reconfigureNetworkWith("partition", false, func(cfg *network.Config) {
+		blockLinks(cfg, blocked)
+	})
+	if err != nil {
+		p.log("error partitioning the network: %s", err)
+		return
+	}
+	p.markTimeline("partition", "start", pp.Start)
+
+	select {
+	case <-time.After(pp.Duration):
+	case <-p.ctx.Done():
+		return
+	}
+	p.log("healing partition")
+	if err := p.reconfigureNetwork("partition-healed", false, nil); err != nil {
+		p.log("error healing the partition: %s", err)
+		return
+	}
+	healed := time.Now()
+	p.markTimeline("partition", "healed", pp.Start+pp.Duration)
+
+	// wait for the meshes to get back to D_lo peers
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !p.meshesRecovered() {
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+	ms := float64(time.Since(healed)) / float64(time.Millisecond)
+	p.log("meshes recovered %.0fms after healing the partition", ms)
+	p.markTimeline("partition", "meshes_recovered", unplanned)
+	p.runenv.R().RecordPoint("partition_mesh_recovery_ms", ms)
+
+	p.deliveriesLk.Lock()
+	p.meshRecoveryMs = ms
+	p.deliveriesLk.Unlock()
+}
+
+func (p *PubsubNode) meshesRecovered() bool {
+	tracer := p.testTracer()
+	if tracer == nil {
+		return true
+	}
+	dlo := gossipSubParams(p.cfg).Dlo
+	for _, t := range p.cfg.Topics {
+		if tracer.MeshSize(t.Id) < dlo {
+			return false
+		}
+	}
+	return true
+}
+
+// blockLinks drops all the packets sent to the given addresses, keeping the
+// per-link rules of the other links
+func blockLinks(cfg *network.Config, ips []net.IP) {
+	for _, ip := range ips {
+		subnet := net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		found := false
+		for i := range cfg.Rules {
+			if cfg.Rules[i].Subnet.IP.Equal(ip) {
+				cfg.Rules[i].Loss = 100
+				found = true
+			}
+		}
+		if !found {
+			shape := cfg.Default
+			shape.Loss = 100
+			cfg.Rules = append(cfg.Rules, network.LinkRule{LinkShape: shape, Subnet: ptypes.IPNet{IPNet: subnet}})
+		}
+	}
+}
+
+// computePartition summarizes the deliveries of the messages published before,
+// during and after the partition, and how long the meshes took to recover
+func computePartition(reports []NodeReport, pp PartitionParams, runStart time.Time) *outputs.Partition {
+	start := runStart.Add(pp.Start)
+	end := start.Add(pp.Duration)
+
+	merged := make(map[int64]DeliveryBucket)
+	receivers := 0
+	var recovery []float64
+	for _, r := range reports {
+		if !r.Attacker {
+			receivers++
+			if r.MeshRecoveryMs > 0 {
+				recovery = append(recovery, r.MeshRecoveryMs)
+			}
+		}
+		for sec, b := range r.Buckets {
+			m := merged[sec]
+			m.Published += b.Published
+			if !r.Attacker {
+				m.Delivered += b.Delivered
+				m.LatencySumMs += b.LatencySumMs
+			}
+			merged[sec] = m
+		}
+	}
+
+	before, during, after := splitPhases(merged, start, end)
+	return &outputs.Partition{
+		Groups:         pp.Groups,
+		StartSecs:      float64(start.Unix()),
+		DurationSecs:   pp.Duration.Seconds(),
+		Before:         summarizePhase(before, receivers),
+		During:         summarizePhase(during, receivers),
+		After:          summarizePhase(after, receivers),
+		MeshRecoveryMs: latencyStats(recovery),
+	}
+}
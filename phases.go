@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/testground/sdk-go/ptypes"
+
+	"gossipsub_testplan/outputs"
+)
+
+// PhaseConfig is one phase of the phased workload, publishing to every topic
+// with its own message rate and size
+type PhaseConfig struct {
+	Name        string
+	Duration    ptypes.Duration
+	MessageRate ptypes.Rate
+	MessageSize ptypes.Size
+}
+
+// PhasesParams configure the phases of the phased workload. If Randomize is
+// set, the phases run in a random order derived from Seed, or from the run ID
+// if Seed is 0, so that every node picks the same order.
+type PhasesParams struct {
+	Phases    []PhaseConfig
+	Randomize bool
+	Seed      int64
+}
+
+func (p PhasesParams) enabled() bool {
+	return len(p.Phases) > 0
+}
+
+// ordered returns the phases in the order they run in this run, and the seed
+// used to shuffle them
+func (p PhasesParams) ordered(runID string) ([]PhaseConfig, int64) {
+	phases := append([]PhaseConfig(nil), p.Phases...)
+	if !p.Randomize {
+		return phases, 0
+	}
+	seed := p.Seed
+	if seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(runID))
+		seed = int64(h.Sum64())
+	}
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(phases), func(i, j int) { phases[i], phases[j] = phases[j], phases[i] })
+	return phases, seed
+}
+
+// phasedWorkload runs a constant rate workload for each phase in turn. The
+// last phase lasts until the end of the run.
+type phasedWorkload struct {
+	phases    []PhaseConfig
+	workloads []*constantRateWorkload
+	idx       int
+	// offset of the start of the current phase
+	start time.Duration
+	// offset of the last message returned
+	now time.Duration
+}
+
+func newPhasedWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	if len(env.Phases) == 0 {
+		return nil, fmt.Errorf("phased workload requires phases")
+	}
+	w := &phasedWorkload{phases: env.Phases}
+	for _, phase := range env.Phases {
+		phaseTopics := make([]TopicConfig, len(topics))
+		for i, t := range topics {
+			phaseTopics[i] = TopicConfig{Id: t.Id, MessageRate: phase.MessageRate, MessageSize: phase.MessageSize}
+		}
+		cw, err := newConstantRateWorkload(phaseTopics, env)
+		if err != nil {
+			return nil, fmt.Errorf("phase %s: %w", phase.Name, err)
+		}
+		w.workloads = append(w.workloads, cw.(*constantRateWorkload))
+	}
+	return w, nil
+}
+
+func (w *phasedWorkload) Next() (uint64, time.Duration, string) {
+	for {
+		cw := w.workloads[w.idx]
+		size, _, topic := cw.Next()
+		if cw.now < w.phases[w.idx].Duration.Duration || w.idx == len(w.phases)-1 {
+			at := w.start + cw.now
+			delay := at - w.now
+			w.now = at
+			return size, delay, topic
+		}
+		w.start += w.phases[w.idx].Duration.Duration
+		w.idx++
+	}
+}
+
+// computePhases summarizes the deliveries of the messages published in each
+// phase, starting at the given publish start time
+func computePhases(reports []NodeReport, phases []PhaseConfig, seed int64, randomized bool, start time.Time) *outputs.Phases {
+	out := &outputs.Phases{Randomized: randomized, Seed: seed}
+
+	// only deliveries to honest nodes are expected
+	merged := make(map[int64]DeliveryBucket)
+	receivers := 0
+	for _, r := range reports {
+		if !r.Attacker {
+			receivers++
+		}
+		for sec, b := range r.Buckets {
+			m := merged[sec]
+			m.Published += b.Published
+			if !r.Attacker {
+				m.Delivered += b.Delivered
+				m.LatencySumMs += b.LatencySumMs
+			}
+			merged[sec] = m
+		}
+	}
+
+	for i, phase := range phases {
+		end := start.Add(phase.Duration.Duration)
+		if i == len(phases)-1 {
+			// the last phase lasts until the end of the run
+			end = time.Unix(1<<62, 0)
+		}
+		_, during, _ := splitPhases(merged, start, end)
+		out.Order = append(out.Order, phase.Name)
+		out.Phases = append(out.Phases, outputs.PhaseResult{
+			Name:         phase.Name,
+			StartSecs:    float64(start.Unix()),
+			PhaseSummary: summarizePhase(during, receivers),
+		})
+		start = end
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+
+	"gossipsub_testplan/outputs"
+)
+
+// pingLoop periodically pings every connected peer, so that the latency applied
+// by the sidecar can be checked against the latency actually measured
+func (p *PubsubNode) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, pid := range p.h.Network().Peers() {
+			wg.Add(1)
+			go func(pid peer.ID) {
+				defer wg.Done()
+				p.pingPeer(pid, interval)
+			}(pid)
+		}
+		wg.Wait()
+	}
+}
+
+func (p *PubsubNode) pingPeer(pid peer.ID, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(p.ctx, timeout)
+	defer cancel()
+
+	res, ok := <-ping.Ping(ctx, p.h, pid)
+	if !ok || res.Error != nil {
+		return
+	}
+
+	p.rttLk.Lock()
+	defer p.rttLk.Unlock()
+	link, ok := p.rtts[pid]
+	if !ok {
+		link = &outputs.LinkRTT{Peer: pid.String(), PeerSeq: p.discovery.SeqOf(pid)}
+		p.rtts[pid] = link
+	}
+	link.Samples = append(link.Samples, outputs.RTTSample{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		RTTMs:     float64(res.RTT) / float64(time.Millisecond),
+	})
+}
+
+// writeRTTs outputs the RTT time series of every link as json
+func (p *PubsubNode) writeRTTs() error {
+	p.rttLk.Lock()
+	defer p.rttLk.Unlock()
+
+	out := outputs.PingRTTs{Version: outputs.SchemaVersion, Seq: p.seq}
+	for _, link := range p.rtts {
+		out.Links = append(out.Links, link)
+	}
+
+	path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.PingRTTPrefix, p.seq)
+	jsonstr, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
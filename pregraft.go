@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PreGraftParams configure connect-time pre-grafting. The nodes join the
+// topics before connecting to the topology, and graft a share of the peers
+// they connect to as soon as they get their subscriptions, instead of leaving
+// the mesh to the heartbeat.
+type PreGraftParams struct {
+	// percentage of the new connections pre-grafted. -1 disables pre-grafting,
+	// and 0 only joins the topics before connecting, for comparison.
+	Pct int
+}
+
+func (g PreGraftParams) enabled() bool {
+	return g.Pct >= 0
+}
+
+func (g PreGraftParams) validate() error {
+	if g.Pct < -1 || g.Pct > 100 {
+		return fmt.Errorf("pregraft_pct must be between -1 and 100")
+	}
+	return nil
+}
+
+// preGrafter grafts new peers from the RPC inspector of the router. The router
+// only sends GRAFTs from its heartbeat and when a topic is joined, so both ends
+// of a pre-grafted connection add a GRAFT from the other to the first RPC they
+// get from it, the hello listing its subscriptions. Each router then grafts
+// the peer as if it had asked to, or PRUNEs it back if the mesh is full or the
+// peer is backed off, like it would answer a real GRAFT. Both ends pick the
+// same connections from a hash of the two peer IDs, so that the meshes stay
+// symmetric.
+type preGrafter struct {
+	local peer.ID
+	pct   int
+
+	lk sync.Mutex
+	// peers whose hello was received since they connected
+	greeted map[peer.ID]struct{}
+	// topics the peers were pre-grafted to, before and after the router
+	// grafted them
+	pending map[peer.ID]map[string]struct{}
+	grafted map[peer.ID]map[string]struct{}
+
+	attempts int64
+	grafts   int64
+	// pre-grafted peers later pruned from the mesh while still connected
+	pruned int64
+	// largest mesh of any topic
+	peak int
+}
+
+func newPreGrafter(h host.Host, params PreGraftParams) *preGrafter {
+	g := &preGrafter{
+		local:   h.ID(),
+		pct:     params.Pct,
+		greeted: make(map[peer.ID]struct{}),
+		pending: make(map[peer.ID]map[string]struct{}),
+		grafted: make(map[peer.ID]map[string]struct{}),
+	}
+	h.Network().Notify(&lnetwork.NotifyBundle{
+		DisconnectedF: func(n lnetwork.Network, c lnetwork.Conn) {
+			if n.Connectedness(c.RemotePeer()) == lnetwork.Connected {
+				return
+			}
+			g.lk.Lock()
+			defer g.lk.Unlock()
+			delete(g.greeted, c.RemotePeer())
+			delete(g.pending, c.RemotePeer())
+		},
+	})
+	return g
+}
+
+// chosen returns true if the connection to the remote peer is pre-grafted
+func (g *preGrafter) chosen(remote peer.ID) bool {
+	a, b := g.local, remote
+	if b < a {
+		a, b = b, a
+	}
+	h := fnv.New32a()
+	h.Write([]byte(a))
+	h.Write([]byte(b))
+	return int(h.Sum32()%100) < g.pct
+}
+
+// inspect adds the GRAFTs to the hello of a chosen peer. It is the RPC
+// inspector of the router, called from its event loop, and must not call into
+// pubsub.
+func (g *preGrafter) inspect(from peer.ID, rpc *pubsub.RPC) error {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if _, ok := g.greeted[from]; ok {
+		return nil
+	}
+	g.greeted[from] = struct{}{}
+	if !g.chosen(from) {
+		return nil
+	}
+	for _, sub := range rpc.GetSubscriptions() {
+		if !sub.GetSubscribe() {
+			continue
+		}
+		topic := sub.GetTopicid()
+		if rpc.Control == nil {
+			rpc.Control = &pb.ControlMessage{}
+		}
+		rpc.Control.Graft = append(rpc.Control.Graft, &pb.ControlGraft{TopicID: &topic})
+		topics := g.pending[from]
+		if topics == nil {
+			topics = make(map[string]struct{})
+			g.pending[from] = topics
+		}
+		topics[topic] = struct{}{}
+		g.attempts++
+	}
+	return nil
+}
+
+// meshChange follows the pre-grafted peers in the local mesh, and the size of
+// the mesh. meshSize returns the current size of the mesh of a topic.
+func (g *preGrafter) meshChange(c MeshChange, meshSize func(string) int) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if !c.Graft {
+		if _, ok := g.grafted[c.Peer][c.Topic]; ok {
+			delete(g.grafted[c.Peer], c.Topic)
+			if c.Cause != MeshCauseDisconnected {
+				g.pruned++
+			}
+		}
+		return
+	}
+	if size := meshSize(c.Topic); size > g.peak {
+		g.peak = size
+	}
+	if _, ok := g.pending[c.Peer][c.Topic]; !ok {
+		return
+	}
+	delete(g.pending[c.Peer], c.Topic)
+	topics := g.grafted[c.Peer]
+	if topics == nil {
+		topics = make(map[string]struct{})
+		g.grafted[c.Peer] = topics
+	}
+	topics[c.Topic] = struct{}{}
+	g.grafts++
+}
+
+// stats returns the GRAFTs added to hellos, the ones the router accepted, the
+// pre-grafted peers pruned since and the largest mesh
+func (g *preGrafter) stats() (attempts, grafts, pruned int64, peak int) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	return g.attempts, g.grafts, g.pruned, g.peak
+}
+
+// startPreGrafting follows the mesh of the node, and returns the router option
+// adding the pre-grafts
+func (p *PubsubNode) startPreGrafting(tracer *TestTracer) pubsub.Option {
+	p.pregraft = newPreGrafter(p.h, p.cfg.PreGraft)
+	tracer.OnMeshChange(func(c MeshChange) {
+		p.pregraft.meshChange(c, tracer.MeshSize)
+	})
+	return pubsub.WithAppSpecificRpcInspector(p.pregraft.inspect)
+}
+
+// recordPreGrafts records the outcome of the pre-grafts of the node
+func (p *PubsubNode) recordPreGrafts() {
+	attempts, grafts, pruned, peak := p.pregraft.stats()
+	p.log("pre-grafting: %d of %d pre-grafts accepted, %d pruned since, largest mesh %d", grafts, attempts, pruned, peak)
+	p.runenv.R().RecordPoint("pregraft_attempts", float64(attempts))
+	p.runenv.R().RecordPoint("pregrafts", float64(grafts))
+	p.runenv.R().RecordPoint("pregrafts_pruned", float64(pruned))
+	p.runenv.R().RecordPoint("mesh_peak", float64(peak))
+}
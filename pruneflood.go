@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// PruneFloodParams configure the mesh churning attack. During the attack
+// window every attacker connects a fresh identity to each of its honest mesh
+// peers, and keeps GRAFTing it into their meshes and PRUNEing it with a PX of
+// bogus peers. The PRUNEs ask for the shortest backoff, so that a GRAFT sent
+// less than a second after them is penalized.
+type PruneFloodParams struct {
+	// period of the GRAFT and PRUNE cycle, disabled if zero. The PRUNE is sent
+	// half way through the cycle.
+	Interval time.Duration
+	// number of victims of each attacker, its mesh peers first
+	Victims int
+	// bogus peers in the PX of every PRUNE
+	PX        int
+	Transport string
+}
+
+func (f PruneFloodParams) enabled() bool {
+	return f.Interval > 0
+}
+
+func (f PruneFloodParams) validate() error {
+	if f.Victims <= 0 {
+		return fmt.Errorf("prune_flood_victims must be positive")
+	}
+	if f.PX < 0 {
+		return fmt.Errorf("prune_flood_px must not be negative")
+	}
+	return nil
+}
+
+// PruneFloodReport is the part of the node report about the PRUNE flood. The
+// attackers report their identities and the control messages they exchanged,
+// the honest nodes the PRUNEs they received and the score of their senders.
+type PruneFloodReport struct {
+	Identities []string
+	Grafts     int64
+	Prunes     int64
+	PX         int64
+	// PRUNEs the victims sent back to the identities
+	PrunedBack int64
+
+	// PRUNEs received by peer ID, and the score given to those peers at the
+	// end of the run
+	PrunesFrom   map[string]int64
+	PrunerScores map[string]float64
+}
+
+// pruneFloodStats count the control messages sent by a flooding attacker
+type pruneFloodStats struct {
+	grafts int64
+	prunes int64
+	px     int64
+
+	lk         sync.Mutex
+	identities []string
+	pruned     []*sybilStats
+}
+
+// runPruneFlood churns the meshes of the victims during the attack window
+func (p *PubsubNode) runPruneFlood() {
+	params := p.cfg.PruneFlood
+	w := p.cfg.AttackWindow
+	if !p.waitAttackStart() {
+		return
+	}
+
+	victims := p.pruneFloodVictims(params.Victims)
+	ctx, cancel := context.WithTimeout(p.ctx, w.Duration)
+	defer cancel()
+	p.log("flooding %d victims with PRUNEs every %s, %d bogus PX peers each", len(victims), params.Interval, params.PX)
+
+	stats := &p.pruneFlood
+	var wg sync.WaitGroup
+	for _, victim := range victims {
+		wg.Add(1)
+		go func(victim PeerRegistration) {
+			defer wg.Done()
+			h, err := createHost(ctx, params.Transport, false, nil, nil, nil)
+			if err != nil {
+				p.log("error creating prune flood host: %s", err)
+				return
+			}
+			defer h.Close()
+			stats.lk.Lock()
+			stats.identities = append(stats.identities, h.ID().String())
+			stats.lk.Unlock()
+			if err := p.pruneFloodVictim(ctx, h, victim, stats); err != nil && ctx.Err() == nil {
+				p.log("prune flood of %s failed: %s", victim.Info.ID.Loggable(), err)
+			}
+		}(victim)
+	}
+	wg.Wait()
+
+	report := p.pruneFloodReport()
+	p.log("prune flood over: %d grafts and %d prunes with %d PX peers sent, pruned back %d times",
+		report.Grafts, report.Prunes, report.PX, report.PrunedBack)
+	p.runenv.R().RecordPoint("prune_flood_grafts_sent", float64(report.Grafts))
+	p.runenv.R().RecordPoint("prune_flood_prunes_sent", float64(report.Prunes))
+	p.runenv.R().RecordPoint("prune_flood_px_sent", float64(report.PX))
+	p.runenv.R().RecordPoint("prune_flood_pruned_back", float64(report.PrunedBack))
+}
+
+// pruneFloodVictims returns the honest mesh peers of the node, topped up with
+// random honest peers
+func (p *PubsubNode) pruneFloodVictims(n int) []PeerRegistration {
+	mesh := make(map[peer.ID]struct{})
+	if tracer := p.testTracer(); tracer != nil {
+		for _, t := range p.cfg.Topics {
+			for _, pid := range tracer.MeshPeers(t.Id) {
+				mesh[pid] = struct{}{}
+			}
+		}
+	}
+	var victims, others []PeerRegistration
+	for _, pr := range p.discovery.allPeers {
+		if pr.NType != NodeTypeHonest || pr.Info.ID == p.h.ID() {
+			continue
+		}
+		if _, ok := mesh[pr.Info.ID]; ok {
+			victims = append(victims, pr)
+		} else {
+			others = append(others, pr)
+		}
+	}
+	rand.Shuffle(len(victims), func(i, j int) { victims[i], victims[j] = victims[j], victims[i] })
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	victims = append(victims, others...)
+	if len(victims) > n {
+		victims = victims[:n]
+	}
+	return victims
+}
+
+// pruneFloodVictim connects the identity to the victim and cycles it through
+// the victim's mesh until the context is done
+func (p *PubsubNode) pruneFloodVictim(ctx context.Context, h host.Host, victim PeerRegistration, stats *pruneFloodStats) error {
+	// the victim's PRUNEs arrive on the stream its router opens to us
+	var back sybilStats
+	var inMesh int32
+	stats.lk.Lock()
+	stats.pruned = append(stats.pruned, &back)
+	stats.lk.Unlock()
+	handler := func(s lnetwork.Stream) {
+		defer s.Reset()
+		readSybilRPCs(s, &back, &inMesh, nil)
+	}
+	h.SetStreamHandler(pubsub.GossipSubID_v11, handler)
+	h.SetStreamHandler(pubsub.GossipSubID_v10, handler)
+
+	cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+	defer cancel()
+	if err := h.Connect(cctx, victim.Info); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, victim.Info.ID, pubsub.GossipSubID_v11)
+	if err != nil {
+		return err
+	}
+	defer s.Reset()
+
+	px, err := bogusPX(p.cfg.PruneFlood.PX)
+	if err != nil {
+		return err
+	}
+	subs := make([]*pb.RPC_SubOpts, 0, len(p.cfg.Topics))
+	graft := &pb.ControlMessage{}
+	prune := &pb.ControlMessage{}
+	backoff := uint64(1)
+	for _, t := range p.cfg.Topics {
+		id := t.Id
+		subscribe := true
+		subs = append(subs, &pb.RPC_SubOpts{Subscribe: &subscribe, Topicid: &id})
+		graft.Graft = append(graft.Graft, &pb.ControlGraft{TopicID: &id})
+		prune.Prune = append(prune.Prune, &pb.ControlPrune{TopicID: &id, Peers: px, Backoff: &backoff})
+	}
+	if err := writeSybilRPC(s, &pb.RPC{Subscriptions: subs}); err != nil {
+		return err
+	}
+
+	half := p.cfg.PruneFlood.Interval / 2
+	for {
+		if err := writeSybilRPC(s, &pb.RPC{Control: graft}); err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.grafts, int64(len(graft.Graft)))
+		select {
+		case <-time.After(half):
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := writeSybilRPC(s, &pb.RPC{Control: prune}); err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.prunes, int64(len(prune.Prune)))
+		atomic.AddInt64(&stats.px, int64(len(prune.Prune)*len(px)))
+		select {
+		case <-time.After(p.cfg.PruneFlood.Interval - half):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// bogusPX returns n peer exchange records of peers that don't exist
+func bogusPX(n int) ([]*pb.PeerInfo, error) {
+	px := make([]*pb.PeerInfo, 0, n)
+	for i := 0; i < n; i++ {
+		_, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := peer.IDFromPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		px = append(px, &pb.PeerInfo{PeerID: []byte(pid)})
+	}
+	return px, nil
+}
+
+// pruneFloodReport collects the node's part of the PRUNE flood report
+func (p *PubsubNode) pruneFloodReport() *PruneFloodReport {
+	stats := &p.pruneFlood
+	report := &PruneFloodReport{
+		Grafts: atomic.LoadInt64(&stats.grafts),
+		Prunes: atomic.LoadInt64(&stats.prunes),
+		PX:     atomic.LoadInt64(&stats.px),
+	}
+	stats.lk.Lock()
+	report.Identities = append(report.Identities, stats.identities...)
+	for _, back := range stats.pruned {
+		report.PrunedBack += atomic.LoadInt64(&back.prunes)
+	}
+	stats.lk.Unlock()
+	if p.cfg.Attacker {
+		return report
+	}
+
+	tracer := p.testTracer()
+	if tracer == nil {
+		return report
+	}
+	scores := p.peerScores()
+	report.PrunesFrom = make(map[string]int64)
+	for pid, n := range tracer.PrunesReceived() {
+		report.PrunesFrom[pid.String()] = n
+		if score, ok := scores[pid]; ok {
+			if report.PrunerScores == nil {
+				report.PrunerScores = make(map[string]float64)
+			}
+			report.PrunerScores[pid.String()] = score
+		}
+	}
+	return report
+}
+
+// summarizePruneFlood matches the PRUNEs received by the honest nodes and
+// their scores with the identities of the attackers
+func summarizePruneFlood(reports []NodeReport, params PruneFloodParams) *outputs.PruneFlood {
+	s := &outputs.PruneFlood{IntervalSecs: params.Interval.Seconds(), PX: params.PX}
+	identities := make(map[string]struct{})
+	for _, r := range reports {
+		if !r.Attacker || r.PruneFlood == nil {
+			continue
+		}
+		s.Attackers++
+		s.GraftsSent += r.PruneFlood.Grafts
+		s.PrunesSent += r.PruneFlood.Prunes
+		s.PXSent += r.PruneFlood.PX
+		s.PrunedBack += r.PruneFlood.PrunedBack
+		for _, id := range r.PruneFlood.Identities {
+			identities[id] = struct{}{}
+		}
+	}
+	s.Identities = len(identities)
+
+	var scoreSum, victimChurn, otherChurn float64
+	var others int
+	for _, r := range reports {
+		if r.Attacker || r.PruneFlood == nil {
+			continue
+		}
+		victim := false
+		for id, n := range r.PruneFlood.PrunesFrom {
+			if _, ok := identities[id]; !ok {
+				continue
+			}
+			victim = true
+			s.PrunesReceived += n
+			score, ok := r.PruneFlood.PrunerScores[id]
+			if !ok {
+				continue
+			}
+			if s.ScoredIdentities == 0 || score < s.MinIdentityScore {
+				s.MinIdentityScore = score
+			}
+			if score < 0 {
+				s.NegativeScores++
+			}
+			scoreSum += score
+			s.ScoredIdentities++
+		}
+		if victim {
+			s.Victims++
+			victimChurn += r.MeshChurnPerMin
+		} else {
+			others++
+			otherChurn += r.MeshChurnPerMin
+		}
+	}
+	if s.ScoredIdentities > 0 {
+		s.MeanIdentityScore = scoreSum / float64(s.ScoredIdentities)
+	}
+	if s.Victims > 0 {
+		s.VictimMeshChurnPerMin = victimChurn / float64(s.Victims)
+	}
+	if others > 0 {
+		s.OtherMeshChurnPerMin = otherChurn / float64(others)
+	}
+	return s
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+// PublisherParams select the nodes that publish. Instance 1 draws the set and
+// shares it on the sync service, so that every node agrees on it even when it
+// is drawn at random.
+type PublisherParams struct {
+	Count int
+	// first, random, every_k or list
+	Strategy string
+	// distance between the publishers of the every_k strategy
+	K int
+	// sequence numbers of the list strategy
+	List []int64
+	// seed of the random strategy. Zero draws a different set on every run.
+	Seed int64
+}
+
+// PublisherSet is the set of publishers shared by instance 1
+type PublisherSet struct {
+	Seqs []int64
+}
+
+var PublisherSetTopic = tgsync.NewTopic("publisher-set", &PublisherSet{})
+
+func (pp PublisherParams) validate() error {
+	switch pp.Strategy {
+	case "first", "random":
+	case "every_k":
+		if pp.K <= 0 {
+			return fmt.Errorf("publisher_strategy every_k requires a positive publisher_k")
+		}
+	case "list":
+		if len(pp.List) == 0 {
+			return fmt.Errorf("publisher_strategy list requires publisher_list")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown publisher_strategy %s", pp.Strategy)
+	}
+	if pp.Count <= 0 {
+		return fmt.Errorf("publisher_count must be positive")
+	}
+	return nil
+}
+
+// single is true for the default of instance 1 publishing alone, which needs
+// no agreement
+func (pp PublisherParams) single() bool {
+	return pp.Strategy == "first" && pp.Count == 1
+}
+
+// parsePublisherList parses comma separated sequence numbers, eg "1,5,9"
+func parsePublisherList(s string) ([]int64, error) {
+	var seqs []int64
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		seq, err := strconv.ParseInt(entry, 10, 64)
+		if err != nil || seq < 1 {
+			return nil, fmt.Errorf("invalid publisher sequence number %q", entry)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs, nil
+}
+
+// selectPublishers returns the sequence numbers of the publishers, in order
+func (pp PublisherParams) selectPublishers(instances int) ([]int64, error) {
+	var seqs []int64
+	switch pp.Strategy {
+	case "first":
+		for seq := int64(1); seq <= int64(instances) && len(seqs) < pp.Count; seq++ {
+			seqs = append(seqs, seq)
+		}
+	case "every_k":
+		for seq := int64(1); seq <= int64(instances) && len(seqs) < pp.Count; seq += int64(pp.K) {
+			seqs = append(seqs, seq)
+		}
+	case "random":
+		seed := pp.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		rng := rand.New(rand.NewSource(seed))
+		for _, i := range rng.Perm(instances) {
+			if len(seqs) == pp.Count {
+				break
+			}
+			seqs = append(seqs, int64(i+1))
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	case "list":
+		for _, seq := range pp.List {
+			if seq > int64(instances) {
+				return nil, fmt.Errorf("publisher %d is above the instance count %d", seq, instances)
+			}
+		}
+		// the list sets the number of publishers
+		return pp.List, nil
+	}
+	if len(seqs) < pp.Count {
+		return nil, fmt.Errorf("only %d of the %d publishers fit in %d instances", len(seqs), pp.Count, instances)
+	}
+	return seqs, nil
+}
+
+// agreePublishers returns the set of publishers of the run. Instance 1
+// selects it and the other instances wait for it on the sync service.
+func agreePublishers(ctx context.Context, client tgsync.Client, pp PublisherParams, seq int64, instances int) (map[int64]bool, error) {
+	if pp.single() {
+		return map[int64]bool{1: true}, nil
+	}
+	if seq == 1 {
+		seqs, err := pp.selectPublishers(instances)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.Publish(ctx, PublisherSetTopic, &PublisherSet{Seqs: seqs}); err != nil {
+			return nil, fmt.Errorf("error sharing the publisher set: %w", err)
+		}
+	}
+
+	ch := make(chan *PublisherSet, 1)
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err := client.Subscribe(sctx, PublisherSetTopic, ch); err != nil {
+		return nil, fmt.Errorf("error subscribing to the publisher set: %w", err)
+	}
+	select {
+	case set := <-ch:
+		publishers := make(map[int64]bool, len(set.Seqs))
+		for _, s := range set.Seqs {
+			publishers[s] = true
+		}
+		return publishers, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// DiscoveryPX is the discovery mode where peer exchange on PRUNE is the only
+// way the nodes find their peers after startup
+const DiscoveryPX = "px"
+
+// PXParams configure peer exchange. With PX, a node pruning a peer from an
+// oversubscribed mesh sends it other peers of the topic, with their signed
+// peer records, for it to connect to. In the px discovery mode the nodes only
+// dial the first Bootstrappers nodes, which are soon oversubscribed and
+// spread the other nodes through PX, and churned nodes rejoin through them.
+type PXParams struct {
+	// whether the routers do peer exchange
+	Enabled bool
+	// number of bootstrap nodes of the px discovery mode, disabled if zero
+	Bootstrappers int
+	// peers sent in every PRUNE, zero keeps the gossipsub default (16)
+	Peers int
+}
+
+// discovery returns true if PX is the only discovery mechanism
+func (x PXParams) discovery() bool {
+	return x.Bootstrappers > 0
+}
+
+// PXReport is the part of the node report about peer exchange: the peers the
+// node got through PX, its connections to peers it didn't dial itself, and
+// its meshes at the end of the run
+type PXReport struct {
+	Bootstrapper bool
+	Received     uint64
+	Signed       uint64
+	PXConns      int
+	Dlo          int
+	MeshSizes    map[string]int
+}
+
+// connectBootstrappers dials the bootstrap nodes of the px discovery mode
+func (p *PubsubNode) connectBootstrappers(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+
+	var bootstrap []PeerRegistration
+	for _, r := range p.discovery.allPeers {
+		if r.NodeTypeSeq <= int64(p.cfg.PX.Bootstrappers) && r.Info.ID != p.h.ID() {
+			bootstrap = append(bootstrap, r)
+		}
+	}
+	p.log("connecting to %d px bootstrap nodes after %s", len(bootstrap), delay)
+	if len(bootstrap) == 0 {
+		return nil
+	}
+	return p.discovery.ConnectingToPeers(ctx, bootstrap)
+}
+
+// pxReport collects the node's part of the peer exchange report. The
+// outbound connections to peers that discovery didn't dial were opened by
+// the router for PX.
+func (p *PubsubNode) pxReport() *PXReport {
+	report := &PXReport{
+		Bootstrapper: p.cfg.PX.discovery() && p.seq <= int64(p.cfg.PX.Bootstrappers),
+		Dlo:          gossipSubParams(p.cfg).Dlo,
+		MeshSizes:    make(map[string]int, len(p.cfg.Topics)),
+	}
+	dialed := make(map[peer.ID]struct{})
+	for _, r := range p.discovery.Connected() {
+		dialed[r.Info.ID] = struct{}{}
+	}
+	for _, c := range p.h.Network().Conns() {
+		if _, ok := dialed[c.RemotePeer()]; !ok && c.Stat().Direction == lnetwork.DirOutbound {
+			report.PXConns++
+		}
+	}
+	if tracer := p.testTracer(); tracer != nil {
+		report.Received, report.Signed = tracer.PXReceived()
+		for _, t := range p.cfg.Topics {
+			report.MeshSizes[t.Id] = tracer.MeshSize(t.Id)
+		}
+	}
+	return report
+}
+
+// summarizePX adds up the peers the honest nodes got through PX and the
+// connections they opened for them, and counts the nodes whose meshes were
+// below Dlo at the end of the run. The bootstrap nodes are left out of the
+// meshes, as every node dialed them.
+func summarizePX(reports []NodeReport, params PXParams) *outputs.PeerExchange {
+	s := &outputs.PeerExchange{Bootstrappers: params.Bootstrappers}
+	var meshSum, meshes int
+	for _, r := range reports {
+		if r.Attacker || r.PX == nil {
+			continue
+		}
+		s.PeersReceived += r.PX.Received
+		s.SignedRecords += r.PX.Signed
+		s.PXConnections += r.PX.PXConns
+		if r.PX.Bootstrapper {
+			continue
+		}
+		s.Nodes++
+		below := false
+		for _, size := range r.PX.MeshSizes {
+			meshSum += size
+			meshes++
+			if size < r.PX.Dlo {
+				below = true
+			}
+		}
+		if below {
+			s.NodesBelowDlo++
+		}
+	}
+	if meshes > 0 {
+		s.MeanMeshSize = float64(meshSum) / float64(meshes)
+	}
+	if s.PeersReceived > 0 {
+		s.SignedShare = float64(s.SignedRecords) / float64(s.PeersReceived)
+	}
+	return s
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	relayclient "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// attempts of a NAT'd node to reserve a slot at its relay
+const relayReserveAttempts = 3
+
+// NATParams put a cohort of nodes behind a NAT. The NAT'd nodes don't listen,
+// so they can dial out but are only reachable through a circuit v2 relay.
+// The relays are regular nodes that also run the relay service, and each
+// NAT'd node reserves a slot at the relay picked by its sequence number.
+type NATParams struct {
+	// percentage of the nodes, with the highest sequence numbers
+	Pct int
+	// number of relays, the lowest sequence numbers
+	Relays int
+}
+
+func (n NATParams) enabled() bool {
+	return n.Pct > 0
+}
+
+func (n NATParams) validate(instances int) error {
+	if n.Pct < 0 || n.Pct > 100 {
+		return fmt.Errorf("nat_pct must be between 0 and 100")
+	}
+	if !n.enabled() {
+		return nil
+	}
+	if n.Relays <= 0 {
+		return fmt.Errorf("nat_relays must be positive")
+	}
+	if n.Relays > instances || inCohort(int64(n.Relays), instances, n.Pct) {
+		return fmt.Errorf("the %d relays must not be NAT'd", n.Relays)
+	}
+	return nil
+}
+
+func (n NATParams) natted(seq int64, instances int) bool {
+	return n.enabled() && inCohort(seq, instances, n.Pct)
+}
+
+func (n NATParams) isRelay(seq int64) bool {
+	return n.enabled() && seq <= int64(n.Relays)
+}
+
+// relayOf returns the sequence number of the relay of a NAT'd node
+func (n NATParams) relayOf(seq int64) int64 {
+	return (seq-1)%int64(n.Relays) + 1
+}
+
+// startRelay runs the relay service on the host, without the default limits
+// on the duration and the data of the relayed connections
+func startRelay(h host.Host, instances int) error {
+	rc := relay.DefaultResources()
+	rc.Limit = nil
+	rc.MaxReservations = instances
+	rc.MaxCircuits = instances
+	rc.MaxReservationsPerIP = instances
+	rc.MaxReservationsPerASN = instances
+	_, err := relay.New(h, relay.WithResources(rc))
+	return err
+}
+
+// setupRelays points the registrations of the NAT'd nodes to their relays,
+// and reserves a slot at its relay if this node is NAT'd. Every node waits
+// for all the reservations before dialing anyone.
+func setupRelays(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client, h host.Host, seq int64, params NATParams, discovery *SyncDiscovery) error {
+	relays := make(map[int64]peer.AddrInfo, params.Relays)
+	for _, pr := range discovery.allPeers {
+		if params.isRelay(pr.NodeTypeSeq) {
+			relays[pr.NodeTypeSeq] = pr.Info
+		}
+	}
+	for i, pr := range discovery.allPeers {
+		if pr.Link.RelaySeq == 0 {
+			continue
+		}
+		ri, ok := relays[pr.Link.RelaySeq]
+		if !ok {
+			return fmt.Errorf("relay %d of node %d did not register", pr.Link.RelaySeq, pr.NodeTypeSeq)
+		}
+		discovery.allPeers[i].Info.Addrs = circuitAddrs(ri)
+	}
+
+	if params.natted(seq, runenv.TestInstanceCount) {
+		ri := relays[params.relayOf(seq)]
+		var err error
+		for i := 0; i < relayReserveAttempts; i++ {
+			if _, err = reserveRelaySlot(ctx, h, ri); err == nil {
+				break
+			}
+			runenv.RecordMessage("reservation at relay %s failed: %s", ri.ID.Loggable(), err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("error reserving a slot at relay %d: %w", params.relayOf(seq), err)
+		}
+		runenv.RecordMessage("Node %d reachable through relay %d", seq, params.relayOf(seq))
+	}
+
+	_, err := client.SignalAndWait(ctx, tgsync.State("relays-reserved"), runenv.TestInstanceCount)
+	return err
+}
+
+func reserveRelaySlot(ctx context.Context, h host.Host, ri peer.AddrInfo) (*relayclient.Reservation, error) {
+	cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+	defer cancel()
+	if err := h.Connect(cctx, ri); err != nil {
+		return nil, err
+	}
+	return relayclient.Reserve(cctx, h, ri)
+}
+
+// circuitAddrs returns the addresses of a node reachable through the relay
+func circuitAddrs(ri peer.AddrInfo) []multiaddr.Multiaddr {
+	circuit := multiaddr.StringCast(fmt.Sprintf("/p2p/%s/p2p-circuit", ri.ID))
+	addrs := make([]multiaddr.Multiaddr, 0, len(ri.Addrs))
+	for _, a := range ri.Addrs {
+		addrs = append(addrs, a.Encapsulate(circuit))
+	}
+	return addrs
+}
+
+// relayedConns counts the open connections going through a relay
+func (p *PubsubNode) relayedConns() int {
+	n := 0
+	for _, c := range p.h.Network().Conns() {
+		if _, err := c.RemoteMultiaddr().ValueForProtocol(multiaddr.P_CIRCUIT); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// summarizeNAT compares the deliveries to the NAT'd nodes against the public
+// ones
+func summarizeNAT(reports []NodeReport, params NATParams) *outputs.NAT {
+	s := &outputs.NAT{Relays: params.Relays}
+	published := make(map[string]struct{})
+	for _, r := range reports {
+		for id := range r.Published {
+			published[id] = struct{}{}
+		}
+	}
+
+	var natLats, publicLats []float64
+	var natExpected, natDelivered, publicExpected, publicDelivered int
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		var expected, delivered int
+		got := toSet(r.Delivered)
+		for id := range published {
+			if _, own := r.Published[id]; own {
+				continue
+			}
+			expected++
+			if _, ok := got[id]; ok {
+				delivered++
+			}
+		}
+		s.RelayedConns += r.RelayedConns
+		if r.NAT {
+			s.NATNodes++
+			natExpected += expected
+			natDelivered += delivered
+			for _, lat := range r.MessageLatenciesMs {
+				natLats = append(natLats, lat)
+			}
+		} else {
+			s.PublicNodes++
+			publicExpected += expected
+			publicDelivered += delivered
+			for _, lat := range r.MessageLatenciesMs {
+				publicLats = append(publicLats, lat)
+			}
+		}
+	}
+	s.NATLatencyMs = latencyStats(natLats)
+	s.PublicLatencyMs = latencyStats(publicLats)
+	s.P50PenaltyMs = s.NATLatencyMs.P50Ms - s.PublicLatencyMs.P50Ms
+	s.P99PenaltyMs = s.NATLatencyMs.P99Ms - s.PublicLatencyMs.P99Ms
+	if natExpected > 0 {
+		s.NATDeliveryRatio = float64(natDelivered) / float64(natExpected)
+	}
+	if publicExpected > 0 {
+		s.PublicDeliveryRatio = float64(publicDelivered) / float64(publicExpected)
+	}
+	return s
+}
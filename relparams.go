@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/testground/sdk-go/runtime"
+)
+
+// countParam returns the value of a count param, which can be relative to the
+// instance count n: a percentage such as "1%", or an expression such as
+// "log2(n)*2" or "max(4, n/10)". The result is rounded to the nearest integer.
+func countParam(runenv *runtime.RunEnv, name string) int {
+	s := stringParam(runenv, name)
+	if v, err := strconv.Atoi(s); err == nil {
+		return v
+	}
+	v, err := evalRelative(s, runenv.TestInstanceCount)
+	if err != nil {
+		panic(fmt.Errorf("invalid value %q of param %s: %w", s, name, err))
+	}
+	runenv.RecordMessage("param %s = %s evaluates to %d for %d instances", name, s, int(math.Round(v)), runenv.TestInstanceCount)
+	return int(math.Round(v))
+}
+
+// evalRelative evaluates an arithmetic expression of the instance count n.
+// It supports + - * /, parentheses, a % suffix for a percentage of n, and the
+// functions log2, log10, ln, sqrt, ceil, floor, min and max.
+func evalRelative(expr string, n int) (float64, error) {
+	e := &relExpr{s: expr, n: float64(n)}
+	v, err := e.sum()
+	if err != nil {
+		return 0, err
+	}
+	e.skipSpace()
+	if e.pos < len(e.s) {
+		return 0, fmt.Errorf("unexpected %q at %d", e.s[e.pos:], e.pos)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("not a finite number")
+	}
+	return v, nil
+}
+
+type relExpr struct {
+	s   string
+	pos int
+	n   float64
+}
+
+func (e *relExpr) skipSpace() {
+	for e.pos < len(e.s) && e.s[e.pos] == ' ' {
+		e.pos++
+	}
+}
+
+// peek returns the next character, or 0 at the end of the expression
+func (e *relExpr) peek() byte {
+	e.skipSpace()
+	if e.pos < len(e.s) {
+		return e.s[e.pos]
+	}
+	return 0
+}
+
+func (e *relExpr) sum() (float64, error) {
+	v, err := e.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch e.peek() {
+		case '+', '-':
+			op := e.s[e.pos]
+			e.pos++
+			r, err := e.product()
+			if err != nil {
+				return 0, err
+			}
+			if op == '+' {
+				v += r
+			} else {
+				v -= r
+			}
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (e *relExpr) product() (float64, error) {
+	v, err := e.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch e.peek() {
+		case '*', '/':
+			op := e.s[e.pos]
+			e.pos++
+			r, err := e.unary()
+			if err != nil {
+				return 0, err
+			}
+			if op == '*' {
+				v *= r
+			} else {
+				v /= r
+			}
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (e *relExpr) unary() (float64, error) {
+	if e.peek() == '-' {
+		e.pos++
+		v, err := e.unary()
+		return -v, err
+	}
+	v, err := e.primary()
+	if err != nil {
+		return 0, err
+	}
+	if e.peek() == '%' {
+		e.pos++
+		v = v * e.n / 100
+	}
+	return v, nil
+}
+
+func (e *relExpr) primary() (float64, error) {
+	c := e.peek()
+	switch {
+	case c == '(':
+		e.pos++
+		v, err := e.sum()
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != ')' {
+			return 0, fmt.Errorf("missing ) at %d", e.pos)
+		}
+		e.pos++
+		return v, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := e.pos
+		for e.pos < len(e.s) && (e.s[e.pos] >= '0' && e.s[e.pos] <= '9' || e.s[e.pos] == '.') {
+			e.pos++
+		}
+		return strconv.ParseFloat(e.s[start:e.pos], 64)
+	case unicode.IsLetter(rune(c)):
+		start := e.pos
+		for e.pos < len(e.s) && (unicode.IsLetter(rune(e.s[e.pos])) || e.s[e.pos] >= '0' && e.s[e.pos] <= '9') {
+			e.pos++
+		}
+		name := strings.ToLower(e.s[start:e.pos])
+		if name == "n" {
+			return e.n, nil
+		}
+		return e.call(name)
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	default:
+		return 0, fmt.Errorf("unexpected %q at %d", c, e.pos)
+	}
+}
+
+// call evaluates the arguments of a function and applies it
+func (e *relExpr) call(name string) (float64, error) {
+	if e.peek() != '(' {
+		return 0, fmt.Errorf("unknown name %s", name)
+	}
+	e.pos++
+	var args []float64
+	for {
+		v, err := e.sum()
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, v)
+		if e.peek() == ',' {
+			e.pos++
+			continue
+		}
+		if e.peek() != ')' {
+			return 0, fmt.Errorf("missing ) at %d", e.pos)
+		}
+		e.pos++
+		break
+	}
+
+	unary := map[string]func(float64) float64{
+		"log2":  math.Log2,
+		"log10": math.Log10,
+		"ln":    math.Log,
+		"sqrt":  math.Sqrt,
+		"ceil":  math.Ceil,
+		"floor": math.Floor,
+	}
+	if fn, ok := unary[name]; ok {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("%s takes one argument", name)
+		}
+		return fn(args[0]), nil
+	}
+	switch name {
+	case "min", "max":
+		v := args[0]
+		for _, a := range args[1:] {
+			if name == "min" {
+				v = math.Min(v, a)
+			} else {
+				v = math.Max(v, a)
+			}
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown function %s", name)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// two-sided 95% critical values of the t distribution, by degrees of freedom
+// from 1 to 30. Larger samples use the normal approximation.
+var tCritical95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// repetitionBarrier is the time allowed for all the nodes to reach the barrier
+// starting each repetition after the first
+const repetitionBarrier = 30 * time.Second
+
+// repetitionsTime is the time the repetitions after the first one add to the
+// run: their measured window, the cooldown before them and their barrier
+func repetitionsTime(repetitions int, runtime, cooldown time.Duration) time.Duration {
+	return time.Duration(repetitions-1) * (runtime + cooldown + repetitionBarrier)
+}
+
+// repetitionState is the barrier state starting the i-th repetition, for the
+// pubsub nodes with the same name
+func (p *PubsubNode) repetitionState(i int) tgsync.State {
+	if p.cfg.Name == "" {
+		return tgsync.State(fmt.Sprintf("repetition-%d", i))
+	}
+	return tgsync.State(fmt.Sprintf("repetition-%d-%s", i, p.cfg.Name))
+}
+
+// runRepetitions runs the measured window once per repetition over the same
+// overlay. Between two repetitions the messages drain for the cooldown, and
+// all the nodes wait for each other before the publishers start again.
+func (p *PubsubNode) runRepetitions(runtime time.Duration) error {
+	start := p.runStart
+	for i := 0; i < p.cfg.Repetitions; i++ {
+		if i > 0 {
+			p.log("repetition %d done, draining for %s", i, p.cfg.Cooldown)
+			select {
+			case <-time.After(p.cfg.Cooldown):
+			case <-p.ctx.Done():
+				return p.ctx.Err()
+			}
+			if _, err := p.client.SignalAndWait(p.ctx, p.repetitionState(i), p.runenv.TestInstanceCount); err != nil {
+				return fmt.Errorf("error waiting for repetition %d: %w", i+1, err)
+			}
+			start = time.Now()
+			p.markTimeline("repetition", fmt.Sprintf("%d start", i+1), unplanned)
+			if p.cfg.Publisher {
+				p.nextRepetition <- i
+			}
+		}
+
+		select {
+		case <-time.After(time.Until(start.Add(runtime))):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		p.deliveriesLk.Lock()
+		p.repetitions = append(p.repetitions, TimeWindow{Start: start.UnixNano(), End: time.Now().UnixNano()})
+		p.deliveriesLk.Unlock()
+	}
+	return nil
+}
+
+// computeRepetitions summarizes the deliveries of each repetition, and the
+// confidence intervals of the delivery ratio and the mean latency across the
+// repetitions. Each repetition gets the messages published from its start up
+// to the start of the next one.
+func computeRepetitions(reports []NodeReport, windows []TimeWindow) *outputs.Repetitions {
+	// only deliveries to honest nodes are expected
+	merged := make(map[int64]DeliveryBucket)
+	receivers := 0
+	for _, r := range reports {
+		if !r.Attacker {
+			receivers++
+		}
+		for sec, b := range r.Buckets {
+			m := merged[sec]
+			m.Published += b.Published
+			if !r.Attacker {
+				m.Delivered += b.Delivered
+				m.LatencySumMs += b.LatencySumMs
+			}
+			merged[sec] = m
+		}
+	}
+
+	out := &outputs.Repetitions{Count: len(windows)}
+	var ratios, latencies []float64
+	for i, w := range windows {
+		start := time.Unix(0, w.Start)
+		end := time.Unix(1<<62, 0)
+		if i+1 < len(windows) {
+			end = time.Unix(0, windows[i+1].Start)
+		}
+		if i == 0 {
+			start = time.Unix(0, 0)
+		}
+		_, during, _ := splitPhases(merged, start, end)
+		summary := summarizePhase(during, receivers)
+		out.Runs = append(out.Runs, outputs.RepetitionResult{
+			Index:        i + 1,
+			StartSecs:    float64(w.Start) / float64(time.Second),
+			DurationSecs: float64(w.End-w.Start) / float64(time.Second),
+			PhaseSummary: summary,
+		})
+		ratios = append(ratios, summary.DeliveryRatio)
+		latencies = append(latencies, summary.MeanLatencyMs)
+	}
+	out.DeliveryRatio = estimate(ratios)
+	out.MeanLatencyMs = estimate(latencies)
+	return out
+}
+
+// estimate returns the mean of the samples and its 95% confidence interval
+func estimate(xs []float64) outputs.Estimate {
+	e := outputs.Estimate{Samples: len(xs)}
+	if len(xs) == 0 {
+		return e
+	}
+	var total float64
+	for _, x := range xs {
+		total += x
+	}
+	e.Mean = total / float64(len(xs))
+	e.CI95Low, e.CI95High = e.Mean, e.Mean
+	if len(xs) < 2 {
+		return e
+	}
+	var ss float64
+	for _, x := range xs {
+		ss += (x - e.Mean) * (x - e.Mean)
+	}
+	e.StdDev = math.Sqrt(ss / float64(len(xs)-1))
+	t := 1.96
+	if df := len(xs) - 1; df <= len(tCritical95) {
+		t = tCritical95[df-1]
+	}
+	half := t * e.StdDev / math.Sqrt(float64(len(xs)))
+	e.CI95Low, e.CI95High = e.Mean-half, e.Mean+half
+	return e
+}
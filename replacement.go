@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// replacementLog pairs the mesh peers pruned for their negative score with the
+// peers grafted to the same topic afterwards, and writes every pair to the
+// node's score-replacements file
+type replacementLog struct {
+	lk sync.Mutex
+	// score-driven prunes waiting for a replacement, oldest first, by topic
+	pending  map[string][]outputs.ScoreReplacement
+	out      *os.File
+	prunes   int
+	replaced int
+}
+
+func (p *PubsubNode) openReplacementLog() error {
+	path := fmt.Sprintf("%s%c%s%d.json", p.runenv.TestOutputsPath, os.PathSeparator, outputs.ScoreReplacementPrefix, p.seq)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating score replacements file: %w", err)
+	}
+	p.replacements = &replacementLog{pending: make(map[string][]outputs.ScoreReplacement), out: f}
+	return nil
+}
+
+// auditMeshChange is called by the tracer on every change of the local mesh.
+// gossipsub prunes mesh peers with a negative score in the heartbeat, and
+// only grafts peers with a non-negative score.
+func (p *PubsubNode) auditMeshChange(c MeshChange) {
+	if c.Cause == MeshCauseDisconnected {
+		return
+	}
+	topic, pid, graft := c.Topic, c.Peer, c.Graft
+	score, scored := p.peerScores()[pid]
+
+	l := p.replacements
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.pending == nil {
+		// the log was closed at the end of the run
+		return
+	}
+	if !graft {
+		if !scored || score >= 0 {
+			return
+		}
+		l.prunes++
+		l.pending[topic] = append(l.pending[topic], outputs.ScoreReplacement{
+			Version:     outputs.SchemaVersion,
+			Topic:       topic,
+			Pruned:      pid.String(),
+			PrunedScore: score,
+			PrunedAt:    time.Now(),
+		})
+		p.log("pruned %s from %s for its score %.2f", pid, topic, score)
+		return
+	}
+
+	pending := l.pending[topic]
+	if len(pending) == 0 {
+		return
+	}
+	r := pending[0]
+	l.pending[topic] = pending[1:]
+	r.Grafted = pid.String()
+	r.GraftedAt = time.Now()
+	if scored {
+		r.GraftedScore = score
+		r.Reason = fmt.Sprintf("score %.2f is not negative", score)
+	} else {
+		r.Reason = "new peer without a score yet"
+	}
+	l.replaced++
+	p.log("grafted %s to %s in place of %s: %s", pid, topic, r.Pruned, r.Reason)
+	l.write(p, r)
+}
+
+func (l *replacementLog) write(p *PubsubNode, r outputs.ScoreReplacement) {
+	if err := json.NewEncoder(l.out).Encode(r); err != nil {
+		p.log("error writing score replacement: %s", err)
+	}
+}
+
+// closeReplacementLog writes the prunes that were never replaced, and records
+// how many score-driven prunes were replaced
+func (p *PubsubNode) closeReplacementLog() {
+	l := p.replacements
+	if l == nil {
+		return
+	}
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	for _, pending := range l.pending {
+		for _, r := range pending {
+			l.write(p, r)
+		}
+	}
+	l.pending = nil
+	l.out.Close()
+	p.runenv.R().RecordPoint("score_prunes", float64(l.prunes))
+	p.runenv.R().RecordPoint("score_replacements", float64(l.replaced))
+}
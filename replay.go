@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+)
+
+// ReplayEntry is a message of a replayed trace. OffsetMs is the publish time
+// relative to the start of the publishing, and Publisher the sequence number
+// of the node that publishes it. An empty Topic is the first workload topic.
+type ReplayEntry struct {
+	OffsetMs  float64
+	Size      uint64
+	Publisher int64
+	Topic     string
+}
+
+func loadReplayTrace(path string) ([]ReplayEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading replay trace: %w", err)
+	}
+	var entries []ReplayEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding replay trace: %w", err)
+	}
+	for i, e := range entries {
+		if e.OffsetMs < 0 || e.Publisher < 1 {
+			return nil, fmt.Errorf("replay trace entry %d has a negative offset or an invalid publisher", i)
+		}
+	}
+	return entries, nil
+}
+
+// replayWorkload publishes the messages of a trace whose publisher is the
+// local node. Once the trace is over the node stops publishing.
+type replayWorkload struct {
+	entries []ReplayEntry
+	idx     int
+	// offset of the last message returned
+	now time.Duration
+}
+
+func newReplayWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	if env.ReplayFile == "" {
+		return nil, fmt.Errorf("replay workload requires a replay_file")
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("replay workload requires a topic")
+	}
+	trace, err := loadReplayTrace(env.ReplayFile)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &replayWorkload{}
+	for _, e := range trace {
+		if e.Publisher != env.Seq {
+			continue
+		}
+		if e.Topic == "" {
+			e.Topic = topics[0].Id
+		}
+		w.entries = append(w.entries, e)
+	}
+	sort.SliceStable(w.entries, func(i, j int) bool { return w.entries[i].OffsetMs < w.entries[j].OffsetMs })
+	return w, nil
+}
+
+func (w *replayWorkload) Next() (uint64, time.Duration, string) {
+	if w.idx == len(w.entries) {
+		// nothing left to publish, wait for the end of the run
+		return 0, time.Duration(math.MaxInt64 / 2), ""
+	}
+	e := w.entries[w.idx]
+	w.idx++
+
+	at := time.Duration(e.OffsetMs * float64(time.Millisecond))
+	delay := at - w.now
+	w.now = at
+	return e.Size, delay, e.Topic
+}
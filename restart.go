@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/testground/sdk-go/network"
+
+	"gossipsub_testplan/outputs"
+)
+
+// RestartReport is a restart of the node: its outage, the previously known
+// peers it redialed on the way back, and how long its meshes took to recover
+type RestartReport struct {
+	Down TimeWindow
+	// peers connected before the crash, and how many of them were redialed
+	KnownPeers int
+	Redialed   int
+	// time from the restart until the first mesh peer, and until the mesh of
+	// every topic reached D_lo peers. Zero if it never happened.
+	FirstGraftMs   float64
+	MeshRecoveryMs float64
+}
+
+// restartFault takes the node down as if its process died: it loses its
+// subscriptions and connections, and all its traffic is dropped. On recovery
+// it comes back with the same host, hence the same peer ID and keys, redials
+// the peers it knew before the crash and subscribes again.
+type restartFault struct{}
+
+func (restartFault) Name() string { return "restart" }
+
+func (restartFault) Inject(p *PubsubNode) error {
+	err := p.reconfigureNetwork("restart-injected", false, func(s *network.LinkShape) {
+		s.Filter = network.Drop
+		s.Loss = 100
+	})
+	if err != nil {
+		return err
+	}
+	p.downLk.Lock()
+	p.faultDown = TimeWindow{Start: time.Now().UnixNano()}
+	p.knownPeers = p.h.Network().Peers()
+	p.downLk.Unlock()
+
+	p.unsubscribeAll()
+	for _, pid := range p.h.Network().Peers() {
+		p.h.Network().ClosePeer(pid)
+	}
+	return nil
+}
+
+func (restartFault) Recover(p *PubsubNode) error {
+	if err := p.reconfigureNetwork("restart-recovered", false, nil); err != nil {
+		return err
+	}
+	p.downLk.Lock()
+	down := p.faultDown
+	down.End = time.Now().UnixNano()
+	p.downWindows = append(p.downWindows, down)
+	known := p.knownPeers
+	p.knownPeers = nil
+	p.downLk.Unlock()
+
+	restart := RestartReport{Down: down, KnownPeers: len(known), Redialed: p.redialKnownPeers(known)}
+	if restart.Redialed == 0 {
+		p.log("restart: none of the %d known peers answered, reconnecting to the topology", len(known))
+		if err := p.discovery.ConnectTopology(p.ctx, 0); err != nil {
+			p.log("restart: error reconnecting to the topology: %s", err)
+		}
+	}
+	p.resubscribeAll()
+	p.log("restart: back with the same peer ID, redialed %d of %d known peers", restart.Redialed, restart.KnownPeers)
+
+	p.downLk.Lock()
+	p.restarts = append(p.restarts, restart)
+	i := len(p.restarts) - 1
+	p.downLk.Unlock()
+	go p.timeRegraft(i)
+	return nil
+}
+
+// redialKnownPeers connects again to the peers known before the crash, at the
+// addresses they registered or else the ones in the peerstore. It returns the
+// number of successful connections.
+func (p *PubsubNode) redialKnownPeers(known []peer.ID) int {
+	registered := make(map[peer.ID]peer.AddrInfo, len(p.discovery.allPeers))
+	for _, pr := range p.discovery.allPeers {
+		registered[pr.Info.ID] = pr.Info
+	}
+
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	redialed := 0
+	for _, pid := range known {
+		info, ok := registered[pid]
+		if !ok {
+			info = p.h.Peerstore().PeerInfo(pid)
+		}
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(p.ctx, PeerConnectTimeout)
+			defer cancel()
+			if err := p.h.Connect(ctx, info); err != nil {
+				return
+			}
+			lk.Lock()
+			redialed++
+			lk.Unlock()
+		}(info)
+	}
+	wg.Wait()
+	return redialed
+}
+
+// timeRegraft times the i-th restart until the meshes are rebuilt
+func (p *PubsubNode) timeRegraft(i int) {
+	tracer := p.testTracer()
+	if tracer == nil {
+		return
+	}
+	p.downLk.Lock()
+	back := time.Unix(0, p.restarts[i].Down.End)
+	p.downLk.Unlock()
+	sinceBack := func() float64 { return float64(time.Since(back)) / float64(time.Millisecond) }
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	grafted := false
+	for {
+		if !grafted {
+			for _, t := range p.cfg.Topics {
+				if tracer.MeshSize(t.Id) > 0 {
+					grafted = true
+					ms := sinceBack()
+					p.downLk.Lock()
+					p.restarts[i].FirstGraftMs = ms
+					p.downLk.Unlock()
+					p.runenv.R().RecordPoint("restart_first_graft_ms", ms)
+					break
+				}
+			}
+		}
+		if p.meshesRecovered() {
+			ms := sinceBack()
+			p.downLk.Lock()
+			p.restarts[i].MeshRecoveryMs = ms
+			p.downLk.Unlock()
+			p.log("restart: meshes recovered %.0fms after the restart", ms)
+			p.runenv.R().RecordPoint("restart_mesh_recovery_ms", ms)
+			p.markTimeline("fault", "restart meshes_recovered", unplanned)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// restartReports returns the restarts of the node. A restart whose meshes are
+// still recovering is reported as it is.
+func (p *PubsubNode) restartReports() []RestartReport {
+	p.downLk.Lock()
+	defer p.downLk.Unlock()
+	return append([]RestartReport(nil), p.restarts...)
+}
+
+// summarizeRestarts measures how the restarted nodes rejoined the meshes, and
+// how many of the messages published while they were down they got anyway,
+// from the gossip of their peers
+func summarizeRestarts(reports []NodeReport, published map[string]int64) *outputs.Restarts {
+	s := &outputs.Restarts{}
+	var firstGraft, recovery []float64
+	for _, r := range reports {
+		if len(r.Restarts) == 0 {
+			continue
+		}
+		delivered := toSet(r.Delivered)
+		for _, restart := range r.Restarts {
+			s.Restarts++
+			s.KnownPeers += restart.KnownPeers
+			s.Redialed += restart.Redialed
+			if restart.FirstGraftMs > 0 {
+				firstGraft = append(firstGraft, restart.FirstGraftMs)
+			}
+			if restart.MeshRecoveryMs > 0 {
+				recovery = append(recovery, restart.MeshRecoveryMs)
+			}
+			for id, ts := range published {
+				if _, own := r.Published[id]; own || !restart.Down.contains(ts) {
+					continue
+				}
+				s.Missed++
+				if _, ok := delivered[id]; ok {
+					s.Recovered++
+				}
+			}
+		}
+	}
+	s.FirstGraftMs = latencyStats(firstGraft)
+	s.MeshRecoveryMs = latencyStats(recovery)
+	if s.Missed > 0 {
+		s.RecoveredRatio = float64(s.Recovered) / float64(s.Missed)
+	}
+	return s
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// IWantStats count the message IDs requested from a node in IWANTs. The
+// router serves a message to the same peer at most GossipRetransmission times
+// while it is in the message cache, and doesn't trace the requests it refuses
+// or ignores. The tracer replays the cache from the messages the node
+// published and delivered, each kept for HistoryLength heartbeats, so the
+// counts are estimates: requests beyond the limit for the peer are refused,
+// and requests for a message out of the cache are expired.
+type IWantStats struct {
+	Limit     int
+	Requested int64
+	Served    int64
+	Refused   int64
+	// requests for messages the node had, after they left the message cache
+	Expired int64
+	// requests for messages the node never had
+	Unknown int64
+}
+
+// cachedMessage is a message in the replayed message cache, and the number of
+// times each peer requested it
+type cachedMessage struct {
+	id       string
+	added    int64
+	requests map[peer.ID]int
+}
+
+// cacheMessage adds a message published or delivered by the node to the
+// replayed message cache. It is called from the event loop.
+func (t *TestTracer) cacheMessage(raw []byte, ts int64) {
+	id := encodeMsgID(raw)
+	t.iwantLk.Lock()
+	defer t.iwantLk.Unlock()
+	t.expireMessages(ts)
+	if t.iwantCache == nil {
+		t.iwantCache = make(map[string]*cachedMessage)
+	}
+	if _, ok := t.iwantCache[id]; ok {
+		return
+	}
+	msg := &cachedMessage{id: id, added: ts}
+	t.iwantCache[id] = msg
+	t.iwantOrder = append(t.iwantOrder, msg)
+}
+
+// expireMessages drops the messages that left the message cache by the given
+// time. The caller holds iwantLk.
+func (t *TestTracer) expireMessages(now int64) {
+	window := t.cacheWindow().Nanoseconds()
+	var n int
+	for n < len(t.iwantOrder) && now-t.iwantOrder[n].added > window {
+		delete(t.iwantCache, t.iwantOrder[n].id)
+		t.iwantOrder[n] = nil
+		n++
+	}
+	t.iwantOrder = t.iwantOrder[n:]
+}
+
+// countIWants counts the message IDs requested by a peer against the
+// retransmission limit. It is called from the event loop.
+func (t *TestTracer) countIWants(from []byte, ts int64, iwants []*pb.TraceEvent_ControlIWantMeta) {
+	pid, err := peer.IDFromBytes(from)
+	if err != nil {
+		return
+	}
+	limit := t.retransmissionLimit()
+
+	var ids []string
+	for _, iwant := range iwants {
+		for _, raw := range iwant.GetMessageIDs() {
+			ids = append(ids, encodeMsgID(raw))
+		}
+	}
+
+	t.iwantLk.Lock()
+	defer t.iwantLk.Unlock()
+	t.expireMessages(ts)
+	t.iwants.Requested += int64(len(ids))
+	var missing []string
+	for _, id := range ids {
+		msg, ok := t.iwantCache[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if msg.requests == nil {
+			msg.requests = make(map[peer.ID]int)
+		}
+		msg.requests[pid]++
+		if msg.requests[pid] > limit {
+			t.iwants.Refused++
+		} else {
+			t.iwants.Served++
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	for _, id := range missing {
+		_, delivered := t.records.Delivered[id]
+		_, published := t.records.Published[id]
+		if delivered || published {
+			t.iwants.Expired++
+		} else {
+			t.iwants.Unknown++
+		}
+	}
+}
+
+// retransmissionLimit returns the retransmission limit of the node's router
+func (t *TestTracer) retransmissionLimit() int {
+	if t.metrics.Router != nil {
+		return t.metrics.Router.GossipRetransmission
+	}
+	return pubsub.GossipSubGossipRetransmission
+}
+
+// cacheWindow returns how long the node's router keeps a message in its
+// message cache
+func (t *TestTracer) cacheWindow() time.Duration {
+	if t.metrics.Router != nil {
+		return time.Duration(float64(t.metrics.Router.HistoryLength) * t.metrics.Router.HeartbeatIntervalMs * float64(time.Millisecond))
+	}
+	return time.Duration(pubsub.GossipSubHistoryLength) * pubsub.GossipSubHeartbeatInterval
+}
+
+// IWants returns the IWANT requests received so far
+func (t *TestTracer) IWants() IWantStats {
+	t.iwantLk.Lock()
+	defer t.iwantLk.Unlock()
+	stats := t.iwants
+	stats.Limit = t.retransmissionLimit()
+	return stats
+}
+
+// summarizeIWants adds up the IWANT requests served and refused by the honest
+// nodes
+func summarizeIWants(reports []NodeReport) outputs.IWantServing {
+	var s outputs.IWantServing
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		s.Limit = r.IWants.Limit
+		s.Requested += r.IWants.Requested
+		s.Served += r.IWants.Served
+		s.Refused += r.IWants.Refused
+		s.Expired += r.IWants.Expired
+		s.Unknown += r.IWants.Unknown
+		if r.IWants.Refused > 0 {
+			s.RefusingNodes++
+		}
+		if r.IWants.Refused > s.MaxRefusedByNode {
+			s.MaxRefusedByNode = r.IWants.Refused
+		}
+	}
+	return s
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sync"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"gossipsub_testplan/outputs"
+)
+
+// rpcSizes is the wire size of the RPCs sent or received, broken down by field
+type rpcSizes struct {
+	total         uint64
+	publish       uint64
+	ihaveIDs      uint64
+	iwantIDs      uint64
+	subscriptions uint64
+	prunePX       uint64
+}
+
+func (s *rpcSizes) add(rpc *pubsub.RPC) {
+	s.total += uint64(rpc.Size())
+	for _, msg := range rpc.GetPublish() {
+		s.publish += uint64(len(msg.GetData()))
+	}
+	for _, sub := range rpc.GetSubscriptions() {
+		s.subscriptions += uint64(sub.Size())
+	}
+
+	ctrl := rpc.GetControl()
+	for _, ihave := range ctrl.GetIhave() {
+		for _, id := range ihave.GetMessageIDs() {
+			s.ihaveIDs += uint64(len(id))
+		}
+	}
+	for _, iwant := range ctrl.GetIwant() {
+		for _, id := range iwant.GetMessageIDs() {
+			s.iwantIDs += uint64(len(id))
+		}
+	}
+	for _, prune := range ctrl.GetPrune() {
+		for _, pi := range prune.GetPeers() {
+			s.prunePX += uint64(pi.Size())
+		}
+	}
+}
+
+func (s *rpcSizes) copyTo(m *RPCMetrics) {
+	m.Bytes = s.total
+	m.PublishBytes = s.publish
+	m.IHaveIDBytes = s.ihaveIDs
+	m.IWantIDBytes = s.iwantIDs
+	m.SubscriptionBytes = s.subscriptions
+	m.PrunePXBytes = s.prunePX
+}
+
+// rpcSizeTracer measures the RPCs themselves, which the trace events only
+// describe by their message IDs and counts
+type rpcSizeTracer struct {
+	lk   sync.Mutex
+	sent rpcSizes
+	recv rpcSizes
+	// duplicate messages received, and the size of their payloads
+	duplicates     uint64
+	duplicateBytes uint64
+	// RPCs dropped from the outbound queues
+	dropped uint64
+
+	// traffic of each topic. IWANTs name no topic, so their bytes are only
+	// counted for the whole node.
+	topics    map[string]*outputs.TopicOverhead
+	iwantSent uint64
+	iwantRecv uint64
+
+	// peers received in PX, and how many came with a signed peer record
+	pxPeers  uint64
+	pxSigned uint64
+
+	// messages that entered validation, and that left it delivered or
+	// rejected by the validators, and messages delivered
+	validating uint64
+	validated  uint64
+	delivered  uint64
+}
+
+func (t *rpcSizeTracer) topic(id string) *outputs.TopicOverhead {
+	if t.topics == nil {
+		t.topics = make(map[string]*outputs.TopicOverhead)
+	}
+	o, ok := t.topics[id]
+	if !ok {
+		o = &outputs.TopicOverhead{}
+		t.topics[id] = o
+	}
+	return o
+}
+
+// addTopics adds the payload and control bytes of the RPC to its topics
+func (t *rpcSizeTracer) addTopics(rpc *pubsub.RPC, sent bool) {
+	count := func(topic string, payload, control int) {
+		o := t.topic(topic)
+		if sent {
+			o.PayloadBytesSent += uint64(payload)
+			o.ControlBytesSent += uint64(control)
+		} else {
+			o.PayloadBytesReceived += uint64(payload)
+			o.ControlBytesReceived += uint64(control)
+		}
+	}
+	for _, msg := range rpc.GetPublish() {
+		count(msg.GetTopic(), len(msg.GetData()), 0)
+	}
+	ctrl := rpc.GetControl()
+	for _, ihave := range ctrl.GetIhave() {
+		count(ihave.GetTopicID(), 0, ihave.Size())
+	}
+	for _, graft := range ctrl.GetGraft() {
+		count(graft.GetTopicID(), 0, graft.Size())
+	}
+	for _, prune := range ctrl.GetPrune() {
+		count(prune.GetTopicID(), 0, prune.Size())
+	}
+	for _, iwant := range ctrl.GetIwant() {
+		if sent {
+			t.iwantSent += uint64(iwant.Size())
+		} else {
+			t.iwantRecv += uint64(iwant.Size())
+		}
+	}
+}
+
+func (t *rpcSizeTracer) SendRPC(rpc *pubsub.RPC, p peer.ID) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.sent.add(rpc)
+	t.addTopics(rpc, true)
+}
+
+func (t *rpcSizeTracer) RecvRPC(rpc *pubsub.RPC) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.recv.add(rpc)
+	t.addTopics(rpc, false)
+	for _, prune := range rpc.GetControl().GetPrune() {
+		for _, pi := range prune.GetPeers() {
+			t.pxPeers++
+			if len(pi.GetSignedPeerRecord()) > 0 {
+				t.pxSigned++
+			}
+		}
+	}
+}
+
+func (t *rpcSizeTracer) DuplicateMessage(msg *pubsub.Message) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.duplicates++
+	t.duplicateBytes += uint64(len(msg.GetData()))
+	o := t.topic(msg.GetTopic())
+	o.Duplicates++
+	o.DuplicateBytes += uint64(len(msg.GetData()))
+}
+
+// overhead returns a copy of the traffic of each topic
+func (t *rpcSizeTracer) overhead() outputs.NodeOverhead {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	o := outputs.NodeOverhead{
+		Topics:             make(map[string]outputs.TopicOverhead, len(t.topics)),
+		IWantBytesSent:     t.iwantSent,
+		IWantBytesReceived: t.iwantRecv,
+	}
+	for id, to := range t.topics {
+		o.Topics[id] = *to
+	}
+	return o
+}
+
+func (t *rpcSizeTracer) DropRPC(rpc *pubsub.RPC, p peer.ID) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.dropped++
+}
+
+func (t *rpcSizeTracer) copyTo(sent *RPCMetrics, recv *RPCMetrics) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.sent.copyTo(sent)
+	t.recv.copyTo(recv)
+}
+
+func (t *rpcSizeTracer) ValidateMessage(msg *pubsub.Message) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.validating++
+}
+
+func (t *rpcSizeTracer) DeliverMessage(msg *pubsub.Message) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	t.validated++
+	t.delivered++
+}
+
+// RejectMessage counts the messages rejected once in validation. The others
+// are rejected before they enter it.
+func (t *rpcSizeTracer) RejectMessage(msg *pubsub.Message, r string) {
+	switch r {
+	case pubsub.RejectValidationFailed, pubsub.RejectValidationThrottled, pubsub.RejectValidationIgnored:
+		t.lk.Lock()
+		defer t.lk.Unlock()
+		t.validated++
+	}
+}
+
+func (t *rpcSizeTracer) AddPeer(p peer.ID, proto protocol.ID)                  {}
+func (t *rpcSizeTracer) RemovePeer(p peer.ID)                                  {}
+func (t *rpcSizeTracer) Join(topic string)                                     {}
+func (t *rpcSizeTracer) Leave(topic string)                                    {}
+func (t *rpcSizeTracer) Graft(p peer.ID, topic string)                         {}
+func (t *rpcSizeTracer) Prune(p peer.ID, topic string)                         {}
+func (t *rpcSizeTracer) ThrottlePeer(p peer.ID)                                {}
+func (t *rpcSizeTracer) UndeliverableMessage(msg *pubsub.Message)              {}
+func (t *rpcSizeTracer) SendMessage(s peer.ID, d peer.ID, msg *pubsub.Message) {}
+
+var _ pubsub.RawTracer = (*rpcSizeTracer)(nil)
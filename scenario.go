@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// SatelliteParams configure the satellite scenario: a single publisher, and
+// consumers split between a satellite class and a normal class
+type SatelliteParams struct {
+	// percentage of the consumers on a satellite link
+	Pct int
+	// latency of the satellite links
+	Latency time.Duration
+}
+
+// applyScenario overrides the params with the settings of a preset scenario
+func applyScenario(p *testParams, scenario string) {
+	if scenario != "eclipse" && scenario != "dout" {
+		p.eclipse = EclipseParams{}
+	}
+	if scenario != "dout" {
+		p.eclipse.Outbound = 0
+	}
+	switch scenario {
+	case "":
+	case "satellite":
+		// only instance 1 publishes
+		p.workload = "constant"
+	case "eclipse":
+		// the attackers target the publisher unless eclipse_victim is set
+		p.workload = "constant"
+	case "dout":
+		// the eclipse scenario, with the victim's honest connections all
+		// outbound
+		p.workload = "constant"
+	default:
+		panic(fmt.Errorf("unknown scenario %s", scenario))
+	}
+}
+
+// nodeClass returns the class of a consumer in the scenario, or "" if the node
+// is not part of any class
+func (p testParams) nodeClass(seq int64, instances int) string {
+	if p.scenario != "satellite" || seq == 1 {
+		return ""
+	}
+	if inCohort(seq, instances, p.satellite.Pct) {
+		return "satellite"
+	}
+	return "normal"
+}
+
+// summarizeClasses computes the delivery latency distribution of each class of
+// consumers, and how fairly the latency and the deliveries are spread among
+// the nodes of the class
+func summarizeClasses(reports []NodeReport) map[string]outputs.ClassSummary {
+	latencies := make(map[string][]float64)
+	means := make(map[string][]float64)
+	delivered := make(map[string][]float64)
+	for _, r := range reports {
+		if r.Class == "" {
+			continue
+		}
+		latencies[r.Class] = append(latencies[r.Class], r.LatenciesMs...)
+		means[r.Class] = append(means[r.Class], latencyStats(r.LatenciesMs).MeanMs)
+		delivered[r.Class] = append(delivered[r.Class], float64(len(r.Delivered)))
+	}
+	if len(latencies) == 0 {
+		return nil
+	}
+
+	classes := make(map[string]outputs.ClassSummary, len(latencies))
+	for class, lats := range latencies {
+		classes[class] = outputs.ClassSummary{
+			Nodes:            len(means[class]),
+			Latency:          latencyStats(lats),
+			LatencyFairness:  jainIndex(means[class]),
+			DeliveryFairness: jainIndex(delivered[class]),
+		}
+	}
+	return classes
+}
+
+// jainIndex is Jain's fairness index: 1 when all values are equal, down to
+// 1/n when a single value is non-zero
+func jainIndex(vals []float64) float64 {
+	var sum, sumSq float64
+	for _, v := range vals {
+		sum += v
+		sumSq += v * v
+	}
+	if sumSq == 0 {
+		return 1
+	}
+	return math.Pow(sum, 2) / (float64(len(vals)) * sumSq)
+}
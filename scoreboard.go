@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+const (
+	// the network is considered to have mitigated the attack once the delivery
+	// ratio and latency are back within these factors of the baseline phase
+	mitigationRatioFactor   = 0.95
+	mitigationLatencyFactor = 1.1
+)
+
+// AttackWindow is the period of the run in which attacks take place, relative
+// to the start of the run (ie after warmup)
+type AttackWindow struct {
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func (w AttackWindow) enabled() bool {
+	return w.Duration > 0
+}
+
+// DeliveryBucket aggregates the messages published within the same second
+type DeliveryBucket struct {
+	Published    int64
+	Delivered    int64
+	LatencySumMs float64
+}
+
+// AttackReport holds the records of a node for the attack scoreboard. Buckets
+// are keyed by the unix second in which the messages were published.
+type AttackReport struct {
+	Buckets        map[int64]DeliveryBucket
+	AttackBytesOut int64
+
+	// scores the node gave to its peers at the end of the attack window and
+	// at the end of the run, by peer ID. Only set with peer scoring.
+	AttackScores map[string]float64
+	AfterScores  map[string]float64
+}
+
+// recordPublished accounts for a message published by this node
+func (p *PubsubNode) recordPublished(published time.Time) {
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+
+	b := p.buckets[published.Unix()]
+	b.Published++
+	p.buckets[published.Unix()] = b
+}
+
+// recordDelivery accounts for a message delivered to this node
+func (p *PubsubNode) recordDelivery(published time.Time, received time.Time) {
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+
+	b := p.buckets[published.Unix()]
+	b.Delivered++
+	b.LatencySumMs += float64(received.Sub(published)) / float64(time.Millisecond)
+	p.buckets[published.Unix()] = b
+}
+
+// sampleAttackBandwidth measures the bytes sent by this node during the attack
+// window, and snapshots its peer scores at the end of the window
+func (p *PubsubNode) sampleAttackBandwidth() {
+	w := p.cfg.AttackWindow
+	select {
+	case <-time.After(time.Until(p.runStart.Add(w.Start))):
+	case <-p.ctx.Done():
+		return
+	}
+	p.markTimeline("attack", "window_start", w.Start)
+	start := p.cfg.Bandwidth.GetBandwidthTotals().TotalOut
+
+	select {
+	case <-time.After(w.Duration):
+	case <-p.ctx.Done():
+		return
+	}
+	p.markTimeline("attack", "window_end", w.Start+w.Duration)
+	end := p.cfg.Bandwidth.GetBandwidthTotals().TotalOut
+	scores := encodeScores(p.peerScores())
+
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+	p.attackBytesOut = end - start
+	p.attackScores = scores
+}
+
+func encodeScores(scores map[peer.ID]float64) map[string]float64 {
+	if len(scores) == 0 {
+		return nil
+	}
+	out := make(map[string]float64, len(scores))
+	for pid, score := range scores {
+		out[pid.String()] = score
+	}
+	return out
+}
+
+// attackReport returns the node's delivery stats for the attack scoreboard
+func (p *PubsubNode) attackReport() *AttackReport {
+	p.deliveriesLk.Lock()
+	report := &AttackReport{
+		Buckets:        make(map[int64]DeliveryBucket, len(p.buckets)),
+		AttackBytesOut: p.attackBytesOut,
+		AttackScores:   p.attackScores,
+	}
+	for sec, b := range p.buckets {
+		report.Buckets[sec] = b
+	}
+	p.deliveriesLk.Unlock()
+	report.AfterScores = encodeScores(p.peerScores())
+	return report
+}
+
+// writeScoreboard writes the attack scoreboard computed from the node reports
+func (p *PubsubNode) writeScoreboard(reports []NodeReport) error {
+	w := p.cfg.AttackWindow
+	board := computeScoreboard(reports, p.runStart.Add(w.Start), p.runStart.Add(w.Start+w.Duration))
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.ScoreboardFile)
+	jsonstr, err := json.MarshalIndent(board, "", "  ")
+	if err != nil {
+		return err
+	}
+	p.log("writing attack scoreboard to %s", path)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
+
+func computeScoreboard(reports []NodeReport, attackStart time.Time, attackEnd time.Time) outputs.AttackScoreboard {
+	board := outputs.AttackScoreboard{
+		Version:              outputs.SchemaVersion,
+		AttackStartSecs:      float64(attackStart.Unix()),
+		AttackDurationSecs:   attackEnd.Sub(attackStart).Seconds(),
+		TimeToMitigationSecs: -1,
+	}
+
+	// merge the buckets of all nodes. Messages are only expected to be delivered
+	// to honest nodes, so the attackers' deliveries are ignored
+	merged := make(map[int64]DeliveryBucket)
+	for _, r := range reports {
+		if r.Attack == nil {
+			continue
+		}
+		if r.Attacker {
+			board.AttackerNodes++
+			board.AttackerBytesOut += r.Attack.AttackBytesOut
+		} else {
+			board.HonestNodes++
+		}
+		for sec, b := range r.Attack.Buckets {
+			m := merged[sec]
+			m.Published += b.Published
+			if !r.Attacker {
+				m.Delivered += b.Delivered
+				m.LatencySumMs += b.LatencySumMs
+			}
+			merged[sec] = m
+		}
+	}
+
+	secs := make([]int64, 0, len(merged))
+	for sec := range merged {
+		secs = append(secs, sec)
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+
+	baseline, attack, recovery := splitPhases(merged, attackStart, attackEnd)
+	board.Baseline = summarizePhase(baseline, board.HonestNodes)
+	board.Attack = summarizePhase(attack, board.HonestNodes)
+	board.Recovery = summarizePhase(recovery, board.HonestNodes)
+	board.Scores = compareScores(reports)
+	board.DeliveryRatioDelta = board.Attack.DeliveryRatio - board.Baseline.DeliveryRatio
+	board.AddedLatencyMs = board.Attack.MeanLatencyMs - board.Baseline.MeanLatencyMs
+
+	// the network only mitigates the attack once it has degraded delivery
+	for _, sec := range secs {
+		if sec < attackStart.Unix() {
+			continue
+		}
+		s := summarizePhase(merged[sec], board.HonestNodes)
+		if s.Published == 0 {
+			continue
+		}
+		withinBaseline := s.DeliveryRatio >= board.Baseline.DeliveryRatio*mitigationRatioFactor &&
+			s.MeanLatencyMs <= board.Baseline.MeanLatencyMs*mitigationLatencyFactor
+		if !board.Degraded {
+			board.Degraded = !withinBaseline
+			continue
+		}
+		if withinBaseline {
+			board.TimeToMitigationSecs = float64(sec - attackStart.Unix())
+			break
+		}
+	}
+
+	return board
+}
+
+// compareScores splits the scores the honest nodes gave to their peers between
+// honest and attacker peers. Peers that are not registered are sybil
+// identities, and count as attackers.
+func compareScores(reports []NodeReport) *outputs.ScoreComparison {
+	attackers := make(map[string]bool, len(reports))
+	for _, r := range reports {
+		attackers[r.PeerID] = r.Attacker
+	}
+
+	var attackHonest, attackAttacker, afterHonest, afterAttacker []float64
+	split := func(scores map[string]float64, honest, attacker *[]float64) {
+		for pid, score := range scores {
+			if isAttacker, ok := attackers[pid]; ok && !isAttacker {
+				*honest = append(*honest, score)
+			} else {
+				*attacker = append(*attacker, score)
+			}
+		}
+	}
+	for _, r := range reports {
+		if r.Attacker || r.Attack == nil {
+			continue
+		}
+		split(r.Attack.AttackScores, &attackHonest, &attackAttacker)
+		split(r.Attack.AfterScores, &afterHonest, &afterAttacker)
+	}
+	if len(attackHonest)+len(attackAttacker)+len(afterHonest)+len(afterAttacker) == 0 {
+		return nil
+	}
+	return &outputs.ScoreComparison{
+		Attack: scoreWindow(attackHonest, attackAttacker),
+		After:  scoreWindow(afterHonest, afterAttacker),
+	}
+}
+
+func scoreWindow(honest, attacker []float64) outputs.ScoreWindow {
+	w := outputs.ScoreWindow{
+		Honest:   scoreDistribution(honest),
+		Attacker: scoreDistribution(attacker),
+	}
+	w.MedianGap = w.Honest.Median - w.Attacker.Median
+	return w
+}
+
+func scoreDistribution(scores []float64) outputs.ScoreDistribution {
+	d := outputs.ScoreDistribution{Count: len(scores)}
+	if len(scores) == 0 {
+		return d
+	}
+	sort.Float64s(scores)
+	var total float64
+	for _, s := range scores {
+		total += s
+		if s < 0 {
+			d.Negative++
+		}
+	}
+	d.Min = scores[0]
+	d.Median = scores[len(scores)/2]
+	d.Mean = total / float64(len(scores))
+	d.Max = scores[len(scores)-1]
+	return d
+}
+
+// splitPhases adds up the buckets published before, during and after the window
+func splitPhases(buckets map[int64]DeliveryBucket, start time.Time, end time.Time) (before, during, after DeliveryBucket) {
+	for sec, b := range buckets {
+		switch {
+		case sec < start.Unix():
+			before = addBuckets(before, b)
+		case sec < end.Unix():
+			during = addBuckets(during, b)
+		default:
+			after = addBuckets(after, b)
+		}
+	}
+	return before, during, after
+}
+
+func addBuckets(a, b DeliveryBucket) DeliveryBucket {
+	return DeliveryBucket{
+		Published:    a.Published + b.Published,
+		Delivered:    a.Delivered + b.Delivered,
+		LatencySumMs: a.LatencySumMs + b.LatencySumMs,
+	}
+}
+
+func summarizePhase(b DeliveryBucket, receivers int) outputs.PhaseSummary {
+	s := outputs.PhaseSummary{Published: b.Published, Delivered: b.Delivered}
+	if b.Published > 0 && receivers > 0 {
+		s.DeliveryRatio = float64(b.Delivered) / float64(b.Published*int64(receivers))
+	}
+	if b.Delivered > 0 {
+		s.MeanLatencyMs = b.LatencySumMs / float64(b.Delivered)
+	}
+	return s
+}
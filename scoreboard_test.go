@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeScoreboardMitigation(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := start.Add(5 * time.Second)
+	full := DeliveryBucket{Published: 10, Delivered: 20, LatencySumMs: 200}
+	lossy := DeliveryBucket{Published: 10, Delivered: 10, LatencySumMs: 100}
+	slow := DeliveryBucket{Published: 10, Delivered: 20, LatencySumMs: 1000}
+
+	tests := []struct {
+		name string
+		// merged buckets of the seconds from the start of the attack
+		attack       []DeliveryBucket
+		wantDegraded bool
+		wantSecs     float64
+	}{
+		{name: "never degraded", attack: []DeliveryBucket{full, full, full}, wantSecs: -1},
+		{name: "degraded late", attack: []DeliveryBucket{full, full, lossy, full}, wantDegraded: true, wantSecs: 3},
+		{name: "degraded at once", attack: []DeliveryBucket{lossy, lossy, full}, wantDegraded: true, wantSecs: 2},
+		{name: "slower", attack: []DeliveryBucket{slow, full}, wantDegraded: true, wantSecs: 1},
+		{name: "never recovered", attack: []DeliveryBucket{full, lossy, lossy}, wantDegraded: true, wantSecs: -1},
+		{name: "idle seconds", attack: []DeliveryBucket{{}, lossy, {}, full}, wantDegraded: true, wantSecs: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// both honest nodes publish half of the messages and receive
+			// their share of the deliveries
+			honest := &AttackReport{Buckets: map[int64]DeliveryBucket{
+				start.Unix() - 1: {Published: 5, Delivered: 10, LatencySumMs: 100},
+			}}
+			for i, b := range tt.attack {
+				honest.Buckets[start.Unix()+int64(i)] = DeliveryBucket{Published: b.Published / 2, Delivered: b.Delivered / 2, LatencySumMs: b.LatencySumMs / 2}
+			}
+			reports := []NodeReport{{Attack: honest}, {Attack: honest}, {Attacker: true, Attack: &AttackReport{}}}
+			board := computeScoreboard(reports, start, end)
+
+			if board.HonestNodes != 2 || board.AttackerNodes != 1 {
+				t.Fatalf("got %d honest and %d attacker nodes", board.HonestNodes, board.AttackerNodes)
+			}
+			if board.Baseline.DeliveryRatio != 1 {
+				t.Fatalf("got a baseline delivery ratio of %f", board.Baseline.DeliveryRatio)
+			}
+			if board.Degraded != tt.wantDegraded {
+				t.Errorf("got degraded %t, want %t", board.Degraded, tt.wantDegraded)
+			}
+			if board.TimeToMitigationSecs != tt.wantSecs {
+				t.Errorf("got a time to mitigation of %fs, want %fs", board.TimeToMitigationSecs, tt.wantSecs)
+			}
+		})
+	}
+}
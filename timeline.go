@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"gossipsub_testplan/outputs"
+)
+
+// unplanned is the offset of the timeline marks of events that are not
+// scheduled, like churn
+const unplanned time.Duration = -1
+
+// TimelineMark is an event of the run observed by a node
+type TimelineMark struct {
+	Kind string
+	Name string
+	// planned offset from the start of the run, unplanned if negative
+	Offset time.Duration
+	// unix nanoseconds at which the event took place
+	Actual int64
+}
+
+// markTimeline records that the event took place now
+func (p *PubsubNode) markTimeline(kind string, name string, offset time.Duration) {
+	p.timelineLk.Lock()
+	defer p.timelineLk.Unlock()
+	p.timeline = append(p.timeline, TimelineMark{Kind: kind, Name: name, Offset: offset, Actual: time.Now().UnixNano()})
+}
+
+func (p *PubsubNode) timelineMarks() []TimelineMark {
+	p.timelineLk.Lock()
+	defer p.timelineLk.Unlock()
+	return append([]TimelineMark(nil), p.timeline...)
+}
+
+// phaseMarks returns the boundaries of the phases of the phased workload. They
+// aren't observed, so they are derived from the leader's publish start.
+func (p *PubsubNode) phaseMarks() []TimelineMark {
+	phases, _ := p.cfg.Phases.ordered(p.runenv.TestRun)
+	p.deliveriesLk.Lock()
+	start := p.publishStart
+	p.deliveriesLk.Unlock()
+	if start.IsZero() {
+		return nil
+	}
+
+	var marks []TimelineMark
+	var at time.Duration
+	for _, phase := range phases {
+		marks = append(marks, TimelineMark{
+			Kind:   "phase",
+			Name:   phase.Name,
+			Offset: p.cfg.FirstPublishOffset + at,
+			Actual: start.Add(at).UnixNano(),
+		})
+		at += phase.Duration.Duration
+	}
+	return marks
+}
+
+// buildTimeline merges the marks of all the nodes. The marks of the same
+// event at different nodes make a single entry, with the first and the last
+// time it was observed. Planned times are relative to the leader's start of
+// the run.
+func buildTimeline(reports []NodeReport, runStart time.Time, extra []TimelineMark) outputs.Timeline {
+	type key struct {
+		kind, name string
+		offset     time.Duration
+	}
+	events := make(map[key]*outputs.TimelineEvent)
+	add := func(seq int64, m TimelineMark) {
+		k := key{m.Kind, m.Name, m.Offset}
+		if m.Offset < 0 {
+			k.offset = unplanned
+		}
+		e, ok := events[k]
+		if !ok {
+			e = &outputs.TimelineEvent{Kind: m.Kind, Name: m.Name, FirstActual: m.Actual, LastActual: m.Actual}
+			if m.Offset >= 0 {
+				e.Planned = runStart.Add(m.Offset).UnixNano()
+			}
+			events[k] = e
+		}
+		if m.Actual < e.FirstActual {
+			e.FirstActual = m.Actual
+		}
+		if m.Actual > e.LastActual {
+			e.LastActual = m.Actual
+		}
+		if n := len(e.Seqs); n == 0 || e.Seqs[n-1] != seq {
+			e.Seqs = append(e.Seqs, seq)
+		}
+	}
+	for _, r := range reports {
+		for _, m := range r.Timeline {
+			add(r.Seq, m)
+		}
+	}
+	for _, m := range extra {
+		add(1, m)
+	}
+
+	t := outputs.Timeline{Version: outputs.SchemaVersion, RunStart: runStart.UnixNano()}
+	for _, e := range events {
+		t.Events = append(t.Events, *e)
+	}
+	when := func(e outputs.TimelineEvent) int64 {
+		if e.Planned != 0 {
+			return e.Planned
+		}
+		return e.FirstActual
+	}
+	sort.Slice(t.Events, func(i, j int) bool {
+		a, b := t.Events[i], t.Events[j]
+		if when(a) != when(b) {
+			return when(a) < when(b)
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return t
+}
+
+// writeTimeline writes the timeline of the run to timeline.json
+func (p *PubsubNode) writeTimeline(reports []NodeReport) error {
+	var extra []TimelineMark
+	if p.cfg.Workload == "phased" {
+		extra = p.phaseMarks()
+	}
+	t := buildTimeline(reports, p.runStart, extra)
+	jsonstr, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s%c%s", p.runenv.TestOutputsPath, os.PathSeparator, outputs.TimelineFile)
+	if err := ioutil.WriteFile(path, jsonstr, os.ModePerm); err != nil {
+		return err
+	}
+	p.log("wrote %d timeline events to %s", len(t.Events), path)
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/testground/sdk-go/network"
+	"github.com/testground/sdk-go/ptypes"
+	"github.com/testground/sdk-go/runtime"
+	tgsync "github.com/testground/sdk-go/sync"
+)
+
+// TopologyFileVersion is the version of the topology file format with per
+// edge attributes
+const TopologyFileVersion = 2
+
+// Directions of the traffic the attributes of an edge apply to
+const (
+	EdgeBoth     = "both"
+	EdgeForward  = "forward"
+	EdgeBackward = "backward"
+)
+
+// TopologyFile defines the connections between the nodes as a list of edges,
+// identified by the sequence numbers of the nodes
+type TopologyFile struct {
+	Version int
+	Edges   []TopologyEdge
+}
+
+// TopologyEdge is a connection dialed by From to To. Latency and BandwidthMB
+// override the default link shape on the edge, in the Direction they apply to:
+// both (the default), forward (From to To) or backward (To to From).
+type TopologyEdge struct {
+	From        int64
+	To          int64
+	Latency     ptypes.Duration
+	BandwidthMB int
+	Direction   string
+}
+
+// shaped returns true if the edge overrides the link shape
+func (e TopologyEdge) shaped() bool {
+	return e.Latency.Duration > 0 || e.BandwidthMB > 0
+}
+
+// shapes returns true if the edge's attributes apply to the traffic sent by seq
+func (e TopologyEdge) shapes(seq int64) bool {
+	switch e.Direction {
+	case EdgeForward:
+		return e.From == seq
+	case EdgeBackward:
+		return e.To == seq
+	default:
+		return e.From == seq || e.To == seq
+	}
+}
+
+// other returns the end of the edge that isn't seq
+func (e TopologyEdge) other(seq int64) int64 {
+	if e.From == seq {
+		return e.To
+	}
+	return e.From
+}
+
+func (t *TopologyFile) validate(instances int) error {
+	if t.Version != TopologyFileVersion {
+		return fmt.Errorf("unsupported topology file version %d, expected %d", t.Version, TopologyFileVersion)
+	}
+	for i, e := range t.Edges {
+		if e.From < 1 || e.To < 1 || e.From > int64(instances) || e.To > int64(instances) {
+			return fmt.Errorf("edge %d connects %d to %d, expected sequence numbers between 1 and %d", i, e.From, e.To, instances)
+		}
+		if e.From == e.To {
+			return fmt.Errorf("edge %d connects node %d to itself", i, e.From)
+		}
+		if e.Latency.Duration < 0 || e.BandwidthMB < 0 {
+			return fmt.Errorf("edge %d has a negative latency or bandwidth", i)
+		}
+		switch e.Direction {
+		case "", EdgeBoth, EdgeForward, EdgeBackward:
+		default:
+			return fmt.Errorf("edge %d has unknown direction %s", i, e.Direction)
+		}
+	}
+	return nil
+}
+
+func loadTopologyFile(path string, instances int) (*TopologyFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading topology file: %w", err)
+	}
+	var t TopologyFile
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("error decoding topology file: %w", err)
+	}
+	if err := t.validate(instances); err != nil {
+		return nil, fmt.Errorf("invalid topology file %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// upgradeConnectionsDef converts the json of the topology param, a map of
+// sequence number to the "seq-x-y" connections that node dials, to the
+// current topology file format. The latency of each node applies to all the
+// edges it dials.
+func upgradeConnectionsDef(jsonstr string, instances int) (*TopologyFile, error) {
+	var defs map[string]*ConnectionsDef
+	if err := json.Unmarshal([]byte(jsonstr), &defs); err != nil {
+		return nil, fmt.Errorf("error decoding topology: %w", err)
+	}
+	t := &TopologyFile{Version: TopologyFileVersion}
+	for key, def := range defs {
+		if def == nil {
+			continue
+		}
+		from, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q in topology: %w", key, err)
+		}
+		for _, conn := range def.Connections {
+			parts := strings.Split(conn, "-")
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("connection %q of node %d must be seq-x-y", conn, from)
+			}
+			to, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("connection %q of node %d: %w", conn, from, err)
+			}
+			t.Edges = append(t.Edges, TopologyEdge{From: from, To: to, Latency: ptypes.Duration{Duration: def.Latency}, Direction: EdgeForward})
+		}
+	}
+	if err := t.validate(instances); err != nil {
+		return nil, fmt.Errorf("invalid topology: %w", err)
+	}
+	return t, nil
+}
+
+// FileTopology dials the nodes at the other end of the edges of a topology
+// file the local node is the origin of
+type FileTopology struct {
+	Seq  int64
+	File *TopologyFile
+}
+
+func (t FileTopology) SelectPeers(local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	bySeq := make(map[int64]PeerRegistration, len(remote))
+	for _, r := range remote {
+		bySeq[r.NodeTypeSeq] = r
+	}
+	out := make([]PeerRegistration, 0)
+	for _, e := range t.File.Edges {
+		if e.From != t.Seq {
+			continue
+		}
+		if r, ok := bySeq[e.To]; ok {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// SelectNPeers only returns peers at the other end of the local node's edges
+func (t FileTopology) SelectNPeers(n int, local peer.ID, remote []PeerRegistration) []PeerRegistration {
+	out := t.SelectPeers(local, remote)
+	if n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+// shapedEdges returns true if any edge overrides the link shape
+func (t *TopologyFile) shapedEdges() bool {
+	for _, e := range t.Edges {
+		if e.shaped() {
+			return true
+		}
+	}
+	return false
+}
+
+// configureEdgeShapes applies the attributes of the edges that shape the
+// traffic sent by the local node on top of the network config, reusing the
+// per link rule of the remote node if there is one
+func configureEdgeShapes(ctx context.Context, runenv *runtime.RunEnv, netclient *network.Client, config *network.Config, seq int64, topo *TopologyFile, remote []PeerRegistration) error {
+	ips := make(map[int64]net.IP, len(remote))
+	for _, r := range remote {
+		ips[r.NodeTypeSeq] = r.Link.IP
+	}
+
+	cfg := *config
+	cfg.Rules = make([]network.LinkRule, len(config.Rules))
+	copy(cfg.Rules, config.Rules)
+	var shaped int
+	for _, e := range topo.Edges {
+		if !e.shaped() || !e.shapes(seq) {
+			continue
+		}
+		ip := ips[e.other(seq)]
+		if ip == nil {
+			return fmt.Errorf("node %d did not register its data network address", e.other(seq))
+		}
+		rule := -1
+		for i := range cfg.Rules {
+			if cfg.Rules[i].Subnet.IP.Equal(ip) {
+				rule = i
+				break
+			}
+		}
+		if rule < 0 {
+			cfg.Rules = append(cfg.Rules, network.LinkRule{
+				LinkShape: cfg.Default,
+				Subnet:    ptypes.IPNet{IPNet: net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}},
+			})
+			rule = len(cfg.Rules) - 1
+		}
+		if e.Latency.Duration > 0 {
+			cfg.Rules[rule].Latency = e.Latency.Duration
+		}
+		if e.BandwidthMB > 0 {
+			cfg.Rules[rule].Bandwidth = uint64(e.BandwidthMB) * 1000 * 1000
+		}
+		shaped++
+	}
+	if shaped == 0 {
+		return nil
+	}
+
+	// only the nodes with shaped edges reconfigure their network
+	cfg.CallbackState = tgsync.State(fmt.Sprintf("edge-shapes-configured-%d", seq))
+	cfg.CallbackTarget = 1
+	runenv.RecordMessage("Configuring %d topology edges", shaped)
+	if err := netclient.ConfigureNetwork(ctx, &cfg); err != nil {
+		return err
+	}
+	*config = cfg
+	return nil
+}
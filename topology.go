@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gossipsub_testplan/outputs"
+)
+
+// buildTopology merges the connections dialed by every node into a single graph
+func buildTopology(reports []NodeReport) outputs.Topology {
+	topo := outputs.Topology{Version: outputs.SchemaVersion}
+	for _, r := range reports {
+		topo.Nodes = append(topo.Nodes, outputs.TopologyNode{Seq: r.Seq, PeerID: r.PeerID, Attacker: r.Attacker, BandwidthMB: r.BandwidthMB})
+		for _, to := range r.Dialed {
+			topo.Edges = append(topo.Edges, outputs.TopologyEdge{From: r.Seq, To: to})
+		}
+	}
+	topo.Metrics = graphMetrics(topo)
+	return topo
+}
+
+// writeTopology writes the realized topology as json, and as GraphML and DOT
+// so that it can be loaded directly into tools like Gephi or networkx
+func (p *PubsubNode) writeTopology(reports []NodeReport) error {
+	topo := buildTopology(reports)
+	if err := writeTopologyFiles(p.runenv.TestOutputsPath, topo); err != nil {
+		return err
+	}
+	p.log("wrote topology with %d nodes and %d edges: diameter %d, average path length %.2f, clustering %.3f",
+		len(topo.Nodes), len(topo.Edges), topo.Metrics.Diameter, topo.Metrics.AvgPathLength, topo.Metrics.Clustering)
+	return nil
+}
+
+func writeTopologyFiles(outputsPath string, topo outputs.Topology) error {
+	jsonstr, err := json.MarshalIndent(topo, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		outputs.TopologyFile:        jsonstr,
+		outputs.TopologyGraphMLFile: topologyGraphML(topo),
+		outputs.TopologyDOTFile:     topologyDOT(topo),
+	}
+	for name, data := range files {
+		path := fmt.Sprintf("%s%c%s", outputsPath, os.PathSeparator, name)
+		if err := ioutil.WriteFile(path, data, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func topologyGraphML(topo outputs.Topology) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	b.WriteString(`  <key id="peer_id" for="node" attr.name="peer_id" attr.type="string"/>` + "\n")
+	b.WriteString(`  <key id="attacker" for="node" attr.name="attacker" attr.type="boolean"/>` + "\n")
+	b.WriteString(`  <graph id="topology" edgedefault="directed">` + "\n")
+	for _, n := range topo.Nodes {
+		fmt.Fprintf(&b, "    <node id=\"%d\">\n", n.Seq)
+		fmt.Fprintf(&b, "      <data key=\"peer_id\">%s</data>\n", xmlEscape(n.PeerID))
+		fmt.Fprintf(&b, "      <data key=\"attacker\">%t</data>\n", n.Attacker)
+		b.WriteString("    </node>\n")
+	}
+	for i, e := range topo.Edges {
+		fmt.Fprintf(&b, "    <edge id=\"e%d\" source=\"%d\" target=\"%d\"/>\n", i, e.From, e.To)
+	}
+	b.WriteString("  </graph>\n</graphml>\n")
+	return b.Bytes()
+}
+
+func topologyDOT(topo outputs.Topology) []byte {
+	var b bytes.Buffer
+	b.WriteString("digraph topology {\n")
+	for _, n := range topo.Nodes {
+		fmt.Fprintf(&b, "  %d [peer_id=%q, attacker=%t];\n", n.Seq, n.PeerID, n.Attacker)
+	}
+	for _, e := range topo.Edges {
+		fmt.Fprintf(&b, "  %d -> %d;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
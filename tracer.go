@@ -1,14 +1,19 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
+	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	pb "github.com/libp2p/go-libp2p-pubsub/pb"
 	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
 )
 
 type RPCMetrics struct {
@@ -18,6 +23,16 @@ type RPCMetrics struct {
 	Prunes   uint64
 	IWants   uint64
 	IHaves   uint64
+	// peers offered in the PX of the PRUNEs
+	PrunePeers uint64
+
+	// wire size of the RPCs, and the part of it taken by each field
+	Bytes             uint64
+	PublishBytes      uint64
+	IHaveIDBytes      uint64
+	IWantIDBytes      uint64
+	SubscriptionBytes uint64
+	PrunePXBytes      uint64
 }
 
 type TestMetrics struct {
@@ -34,6 +49,11 @@ type TestMetrics struct {
 
 	SentRPC     RPCMetrics
 	ReceivedRPC RPCMetrics
+
+	// score profile the node used, empty for score_params
+	ScoreProfile string `json:",omitempty"`
+	// gossipsub parameters the node ran with, nil for floodsub
+	Router *outputs.RouterParams `json:",omitempty"`
 }
 
 type TestTracer struct {
@@ -45,6 +65,115 @@ type TestTracer struct {
 	doneCh  chan struct{}
 
 	metrics TestMetrics
+	sizes   *rpcSizeTracer
+
+	// the local mesh peers for each topic, rebuilt from GRAFT and PRUNE events
+	meshLk sync.RWMutex
+	mesh   map[string]map[peer.ID]struct{}
+	// number of local GRAFT and PRUNE events, across all topics
+	meshGrafts int64
+	meshPrunes int64
+	// size at which a mesh is considered formed, and when each topic's mesh
+	// first reached it in unix nanoseconds
+	meshTarget int
+	meshFormed map[string]int64
+	// called on every change of the local mesh, without holding meshLk
+	meshListeners []func(MeshChange)
+	// the event that preceded the mesh changes being traced. Only used by the
+	// event loop.
+	cause meshCause
+
+	// time of the last RPC sent to or received from each peer
+	activityLk   sync.Mutex
+	lastActivity map[peer.ID]time.Time
+
+	// PRUNEs received from each peer
+	prunesLk   sync.Mutex
+	prunesFrom map[peer.ID]int64
+
+	// IWANT requests received, and the replayed message cache, oldest
+	// message first
+	iwantLk    sync.Mutex
+	iwants     IWantStats
+	iwantCache map[string]*cachedMessage
+	iwantOrder []*cachedMessage
+
+	// message level records for the run summary
+	recordsLk sync.Mutex
+	records   MessageRecords
+	// topics whose messages are not part of the workload, and are left out
+	// of the records
+	ignored map[string]struct{}
+	// messages rejected because the validation queue was full or throttled
+	throttled uint64
+}
+
+// MessageRecords are the message level events seen by the tracer. Message IDs
+// and peer IDs are base64 and base58 encoded respectively.
+type MessageRecords struct {
+	// publish time in unix nanoseconds, by message ID
+	Published map[string]int64
+	Delivered map[string]struct{}
+	Rejected  map[string]struct{}
+	// message IDs dropped from the outbound queue, by destination peer
+	Dropped map[string][]string
+	// all the peers that were added to pubsub
+	Neighbors map[string]struct{}
+	// peers our own published messages were sent to, by message ID
+	SentTo map[string]map[string]struct{}
+}
+
+// Causes of the changes of the local mesh. The router doesn't trace why it
+// changed the mesh, so the cause is inferred from the event preceding the
+// change: the GRAFT or PRUNE received from the peer, the topic being joined or
+// left, or the peer disconnecting. Any other change is the router's own
+// decision in the heartbeat.
+const (
+	MeshCauseHeartbeat    = "heartbeat"
+	MeshCauseRemote       = "remote"
+	MeshCauseJoin         = "join"
+	MeshCauseLeave        = "leave"
+	MeshCauseDisconnected = "disconnected"
+)
+
+// MeshChange is a peer added to or removed from the local mesh of a topic
+type MeshChange struct {
+	Topic string
+	Peer  peer.ID
+	Graft bool
+	Cause string
+}
+
+// meshCause is the event preceding a mesh change
+type meshCause struct {
+	cause string
+	topic string
+	// peer the RPC was received from, and the topics it grafted and pruned
+	from   peer.ID
+	grafts map[string]struct{}
+	prunes map[string]struct{}
+}
+
+// of returns the cause of a change of the mesh
+func (c meshCause) of(topic string, pid peer.ID, graft bool) string {
+	switch c.cause {
+	case MeshCauseRemote:
+		if pid != c.from {
+			break
+		}
+		ctrl := c.prunes
+		if graft {
+			ctrl = c.grafts
+		}
+		if _, ok := ctrl[topic]; ok {
+			return MeshCauseRemote
+		}
+	case MeshCauseJoin, MeshCauseLeave:
+		if topic == c.topic {
+			return c.cause
+		}
+	}
+	return MeshCauseHeartbeat
 }
 
 func NewTestTracer(outputPathPrefix string, localPeerID peer.ID, full bool) (*TestTracer, error) {
@@ -70,6 +199,20 @@ func NewTestTracer(outputPathPrefix string, localPeerID peer.ID, full bool) (*Te
 		aggregateOutputPath: outputPathPrefix + "-aggregate.json",
 		eventCh:             make(chan *pb.TraceEvent, 1024),
 		doneCh:              make(chan struct{}, 1),
+		mesh:                make(map[string]map[peer.ID]struct{}),
+		meshFormed:          make(map[string]int64),
+		lastActivity:        make(map[peer.ID]time.Time),
+		prunesFrom:          make(map[peer.ID]int64),
+		sizes:               &rpcSizeTracer{},
+		ignored:             make(map[string]struct{}),
+		records: MessageRecords{
+			Published: make(map[string]int64),
+			Delivered: make(map[string]struct{}),
+			Rejected:  make(map[string]struct{}),
+			Dropped:   make(map[string][]string),
+			Neighbors: make(map[string]struct{}),
+			SentTo:    make(map[string]map[string]struct{}),
+		},
 	}
 
 	t.metrics.LocalPeer = localPeerID.String()
@@ -80,6 +223,7 @@ func NewTestTracer(outputPathPrefix string, localPeerID peer.ID, full bool) (*Te
 
 func (t *TestTracer) Stop() error {
 	t.doneCh <- struct{}{}
+	t.sizes.copyTo(&t.metrics.SentRPC, &t.metrics.ReceivedRPC)
 
 	jsonstr, err := json.MarshalIndent(t.metrics, "", "  ")
 	if err != nil {
@@ -94,6 +238,9 @@ func (t *TestTracer) eventLoop() {
 		case <-t.doneCh:
 			return
 		case evt := <-t.eventCh:
+			if typ := evt.GetType(); typ != pb.TraceEvent_GRAFT && typ != pb.TraceEvent_PRUNE {
+				t.cause = meshCause{}
+			}
 			switch evt.GetType() {
 			case pb.TraceEvent_PUBLISH_MESSAGE:
 				t.publishMessage(evt)
@@ -134,16 +281,123 @@ func (t *TestTracer) Trace(evt *pb.TraceEvent) {
 	t.eventCh <- evt
 }
 
+// RPCSizes returns the raw tracer measuring the size of each RPC field. It has
+// to be passed to pubsub with WithRawTracer.
+func (t *TestTracer) RPCSizes() pubsub.RawTracer {
+	return t.sizes
+}
+
+// Duplicates returns the number of duplicate messages received so far, and the
+// total size of their payloads
+func (t *TestTracer) Duplicates() (count uint64, bytes uint64) {
+	t.sizes.lk.Lock()
+	defer t.sizes.lk.Unlock()
+	return t.sizes.duplicates, t.sizes.duplicateBytes
+}
+
+// Overhead returns the duplicates, payload bytes and control bytes of each
+// topic so far
+func (t *TestTracer) Overhead() outputs.NodeOverhead {
+	return t.sizes.overhead()
+}
+
+// LiveCounts returns the messages delivered and the duplicates received so
+// far, and the messages being validated
+func (t *TestTracer) LiveCounts() LiveCounts {
+	t.sizes.lk.Lock()
+	defer t.sizes.lk.Unlock()
+	return LiveCounts{
+		At:         time.Now(),
+		Delivered:  t.sizes.delivered,
+		Duplicates: t.sizes.duplicates,
+		Validating: t.sizes.validating - t.sizes.validated,
+	}
+}
+
+// PXReceived returns the number of peers received in PX so far, and how many
+// came with a signed peer record
+func (t *TestTracer) PXReceived() (peers uint64, signed uint64) {
+	t.sizes.lk.Lock()
+	defer t.sizes.lk.Unlock()
+	return t.sizes.pxPeers, t.sizes.pxSigned
+}
+
+// DeliveredMessageIDs returns up to n IDs of the workload messages delivered
+// so far, the node's own included, in no particular order
+func (t *TestTracer) DeliveredMessageIDs(n int) []string {
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	ids := make([]string, 0, n)
+	for id := range t.records.Delivered {
+		if len(ids) == n {
+			break
+		}
+		if raw, err := base64.StdEncoding.DecodeString(id); err == nil {
+			ids = append(ids, string(raw))
+		}
+	}
+	return ids
+}
+
+// ValidationThrottled returns the number of messages rejected so far because
+// the validation queue was full or throttled
+func (t *TestTracer) ValidationThrottled() uint64 {
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	return t.throttled
+}
+
+// DroppedRPCs returns the number of RPCs dropped from the outbound queues so far
+func (t *TestTracer) DroppedRPCs() uint64 {
+	t.sizes.lk.Lock()
+	defer t.sizes.lk.Unlock()
+	return t.sizes.dropped
+}
+
+// IgnoreTopic leaves the messages of a topic out of the message records
+func (t *TestTracer) IgnoreTopic(topic string) {
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	t.ignored[topic] = struct{}{}
+}
+
 func (t *TestTracer) publishMessage(evt *pb.TraceEvent) {
 	t.metrics.Published++
+	t.cacheMessage(evt.GetPublishMessage().GetMessageID(), evt.GetTimestamp())
+
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	if _, ok := t.ignored[evt.GetPublishMessage().GetTopic()]; ok {
+		return
+	}
+	t.records.Published[encodeMsgID(evt.GetPublishMessage().GetMessageID())] = evt.GetTimestamp()
 }
 
 func (t *TestTracer) rejectMessage(evt *pb.TraceEvent) {
 	t.metrics.Rejected++
+
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	switch evt.GetRejectMessage().GetReason() {
+	case pubsub.RejectValidationQueueFull, pubsub.RejectValidationThrottled:
+		t.throttled++
+	}
+	if _, ok := t.ignored[evt.GetRejectMessage().GetTopic()]; ok {
+		return
+	}
+	t.records.Rejected[encodeMsgID(evt.GetRejectMessage().GetMessageID())] = struct{}{}
 }
 
 func (t *TestTracer) deliverMessage(evt *pb.TraceEvent) {
 	t.metrics.Delivered++
+	t.cacheMessage(evt.GetDeliverMessage().GetMessageID(), evt.GetTimestamp())
+
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	if _, ok := t.ignored[evt.GetDeliverMessage().GetTopic()]; ok {
+		return
+	}
+	t.records.Delivered[encodeMsgID(evt.GetDeliverMessage().GetMessageID())] = struct{}{}
 }
 
 func (t *TestTracer) duplicateMessage(evt *pb.TraceEvent) {
@@ -153,11 +407,92 @@ func (t *TestTracer) duplicateMessage(evt *pb.TraceEvent) {
 func (t *TestTracer) sendRPC(evt *pb.TraceEvent) {
 	meta := evt.GetSendRPC().GetMeta()
 	updateRPCStats(&t.metrics.SentRPC, meta)
+	t.touch(evt.GetSendRPC().GetSendTo(), evt.GetTimestamp())
+
+	if len(meta.GetMessages()) == 0 {
+		return
+	}
+	pid, err := peer.IDFromBytes(evt.GetSendRPC().GetSendTo())
+	if err != nil {
+		return
+	}
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	for _, msg := range meta.GetMessages() {
+		id := encodeMsgID(msg.GetMessageID())
+		if _, ok := t.records.Published[id]; !ok {
+			continue
+		}
+		if t.records.SentTo[id] == nil {
+			t.records.SentTo[id] = make(map[string]struct{})
+		}
+		t.records.SentTo[id][pid.String()] = struct{}{}
+	}
 }
 
 func (t *TestTracer) recvRPC(evt *pb.TraceEvent) {
 	meta := evt.GetRecvRPC().GetMeta()
 	updateRPCStats(&t.metrics.ReceivedRPC, meta)
+	t.touch(evt.GetRecvRPC().GetReceivedFrom(), evt.GetTimestamp())
+
+	ctrl := meta.GetControl()
+	if len(ctrl.GetIwant()) > 0 {
+		t.countIWants(evt.GetRecvRPC().GetReceivedFrom(), evt.GetTimestamp(), ctrl.GetIwant())
+	}
+	if len(ctrl.GetGraft()) == 0 && len(ctrl.GetPrune()) == 0 {
+		return
+	}
+	from, err := peer.IDFromBytes(evt.GetRecvRPC().GetReceivedFrom())
+	if err != nil {
+		return
+	}
+	t.cause = meshCause{
+		cause:  MeshCauseRemote,
+		from:   from,
+		grafts: make(map[string]struct{}),
+		prunes: make(map[string]struct{}),
+	}
+	for _, g := range ctrl.GetGraft() {
+		t.cause.grafts[g.GetTopic()] = struct{}{}
+	}
+	for _, p := range ctrl.GetPrune() {
+		t.cause.prunes[p.GetTopic()] = struct{}{}
+	}
+	if len(ctrl.GetPrune()) > 0 {
+		t.prunesLk.Lock()
+		t.prunesFrom[from] += int64(len(ctrl.GetPrune()))
+		t.prunesLk.Unlock()
+	}
+}
+
+// PrunesReceived returns the number of PRUNEs received from each peer
+func (t *TestTracer) PrunesReceived() map[peer.ID]int64 {
+	t.prunesLk.Lock()
+	defer t.prunesLk.Unlock()
+	prunes := make(map[peer.ID]int64, len(t.prunesFrom))
+	for pid, n := range t.prunesFrom {
+		prunes[pid] = n
+	}
+	return prunes
+}
+
+// touch records an RPC exchanged with the peer at ts, in unix nanoseconds
+func (t *TestTracer) touch(id []byte, ts int64) {
+	pid, err := peer.IDFromBytes(id)
+	if err != nil {
+		return
+	}
+	t.activityLk.Lock()
+	t.lastActivity[pid] = time.Unix(0, ts)
+	t.activityLk.Unlock()
+}
+
+// LastActivity returns the time of the last RPC exchanged with the peer
+func (t *TestTracer) LastActivity(pid peer.ID) (time.Time, bool) {
+	t.activityLk.Lock()
+	defer t.activityLk.Unlock()
+	last, ok := t.lastActivity[pid]
+	return last, ok
 }
 
 func updateRPCStats(stats *RPCMetrics, meta *pb.TraceEvent_RPCMeta) {
@@ -168,34 +503,223 @@ func updateRPCStats(stats *RPCMetrics, meta *pb.TraceEvent_RPCMeta) {
 	stats.IWants += uint64(len(ctrl.GetIwant()))
 	stats.Grafts += uint64(len(ctrl.GetGraft()))
 	stats.Prunes += uint64(len(ctrl.GetPrune()))
+	for _, prune := range ctrl.GetPrune() {
+		stats.PrunePeers += uint64(len(prune.GetPeers()))
+	}
 }
 
 func (t *TestTracer) dropRPC(evt *pb.TraceEvent) {
 	t.metrics.DroppedRPC++
+
+	drop := evt.GetDropRPC()
+	pid, err := peer.IDFromBytes(drop.GetSendTo())
+	if err != nil {
+		return
+	}
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	for _, msg := range drop.GetMeta().GetMessages() {
+		t.records.Dropped[pid.String()] = append(t.records.Dropped[pid.String()], encodeMsgID(msg.GetMessageID()))
+	}
 }
 
 func (t *TestTracer) addPeer(evt *pb.TraceEvent) {
 	t.metrics.PeersAdded++
+
+	pid, err := peer.IDFromBytes(evt.GetAddPeer().GetPeerID())
+	if err != nil {
+		return
+	}
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+	t.records.Neighbors[pid.String()] = struct{}{}
 }
 
 func (t *TestTracer) removePeer(evt *pb.TraceEvent) {
 	t.metrics.PeersRemoved++
+
+	// the router drops disconnected peers from the mesh without a PRUNE event
+	pid, err := peer.IDFromBytes(evt.GetRemovePeer().GetPeerID())
+	if err != nil {
+		return
+	}
+	t.meshLk.Lock()
+	var changes []MeshChange
+	for topic, peers := range t.mesh {
+		if _, ok := peers[pid]; ok {
+			delete(peers, pid)
+			changes = append(changes, MeshChange{Topic: topic, Peer: pid, Cause: MeshCauseDisconnected})
+		}
+	}
+	listeners := t.meshListeners
+	t.meshLk.Unlock()
+
+	for _, c := range changes {
+		for _, fn := range listeners {
+			fn(c)
+		}
+	}
 }
 
 func (t *TestTracer) join(evt *pb.TraceEvent) {
 	t.metrics.TopicsJoined++
+	t.cause = meshCause{cause: MeshCauseJoin, topic: evt.GetJoin().GetTopic()}
 }
 
 func (t *TestTracer) leave(evt *pb.TraceEvent) {
 	t.metrics.TopicsLeft++
+	t.cause = meshCause{cause: MeshCauseLeave, topic: evt.GetLeave().GetTopic()}
 }
 
 func (t *TestTracer) graft(evt *pb.TraceEvent) {
-	// already accounted for in sendRPC
+	// already accounted for in sendRPC, just keep track of the mesh
+	graft := evt.GetGraft()
+	pid, err := peer.IDFromBytes(graft.GetPeerID())
+	if err != nil {
+		return
+	}
+	t.meshLk.Lock()
+	peers, ok := t.mesh[graft.GetTopic()]
+	if !ok {
+		peers = make(map[peer.ID]struct{})
+		t.mesh[graft.GetTopic()] = peers
+	}
+	peers[pid] = struct{}{}
+	t.meshGrafts++
+	if _, ok := t.meshFormed[graft.GetTopic()]; !ok && t.meshTarget > 0 && len(peers) >= t.meshTarget {
+		t.meshFormed[graft.GetTopic()] = evt.GetTimestamp()
+	}
+	listeners := t.meshListeners
+	t.meshLk.Unlock()
+
+	c := MeshChange{Topic: graft.GetTopic(), Peer: pid, Graft: true, Cause: t.cause.of(graft.GetTopic(), pid, true)}
+	for _, fn := range listeners {
+		fn(c)
+	}
 }
 
 func (t *TestTracer) prune(evt *pb.TraceEvent) {
-	// already accounted for in sendRPC
+	// already accounted for in sendRPC, just keep track of the mesh
+	prune := evt.GetPrune()
+	pid, err := peer.IDFromBytes(prune.GetPeerID())
+	if err != nil {
+		return
+	}
+	t.meshLk.Lock()
+	delete(t.mesh[prune.GetTopic()], pid)
+	t.meshPrunes++
+	listeners := t.meshListeners
+	t.meshLk.Unlock()
+
+	c := MeshChange{Topic: prune.GetTopic(), Peer: pid, Cause: t.cause.of(prune.GetTopic(), pid, false)}
+	for _, fn := range listeners {
+		fn(c)
+	}
+}
+
+// SetScoreProfile records the score profile used by the node in the
+// aggregate output. It must be called before the node starts.
+func (t *TestTracer) SetScoreProfile(name string) {
+	t.metrics.ScoreProfile = name
+}
+
+// SetRouterParams records the gossipsub parameters of the node in the
+// aggregate output. It must be called before the node starts.
+func (t *TestTracer) SetRouterParams(params outputs.RouterParams) {
+	t.metrics.Router = &params
+}
+
+// OnMeshChange adds a function called on every change of the local mesh, from
+// the tracer's event loop
+func (t *TestTracer) OnMeshChange(fn func(MeshChange)) {
+	t.meshLk.Lock()
+	defer t.meshLk.Unlock()
+	t.meshListeners = append(t.meshListeners, fn)
+}
+
+// SetMeshTarget sets the mesh size at which a topic's mesh is considered formed
+func (t *TestTracer) SetMeshTarget(d int) {
+	t.meshLk.Lock()
+	defer t.meshLk.Unlock()
+	t.meshTarget = d
+}
+
+// MeshFormed returns when the mesh of each topic first reached the target size,
+// in unix nanoseconds. Topics whose mesh never reached it are left out.
+func (t *TestTracer) MeshFormed() map[string]int64 {
+	t.meshLk.RLock()
+	defer t.meshLk.RUnlock()
+	formed := make(map[string]int64, len(t.meshFormed))
+	for topic, ts := range t.meshFormed {
+		formed[topic] = ts
+	}
+	return formed
+}
+
+// MeshChanges returns the number of GRAFT and PRUNE events seen so far
+func (t *TestTracer) MeshChanges() (grafts int64, prunes int64) {
+	t.meshLk.RLock()
+	defer t.meshLk.RUnlock()
+	return t.meshGrafts, t.meshPrunes
+}
+
+// Records returns a copy of the message level records collected so far
+func (t *TestTracer) Records() MessageRecords {
+	t.recordsLk.Lock()
+	defer t.recordsLk.Unlock()
+
+	r := MessageRecords{
+		Published: make(map[string]int64, len(t.records.Published)),
+		Delivered: make(map[string]struct{}, len(t.records.Delivered)),
+		Rejected:  make(map[string]struct{}, len(t.records.Rejected)),
+		Dropped:   make(map[string][]string, len(t.records.Dropped)),
+		Neighbors: make(map[string]struct{}, len(t.records.Neighbors)),
+		SentTo:    make(map[string]map[string]struct{}, len(t.records.SentTo)),
+	}
+	for id, ts := range t.records.Published {
+		r.Published[id] = ts
+	}
+	for id := range t.records.Delivered {
+		r.Delivered[id] = struct{}{}
+	}
+	for id := range t.records.Rejected {
+		r.Rejected[id] = struct{}{}
+	}
+	for pid, ids := range t.records.Dropped {
+		r.Dropped[pid] = append([]string(nil), ids...)
+	}
+	for pid := range t.records.Neighbors {
+		r.Neighbors[pid] = struct{}{}
+	}
+	for id, peers := range t.records.SentTo {
+		r.SentTo[id] = make(map[string]struct{}, len(peers))
+		for pid := range peers {
+			r.SentTo[id][pid] = struct{}{}
+		}
+	}
+	return r
+}
+
+func encodeMsgID(id []byte) string {
+	return base64.StdEncoding.EncodeToString(id)
+}
+
+// MeshPeers returns the current mesh peers for a topic
+func (t *TestTracer) MeshPeers(topic string) []peer.ID {
+	t.meshLk.RLock()
+	defer t.meshLk.RUnlock()
+	peers := make([]peer.ID, 0, len(t.mesh[topic]))
+	for pid := range t.mesh[topic] {
+		peers = append(peers, pid)
+	}
+	return peers
+}
+
+// MeshSize returns the number of peers in the local mesh for the topic
+func (t *TestTracer) MeshSize(topic string) int {
+	t.meshLk.RLock()
+	defer t.meshLk.RUnlock()
+	return len(t.mesh[topic])
 }
 
 var _ pubsub.EventTracer = (*TestTracer)(nil)
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/quicreuse"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Transports the libp2p hosts can be restricted to
+const (
+	TransportTCP          = "tcp"
+	TransportQUIC         = "quic"
+	TransportWS           = "ws"
+	TransportWebTransport = "webtransport"
+)
+
+func validTransport(transport string) bool {
+	switch transport {
+	case TransportTCP, TransportQUIC, TransportWS, TransportWebTransport:
+		return true
+	}
+	return false
+}
+
+// transportOptions restricts a host to a single transport
+func transportOptions(transport string) ([]libp2p.Option, error) {
+	switch transport {
+	case TransportTCP:
+		return []libp2p.Option{libp2p.Transport(tcp.NewTCPTransport)}, nil
+	case TransportQUIC:
+		return []libp2p.Option{libp2p.QUICReuse(quicreuse.NewConnManager), libp2p.Transport(libp2pquic.NewTransport)}, nil
+	case TransportWS:
+		return []libp2p.Option{libp2p.Transport(websocket.New)}, nil
+	case TransportWebTransport:
+		return []libp2p.Option{libp2p.QUICReuse(quicreuse.NewConnManager), libp2p.Transport(webtransport.New)}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %s", transport)
+	}
+}
+
+// transportListenAddr is the address a host listens on for a transport, to be
+// encapsulated in its IP address. UDP based transports listen on udpPort, TCP
+// based ones on a random port.
+func transportListenAddr(transport string, udpPort int) multiaddr.Multiaddr {
+	switch transport {
+	case TransportQUIC:
+		return multiaddr.StringCast(fmt.Sprintf("/udp/%d/quic-v1", udpPort))
+	case TransportWS:
+		return multiaddr.StringCast("/tcp/0/ws")
+	case TransportWebTransport:
+		return multiaddr.StringCast(fmt.Sprintf("/udp/%d/quic-v1/webtransport", udpPort))
+	default:
+		return multiaddr.StringCast("/tcp/0")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/testground/sdk-go/runtime"
+
+	"gossipsub_testplan/outputs"
+)
+
+// UploadParams upload the outputs of every instance to an S3-compatible
+// object store at the end of the run, under <prefix>/<run ID>/<seq>/ in the
+// bucket, so that they don't have to be collected from the instances
+type UploadParams struct {
+	// URL of the endpoint, eg https://s3.eu-west-1.amazonaws.com or
+	// http://minio:9000, disabled if empty. Buckets are addressed by path.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// whether the traces are uploaded too, and gzipped
+	Traces   bool
+	Compress bool
+	Timeout  time.Duration
+}
+
+func (u UploadParams) enabled() bool {
+	return u.Endpoint != ""
+}
+
+func (u UploadParams) validate() error {
+	if !u.enabled() {
+		return nil
+	}
+	if _, err := url.Parse(u.Endpoint); err != nil {
+		return fmt.Errorf("invalid upload_endpoint: %w", err)
+	}
+	if u.Bucket == "" {
+		return fmt.Errorf("uploads require an upload_bucket")
+	}
+	if u.AccessKey == "" || u.SecretKey == "" {
+		return fmt.Errorf("uploads require credentials, in the upload_access_key and upload_secret_key params or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables")
+	}
+	if u.Timeout <= 0 {
+		return fmt.Errorf("t_upload_timeout must be positive")
+	}
+	return nil
+}
+
+// uploadOutputs uploads the files in the outputs path of the instance. The
+// traces are skipped unless enabled.
+func uploadOutputs(runenv *runtime.RunEnv, params UploadParams, seq int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), params.Timeout)
+	defer cancel()
+
+	entries, err := ioutil.ReadDir(runenv.TestOutputsPath)
+	if err != nil {
+		return err
+	}
+	prefix := path.Join(params.Prefix, runenv.TestRun, strconv.FormatInt(seq, 10))
+	start := time.Now()
+	var files int
+	var bytes int64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		trace := strings.HasPrefix(e.Name(), outputs.TracerOutputsPrefix)
+		if trace && !params.Traces {
+			continue
+		}
+		file := filepath.Join(runenv.TestOutputsPath, e.Name())
+		key := path.Join(prefix, e.Name())
+		compressed := trace && params.Compress
+		if compressed {
+			if file, err = gzipFile(file, runenv.TestTempPath); err != nil {
+				return fmt.Errorf("error compressing %s: %w", e.Name(), err)
+			}
+			key += ".gz"
+		}
+		n, err := putObject(ctx, params, key, file)
+		if compressed {
+			os.Remove(file)
+		}
+		if err != nil {
+			return fmt.Errorf("error uploading %s: %w", e.Name(), err)
+		}
+		files++
+		bytes += n
+	}
+
+	elapsed := time.Since(start)
+	runenv.RecordMessage("uploaded %d files, %d bytes, to %s/%s/%s in %s", files, bytes, params.Endpoint, params.Bucket, prefix, elapsed)
+	runenv.R().RecordPoint("upload_secs", elapsed.Seconds())
+	runenv.R().RecordPoint("upload_bytes", float64(bytes))
+	return nil
+}
+
+// gzipFile compresses a file into a temporary file, and returns its path
+func gzipFile(file string, dir string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(dir, filepath.Base(file)+"-*.gz")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// putObject uploads a file to the bucket with a request signed with AWS
+// signature version 4. The payload is left unsigned so that it's streamed
+// from the file.
+func putObject(ctx context.Context, params UploadParams, key string, file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	u, err := url.Parse(params.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	u.Path = "/" + params.Bucket + "/" + key
+	u.RawPath = awsEscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = info.Size()
+	signRequest(req, params, time.Now().UTC())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return info.Size(), nil
+}
+
+// signRequest adds the AWS signature version 4 headers to a request with an
+// unsigned payload
+func signRequest(req *http.Request, params UploadParams, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + params.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+params.SecretKey), date)
+	for _, part := range []string{params.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		params.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscapePath escapes every byte of a path but the unreserved characters
+// and the slashes, as the signature requires
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
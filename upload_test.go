@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestAWSEscapePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/bucket/run/summary.json", want: "/bucket/run/summary.json"},
+		{path: "/bucket/a-b_c.d~e", want: "/bucket/a-b_c.d~e"},
+		{path: "/bucket/with space", want: "/bucket/with%20space"},
+		{path: "/bucket/a+b=c", want: "/bucket/a%2Bb%3Dc"},
+		{path: "/bucket/é", want: "/bucket/%C3%A9"},
+	}
+	for _, tt := range tests {
+		if got := awsEscapePath(tt.path); got != tt.want {
+			t.Errorf("awsEscapePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
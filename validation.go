@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"gossipsub_testplan/outputs"
+)
+
+// ValidationParams simulate the cost and the outcome of validating messages.
+// A message is invalid based on a hash of its payload, so that every node
+// agrees on it. The publisher doesn't validate its own messages, so invalid
+// messages are rejected by the first hop, which penalizes the publisher.
+type ValidationParams struct {
+	Delay time.Duration
+	// percentage of the messages rejected
+	InvalidPct float64
+	// whether every decision is written as a validation event
+	Events bool
+}
+
+func (v ValidationParams) enabled() bool {
+	return v.Delay > 0 || v.InvalidPct > 0 || v.Events
+}
+
+// Reasons of the validation decisions
+const (
+	ValidationReasonOwn     = "own"
+	ValidationReasonEclipse = "eclipse_attacker"
+	ValidationReasonLazy    = "lazy"
+	ValidationReasonTimeout = "timeout"
+	ValidationReasonInvalid = "invalid"
+	ValidationReasonValid   = "valid"
+)
+
+// ValidationCount is the number of decisions with the same outcome, and the
+// sum of their validation latencies
+type ValidationCount struct {
+	Count     int64
+	LatencyMs float64
+}
+
+// validationStats count the validation decisions by propagation source and
+// by verdict/reason
+type validationStats struct {
+	lk       sync.Mutex
+	outcomes map[peer.ID]map[string]ValidationCount
+}
+
+func (v ValidationParams) validate() error {
+	if v.Delay < 0 {
+		return fmt.Errorf("validate_delay_ms can't be negative")
+	}
+	if v.InvalidPct < 0 || v.InvalidPct > 100 {
+		return fmt.Errorf("invalid_message_pct must be between 0 and 100")
+	}
+	return nil
+}
+
+// invalid returns true if the message with the given payload is in the
+// rejected fraction
+func (v ValidationParams) invalid(data []byte) bool {
+	if v.InvalidPct <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return float64(h.Sum64()%10000) < v.InvalidPct*100
+}
+
+// registerValidator registers the simulated validator of a workload topic, or
+// the one of an eclipse attacker or a lazy node
+func (p *PubsubNode) registerValidator(topic string) error {
+	v := p.cfg.Validation
+	decide := func(ctx context.Context, from peer.ID, msg *pubsub.Message) (pubsub.ValidationResult, string) {
+		if from == p.h.ID() {
+			return pubsub.ValidationAccept, ValidationReasonOwn
+		}
+		// eclipse attackers never forward a message
+		if p.eclipsing() {
+			return pubsub.ValidationIgnore, ValidationReasonEclipse
+		}
+		// neither do lazy nodes, and ignored messages never reach the
+		// message cache, so they don't gossip them either
+		if p.cfg.Lazy {
+			return pubsub.ValidationIgnore, ValidationReasonLazy
+		}
+		if v.Delay > 0 {
+			select {
+			case <-time.After(v.Delay):
+			case <-ctx.Done():
+				return pubsub.ValidationIgnore, ValidationReasonTimeout
+			}
+		}
+		if v.invalid(msg.GetData()) {
+			atomic.AddInt64(&p.invalidRejected, 1)
+			return pubsub.ValidationReject, ValidationReasonInvalid
+		}
+		return pubsub.ValidationAccept, ValidationReasonValid
+	}
+	validator := func(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		start := time.Now()
+		result, reason := decide(ctx, from, msg)
+		p.recordValidation(topic, from, msg, result, reason, time.Since(start))
+		return result
+	}
+	if err := p.ps.RegisterTopicValidator(topic, pubsub.ValidatorEx(validator)); err != nil {
+		return fmt.Errorf("error registering validator for topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// rejectedInvalid returns the number of messages rejected by the validator
+func (p *PubsubNode) rejectedInvalid() int64 {
+	return atomic.LoadInt64(&p.invalidRejected)
+}
+
+func verdictName(result pubsub.ValidationResult) string {
+	switch result {
+	case pubsub.ValidationAccept:
+		return "accept"
+	case pubsub.ValidationReject:
+		return "reject"
+	default:
+		return "ignore"
+	}
+}
+
+// recordValidation counts a validation decision, and writes it as a
+// validation event if enabled
+func (p *PubsubNode) recordValidation(topic string, from peer.ID, msg *pubsub.Message, result pubsub.ValidationResult, reason string, latency time.Duration) {
+	verdict := verdictName(result)
+	latencyMs := float64(latency) / float64(time.Millisecond)
+
+	s := &p.validations
+	s.lk.Lock()
+	if s.outcomes == nil {
+		s.outcomes = make(map[peer.ID]map[string]ValidationCount)
+	}
+	if s.outcomes[from] == nil {
+		s.outcomes[from] = make(map[string]ValidationCount)
+	}
+	key := verdict + "/" + reason
+	c := s.outcomes[from][key]
+	c.Count++
+	c.LatencyMs += latencyMs
+	s.outcomes[from][key] = c
+	s.lk.Unlock()
+
+	if p.cfg.Validation.Events {
+		p.traceEvent("validation", outputs.ValidationEvent{
+			Topic:     topic,
+			MessageID: encodeMsgID([]byte(msg.ID)),
+			From:      from.String(),
+			Verdict:   verdict,
+			Reason:    reason,
+			LatencyMs: latencyMs,
+		})
+	}
+}
+
+// validationOutcomes returns the validation decisions by propagation source
+// and by verdict/reason
+func (p *PubsubNode) validationOutcomes() map[string]map[string]ValidationCount {
+	s := &p.validations
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make(map[string]map[string]ValidationCount, len(s.outcomes))
+	for pid, counts := range s.outcomes {
+		c := make(map[string]ValidationCount, len(counts))
+		for k, v := range counts {
+			c[k] = v
+		}
+		out[pid.String()] = c
+	}
+	return out
+}
+
+// summarizeValidation adds up the validation decisions by the cohort of the
+// validating node and of the propagation source. Sources that didn't report,
+// like sybil identities, are unknown.
+func summarizeValidation(reports []NodeReport) *outputs.Validation {
+	cohorts := make(map[string]string, len(reports))
+	for _, r := range reports {
+		cohorts[r.PeerID] = cohortName(r.Attacker)
+	}
+
+	type key struct{ validator, source, outcome string }
+	counts := make(map[key]ValidationCount)
+	for _, r := range reports {
+		for from, outcomes := range r.Validations {
+			source, ok := cohorts[from]
+			if !ok {
+				source = "unknown"
+			}
+			for outcome, c := range outcomes {
+				k := key{cohortName(r.Attacker), source, outcome}
+				total := counts[k]
+				total.Count += c.Count
+				total.LatencyMs += c.LatencyMs
+				counts[k] = total
+			}
+		}
+	}
+
+	s := &outputs.Validation{}
+	for k, c := range counts {
+		verdict, reason := k.outcome, ""
+		if i := strings.IndexByte(k.outcome, '/'); i >= 0 {
+			verdict, reason = k.outcome[:i], k.outcome[i+1:]
+		}
+		switch verdict {
+		case "accept":
+			s.Accepted += c.Count
+		case "reject":
+			s.Rejected += c.Count
+		default:
+			s.Ignored += c.Count
+		}
+		s.Outcomes = append(s.Outcomes, outputs.ValidationOutcome{
+			Validator:     k.validator,
+			Source:        k.source,
+			Verdict:       verdict,
+			Reason:        reason,
+			Count:         c.Count,
+			MeanLatencyMs: c.LatencyMs / float64(c.Count),
+		})
+	}
+	sort.Slice(s.Outcomes, func(i, j int) bool {
+		a, b := s.Outcomes[i], s.Outcomes[j]
+		if a.Validator != b.Validator {
+			return a.Validator < b.Validator
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Verdict != b.Verdict {
+			return a.Verdict < b.Verdict
+		}
+		return a.Reason < b.Reason
+	})
+	return s
+}
+
+func cohortName(attacker bool) string {
+	if attacker {
+		return "attacker"
+	}
+	return "honest"
+}
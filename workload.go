@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A Workload generates the sequence of messages published by a node
+type Workload interface {
+	// Next returns the size of the next message, how long to wait after the
+	// previous message before publishing it, and the topic to publish it to
+	Next() (size uint64, delay time.Duration, topic string)
+}
+
+// WorkloadEnv describes the node running the workload, for workloads that
+// depend on the node's place in the test
+type WorkloadEnv struct {
+	Seq       int64
+	Instances int
+	Committee CommitteeParams
+	// phases of the phased workload, in the order they run
+	Phases []PhaseConfig
+	// trace of the replay workload
+	ReplayFile string
+	// arrival processes of the poisson and bursty workloads
+	Arrival ArrivalParams
+}
+
+// WorkloadFactory creates a workload publishing to the given topics
+type WorkloadFactory func(topics []TopicConfig, env WorkloadEnv) (Workload, error)
+
+// workloads contains the workload implementations selectable by the `workload` param
+var workloads = map[string]WorkloadFactory{
+	"constant":  newConstantRateWorkload,
+	"poisson":   newPoissonWorkload,
+	"bursty":    newBurstyWorkload,
+	"committee": newCommitteeWorkload,
+	"phased":    newPhasedWorkload,
+	"replay":    newReplayWorkload,
+}
+
+func NewWorkload(name string, topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	factory, ok := workloads[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown workload %s", name)
+	}
+	return factory(topics, env)
+}
+
+// publishesFromAllNodes returns true if every node publishes with the
+// workload, rather than only the publisher
+func publishesFromAllNodes(name string) bool {
+	return name == "committee" || name == "replay"
+}
+
+// constantRateWorkload publishes to each topic at the topic's fixed message rate
+// and size, interleaving messages for different topics by their publish time
+type constantRateWorkload struct {
+	topics    []TopicConfig
+	intervals []time.Duration
+	// offset of the next message for each topic, relative to the start
+	next []time.Duration
+	// offset of the last message returned
+	now time.Duration
+}
+
+func newConstantRateWorkload(topics []TopicConfig, env WorkloadEnv) (Workload, error) {
+	w := &constantRateWorkload{}
+	for _, t := range topics {
+		if t.MessageRate.Quantity <= 0 {
+			continue
+		}
+		interval := time.Duration(float64(t.MessageRate.Interval) / t.MessageRate.Quantity)
+		w.topics = append(w.topics, t)
+		w.intervals = append(w.intervals, interval)
+		w.next = append(w.next, interval)
+	}
+	if len(w.topics) == 0 {
+		return nil, fmt.Errorf("constant workload requires at least one topic with a positive message rate")
+	}
+	return w, nil
+}
+
+func (w *constantRateWorkload) Next() (uint64, time.Duration, string) {
+	idx := 0
+	earliest := time.Duration(math.MaxInt64)
+	for i, next := range w.next {
+		if next < earliest {
+			idx = i
+			earliest = next
+		}
+	}
+
+	delay := earliest - w.now
+	w.now = earliest
+	w.next[idx] += w.intervals[idx]
+
+	t := w.topics[idx]
+	return uint64(t.MessageSize), delay, t.Id
+}